@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pion/ion-sfu/pkg/log"
+	sfu "github.com/pion/ion-sfu/pkg/node"
+)
+
+type adminConfig struct {
+	// serve the admin api when set, it needs Token
+	Port string `mapstructure:"port"`
+	// the admin calls carry it as "Authorization: Bearer <token>"
+	Token string `mapstructure:"token"`
+}
+
+// newAdminHandler return the admin api of node for the holders of token.
+// POST /kick?router=<id>&sub=<id> closes a sub of a router, POST
+// /close?router=<id> closes a router with its pub and subs. GET
+// /jitterbuffer?router=<id>[&packets=1] returns the json snapshot of the
+// jitter buffer of a router, with the packets base64 encoded if asked.
+// Unknown routers and subs are 404. POST /tracessrc?ssrc=<ssrc> logs the
+// rtp and rtcp of an ssrc whatever the log level, without ssrc it stops.
+func newAdminHandler(node *sfu.SFU, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kick", onlyMethod(http.MethodPost, func(w http.ResponseWriter, req *http.Request) {
+		router := node.GetRouter(req.URL.Query().Get("router"))
+		if router == nil {
+			http.Error(w, "router not found", http.StatusNotFound)
+			return
+		}
+		sub := req.URL.Query().Get("sub")
+		if !router.RemoveSub(sub) {
+			http.Error(w, "sub not found", http.StatusNotFound)
+			return
+		}
+		log.Infof("admin: kicked sub %s of router %s", sub, router.ID())
+	}))
+	mux.HandleFunc("/close", onlyMethod(http.MethodPost, func(w http.ResponseWriter, req *http.Request) {
+		router := node.GetRouter(req.URL.Query().Get("router"))
+		if router == nil {
+			http.Error(w, "router not found", http.StatusNotFound)
+			return
+		}
+		router.Close()
+		log.Infof("admin: closed router %s", router.ID())
+	}))
+	mux.HandleFunc("/jitterbuffer", onlyMethod(http.MethodGet, func(w http.ResponseWriter, req *http.Request) {
+		router := node.GetRouter(req.URL.Query().Get("router"))
+		if router == nil {
+			http.Error(w, "router not found", http.StatusNotFound)
+			return
+		}
+		dump, ok := router.DumpJitterBuffer(req.URL.Query().Get("packets") == "1")
+		if !ok {
+			http.Error(w, "router has no jitter buffer", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(dump); err != nil {
+			log.Errorf("admin: jitter buffer dump of router %s err=%v", router.ID(), err)
+		}
+	}))
+	mux.HandleFunc("/tracessrc", onlyMethod(http.MethodPost, func(w http.ResponseWriter, req *http.Request) {
+		param := req.URL.Query().Get("ssrc")
+		if param == "" {
+			log.StopTraceSSRC()
+			log.Infof("admin: stopped ssrc trace")
+			return
+		}
+		ssrc, err := strconv.ParseUint(param, 10, 32)
+		if err != nil {
+			http.Error(w, "invalid ssrc", http.StatusBadRequest)
+			return
+		}
+		log.TraceSSRC(uint32(ssrc))
+		log.Infof("admin: tracing ssrc %d", ssrc)
+	}))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get(authMetadataKey)
+		if !strings.HasPrefix(strings.ToLower(auth), bearerPrefix) ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimSpace(auth[len(bearerPrefix):])), []byte(token)) != 1 {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
+
+// onlyMethod serve the requests of method with h, the others are 405
+func onlyMethod(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, req)
+	}
+}
+
+// serveAdmin serve the admin api of node on the port of config, with the
+// tls of grpc when it is on
+func serveAdmin(node *sfu.SFU, config adminConfig, tlsConfig *tls.Config) {
+	srv := &http.Server{Addr: config.Port, Handler: newAdminHandler(node, config.Token), TLSConfig: tlsConfig}
+	log.Infof("SFU admin api at %s", config.Port)
+	var err error
+	if tlsConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		log.Warnf("admin api is served without tls")
+		err = srv.ListenAndServe()
+	}
+	if err != nil {
+		log.Errorf("failed to serve admin api: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+	"github.com/pion/ion-sfu/pkg/log"
+	"github.com/pion/ion-sfu/pkg/rtc/plugins"
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+)
+
+const testAdminToken = "admin-secret"
+
+func adminCall(t *testing.T, url, token string) int {
+	code, _ := adminRequest(t, "POST", url, token)
+	return code
+}
+
+func adminRequest(t *testing.T, method, url, token string) (int, []byte) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestAdminKickAndClose(t *testing.T) {
+	node := newTestSFU(t)
+	defer node.Close()
+	admin := httptest.NewServer(newAdminHandler(node, testAdminToken))
+	defer admin.Close()
+
+	router, err := node.NewRouter("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := transport.NewMemoryTransport("pub")
+	router.AddPub(pub)
+	kicked := transport.NewMemoryTransport("kicked")
+	router.AddSub(kicked.ID(), kicked)
+	other := transport.NewMemoryTransport("other")
+	router.AddSub(other.ID(), other)
+
+	if code := adminCall(t, admin.URL+"/kick?router=room&sub=kicked", ""); code != http.StatusUnauthorized {
+		t.Fatalf("kick without token code=%d, want 401", code)
+	}
+	if code := adminCall(t, admin.URL+"/kick?router=room&sub=kicked", "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("kick with a wrong token code=%d, want 401", code)
+	}
+	if kicked.IsClosed() {
+		t.Fatal("unauthorized kick closed the sub")
+	}
+	if code := adminCall(t, admin.URL+"/kick?router=unknown&sub=kicked", testAdminToken); code != http.StatusNotFound {
+		t.Fatalf("kick of an unknown router code=%d, want 404", code)
+	}
+	if code := adminCall(t, admin.URL+"/kick?router=room&sub=unknown", testAdminToken); code != http.StatusNotFound {
+		t.Fatalf("kick of an unknown sub code=%d, want 404", code)
+	}
+
+	if code := adminCall(t, admin.URL+"/kick?router=room&sub=kicked", testAdminToken); code != http.StatusOK {
+		t.Fatalf("kick code=%d, want 200", code)
+	}
+	if !kicked.IsClosed() || router.GetSub("kicked") != nil {
+		t.Fatal("kicked sub not closed")
+	}
+	if other.IsClosed() || pub.IsClosed() {
+		t.Fatal("kick closed another transport")
+	}
+
+	if code := adminCall(t, admin.URL+"/close?router=unknown", testAdminToken); code != http.StatusNotFound {
+		t.Fatalf("close of an unknown router code=%d, want 404", code)
+	}
+	if code := adminCall(t, admin.URL+"/close?router=room", testAdminToken); code != http.StatusOK {
+		t.Fatalf("close code=%d, want 200", code)
+	}
+	if !pub.IsClosed() || !other.IsClosed() {
+		t.Fatal("transports of the closed router still open")
+	}
+	testhelper.WaitFor(t, time.Second, func() bool { return node.GetRouter("room") == nil })
+}
+
+func TestAdminJitterBufferDump(t *testing.T) {
+	node := newTestSFU(t)
+	defer node.Close()
+	admin := httptest.NewServer(newAdminHandler(node, testAdminToken))
+	defer admin.Close()
+
+	router, err := node.NewRouter("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := transport.NewMemoryTransport("pub")
+	router.AddPub(pub)
+	// 3 is lost
+	for _, sn := range []uint16{1, 2, 4} {
+		if err := pub.PushRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SSRC: 1234, PayloadType: 96, SequenceNumber: sn}, Payload: []byte{0x10}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	url := admin.URL + "/jitterbuffer?router=room&packets=1"
+	if code, _ := adminRequest(t, "GET", url, ""); code != http.StatusUnauthorized {
+		t.Fatalf("dump without token code=%d, want 401", code)
+	}
+	if code, _ := adminRequest(t, "POST", url, testAdminToken); code != http.StatusMethodNotAllowed {
+		t.Fatalf("dump by post code=%d, want 405", code)
+	}
+	if code, _ := adminRequest(t, "GET", admin.URL+"/jitterbuffer?router=unknown", testAdminToken); code != http.StatusNotFound {
+		t.Fatalf("dump of an unknown router code=%d, want 404", code)
+	}
+	var dumps []plugins.BufferDump
+	testhelper.WaitFor(t, time.Second, func() bool {
+		code, body := adminRequest(t, "GET", url, testAdminToken)
+		if code != http.StatusOK {
+			t.Fatalf("dump code=%d body=%s", code, body)
+		}
+		if err := json.Unmarshal(body, &dumps); err != nil {
+			t.Fatal(err)
+		}
+		return len(dumps) != 0 && dumps[0].Occupancy >= 3
+	})
+	d := dumps[0]
+	if d.SSRC != 1234 || d.FirstSN != 1 || d.LastSN != 4 || len(d.Gaps) != 1 || d.Gaps[0] != 3 || len(d.Packets) != 3 {
+		t.Fatalf("dump %+v, want 1 to 4 missing 3 with the packets", d)
+	}
+}
+
+func TestAdminTraceSSRC(t *testing.T) {
+	node := newTestSFU(t)
+	defer node.Close()
+	admin := httptest.NewServer(newAdminHandler(node, testAdminToken))
+	defer admin.Close()
+	defer log.StopTraceSSRC()
+
+	if code := adminCall(t, admin.URL+"/tracessrc?ssrc=1234", ""); code != http.StatusUnauthorized {
+		t.Fatalf("trace without token code=%d, want 401", code)
+	}
+	if code := adminCall(t, admin.URL+"/tracessrc?ssrc=abc", testAdminToken); code != http.StatusBadRequest {
+		t.Fatalf("trace of an invalid ssrc code=%d, want 400", code)
+	}
+	if _, ok := log.TracedSSRC(); ok {
+		t.Fatal("failed calls traced an ssrc")
+	}
+	if code := adminCall(t, admin.URL+"/tracessrc?ssrc=4294967295", testAdminToken); code != http.StatusOK {
+		t.Fatalf("trace code=%d, want 200", code)
+	}
+	if !log.TracingSSRC(4294967295) {
+		t.Fatal("ssrc not traced")
+	}
+	if code := adminCall(t, admin.URL+"/tracessrc", testAdminToken); code != http.StatusOK {
+		t.Fatalf("stop trace code=%d, want 200", code)
+	}
+	if _, ok := log.TracedSSRC(); ok {
+		t.Fatal("trace not stopped")
+	}
+}
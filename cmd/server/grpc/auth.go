@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// metadata key of the token, the value is "Bearer <token>"
+	authMetadataKey = "authorization"
+	bearerPrefix    = "bearer "
+
+	opPublish   = "publish"
+	opSubscribe = "subscribe"
+	// create and close routers, and list them over the rest api
+	opManage = "manage"
+	opList   = "list"
+)
+
+type authConfig struct {
+	Secret string `mapstructure:"secret"`
+}
+
+// Claims is the identity carried by a token
+type Claims struct {
+	jwt.StandardClaims
+	// the identity may publish
+	Publish bool `json:"publish"`
+	// the mids the identity may subscribe to, all if empty
+	Mids []string `json:"mids,omitempty"`
+}
+
+// Authenticator validate the token of a call and return its identity
+type Authenticator interface {
+	Authenticate(token string) (*Claims, error)
+}
+
+// Authorizer decide whether claims allow op on mid
+type Authorizer func(claims *Claims, op, mid string) bool
+
+// JWTAuthenticator validate HMAC signed jwt tokens
+type JWTAuthenticator struct {
+	secret []byte
+}
+
+// NewJWTAuthenticator return an authenticator of tokens signed with secret
+func NewJWTAuthenticator(secret string) *JWTAuthenticator {
+	return &JWTAuthenticator{secret: []byte(secret)}
+}
+
+// Authenticate parse token and check its signature and expiry
+func (a *JWTAuthenticator) Authenticate(token string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		return a.secret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// ClaimsAuthorizer allow what the claims grant
+func ClaimsAuthorizer(claims *Claims, op, mid string) bool {
+	switch op {
+	case opPublish, opManage:
+		return claims.Publish
+	case opSubscribe, opList:
+		if len(claims.Mids) == 0 {
+			return true
+		}
+		for _, m := range claims.Mids {
+			if m == mid {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unary methods callable without a token, e.g. by load balancers
+var authExempt = map[string]bool{
+	"/sfu.SFU/HealthCheck": true,
+}
+
+type claimsKey struct{}
+
+// claimsFrom return the claims authStream or authUnary put in ctx, nil
+// without auth
+func claimsFrom(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsKey{}).(*Claims)
+	return claims
+}
+
+// authStream reject the calls without a valid token, the identity is
+// passed to the handler in the stream context. It lets every call
+// through when the server has no authenticator.
+func (s *server) authStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if s.auth == nil {
+		return handler(srv, ss)
+	}
+	claims, err := s.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authServerStream{
+		ServerStream: ss,
+		ctx:          context.WithValue(ss.Context(), claimsKey{}, claims),
+	})
+}
+
+// authUnary is authStream for the unary calls, those in authExempt need
+// no token
+func (s *server) authUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if s.auth == nil || authExempt[info.FullMethod] {
+		return handler(ctx, req)
+	}
+	claims, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(context.WithValue(ctx, claimsKey{}, claims), req)
+}
+
+// authenticate return the identity of the token of the call
+func (s *server) authenticate(ctx context.Context) (*Claims, error) {
+	token, err := bearerToken(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	claims, err := s.auth.Authenticate(token)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid token: %v", err)
+	}
+	return claims, nil
+}
+
+// authorize check the identity of the call may do op on mid
+func (s *server) authorize(ctx context.Context, op, mid string) error {
+	claims := claimsFrom(ctx)
+	if claims == nil || s.authorizer == nil {
+		return nil
+	}
+	if !s.authorizer(claims, op, mid) {
+		return status.Errorf(codes.PermissionDenied, "%s %s not allowed", op, mid)
+	}
+	return nil
+}
+
+func bearerToken(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(authMetadataKey)
+	if len(values) == 0 {
+		return "", errors.New("missing token")
+	}
+	if !strings.HasPrefix(strings.ToLower(values[0]), bearerPrefix) {
+		return "", errors.New("not a bearer token")
+	}
+	return strings.TrimSpace(values[0][len(bearerPrefix):]), nil
+}
+
+// authServerStream replace the context of a stream
+type authServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (a *authServerStream) Context() context.Context {
+	return a.ctx
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/pion/ion-sfu/cmd/server/grpc/proto"
+)
+
+const testSecret = "secret"
+
+func signToken(t *testing.T, secret string, claims *Claims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatalf("SignedString err=%v", err)
+	}
+	return token
+}
+
+// subscribeCode return the status code of a subscribe to mid with token
+func subscribeCode(t *testing.T, client pb.SFUClient, token, mid string) codes.Code {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, authMetadataKey, "Bearer "+token)
+	}
+	stream, err := client.Subscribe(ctx)
+	if err != nil {
+		t.Fatalf("Subscribe err=%v", err)
+	}
+	err = stream.Send(&pb.SubscribeRequest{
+		Mid: mid,
+		Payload: &pb.SubscribeRequest_Connect{
+			Connect: &pb.Connect{Description: &pb.SessionDescription{Type: "offer"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Send err=%v", err)
+	}
+	_, err = stream.Recv()
+	return status.Code(err)
+}
+
+func TestAuth(t *testing.T) {
+	srv := newServer(newTestSFU(t))
+	defer srv.node.Close()
+	srv.auth = NewJWTAuthenticator(testSecret)
+	srv.authorizer = ClaimsAuthorizer
+	client, stop := startServer(t, srv)
+	defer stop()
+
+	if code := subscribeCode(t, client, "", "mid"); code != codes.Unauthenticated {
+		t.Errorf("no token code=%v, want Unauthenticated", code)
+	}
+	if code := subscribeCode(t, client, "not a token", "mid"); code != codes.Unauthenticated {
+		t.Errorf("malformed token code=%v, want Unauthenticated", code)
+	}
+	if code := subscribeCode(t, client, signToken(t, "other", &Claims{}), "mid"); code != codes.Unauthenticated {
+		t.Errorf("token of another secret code=%v, want Unauthenticated", code)
+	}
+	expired := &Claims{StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(-time.Minute).Unix()}}
+	if code := subscribeCode(t, client, signToken(t, testSecret, expired), "mid"); code != codes.Unauthenticated {
+		t.Errorf("expired token code=%v, want Unauthenticated", code)
+	}
+
+	token := signToken(t, testSecret, &Claims{Mids: []string{"mid"}})
+	if code := subscribeCode(t, client, token, "other"); code != codes.PermissionDenied {
+		t.Errorf("unauthorized mid code=%v, want PermissionDenied", code)
+	}
+	// the mid has no router, the call gets past auth
+	if code := subscribeCode(t, client, token, "mid"); code == codes.Unauthenticated || code == codes.PermissionDenied {
+		t.Errorf("authorized mid code=%v", code)
+	}
+
+	// the token does not allow publishing
+	stream, err := client.Publish(metadata.AppendToOutgoingContext(context.Background(), authMetadataKey, "Bearer "+token))
+	if err != nil {
+		t.Fatalf("Publish err=%v", err)
+	}
+	err = stream.Send(&pb.PublishRequest{
+		Payload: &pb.PublishRequest_Connect{
+			Connect: &pb.Connect{Description: &pb.SessionDescription{Type: "offer"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Send err=%v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("publish code=%v, want PermissionDenied", status.Code(err))
+	}
+}
+
+func TestAuthUnary(t *testing.T) {
+	srv := newServer(newTestSFU(t))
+	defer srv.node.Close()
+	srv.auth = NewJWTAuthenticator(testSecret)
+	srv.authorizer = ClaimsAuthorizer
+	client, stop := startServer(t, srv)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Stats(ctx, &pb.StatsRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("stats without token code=%v, want Unauthenticated", status.Code(err))
+	}
+	if _, err := client.ListRouters(ctx, &pb.ListRoutersRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("list without token code=%v, want Unauthenticated", status.Code(err))
+	}
+	if _, err := client.HealthCheck(ctx, &pb.HealthCheckRequest{}); err != nil {
+		t.Errorf("health check without token err=%v", err)
+	}
+
+	some := metadata.AppendToOutgoingContext(ctx, authMetadataKey, "Bearer "+signToken(t, testSecret, &Claims{Mids: []string{"mid"}}))
+	if _, err := client.Stats(some, &pb.StatsRequest{}); err != nil {
+		t.Errorf("stats with token err=%v", err)
+	}
+	if _, err := client.ListRouters(some, &pb.ListRoutersRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("list of a token for one mid code=%v, want PermissionDenied", status.Code(err))
+	}
+	all := metadata.AppendToOutgoingContext(ctx, authMetadataKey, "Bearer "+signToken(t, testSecret, &Claims{}))
+	if _, err := client.ListRouters(all, &pb.ListRoutersRequest{}); err != nil {
+		t.Errorf("list with token err=%v", err)
+	}
+}
+
+func TestNoAuth(t *testing.T) {
+	srv := newServer(newTestSFU(t))
+	defer srv.node.Close()
+	client, stop := startServer(t, srv)
+	defer stop()
+
+	// without an authenticator calls need no token
+	if code := subscribeCode(t, client, "", "mid"); code == codes.Unauthenticated || code == codes.PermissionDenied {
+		t.Errorf("code=%v without auth", code)
+	}
+}
+
+func TestClaimsAuthorizer(t *testing.T) {
+	all := &Claims{Publish: true}
+	some := &Claims{Mids: []string{"a", "b"}}
+	tests := []struct {
+		claims  *Claims
+		op, mid string
+		allowed bool
+	}{
+		{all, opPublish, "", true},
+		{all, opSubscribe, "x", true},
+		{some, opPublish, "", false},
+		{some, opSubscribe, "b", true},
+		{some, opSubscribe, "c", false},
+		{all, opManage, "x", true},
+		{some, opManage, "a", false},
+		{some, opList, "a", true},
+		{some, opList, "", false},
+		{all, opList, "", true},
+		{all, "unknown", "", false},
+	}
+	for _, tt := range tests {
+		if got := ClaimsAuthorizer(tt.claims, tt.op, tt.mid); got != tt.allowed {
+			t.Errorf("ClaimsAuthorizer(%+v, %s, %s)=%v, want %v", tt.claims, tt.op, tt.mid, got, tt.allowed)
+		}
+	}
+}
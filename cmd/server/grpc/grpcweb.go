@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/improbable-eng/grpc-web/go/grpcweb"
+	"google.golang.org/grpc"
+
+	"github.com/pion/ion-sfu/pkg/log"
+)
+
+type grpcWebConfig struct {
+	// serve the grpc service over grpc-web when set
+	Port string `mapstructure:"port"`
+}
+
+// newGRPCWebHandler wrap s for grpc-web clients of any origin. grpc-web
+// can't stream from the client over http/1.1, Publish and Subscribe take
+// the websocket transport of the improbable-eng client.
+func newGRPCWebHandler(s *grpc.Server) http.Handler {
+	return grpcweb.WrapServer(s,
+		grpcweb.WithOriginFunc(func(string) bool { return true }),
+		grpcweb.WithWebsockets(true),
+		grpcweb.WithWebsocketOriginFunc(func(*http.Request) bool { return true }),
+	)
+}
+
+// serveGRPCWeb serve s over grpc-web on port, with the tls of grpc when it
+// is on. The calls go through the interceptors of s, auth included.
+func serveGRPCWeb(s *grpc.Server, port string, config *tls.Config) {
+	srv := &http.Server{Addr: port, Handler: newGRPCWebHandler(s), TLSConfig: config}
+	log.Infof("SFU grpc-web at %s", port)
+	var err error
+	if config != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		log.Warnf("grpc-web is served without tls")
+		err = srv.ListenAndServe()
+	}
+	if err != nil {
+		log.Errorf("failed to serve grpc-web: %v", err)
+	}
+}
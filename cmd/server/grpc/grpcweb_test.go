@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v2"
+	"google.golang.org/grpc"
+
+	pb "github.com/pion/ion-sfu/cmd/server/grpc/proto"
+)
+
+// startGRPCWeb serve srv over grpc-web on a test http server
+func startGRPCWeb(t *testing.T, srv *server) (*httptest.Server, func()) {
+	s := grpc.NewServer(grpc.StreamInterceptor(srv.authStream))
+	pb.RegisterSFUServer(s, srv)
+	web := httptest.NewServer(newGRPCWebHandler(s))
+	return web, func() {
+		web.Close()
+		s.Stop()
+	}
+}
+
+// grpcWebFrame return msg in a grpc length prefixed frame
+func grpcWebFrame(t *testing.T, msg proto.Message) []byte {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	return append(frame, data...)
+}
+
+// nextGRPCWebFrame return the flags and data of the first frame of buf and
+// the rest, false if buf holds no whole frame
+func nextGRPCWebFrame(buf []byte) (byte, []byte, []byte, bool) {
+	if len(buf) < 5 {
+		return 0, nil, buf, false
+	}
+	n := int(binary.BigEndian.Uint32(buf[1:5]))
+	if len(buf) < 5+n {
+		return 0, nil, buf, false
+	}
+	return buf[0], buf[5 : 5+n], buf[5+n:], true
+}
+
+func TestGRPCWebPublish(t *testing.T) {
+	srv := newServer(newTestSFU(t))
+	defer srv.node.Close()
+	web, stop := startGRPCWeb(t, srv)
+	defer stop()
+
+	m := webrtc.MediaEngine{}
+	m.RegisterDefaultCodecs()
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	track, err := pc.NewTrack(webrtc.DefaultPayloadTypeVP8, 5000, "video", "pion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the streaming calls go over the websocket transport of grpc-web
+	dialer := websocket.Dialer{Subprotocols: []string{"grpc-websockets"}}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(web.URL, "http")+"/sfu.SFU/Publish", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	headers := "content-type: application/grpc-web+proto\r\nx-grpc-web: 1\r\n\r\n"
+	if err := ws.WriteMessage(websocket.BinaryMessage, []byte(headers)); err != nil {
+		t.Fatal(err)
+	}
+	request := grpcWebFrame(t, &pb.PublishRequest{Payload: &pb.PublishRequest_Connect{Connect: &pb.Connect{
+		Description: &pb.SessionDescription{Type: offer.Type.String(), Sdp: []byte(offer.SDP)},
+	}}})
+	// the first byte of a client message tells data from the end of sending
+	if err := ws.WriteMessage(websocket.BinaryMessage, append([]byte{0}, request...)); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf []byte
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("no publish reply: %v", err)
+		}
+		buf = append(buf, data...)
+		flags, frame, rest, ok := nextGRPCWebFrame(buf)
+		if !ok {
+			continue
+		}
+		buf = rest
+		// headers and trailers have the msb set
+		if flags&0x80 != 0 {
+			if bytes.Contains(frame, []byte("grpc-status")) && !bytes.Contains(frame, []byte("grpc-status: 0")) {
+				t.Fatalf("publish failed: %s", frame)
+			}
+			continue
+		}
+		reply := &pb.PublishReply{}
+		if err := proto.Unmarshal(frame, reply); err != nil {
+			t.Fatal(err)
+		}
+		connect := reply.GetConnect()
+		if connect == nil || reply.Mid == "" || connect.Description.Type != "answer" || len(connect.Description.Sdp) == 0 {
+			t.Fatalf("reply %v, want the answer", reply)
+		}
+		if srv.node.GetRouter(reply.Mid) == nil {
+			t.Fatal("no router for the pub")
+		}
+		return
+	}
+}
+
+func TestGRPCWebUnary(t *testing.T) {
+	srv := newServer(newTestSFU(t))
+	defer srv.node.Close()
+	web, stop := startGRPCWeb(t, srv)
+	defer stop()
+
+	// browsers of other origins are allowed
+	preflight, _ := http.NewRequest("OPTIONS", web.URL+"/sfu.SFU/Stats", nil)
+	preflight.Header.Set("Origin", "http://example.com")
+	preflight.Header.Set("Access-Control-Request-Method", "POST")
+	preflight.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web")
+	resp, err := http.DefaultClient.Do(preflight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if origin := resp.Header.Get("Access-Control-Allow-Origin"); origin != "http://example.com" {
+		t.Fatalf("preflight allowed origin %q", origin)
+	}
+
+	resp, err = http.Post(web.URL+"/sfu.SFU/Stats", "application/grpc-web+proto", bytes.NewReader(grpcWebFrame(t, &pb.StatsRequest{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags, frame, _, ok := nextGRPCWebFrame(body)
+	if !ok || flags != 0 {
+		t.Fatalf("status=%d body=%q, want a stats reply", resp.StatusCode, body)
+	}
+	if err := proto.Unmarshal(frame, &pb.StatsReply{}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,13 +2,26 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
-
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
 	"github.com/pion/ion-sfu/pkg/log"
 	sfu "github.com/pion/ion-sfu/pkg/node"
 	"github.com/pion/ion-sfu/pkg/rtc/transport"
@@ -16,37 +29,81 @@ import (
 	"github.com/spf13/viper"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
 
 	pb "github.com/pion/ion-sfu/cmd/server/grpc/proto"
 )
 
 type grpcConfig struct {
-	Port string `mapstructure:"port"`
+	Port string    `mapstructure:"port"`
+	TLS  tlsConfig `mapstructure:"tls"`
 }
 
 // Config defines parameters for configuring the sfu instance
 type Config struct {
 	sfu.Config `mapstructure:",squash"`
-	GRPC       grpcConfig `mapstructure:"grpc"`
+	GRPC       grpcConfig      `mapstructure:"grpc"`
+	Auth       authConfig      `mapstructure:"auth"`
+	WebSocket  websocketConfig `mapstructure:"websocket"`
+	GRPCWeb    grpcWebConfig   `mapstructure:"grpcweb"`
+	Admin      adminConfig     `mapstructure:"admin"`
+	REST       restConfig      `mapstructure:"rest"`
 }
 
 var (
 	conf = Config{}
 	file string
+	// serve grpc without tls even if it is configured, for local dev
+	insecure bool
+	// the sfu the grpc server drives, reloads apply to it
+	node *sfu.SFU
+
+	// guards conf, node and reloadHandlers, the config watcher reloads
+	// while main reads them
+	reloadLock     sync.Mutex
+	reloadHandlers []func(*Config)
 )
 
 type server struct {
 	pb.UnimplementedSFUServer
+	node *sfu.SFU
+	// calls are not authenticated when nil
+	auth       Authenticator
+	authorizer Authorizer
+
+	// error count and time of the last health check
+	healthLock   sync.Mutex
+	lastErrCount uint64
+	lastCheck    time.Time
+}
+
+func newServer(node *sfu.SFU) *server {
+	return &server{
+		node:         node,
+		lastErrCount: log.ErrorCount(),
+		lastCheck:    time.Now(),
+	}
 }
 
 const (
 	portRangeLimit = 100
+
+	// env vars with this prefix override the config file, e.g. SFU_GRPC_PORT
+	envPrefix = "SFU"
+
+	// health check reports degraded above these limits
+	maxGoroutines = 10000
+	maxErrorRate  = 1.0 // errors per second
+
+	// how long routers may flush their subs on SIGTERM
+	shutdownTimeout = 10 * time.Second
 )
 
 func showHelp() {
 	fmt.Printf("Usage:%s {params}\n", os.Args[0])
 	fmt.Println("      -c {config file}")
+	fmt.Println("      -insecure (serve grpc without tls)")
 	fmt.Println("      -h (show help info)")
 }
 
@@ -57,7 +114,11 @@ func load() bool {
 	}
 
 	viper.SetConfigFile(file)
-	viper.SetConfigType("toml")
+	viper.SetConfigType(configType(file))
+	viper.SetEnvPrefix(envPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+	bindEnvs(reflect.TypeOf(conf))
 
 	err = viper.ReadInConfig()
 	if err != nil {
@@ -70,22 +131,168 @@ func load() bool {
 		return false
 	}
 
-	if len(conf.WebRTC.ICEPortRange) > 2 {
-		fmt.Printf("config file %s loaded failed. range port must be [min,max]\n", file)
+	if err := validate(conf); err != nil {
+		fmt.Printf("config file %s loaded failed. %v\n", file, err)
 		return false
 	}
 
-	if len(conf.WebRTC.ICEPortRange) != 0 && conf.WebRTC.ICEPortRange[1]-conf.WebRTC.ICEPortRange[0] <= portRangeLimit {
-		fmt.Printf("config file %s loaded failed. range port must be [min, max] and max - min >= %d\n", file, portRangeLimit)
+	fmt.Printf("config %s load ok!\n", file)
+	return true
+}
+
+// OnReload register f to be called with the new config after the config file changed
+func OnReload(f func(*Config)) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	reloadHandlers = append(reloadHandlers, f)
+}
+
+// watch reload the config when the config file changes
+func watch() {
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		log.Infof("config file %s changed", e.Name)
+		reload()
+	})
+	viper.WatchConfig()
+}
+
+// reload apply the config viper has read again, an invalid config is
+// ignored and the last good one stays in use
+func reload() bool {
+	var c Config
+	if err := viper.Unmarshal(&c); err != nil {
+		log.Errorf("config file %s reload failed. %v", file, err)
+		return false
+	}
+	if err := validate(c); err != nil {
+		log.Errorf("config file %s reload failed. %v", file, err)
 		return false
 	}
 
-	fmt.Printf("config %s load ok!\n", file)
+	reloadLock.Lock()
+	// the config may change before the sfu is started or after it stopped
+	if node != nil {
+		if err := node.Reload(c.Config); err != nil {
+			reloadLock.Unlock()
+			log.Errorf("config file %s reload failed. %v", file, err)
+			return false
+		}
+	}
+	conf = c
+	handlers := make([]func(*Config), len(reloadHandlers))
+	copy(handlers, reloadHandlers)
+	reloadLock.Unlock()
+
+	log.Infof("config file %s reloaded", file)
+	for _, f := range handlers {
+		f(&c)
+	}
 	return true
 }
 
+// currentConfig return the config in use, a reload may replace it
+func currentConfig() Config {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	return conf
+}
+
+// setNode make n the sfu the reloads apply to, nil when none runs
+func setNode(n *sfu.SFU) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	node = n
+}
+
+// validate check the settings that would otherwise fail at runtime
+func validate(c Config) error {
+	if len(c.WebRTC.ICEPortRange) != 0 && len(c.WebRTC.ICEPortRange) != 2 {
+		return errors.New("range port must be [min,max]")
+	}
+
+	if len(c.WebRTC.ICEPortRange) != 0 && c.WebRTC.ICEPortRange[1]-c.WebRTC.ICEPortRange[0] <= portRangeLimit {
+		return fmt.Errorf("range port must be [min, max] and max - min >= %d", portRangeLimit)
+	}
+
+	if err := transport.CheckICEServers(c.WebRTC.ICEServers); err != nil {
+		return err
+	}
+
+	if _, port, err := net.SplitHostPort(c.GRPC.Port); err == nil && port == strconv.Itoa(c.Rtp.Port) {
+		return fmt.Errorf("rtp.port %d is the same as grpc.port %s", c.Rtp.Port, c.GRPC.Port)
+	}
+
+	if c.WebSocket.Port != "" && c.WebSocket.Port == c.GRPC.Port {
+		return fmt.Errorf("websocket.port %s is the same as grpc.port", c.WebSocket.Port)
+	}
+
+	if c.GRPCWeb.Port != "" && (c.GRPCWeb.Port == c.GRPC.Port || c.GRPCWeb.Port == c.WebSocket.Port) {
+		return fmt.Errorf("grpcweb.port %s is the same as grpc.port or websocket.port", c.GRPCWeb.Port)
+	}
+
+	if c.Admin.Port != "" {
+		if c.Admin.Token == "" {
+			return errors.New("admin.token must be set to serve the admin api")
+		}
+		if c.Admin.Port == c.GRPC.Port || c.Admin.Port == c.WebSocket.Port || c.Admin.Port == c.GRPCWeb.Port {
+			return fmt.Errorf("admin.port %s is the same as grpc.port, websocket.port or grpcweb.port", c.Admin.Port)
+		}
+	}
+
+	if c.REST.Port != "" {
+		for _, port := range []string{c.GRPC.Port, c.WebSocket.Port, c.GRPCWeb.Port, c.Admin.Port} {
+			if c.REST.Port == port {
+				return fmt.Errorf("rest.port %s is the same as another port", c.REST.Port)
+			}
+		}
+	}
+
+	if c.GRPC.TLS.enabled() {
+		if _, err := serverTLS(c.GRPC.TLS); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configType return the config type by file extension, toml if unknown
+func configType(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".json":
+		return "json"
+	}
+	return "toml"
+}
+
+// bindEnvs bind an env var to every config key, so keys missing
+// from the config file can still be set from the env
+func bindEnvs(t reflect.Type, keys ...string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("mapstructure")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		if tag == ",squash" {
+			bindEnvs(field.Type, keys...)
+			continue
+		}
+		key := append(append([]string(nil), keys...), tag)
+		if field.Type.Kind() == reflect.Struct {
+			bindEnvs(field.Type, key...)
+			continue
+		}
+		if err := viper.BindEnv(strings.Join(key, ".")); err != nil {
+			fmt.Printf("bind env for %s failed. %v\n", strings.Join(key, "."), err)
+		}
+	}
+}
+
 func parse() bool {
 	flag.StringVar(&file, "c", "config.toml", "config file")
+	flag.BoolVar(&insecure, "insecure", false, "serve grpc without tls")
 	help := flag.Bool("h", false, "help info")
 	flag.Parse()
 	if !load() {
@@ -105,19 +312,79 @@ func main() {
 		os.Exit(-1)
 	}
 
-	sfu.Init(conf.Config)
+	// the listeners keep the config they startConf with
+	startConf := currentConfig()
+	sfuNode, err := sfu.New(startConf.Config)
+	if err != nil {
+		log.Panicf("failed to start sfu: %v", err)
+	}
+	setNode(sfuNode)
+	watch()
 	log.Infof("--- Starting SFU Node ---")
-	lis, err := net.Listen("tcp", conf.GRPC.Port)
+	lis, err := net.Listen("tcp", startConf.GRPC.Port)
 	if err != nil {
 		log.Panicf("failed to listen: %v", err)
 	}
-	log.Infof("SFU Listening at %s", conf.GRPC.Port)
-	s := grpc.NewServer()
-	pb.RegisterSFUServer(s, &server{})
+	log.Infof("SFU Listening at %s", startConf.GRPC.Port)
+	srv := newServer(sfuNode)
+	if startConf.Auth.Secret != "" {
+		srv.auth = NewJWTAuthenticator(startConf.Auth.Secret)
+		srv.authorizer = ClaimsAuthorizer
+	}
+	opts := []grpc.ServerOption{
+		grpc.StreamInterceptor(srv.authStream),
+		grpc.UnaryInterceptor(srv.authUnary),
+	}
+	var tlsConfig *tls.Config
+	if startConf.GRPC.TLS.enabled() && !insecure {
+		tlsConfig, err = serverTLS(startConf.GRPC.TLS)
+		if err != nil {
+			log.Panicf("failed to load tls: %v", err)
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	} else {
+		log.Warnf("grpc is served without tls")
+	}
+	if startConf.WebSocket.Port != "" {
+		go serveWebSocket(srv, startConf.WebSocket.Port, tlsConfig)
+	}
+	if startConf.Admin.Port != "" {
+		go serveAdmin(sfuNode, startConf.Admin, tlsConfig)
+	}
+	if startConf.REST.Port != "" {
+		go serveREST(srv, startConf.REST.Port, tlsConfig)
+	}
+	s := grpc.NewServer(opts...)
+	pb.RegisterSFUServer(s, srv)
+	if startConf.GRPCWeb.Port != "" {
+		go serveGRPCWeb(s, startConf.GRPCWeb.Port, tlsConfig)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	stopped := make(chan struct{})
+	go func() {
+		sig := <-sigs
+		log.Infof("got %v, shutting down", sig)
+		shutdown(s, sfuNode, shutdownTimeout)
+		close(stopped)
+	}()
+
 	if err := s.Serve(lis); err != nil {
 		log.Panicf("failed to serve: %v", err)
 	}
-	select {}
+	<-stopped
+}
+
+// shutdown stop accepting pubs and subs, drain the routers of node within
+// timeout, then close the grpc streams left
+func shutdown(s *grpc.Server, node *sfu.SFU, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := node.Shutdown(ctx); err != nil {
+		log.Warnf("sfu shutdown: %v", err)
+	}
+	s.Stop()
 }
 
 // Publish a stream to the sfu. Publish creates a bidirectional
@@ -137,7 +404,13 @@ func main() {
 // message must *always* be sent first.
 // 2. `Trickle` containing candidate information for Trickle ICE.
 //
+// A later `Connect` with the icerestart option restarts ice of the
+// existing connection, e.g. after a network change, and is answered
+// with a new `Connect`.
+//
 // If the client closes this stream, the webrtc stream will be closed.
+//
+// With auth on, the call needs a token allowed to publish.
 func (s *server) Publish(stream pb.SFU_PublishServer) error {
 	var pub *transport.WebRTCTransport
 	for {
@@ -166,16 +439,52 @@ func (s *server) Publish(stream pb.SFU_PublishServer) error {
 			var answer *webrtc.SessionDescription
 			log.Infof("publish->connect called: %v", payload.Connect)
 
-			pub, answer, err = sfu.Publish(webrtc.SessionDescription{
+			// the client network changed, keep the transport and its router entry
+			if pub != nil && payload.Connect.GetOptions().GetIcerestart() {
+				restart, err := pub.ICERestart(webrtc.SessionDescription{
+					Type: webrtc.SDPTypeOffer,
+					SDP:  string(payload.Connect.Description.Sdp),
+				})
+				if err != nil {
+					log.Errorf("publish->connect: error restarting ice: %v", err)
+					pub.Close()
+					return err
+				}
+				err = stream.Send(&pb.PublishReply{
+					Mid: pub.ID(),
+					Payload: &pb.PublishReply_Connect{
+						Connect: &pb.Connect{
+							Description: &pb.SessionDescription{
+								Type: restart.Type.String(),
+								Sdp:  []byte(restart.SDP),
+							},
+						},
+					},
+				})
+				if err != nil {
+					log.Errorf("publish->connect: error sending ice restart answer: %v", err)
+					pub.Close()
+					return err
+				}
+				continue
+			}
+
+			if err := s.authorize(stream.Context(), opPublish, ""); err != nil {
+				return err
+			}
+			pub, answer, err = s.node.Publish(webrtc.SessionDescription{
 				Type: webrtc.SDPTypeOffer,
 				SDP:  string(payload.Connect.Description.Sdp),
 			})
 
+			if err == sfu.ErrShutdown {
+				return status.Error(codes.Unavailable, err.Error())
+			}
 			if err != nil {
 				log.Errorf("publish->connect: error publishing stream: %v", err)
-				pub.Close()
 				return err
 			}
+			closeOnDone(stream.Context(), pub)
 
 			err = stream.Send(&pb.PublishReply{
 				Mid: pub.ID(),
@@ -195,24 +504,36 @@ func (s *server) Publish(stream pb.SFU_PublishServer) error {
 				return err
 			}
 
-			// TODO: Close
-			go func() {
+			// trickle local candidates until the stream ends
+			go func(t *transport.WebRTCTransport) {
 				for {
-					trickle := <-pub.GetCandidateChan()
-					if trickle != nil {
+					select {
+					case <-stream.Context().Done():
+						return
+					case trickle := <-t.GetCandidateChan():
+						if trickle == nil {
+							return
+						}
+						candidate, err := json.Marshal(trickle.ToJSON())
+						if err != nil {
+							log.Errorf("publish->trickle: error marshaling candidate: %v", err)
+							continue
+						}
 						err = stream.Send(&pb.PublishReply{
-							Mid: pub.ID(),
+							Mid: t.ID(),
 							Payload: &pb.PublishReply_Trickle{
 								Trickle: &pb.Trickle{
-									Candidate: trickle.String(),
+									Candidate: string(candidate),
 								},
 							},
 						})
-					} else {
-						return
+						if err != nil {
+							log.Errorf("publish->trickle: error sending candidate: %v", err)
+							return
+						}
 					}
 				}
-			}()
+			}(pub)
 
 		case *pb.PublishRequest_Trickle:
 			if pub == nil {
@@ -243,7 +564,13 @@ func (s *server) Publish(stream pb.SFU_PublishServer) error {
 // message must *always* be sent first.
 // 2. `Trickle` containing candidate information for Trickle ICE.
 //
+// A later `Connect` with the icerestart option restarts ice of the
+// existing connection, e.g. after a network change, and is answered
+// with a new `Connect`.
+//
 // If the client closes this stream, the webrtc stream will be closed.
+//
+// With auth on, the call needs a token allowed to subscribe to the mid.
 func (s *server) Subscribe(stream pb.SFU_SubscribeServer) error {
 	var sub *transport.WebRTCTransport
 	for {
@@ -271,15 +598,55 @@ func (s *server) Subscribe(stream pb.SFU_SubscribeServer) error {
 		case *pb.SubscribeRequest_Connect:
 			var answer *webrtc.SessionDescription
 			log.Infof("subscribe->connect called: %v", payload.Connect)
-			sub, answer, err = sfu.Subscribe(in.Mid, webrtc.SessionDescription{
+
+			// the client network changed, keep the transport and its router entry
+			if sub != nil && payload.Connect.GetOptions().GetIcerestart() {
+				restart, err := sub.ICERestart(webrtc.SessionDescription{
+					Type: webrtc.SDPTypeOffer,
+					SDP:  string(payload.Connect.Description.Sdp),
+				})
+				if err != nil {
+					log.Errorf("subscribe->connect: error restarting ice: %v", err)
+					sub.Close()
+					return err
+				}
+				err = stream.Send(&pb.SubscribeReply{
+					Mid: sub.ID(),
+					Payload: &pb.SubscribeReply_Connect{
+						Connect: &pb.Connect{
+							Description: &pb.SessionDescription{
+								Type: restart.Type.String(),
+								Sdp:  []byte(restart.SDP),
+							},
+						},
+					},
+				})
+				if err != nil {
+					log.Errorf("subscribe->connect: error sending ice restart answer: %v", err)
+					sub.Close()
+					return err
+				}
+				continue
+			}
+			if err := s.authorize(stream.Context(), opSubscribe, in.Mid); err != nil {
+				return err
+			}
+			sub, answer, err = s.node.Subscribe(in.Mid, webrtc.SessionDescription{
 				Type: webrtc.SDPTypeOffer,
 				SDP:  string(payload.Connect.Description.Sdp),
 			})
 
+			if err == sfu.ErrShutdown {
+				return status.Error(codes.Unavailable, err.Error())
+			}
+			if err == sfu.ErrRouterFull {
+				return status.Error(codes.ResourceExhausted, err.Error())
+			}
 			if err != nil {
 				log.Errorf("subscribe->connect: error subscribing stream: %v", err)
 				return err
 			}
+			closeOnDone(stream.Context(), sub)
 
 			err = stream.Send(&pb.SubscribeReply{
 				Mid: sub.ID(),
@@ -299,24 +666,36 @@ func (s *server) Subscribe(stream pb.SFU_SubscribeServer) error {
 				return nil
 			}
 
-			// TODO: Close
-			go func() {
+			// trickle local candidates until the stream ends
+			go func(t *transport.WebRTCTransport) {
 				for {
-					trickle := <-sub.GetCandidateChan()
-					if trickle != nil {
+					select {
+					case <-stream.Context().Done():
+						return
+					case trickle := <-t.GetCandidateChan():
+						if trickle == nil {
+							return
+						}
+						candidate, err := json.Marshal(trickle.ToJSON())
+						if err != nil {
+							log.Errorf("subscribe->trickle: error marshaling candidate: %v", err)
+							continue
+						}
 						err = stream.Send(&pb.SubscribeReply{
-							Mid: sub.ID(),
+							Mid: t.ID(),
 							Payload: &pb.SubscribeReply_Trickle{
 								Trickle: &pb.Trickle{
-									Candidate: trickle.String(),
+									Candidate: string(candidate),
 								},
 							},
 						})
-					} else {
-						return
+						if err != nil {
+							log.Errorf("subscribe->trickle: error sending candidate: %v", err)
+							return
+						}
 					}
 				}
-			}()
+			}(sub)
 
 		case *pb.SubscribeRequest_Trickle:
 			if sub == nil {
@@ -329,3 +708,72 @@ func (s *server) Subscribe(stream pb.SFU_SubscribeServer) error {
 		}
 	}
 }
+
+// closeOnDone close t once ctx is done. The context of a call is cancelled
+// when the client cancels it or goes away, and when the handler returns, so
+// the transport of a call never outlives it and leaves its router.
+func closeOnDone(ctx context.Context, t *transport.WebRTCTransport) {
+	go func() {
+		<-ctx.Done()
+		t.Close()
+	}()
+}
+
+// Stats returns the load of the sfu, assembled from all routers
+func (s *server) Stats(ctx context.Context, in *pb.StatsRequest) (*pb.StatsReply, error) {
+	stats := s.node.Stats()
+	return &pb.StatsReply{
+		Routers: uint32(stats.Routers),
+		Pubs:    uint32(stats.Pubs),
+		Subs:    uint32(stats.Subs),
+		Bitrate: stats.Bitrate,
+		Uptime:  int64(stats.Uptime / time.Second),
+	}, nil
+}
+
+// ListRouters returns the running routers with their pub, subs and stats
+func (s *server) ListRouters(ctx context.Context, in *pb.ListRoutersRequest) (*pb.ListRoutersReply, error) {
+	if err := s.authorize(ctx, opList, ""); err != nil {
+		return nil, err
+	}
+	routers := s.node.ListRouters()
+	reply := &pb.ListRoutersReply{Routers: make([]*pb.RouterInfo, 0, len(routers))}
+	for _, router := range routers {
+		reply.Routers = append(reply.Routers, &pb.RouterInfo{
+			Id:             router.ID,
+			Pub:            router.Pub,
+			Subs:           router.Subs,
+			Bitrate:        router.Stats.Bitrate,
+			Packetsrouted:  router.Stats.PacketsRouted,
+			Packetsdropped: router.Stats.PacketsDropped,
+			Uptime:         int64(router.Stats.Uptime / time.Second),
+		})
+	}
+	return reply, nil
+}
+
+// HealthCheck returns OK, or DEGRADED when there are too many goroutines
+// or too many errors were logged since the last check
+func (s *server) HealthCheck(ctx context.Context, in *pb.HealthCheckRequest) (*pb.HealthCheckReply, error) {
+	s.healthLock.Lock()
+	now := time.Now()
+	errCount := log.ErrorCount()
+	errRate := float64(errCount-s.lastErrCount) / now.Sub(s.lastCheck).Seconds()
+	s.lastErrCount = errCount
+	s.lastCheck = now
+	s.healthLock.Unlock()
+
+	if n := runtime.NumGoroutine(); n > maxGoroutines {
+		return &pb.HealthCheckReply{
+			Status: pb.HealthCheckReply_DEGRADED,
+			Reason: fmt.Sprintf("%d goroutines", n),
+		}, nil
+	}
+	if errRate > maxErrorRate {
+		return &pb.HealthCheckReply{
+			Status: pb.HealthCheckReply_DEGRADED,
+			Reason: fmt.Sprintf("%.2f errors/s", errRate),
+		}, nil
+	}
+	return &pb.HealthCheckReply{Status: pb.HealthCheckReply_OK}, nil
+}
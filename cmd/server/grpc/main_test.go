@@ -0,0 +1,632 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+	"github.com/pion/ion-sfu/pkg/log"
+	sfu "github.com/pion/ion-sfu/pkg/node"
+	"github.com/pion/ion-sfu/pkg/rtc/plugins"
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+
+	pb "github.com/pion/ion-sfu/cmd/server/grpc/proto"
+)
+
+func startServer(t *testing.T, srv *server) (pb.SFUClient, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen err=%v", err)
+	}
+	s := grpc.NewServer(grpc.StreamInterceptor(srv.authStream), grpc.UnaryInterceptor(srv.authUnary))
+	pb.RegisterSFUServer(s, srv)
+	go func() {
+		_ = s.Serve(lis)
+	}()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		s.Stop()
+		t.Fatalf("dial err=%v", err)
+	}
+	return pb.NewSFUClient(conn), func() {
+		conn.Close()
+		s.Stop()
+	}
+}
+
+// newTestSFU return an sfu without rtp relay
+func newTestSFU(t *testing.T) *sfu.SFU {
+	node, err := sfu.New(sfu.Config{
+		Plugins: plugins.Config{
+			On:           true,
+			JitterBuffer: plugins.JitterBufferConfig{On: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("sfu.New err=%v", err)
+	}
+	return node
+}
+
+func TestStats(t *testing.T) {
+	node := newTestSFU(t)
+	defer node.Close()
+	client, stop := startServer(t, newServer(node))
+	defer stop()
+
+	router, err := node.NewRouter("stats")
+	if err != nil {
+		t.Fatalf("NewRouter err=%v", err)
+	}
+	defer router.Close()
+	router.AddPub(transport.NewOutRTPTransport("pub", "127.0.0.1:6790"))
+	router.AddSub("sub1", transport.NewOutRTPTransport("sub1", "127.0.0.1:6791"))
+	router.AddSub("sub2", transport.NewOutRTPTransport("sub2", "127.0.0.1:6792"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := client.Stats(ctx, &pb.StatsRequest{})
+	if err != nil {
+		t.Fatalf("Stats err=%v", err)
+	}
+	if reply.Routers != 1 || reply.Pubs != 1 || reply.Subs != 2 {
+		t.Fatalf("Stats routers=%d pubs=%d subs=%d, want 1 1 2", reply.Routers, reply.Pubs, reply.Subs)
+	}
+}
+
+func TestListRouters(t *testing.T) {
+	node := newTestSFU(t)
+	defer node.Close()
+	client, stop := startServer(t, newServer(node))
+	defer stop()
+
+	first, err := node.NewRouter("first")
+	if err != nil {
+		t.Fatalf("NewRouter err=%v", err)
+	}
+	second, err := node.NewRouter("second")
+	if err != nil {
+		t.Fatalf("NewRouter err=%v", err)
+	}
+	defer first.Close()
+	first.AddPub(transport.NewOutRTPTransport("pub1", "127.0.0.1:6793"))
+	first.AddSub("sub1", transport.NewOutRTPTransport("sub1", "127.0.0.1:6794"))
+	defer second.Close()
+	second.AddPub(transport.NewOutRTPTransport("pub2", "127.0.0.1:6795"))
+	second.AddSub("sub2", transport.NewOutRTPTransport("sub2", "127.0.0.1:6796"))
+	second.AddSub("sub3", transport.NewOutRTPTransport("sub3", "127.0.0.1:6797"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := client.ListRouters(ctx, &pb.ListRoutersRequest{})
+	if err != nil {
+		t.Fatalf("ListRouters err=%v", err)
+	}
+	want := map[string][]string{
+		"first":  {"sub1"},
+		"second": {"sub2", "sub3"},
+	}
+	wantPub := map[string]string{"first": "pub1", "second": "pub2"}
+	if len(reply.Routers) != len(want) {
+		t.Fatalf("ListRouters routers=%v, want first and second", reply.Routers)
+	}
+	for _, router := range reply.Routers {
+		if !reflect.DeepEqual(router.Subs, want[router.Id]) {
+			t.Fatalf("router %s subs=%v, want %v", router.Id, router.Subs, want[router.Id])
+		}
+		if router.Pub != wantPub[router.Id] {
+			t.Fatalf("router %s pub=%s", router.Id, router.Pub)
+		}
+	}
+
+	// a closed router leaves the list
+	second.Close()
+	reply, err = client.ListRouters(ctx, &pb.ListRoutersRequest{})
+	if err != nil {
+		t.Fatalf("ListRouters err=%v", err)
+	}
+	if len(reply.Routers) != 1 || reply.Routers[0].Id != "first" {
+		t.Fatalf("ListRouters routers=%v, want first", reply.Routers)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	srv := newServer(nil)
+	client, stop := startServer(t, srv)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a few errors spread over an hour is healthy
+	srv.lastCheck = time.Now().Add(-time.Hour)
+	log.Errorf("health check test error")
+	reply, err := client.HealthCheck(ctx, &pb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("HealthCheck err=%v", err)
+	}
+	if reply.Status != pb.HealthCheckReply_OK {
+		t.Fatalf("HealthCheck status=%v reason=%s, want OK", reply.Status, reply.Reason)
+	}
+
+	// a burst of errors since the last check is not
+	for i := 0; i < 100; i++ {
+		log.Errorf("health check test error")
+	}
+	reply, err = client.HealthCheck(ctx, &pb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("HealthCheck err=%v", err)
+	}
+	if reply.Status != pb.HealthCheckReply_DEGRADED {
+		t.Fatalf("HealthCheck status=%v, want DEGRADED", reply.Status)
+	}
+}
+
+const testConfig = `
+[grpc]
+port = ":50051"
+
+[router]
+maxbandwidth = 5000000
+
+[plugins.jitterbuffer]
+on = true
+
+[rtp]
+port = 6666
+
+[log]
+level = "info"
+`
+
+// loadConfig write content to a config file named name and load it
+func loadConfig(t *testing.T, name, content string) bool {
+	dir, err := ioutil.TempDir("", "sfu-config")
+	if err != nil {
+		t.Fatalf("TempDir err=%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file = filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile err=%v", err)
+	}
+	conf = Config{}
+	viper.Reset()
+	return load()
+}
+
+// setEnv set env vars and return a func restoring them
+func setEnv(env map[string]string) func() {
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestLoadEnvOverrides(t *testing.T) {
+	defer setEnv(map[string]string{
+		"SFU_GRPC_PORT":                         ":60000",
+		"SFU_LOG_LEVEL":                         "debug",
+		"SFU_ROUTER_MAXBANDWIDTH":               "1000",
+		"SFU_WEBRTC_PORTRANGE":                  "50000,60000",
+		"SFU_PLUGINS_JITTERBUFFER_NACKINTERVAL": "40",
+	})()
+
+	if !loadConfig(t, "config.toml", testConfig) {
+		t.Fatal("load failed")
+	}
+	if conf.GRPC.Port != ":60000" {
+		t.Errorf("grpc.port=%s, want :60000", conf.GRPC.Port)
+	}
+	if conf.Log.Level != "debug" {
+		t.Errorf("log.level=%s, want debug", conf.Log.Level)
+	}
+	if conf.Router.MaxBandwidth != 1000 {
+		t.Errorf("router.maxbandwidth=%d, want 1000", conf.Router.MaxBandwidth)
+	}
+	if len(conf.WebRTC.ICEPortRange) != 2 || conf.WebRTC.ICEPortRange[0] != 50000 || conf.WebRTC.ICEPortRange[1] != 60000 {
+		t.Errorf("webrtc.portrange=%v, want [50000 60000]", conf.WebRTC.ICEPortRange)
+	}
+	if conf.Plugins.JitterBuffer.NackInterval != 40 {
+		t.Errorf("plugins.jitterbuffer.nackinterval=%d, want 40", conf.Plugins.JitterBuffer.NackInterval)
+	}
+	// values without an env var still come from the file
+	if conf.Rtp.Port != 6666 || !conf.Plugins.JitterBuffer.On {
+		t.Errorf("rtp.port=%d plugins.jitterbuffer.on=%v, want file values", conf.Rtp.Port, conf.Plugins.JitterBuffer.On)
+	}
+}
+
+func TestLoadEnvPortRangeValidated(t *testing.T) {
+	for _, portRange := range []string{"50000,50010", "50000", "50000,50100,60000"} {
+		restore := setEnv(map[string]string{"SFU_WEBRTC_PORTRANGE": portRange})
+		if loadConfig(t, "config.toml", testConfig) {
+			t.Errorf("load with portrange %s succeeded, want failure", portRange)
+		}
+		restore()
+	}
+}
+
+func TestLoadFormats(t *testing.T) {
+	tomlConfig := `
+[grpc]
+port = ":50051"
+
+[router]
+rembfeedback = true
+maxbandwidth = 5000000
+
+[plugins]
+on = true
+
+[plugins.jitterbuffer]
+on = true
+nackinterval = 20
+
+[webrtc]
+portrange = [50000, 60000]
+
+[[webrtc.iceserver]]
+urls = ["stun:stun.stunprotocol.org:3478"]
+
+[[webrtc.iceserver]]
+urls = ["turn:turn.awsome.org:3478"]
+username = "awsome"
+credential = "awsome"
+
+[rtp]
+port = 6666
+
+[log]
+level = "info"
+`
+	// yaml reads a bare on as true, so it is quoted
+	yamlConfig := `
+grpc:
+  port: ":50051"
+router:
+  rembfeedback: true
+  maxbandwidth: 5000000
+plugins:
+  "on": true
+  jitterbuffer:
+    "on": true
+    nackinterval: 20
+webrtc:
+  portrange: [50000, 60000]
+  iceserver:
+    - urls: ["stun:stun.stunprotocol.org:3478"]
+    - urls: ["turn:turn.awsome.org:3478"]
+      username: awsome
+      credential: awsome
+rtp:
+  port: 6666
+log:
+  level: info
+`
+	jsonConfig := `{
+  "grpc": {"port": ":50051"},
+  "router": {"rembfeedback": true, "maxbandwidth": 5000000},
+  "plugins": {"on": true, "jitterbuffer": {"on": true, "nackinterval": 20}},
+  "webrtc": {
+    "portrange": [50000, 60000],
+    "iceserver": [
+      {"urls": ["stun:stun.stunprotocol.org:3478"]},
+      {"urls": ["turn:turn.awsome.org:3478"], "username": "awsome", "credential": "awsome"}
+    ]
+  },
+  "rtp": {"port": 6666},
+  "log": {"level": "info"}
+}`
+
+	if !loadConfig(t, "config.toml", tomlConfig) {
+		t.Fatal("load toml failed")
+	}
+	want := conf
+	if len(want.WebRTC.ICEServers) != 2 || want.WebRTC.ICEServers[1].Username != "awsome" {
+		t.Fatalf("toml iceserver=%+v", want.WebRTC.ICEServers)
+	}
+
+	for name, content := range map[string]string{
+		"config.yaml": yamlConfig,
+		"config.yml":  yamlConfig,
+		"config.json": jsonConfig,
+		// unknown extensions are read as toml
+		"config.conf": tomlConfig,
+	} {
+		if !loadConfig(t, name, content) {
+			t.Fatalf("load %s failed", name)
+		}
+		if !reflect.DeepEqual(conf, want) {
+			t.Errorf("%s config=%+v, want %+v", name, conf, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() Config {
+		var c Config
+		c.GRPC.Port = ":50051"
+		c.Rtp.Port = 6666
+		c.WebRTC.ICEServers = []transport.ICEServerConfig{
+			{URLs: []string{"stun:stun.stunprotocol.org:3478"}},
+			{URLs: []string{"turn:turn.awsome.org:3478"}, Username: "awsome", Credential: "awsome"},
+		}
+		return c
+	}
+	if err := validate(valid()); err != nil {
+		t.Fatalf("validate err=%v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(c *Config)
+		want   string
+	}{
+		{
+			name:   "no urls",
+			modify: func(c *Config) { c.WebRTC.ICEServers[0].URLs = nil },
+			want:   "webrtc.iceserver[0].urls is empty",
+		},
+		{
+			name:   "empty url",
+			modify: func(c *Config) { c.WebRTC.ICEServers[0].URLs = []string{""} },
+			want:   `webrtc.iceserver[0].urls[0] "" is not a stun/turn url`,
+		},
+		{
+			name:   "bad scheme",
+			modify: func(c *Config) { c.WebRTC.ICEServers[0].URLs = []string{"http://stun.stunprotocol.org"} },
+			want:   `webrtc.iceserver[0].urls[0] "http://stun.stunprotocol.org" is not a stun/turn url`,
+		},
+		{
+			name:   "turn without credential",
+			modify: func(c *Config) { c.WebRTC.ICEServers[1].Credential = "" },
+			want:   `webrtc.iceserver[1] turn server "turn:turn.awsome.org:3478" needs a username and credential`,
+		},
+		{
+			name:   "turn without username",
+			modify: func(c *Config) { c.WebRTC.ICEServers[1].Username = "" },
+			want:   `webrtc.iceserver[1] turn server "turn:turn.awsome.org:3478" needs a username and credential`,
+		},
+		{
+			name:   "rtp port same as grpc port",
+			modify: func(c *Config) { c.Rtp.Port = 50051 },
+			want:   "rtp.port 50051 is the same as grpc.port :50051",
+		},
+		{
+			name:   "websocket port same as grpc port",
+			modify: func(c *Config) { c.WebSocket.Port = ":50051" },
+			want:   "websocket.port :50051 is the same as grpc.port",
+		},
+		{
+			name:   "grpcweb port same as websocket port",
+			modify: func(c *Config) { c.WebSocket.Port = ":7000"; c.GRPCWeb.Port = ":7000" },
+			want:   "grpcweb.port :7000 is the same as grpc.port or websocket.port",
+		},
+		{
+			name:   "admin without token",
+			modify: func(c *Config) { c.Admin.Port = ":9000" },
+			want:   "admin.token must be set",
+		},
+		{
+			name:   "admin port same as grpc port",
+			modify: func(c *Config) { c.Admin = adminConfig{Port: ":50051", Token: "secret"} },
+			want:   "admin.port :50051 is the same as grpc.port",
+		},
+		{
+			name:   "rest port same as websocket port",
+			modify: func(c *Config) { c.WebSocket.Port = ":7000"; c.REST.Port = ":7000" },
+			want:   "rest.port :7000 is the same as another port",
+		},
+	} {
+		c := valid()
+		tc.modify(&c)
+		err := validate(c)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: validate err=%v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestLoadInvalidICEServer(t *testing.T) {
+	content := testConfig + `
+[[webrtc.iceserver]]
+urls = ["turn:turn.awsome.org:3478"]
+`
+	if loadConfig(t, "config.toml", content) {
+		t.Fatal("load succeeded with a turn server without credentials")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sfu-config")
+	if err != nil {
+		t.Fatalf("TempDir err=%v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+
+	file = filepath.Join(dir, "config.toml")
+	write := func(content string) {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile err=%v", err)
+		}
+	}
+	write(testConfig)
+	conf = Config{}
+	viper.Reset()
+	if !load() {
+		t.Fatal("load failed")
+	}
+	node := newTestSFU(t)
+	setNode(node)
+	defer func() {
+		setNode(nil)
+		node.Close()
+	}()
+
+	reloaded := make(chan *Config, 10)
+	OnReload(func(c *Config) {
+		reloaded <- c
+	})
+	defer func() {
+		reloadHandlers = nil
+	}()
+	watch()
+
+	// wait for a reload with the given grpc port, skipping repeated events
+	wait := func(port string) *Config {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case c := <-reloaded:
+				if c.GRPC.Port == ":50053" {
+					t.Error("invalid config was applied")
+				}
+				if c.GRPC.Port == port {
+					return c
+				}
+			case <-timeout:
+				t.Fatalf("no reload with grpc.port %s", port)
+			}
+		}
+	}
+
+	write(strings.Replace(strings.Replace(testConfig, ":50051", ":50052", 1), `level = "info"`, `level = "debug"`, 1))
+	c := wait(":50052")
+	if c.Log.Level != "debug" {
+		t.Errorf("reloaded log.level=%s, want debug", c.Log.Level)
+	}
+	if zerolog.GlobalLevel() != zerolog.DebugLevel {
+		t.Errorf("log level=%s, want debug", zerolog.GlobalLevel())
+	}
+
+	// an invalid config is skipped, the next valid one is applied
+	write(strings.Replace(testConfig, ":50051", ":50053", 1) + `
+[[webrtc.iceserver]]
+urls = ["turn:turn.awsome.org:3478"]
+`)
+	write(strings.Replace(testConfig, ":50051", ":50054", 1))
+	wait(":50054")
+	reloadLock.Lock()
+	port := conf.GRPC.Port
+	reloadLock.Unlock()
+	if port != ":50054" {
+		t.Errorf("grpc.port=%s, want :50054", port)
+	}
+}
+
+func TestCancelClosesTransports(t *testing.T) {
+	node := newTestSFU(t)
+	defer node.Close()
+	client, stop := startServer(t, newServer(node))
+	defer stop()
+
+	mid, track, unpublish := testPublish(t, client, make(chan struct{}, 1))
+	defer unpublish()
+	router := node.GetRouter(mid)
+	if router == nil {
+		t.Fatal("no router for the pub")
+	}
+	// subs are answered with the tracks the pub streams
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for sn := uint16(0); ; sn++ {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_ = track.WriteRTP(&rtp.Packet{
+					Header:  rtp.Header{Version: 2, SSRC: track.SSRC(), PayloadType: webrtc.DefaultPayloadTypeVP8, SequenceNumber: sn},
+					Payload: []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a},
+				})
+			}
+		}
+	}()
+	testhelper.WaitFor(t, 10*time.Second, func() bool { return len(router.Stats().PubSSRCs) != 0 })
+
+	// subscribe return the stream of a call subscribed to mid and its sub id
+	subscribe := func(ctx context.Context) (pb.SFU_SubscribeClient, string) {
+		pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+		if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			t.Fatal(err)
+		}
+		offer, err := pc.CreateOffer(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream, err := client.Subscribe(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = stream.Send(&pb.SubscribeRequest{
+			Mid: mid,
+			Payload: &pb.SubscribeRequest_Connect{Connect: &pb.Connect{
+				Description: &pb.SessionDescription{Type: offer.Type.String(), Sdp: []byte(offer.SDP)},
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if router.GetSub(reply.Mid) == nil {
+			t.Fatalf("sub %s not on the router", reply.Mid)
+		}
+		return stream, reply.Mid
+	}
+
+	// a cancelled call
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, id := subscribe(ctx)
+	cancel()
+	testhelper.WaitFor(t, 2*time.Second, func() bool { return router.GetSub(id) == nil })
+
+	// a call the handler ended with an error
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, id := subscribe(ctx)
+	err := stream.Send(&pb.SubscribeRequest{
+		Mid:     mid,
+		Payload: &pb.SubscribeRequest_Trickle{Trickle: &pb.Trickle{Candidate: "{"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the candidates of the sub are trickled until the call ends
+	for err == nil {
+		_, err = stream.Recv()
+	}
+	testhelper.WaitFor(t, 2*time.Second, func() bool { return router.GetSub(id) == nil })
+
+	// the pub closes its router
+	unpublish()
+	testhelper.WaitFor(t, 2*time.Second, func() bool { return node.GetRouter(mid) == nil })
+}
@@ -24,6 +24,31 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
+type HealthCheckReply_Status int32
+
+const (
+	HealthCheckReply_OK       HealthCheckReply_Status = 0
+	HealthCheckReply_DEGRADED HealthCheckReply_Status = 1
+)
+
+var HealthCheckReply_Status_name = map[int32]string{
+	0: "OK",
+	1: "DEGRADED",
+}
+
+var HealthCheckReply_Status_value = map[string]int32{
+	"OK":       0,
+	"DEGRADED": 1,
+}
+
+func (x HealthCheckReply_Status) String() string {
+	return proto.EnumName(HealthCheckReply_Status_name, int32(x))
+}
+
+func (HealthCheckReply_Status) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_ca80ff2c9b7a4e60, []int{11, 0}
+}
+
 type PublishRequest struct {
 	Rid string `protobuf:"bytes,1,opt,name=rid,proto3" json:"rid,omitempty"`
 	// Types that are valid to be assigned to Payload:
@@ -512,6 +537,7 @@ func (m *SessionDescription) GetSdp() []byte {
 type Options struct {
 	Bandwidth            uint32   `protobuf:"varint,1,opt,name=bandwidth,proto3" json:"bandwidth,omitempty"`
 	Transportcc          bool     `protobuf:"varint,2,opt,name=transportcc,proto3" json:"transportcc,omitempty"`
+	Icerestart           bool     `protobuf:"varint,3,opt,name=icerestart,proto3" json:"icerestart,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -556,7 +582,352 @@ func (m *Options) GetTransportcc() bool {
 	return false
 }
 
+func (m *Options) GetIcerestart() bool {
+	if m != nil {
+		return m.Icerestart
+	}
+	return false
+}
+
+type StatsRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *StatsRequest) Reset()         { *m = StatsRequest{} }
+func (m *StatsRequest) String() string { return proto.CompactTextString(m) }
+func (*StatsRequest) ProtoMessage()    {}
+func (*StatsRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca80ff2c9b7a4e60, []int{8}
+}
+
+func (m *StatsRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_StatsRequest.Unmarshal(m, b)
+}
+func (m *StatsRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_StatsRequest.Marshal(b, m, deterministic)
+}
+func (m *StatsRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StatsRequest.Merge(m, src)
+}
+func (m *StatsRequest) XXX_Size() int {
+	return xxx_messageInfo_StatsRequest.Size(m)
+}
+func (m *StatsRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_StatsRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StatsRequest proto.InternalMessageInfo
+
+type StatsReply struct {
+	Routers              uint32   `protobuf:"varint,1,opt,name=routers,proto3" json:"routers,omitempty"`
+	Pubs                 uint32   `protobuf:"varint,2,opt,name=pubs,proto3" json:"pubs,omitempty"`
+	Subs                 uint32   `protobuf:"varint,3,opt,name=subs,proto3" json:"subs,omitempty"`
+	Bitrate              uint64   `protobuf:"varint,4,opt,name=bitrate,proto3" json:"bitrate,omitempty"`
+	Uptime               int64    `protobuf:"varint,5,opt,name=uptime,proto3" json:"uptime,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *StatsReply) Reset()         { *m = StatsReply{} }
+func (m *StatsReply) String() string { return proto.CompactTextString(m) }
+func (*StatsReply) ProtoMessage()    {}
+func (*StatsReply) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca80ff2c9b7a4e60, []int{9}
+}
+
+func (m *StatsReply) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_StatsReply.Unmarshal(m, b)
+}
+func (m *StatsReply) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_StatsReply.Marshal(b, m, deterministic)
+}
+func (m *StatsReply) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StatsReply.Merge(m, src)
+}
+func (m *StatsReply) XXX_Size() int {
+	return xxx_messageInfo_StatsReply.Size(m)
+}
+func (m *StatsReply) XXX_DiscardUnknown() {
+	xxx_messageInfo_StatsReply.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StatsReply proto.InternalMessageInfo
+
+func (m *StatsReply) GetRouters() uint32 {
+	if m != nil {
+		return m.Routers
+	}
+	return 0
+}
+
+func (m *StatsReply) GetPubs() uint32 {
+	if m != nil {
+		return m.Pubs
+	}
+	return 0
+}
+
+func (m *StatsReply) GetSubs() uint32 {
+	if m != nil {
+		return m.Subs
+	}
+	return 0
+}
+
+func (m *StatsReply) GetBitrate() uint64 {
+	if m != nil {
+		return m.Bitrate
+	}
+	return 0
+}
+
+func (m *StatsReply) GetUptime() int64 {
+	if m != nil {
+		return m.Uptime
+	}
+	return 0
+}
+
+type HealthCheckRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *HealthCheckRequest) Reset()         { *m = HealthCheckRequest{} }
+func (m *HealthCheckRequest) String() string { return proto.CompactTextString(m) }
+func (*HealthCheckRequest) ProtoMessage()    {}
+func (*HealthCheckRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca80ff2c9b7a4e60, []int{10}
+}
+
+func (m *HealthCheckRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_HealthCheckRequest.Unmarshal(m, b)
+}
+func (m *HealthCheckRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_HealthCheckRequest.Marshal(b, m, deterministic)
+}
+func (m *HealthCheckRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_HealthCheckRequest.Merge(m, src)
+}
+func (m *HealthCheckRequest) XXX_Size() int {
+	return xxx_messageInfo_HealthCheckRequest.Size(m)
+}
+func (m *HealthCheckRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_HealthCheckRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_HealthCheckRequest proto.InternalMessageInfo
+
+type HealthCheckReply struct {
+	Status               HealthCheckReply_Status `protobuf:"varint,1,opt,name=status,proto3,enum=sfu.HealthCheckReply_Status" json:"status,omitempty"`
+	Reason               string                  `protobuf:"bytes,2,opt,name=reason,proto3" json:"reason,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}                `json:"-"`
+	XXX_unrecognized     []byte                  `json:"-"`
+	XXX_sizecache        int32                   `json:"-"`
+}
+
+func (m *HealthCheckReply) Reset()         { *m = HealthCheckReply{} }
+func (m *HealthCheckReply) String() string { return proto.CompactTextString(m) }
+func (*HealthCheckReply) ProtoMessage()    {}
+func (*HealthCheckReply) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca80ff2c9b7a4e60, []int{11}
+}
+
+func (m *HealthCheckReply) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_HealthCheckReply.Unmarshal(m, b)
+}
+func (m *HealthCheckReply) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_HealthCheckReply.Marshal(b, m, deterministic)
+}
+func (m *HealthCheckReply) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_HealthCheckReply.Merge(m, src)
+}
+func (m *HealthCheckReply) XXX_Size() int {
+	return xxx_messageInfo_HealthCheckReply.Size(m)
+}
+func (m *HealthCheckReply) XXX_DiscardUnknown() {
+	xxx_messageInfo_HealthCheckReply.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_HealthCheckReply proto.InternalMessageInfo
+
+func (m *HealthCheckReply) GetStatus() HealthCheckReply_Status {
+	if m != nil {
+		return m.Status
+	}
+	return HealthCheckReply_OK
+}
+
+func (m *HealthCheckReply) GetReason() string {
+	if m != nil {
+		return m.Reason
+	}
+	return ""
+}
+
+type ListRoutersRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ListRoutersRequest) Reset()         { *m = ListRoutersRequest{} }
+func (m *ListRoutersRequest) String() string { return proto.CompactTextString(m) }
+func (*ListRoutersRequest) ProtoMessage()    {}
+func (*ListRoutersRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca80ff2c9b7a4e60, []int{12}
+}
+
+func (m *ListRoutersRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ListRoutersRequest.Unmarshal(m, b)
+}
+func (m *ListRoutersRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ListRoutersRequest.Marshal(b, m, deterministic)
+}
+func (m *ListRoutersRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ListRoutersRequest.Merge(m, src)
+}
+func (m *ListRoutersRequest) XXX_Size() int {
+	return xxx_messageInfo_ListRoutersRequest.Size(m)
+}
+func (m *ListRoutersRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ListRoutersRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ListRoutersRequest proto.InternalMessageInfo
+
+type RouterInfo struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Pub                  string   `protobuf:"bytes,2,opt,name=pub,proto3" json:"pub,omitempty"`
+	Subs                 []string `protobuf:"bytes,3,rep,name=subs,proto3" json:"subs,omitempty"`
+	Bitrate              uint64   `protobuf:"varint,4,opt,name=bitrate,proto3" json:"bitrate,omitempty"`
+	Packetsrouted        uint64   `protobuf:"varint,5,opt,name=packetsrouted,proto3" json:"packetsrouted,omitempty"`
+	Packetsdropped       uint64   `protobuf:"varint,6,opt,name=packetsdropped,proto3" json:"packetsdropped,omitempty"`
+	Uptime               int64    `protobuf:"varint,7,opt,name=uptime,proto3" json:"uptime,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RouterInfo) Reset()         { *m = RouterInfo{} }
+func (m *RouterInfo) String() string { return proto.CompactTextString(m) }
+func (*RouterInfo) ProtoMessage()    {}
+func (*RouterInfo) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca80ff2c9b7a4e60, []int{13}
+}
+
+func (m *RouterInfo) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RouterInfo.Unmarshal(m, b)
+}
+func (m *RouterInfo) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RouterInfo.Marshal(b, m, deterministic)
+}
+func (m *RouterInfo) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RouterInfo.Merge(m, src)
+}
+func (m *RouterInfo) XXX_Size() int {
+	return xxx_messageInfo_RouterInfo.Size(m)
+}
+func (m *RouterInfo) XXX_DiscardUnknown() {
+	xxx_messageInfo_RouterInfo.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RouterInfo proto.InternalMessageInfo
+
+func (m *RouterInfo) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *RouterInfo) GetPub() string {
+	if m != nil {
+		return m.Pub
+	}
+	return ""
+}
+
+func (m *RouterInfo) GetSubs() []string {
+	if m != nil {
+		return m.Subs
+	}
+	return nil
+}
+
+func (m *RouterInfo) GetBitrate() uint64 {
+	if m != nil {
+		return m.Bitrate
+	}
+	return 0
+}
+
+func (m *RouterInfo) GetPacketsrouted() uint64 {
+	if m != nil {
+		return m.Packetsrouted
+	}
+	return 0
+}
+
+func (m *RouterInfo) GetPacketsdropped() uint64 {
+	if m != nil {
+		return m.Packetsdropped
+	}
+	return 0
+}
+
+func (m *RouterInfo) GetUptime() int64 {
+	if m != nil {
+		return m.Uptime
+	}
+	return 0
+}
+
+type ListRoutersReply struct {
+	Routers              []*RouterInfo `protobuf:"bytes,1,rep,name=routers,proto3" json:"routers,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}      `json:"-"`
+	XXX_unrecognized     []byte        `json:"-"`
+	XXX_sizecache        int32         `json:"-"`
+}
+
+func (m *ListRoutersReply) Reset()         { *m = ListRoutersReply{} }
+func (m *ListRoutersReply) String() string { return proto.CompactTextString(m) }
+func (*ListRoutersReply) ProtoMessage()    {}
+func (*ListRoutersReply) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ca80ff2c9b7a4e60, []int{14}
+}
+
+func (m *ListRoutersReply) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ListRoutersReply.Unmarshal(m, b)
+}
+func (m *ListRoutersReply) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ListRoutersReply.Marshal(b, m, deterministic)
+}
+func (m *ListRoutersReply) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ListRoutersReply.Merge(m, src)
+}
+func (m *ListRoutersReply) XXX_Size() int {
+	return xxx_messageInfo_ListRoutersReply.Size(m)
+}
+func (m *ListRoutersReply) XXX_DiscardUnknown() {
+	xxx_messageInfo_ListRoutersReply.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ListRoutersReply proto.InternalMessageInfo
+
+func (m *ListRoutersReply) GetRouters() []*RouterInfo {
+	if m != nil {
+		return m.Routers
+	}
+	return nil
+}
+
 func init() {
+	proto.RegisterEnum("sfu.HealthCheckReply_Status", HealthCheckReply_Status_name, HealthCheckReply_Status_value)
 	proto.RegisterType((*PublishRequest)(nil), "sfu.PublishRequest")
 	proto.RegisterType((*PublishReply)(nil), "sfu.PublishReply")
 	proto.RegisterType((*SubscribeRequest)(nil), "sfu.SubscribeRequest")
@@ -565,38 +936,64 @@ func init() {
 	proto.RegisterType((*Trickle)(nil), "sfu.Trickle")
 	proto.RegisterType((*SessionDescription)(nil), "sfu.SessionDescription")
 	proto.RegisterType((*Options)(nil), "sfu.Options")
+	proto.RegisterType((*StatsRequest)(nil), "sfu.StatsRequest")
+	proto.RegisterType((*StatsReply)(nil), "sfu.StatsReply")
+	proto.RegisterType((*HealthCheckRequest)(nil), "sfu.HealthCheckRequest")
+	proto.RegisterType((*HealthCheckReply)(nil), "sfu.HealthCheckReply")
+	proto.RegisterType((*ListRoutersRequest)(nil), "sfu.ListRoutersRequest")
+	proto.RegisterType((*RouterInfo)(nil), "sfu.RouterInfo")
+	proto.RegisterType((*ListRoutersReply)(nil), "sfu.ListRoutersReply")
 }
 
 func init() { proto.RegisterFile("cmd/server/grpc/proto/sfu.proto", fileDescriptor_ca80ff2c9b7a4e60) }
 
 var fileDescriptor_ca80ff2c9b7a4e60 = []byte{
-	// 412 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xc4, 0x93, 0xc1, 0x8b, 0xd4, 0x30,
-	0x14, 0xc6, 0xb7, 0x56, 0xac, 0x7d, 0x1d, 0x65, 0xcd, 0x22, 0x0e, 0x8b, 0xe0, 0xd0, 0x83, 0xf6,
-	0xb2, 0x13, 0x19, 0x0f, 0xa2, 0xe0, 0x65, 0x15, 0xd1, 0x93, 0x92, 0xd1, 0x8b, 0xb7, 0x36, 0xc9,
-	0xec, 0x04, 0xdb, 0x24, 0x26, 0xa9, 0xd2, 0x83, 0x88, 0xf8, 0x8f, 0x4b, 0xd2, 0xce, 0xb4, 0xb3,
-	0x7a, 0xd5, 0x3d, 0xe5, 0xf1, 0xbd, 0x2f, 0xef, 0xfd, 0xf2, 0x92, 0xc0, 0x03, 0xda, 0x30, 0x6c,
-	0xb9, 0xf9, 0xca, 0x0d, 0xbe, 0x30, 0x9a, 0x62, 0x6d, 0x94, 0x53, 0xd8, 0x6e, 0xda, 0x65, 0x88,
-	0x50, 0x6c, 0x37, 0x6d, 0xfe, 0x33, 0x82, 0xdb, 0xef, 0xdb, 0xaa, 0x16, 0x76, 0x4b, 0xf8, 0x97,
-	0x96, 0x5b, 0x87, 0x8e, 0x21, 0x36, 0x82, 0xcd, 0xa3, 0x45, 0x54, 0xa4, 0xc4, 0x87, 0xa8, 0x80,
-	0x84, 0x2a, 0x29, 0x39, 0x75, 0xf3, 0x6b, 0x8b, 0xa8, 0xc8, 0x56, 0xb3, 0xa5, 0x2f, 0xf3, 0xb2,
-	0xd7, 0xde, 0x1c, 0x91, 0x5d, 0xda, 0x3b, 0x9d, 0x11, 0xf4, 0x73, 0xcd, 0xe7, 0xf1, 0xc4, 0xf9,
-	0xa1, 0xd7, 0xbc, 0x73, 0x48, 0x9f, 0xa7, 0x90, 0xe8, 0xb2, 0xab, 0x55, 0xc9, 0xf2, 0x1f, 0x30,
-	0xdb, 0x23, 0xe8, 0xba, 0xf3, 0x00, 0xcd, 0x08, 0xd0, 0xfc, 0x7b, 0x80, 0x5f, 0x11, 0x1c, 0xaf,
-	0xdb, 0xca, 0x52, 0x23, 0x2a, 0x3e, 0x19, 0xc3, 0xff, 0xa5, 0xf0, 0x57, 0x31, 0xa1, 0xb8, 0x92,
-	0x49, 0xd4, 0x90, 0x0c, 0xa5, 0xd0, 0x33, 0xc8, 0x18, 0xf7, 0x30, 0xda, 0x09, 0x25, 0x03, 0x43,
-	0xb6, 0xba, 0x17, 0x6a, 0xac, 0xb9, 0xb5, 0x42, 0xc9, 0x57, 0x63, 0x9a, 0x4c, 0xbd, 0xe8, 0x21,
-	0x24, 0x2a, 0x44, 0xf6, 0x00, 0xf2, 0x5d, 0xaf, 0x91, 0x5d, 0x32, 0x7f, 0x04, 0xc9, 0x80, 0x83,
-	0xee, 0x43, 0x4a, 0x4b, 0xc9, 0x04, 0x2b, 0x1d, 0x1f, 0xce, 0x3b, 0x0a, 0xf9, 0x73, 0x40, 0x7f,
-	0xf6, 0x44, 0x08, 0xae, 0xbb, 0x4e, 0xef, 0xec, 0x21, 0xf6, 0x13, 0xb3, 0x4c, 0x87, 0xb6, 0x33,
-	0xe2, 0xc3, 0xfc, 0x2d, 0x24, 0x43, 0x63, 0xdf, 0xa4, 0x2a, 0x25, 0xfb, 0x26, 0x98, 0xdb, 0x86,
-	0x5d, 0xb7, 0xc8, 0x28, 0xa0, 0x05, 0x64, 0xce, 0x94, 0xd2, 0x6a, 0x65, 0x1c, 0xa5, 0xa1, 0xc4,
-	0x4d, 0x32, 0x95, 0x56, 0xdf, 0x21, 0x5e, 0xbf, 0xfe, 0x88, 0x9e, 0x42, 0x32, 0xbc, 0x57, 0x74,
-	0x12, 0x0e, 0x76, 0xf8, 0x81, 0x4e, 0xef, 0x1c, 0x8a, 0xba, 0xee, 0xf2, 0xa3, 0x22, 0x7a, 0x1c,
-	0xa1, 0x17, 0x90, 0xee, 0x2f, 0x18, 0xdd, 0xed, 0x47, 0x79, 0xe9, 0xd9, 0x9d, 0x9e, 0x5c, 0x96,
-	0xf7, 0xdb, 0xcf, 0xf1, 0xa7, 0xb3, 0x0b, 0xe1, 0xb6, 0x6d, 0xb5, 0xa4, 0xaa, 0xc1, 0x5a, 0x28,
-	0x89, 0x85, 0x92, 0x67, 0x76, 0xd3, 0xe2, 0xbf, 0xfe, 0xf5, 0xea, 0x46, 0x58, 0x9e, 0xfc, 0x0e,
-	0x00, 0x00, 0xff, 0xff, 0x52, 0x81, 0xb7, 0xdc, 0x0b, 0x04, 0x00, 0x00,
+	// 713 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xc5, 0x55, 0xd1, 0x6e, 0xd3, 0x30,
+	0x14, 0x6d, 0x9a, 0xae, 0x59, 0x6f, 0xbb, 0xae, 0x78, 0x8c, 0x55, 0x13, 0x1a, 0x53, 0x84, 0x60,
+	0x3c, 0xac, 0x41, 0x05, 0x09, 0x81, 0x34, 0x21, 0xb6, 0x0e, 0x86, 0x40, 0x1a, 0x72, 0xe1, 0x85,
+	0xb7, 0xc4, 0xf1, 0xd6, 0x68, 0x6d, 0x13, 0x6c, 0x07, 0xb4, 0x27, 0x40, 0xfc, 0x0f, 0x1f, 0xc1,
+	0x97, 0x61, 0x3b, 0x6e, 0xeb, 0x74, 0x93, 0x78, 0x02, 0x1e, 0xa6, 0x5d, 0x1f, 0x5f, 0xdf, 0x7b,
+	0x7c, 0xee, 0x89, 0x0b, 0x77, 0xc8, 0x24, 0x0e, 0x38, 0x65, 0x9f, 0x29, 0x0b, 0xce, 0x59, 0x46,
+	0x82, 0x8c, 0xa5, 0x22, 0x0d, 0xf8, 0x59, 0xde, 0xd3, 0x11, 0x72, 0x65, 0xe8, 0x7f, 0x77, 0xa0,
+	0xfd, 0x2e, 0x8f, 0xc6, 0x09, 0x1f, 0x61, 0xfa, 0x29, 0xa7, 0x5c, 0xa0, 0x0e, 0xb8, 0x2c, 0x89,
+	0xbb, 0xce, 0xae, 0xb3, 0xd7, 0xc0, 0x2a, 0x44, 0x7b, 0xe0, 0x91, 0x74, 0x3a, 0xa5, 0x44, 0x74,
+	0xab, 0x12, 0x6d, 0xf6, 0x5b, 0x3d, 0x55, 0xe6, 0xa8, 0xc0, 0x4e, 0x2a, 0x78, 0xb6, 0xad, 0x32,
+	0x05, 0x4b, 0xc8, 0xc5, 0x98, 0x76, 0x5d, 0x2b, 0xf3, 0x7d, 0x81, 0xa9, 0x4c, 0xb3, 0x7d, 0xd8,
+	0x00, 0x2f, 0x0b, 0x2f, 0xc7, 0x69, 0x18, 0xfb, 0x5f, 0xa1, 0x35, 0xa7, 0x90, 0x8d, 0x2f, 0x15,
+	0x81, 0xc9, 0x82, 0xc0, 0xe4, 0xef, 0x13, 0xf8, 0xe1, 0x40, 0x67, 0x98, 0x47, 0x9c, 0xb0, 0x24,
+	0xa2, 0x96, 0x0c, 0xff, 0x96, 0x85, 0x1a, 0x85, 0xc5, 0xe2, 0xbf, 0x28, 0x31, 0x06, 0xcf, 0x94,
+	0x42, 0x4f, 0xa1, 0x19, 0x53, 0x45, 0x26, 0x13, 0x49, 0x3a, 0xd5, 0x1c, 0x9a, 0xfd, 0x2d, 0x5d,
+	0x63, 0x48, 0x39, 0x97, 0xd8, 0x60, 0xb1, 0x8d, 0xed, 0x5c, 0x74, 0x0f, 0xbc, 0x54, 0x47, 0xbc,
+	0x44, 0xf2, 0xb4, 0xc0, 0xf0, 0x6c, 0xd3, 0xbf, 0x0f, 0x9e, 0xa1, 0x83, 0x6e, 0x43, 0x83, 0x84,
+	0xd3, 0x38, 0x89, 0x43, 0x41, 0xcd, 0x7d, 0x17, 0x80, 0xff, 0x0c, 0xd0, 0xd5, 0x9e, 0x08, 0x41,
+	0x4d, 0x5c, 0x66, 0xb3, 0x74, 0x1d, 0x2b, 0xc5, 0x78, 0x9c, 0xe9, 0xb6, 0x2d, 0xac, 0x42, 0x3f,
+	0x01, 0xcf, 0x34, 0x56, 0x4d, 0x22, 0x59, 0xf3, 0x4b, 0x12, 0x8b, 0x91, 0x3e, 0xb5, 0x86, 0x17,
+	0x00, 0xda, 0x85, 0xa6, 0x60, 0xe1, 0x94, 0x67, 0x29, 0x13, 0x84, 0xe8, 0x12, 0xab, 0xd8, 0x86,
+	0xd0, 0x0e, 0x40, 0x42, 0x28, 0x93, 0xee, 0x08, 0x99, 0xd0, 0xaa, 0xae, 0x62, 0x0b, 0xf1, 0xdb,
+	0xd0, 0x1a, 0x8a, 0x50, 0x70, 0x63, 0x21, 0xff, 0x9b, 0x03, 0x60, 0x00, 0x35, 0xcd, 0x2e, 0x78,
+	0x2c, 0xcd, 0x05, 0x65, 0xdc, 0x34, 0x9f, 0x2d, 0xd5, 0x4d, 0x32, 0x39, 0x79, 0xdd, 0x73, 0x0d,
+	0xeb, 0x58, 0x61, 0x5c, 0x61, 0x6e, 0x81, 0xa9, 0x58, 0x55, 0x88, 0x12, 0xc9, 0x48, 0x6a, 0x54,
+	0x93, 0x70, 0x0d, 0xcf, 0x96, 0xe8, 0x16, 0xd4, 0x73, 0x79, 0xcb, 0x09, 0xed, 0xae, 0xc8, 0x0d,
+	0x17, 0x9b, 0x95, 0x7f, 0x13, 0xd0, 0x09, 0x0d, 0xc7, 0x62, 0x74, 0x34, 0xa2, 0xe4, 0xc2, 0x22,
+	0xd6, 0x29, 0xc1, 0x8a, 0xde, 0x63, 0xa8, 0xcb, 0x6b, 0x88, 0xbc, 0x60, 0xd7, 0xee, 0xdf, 0xd6,
+	0x43, 0x5b, 0x4e, 0xeb, 0x0d, 0x75, 0x0e, 0x36, 0xb9, 0xaa, 0x31, 0xa3, 0x21, 0x97, 0x0e, 0xa9,
+	0xea, 0x31, 0x98, 0x95, 0xbf, 0x03, 0xf5, 0x22, 0x13, 0xd5, 0xa1, 0x7a, 0xfa, 0xa6, 0x53, 0x41,
+	0x2d, 0x58, 0x1d, 0x1c, 0xbf, 0xc2, 0x2f, 0x06, 0xc7, 0x83, 0x8e, 0xa3, 0x88, 0xbd, 0x4d, 0xb8,
+	0xc0, 0x85, 0x02, 0x33, 0x62, 0xbf, 0xa4, 0x62, 0x05, 0xf4, 0x7a, 0x7a, 0x96, 0xa2, 0x36, 0x54,
+	0xe7, 0xf6, 0x97, 0x91, 0x9a, 0xae, 0xd4, 0xc6, 0x74, 0x52, 0xa1, 0xa5, 0x92, 0xab, 0x3c, 0xf0,
+	0x07, 0x95, 0xee, 0xc2, 0x5a, 0x16, 0x92, 0x0b, 0x2a, 0xb8, 0x56, 0x3e, 0xd6, 0x62, 0xd5, 0x70,
+	0x19, 0x94, 0xf6, 0x6d, 0x1b, 0x20, 0x66, 0x69, 0x96, 0xc9, 0xb4, 0xba, 0x4e, 0x5b, 0x42, 0x2d,
+	0xcd, 0xbd, 0x92, 0xe6, 0x07, 0xd0, 0x29, 0x5d, 0x4d, 0x89, 0xfb, 0xc0, 0x9e, 0xbd, 0x2b, 0x3f,
+	0x89, 0x75, 0xad, 0xee, 0xe2, 0xae, 0x73, 0x33, 0xf4, 0x7f, 0x56, 0xc1, 0x1d, 0xbe, 0xfc, 0x80,
+	0x9e, 0x80, 0x67, 0x9e, 0x45, 0xb4, 0xa1, 0x93, 0xcb, 0xef, 0xf4, 0xf6, 0x8d, 0x32, 0x28, 0xbb,
+	0xf8, 0x95, 0x3d, 0xe7, 0xa1, 0x83, 0x0e, 0xa0, 0x31, 0x7f, 0x47, 0xd0, 0x66, 0xf1, 0xc5, 0x2e,
+	0xbd, 0x6e, 0xdb, 0x1b, 0xcb, 0xf0, 0xe2, 0xf8, 0x3e, 0xac, 0x68, 0xd3, 0xa2, 0xa2, 0x81, 0xed,
+	0xe8, 0xed, 0x75, 0x1b, 0xd2, 0x47, 0xd0, 0x73, 0x68, 0x5a, 0x1e, 0x41, 0x5b, 0x57, 0x5d, 0x53,
+	0x1c, 0xdd, 0xbc, 0xd6, 0x4e, 0x45, 0x01, 0x4b, 0x2e, 0x53, 0xe0, 0xaa, 0x37, 0x4c, 0x81, 0x65,
+	0x65, 0xfd, 0xca, 0x61, 0xf0, 0x71, 0xff, 0x3c, 0x11, 0xa3, 0x3c, 0xea, 0x91, 0x74, 0x12, 0x64,
+	0xf2, 0x53, 0x0f, 0xe4, 0xdf, 0xbe, 0xcc, 0x0e, 0xae, 0xfd, 0x0d, 0x8c, 0xea, 0xfa, 0xdf, 0xa3,
+	0xdf, 0x8a, 0x66, 0x6d, 0xdc, 0x23, 0x07, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -613,6 +1010,9 @@ const _ = grpc.SupportPackageIsVersion4
 type SFUClient interface {
 	Publish(ctx context.Context, opts ...grpc.CallOption) (SFU_PublishClient, error)
 	Subscribe(ctx context.Context, opts ...grpc.CallOption) (SFU_SubscribeClient, error)
+	Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsReply, error)
+	HealthCheck(ctx context.Context, in *HealthCheckRequest, opts ...grpc.CallOption) (*HealthCheckReply, error)
+	ListRouters(ctx context.Context, in *ListRoutersRequest, opts ...grpc.CallOption) (*ListRoutersReply, error)
 }
 
 type sFUClient struct {
@@ -685,10 +1085,40 @@ func (x *sFUSubscribeClient) Recv() (*SubscribeReply, error) {
 	return m, nil
 }
 
+func (c *sFUClient) Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsReply, error) {
+	out := new(StatsReply)
+	err := c.cc.Invoke(ctx, "/sfu.SFU/Stats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sFUClient) HealthCheck(ctx context.Context, in *HealthCheckRequest, opts ...grpc.CallOption) (*HealthCheckReply, error) {
+	out := new(HealthCheckReply)
+	err := c.cc.Invoke(ctx, "/sfu.SFU/HealthCheck", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sFUClient) ListRouters(ctx context.Context, in *ListRoutersRequest, opts ...grpc.CallOption) (*ListRoutersReply, error) {
+	out := new(ListRoutersReply)
+	err := c.cc.Invoke(ctx, "/sfu.SFU/ListRouters", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // SFUServer is the server API for SFU service.
 type SFUServer interface {
 	Publish(SFU_PublishServer) error
 	Subscribe(SFU_SubscribeServer) error
+	Stats(context.Context, *StatsRequest) (*StatsReply, error)
+	HealthCheck(context.Context, *HealthCheckRequest) (*HealthCheckReply, error)
+	ListRouters(context.Context, *ListRoutersRequest) (*ListRoutersReply, error)
 }
 
 // UnimplementedSFUServer can be embedded to have forward compatible implementations.
@@ -701,6 +1131,15 @@ func (*UnimplementedSFUServer) Publish(srv SFU_PublishServer) error {
 func (*UnimplementedSFUServer) Subscribe(srv SFU_SubscribeServer) error {
 	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
 }
+func (*UnimplementedSFUServer) Stats(ctx context.Context, req *StatsRequest) (*StatsReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stats not implemented")
+}
+func (*UnimplementedSFUServer) HealthCheck(ctx context.Context, req *HealthCheckRequest) (*HealthCheckReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method HealthCheck not implemented")
+}
+func (*UnimplementedSFUServer) ListRouters(ctx context.Context, req *ListRoutersRequest) (*ListRoutersReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListRouters not implemented")
+}
 
 func RegisterSFUServer(s *grpc.Server, srv SFUServer) {
 	s.RegisterService(&_SFU_serviceDesc, srv)
@@ -758,10 +1197,77 @@ func (x *sFUSubscribeServer) Recv() (*SubscribeRequest, error) {
 	return m, nil
 }
 
+func _SFU_Stats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SFUServer).Stats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sfu.SFU/Stats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SFUServer).Stats(ctx, req.(*StatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SFU_HealthCheck_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HealthCheckRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SFUServer).HealthCheck(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sfu.SFU/HealthCheck",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SFUServer).HealthCheck(ctx, req.(*HealthCheckRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SFU_ListRouters_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRoutersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SFUServer).ListRouters(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sfu.SFU/ListRouters",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SFUServer).ListRouters(ctx, req.(*ListRoutersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _SFU_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "sfu.SFU",
 	HandlerType: (*SFUServer)(nil),
-	Methods:     []grpc.MethodDesc{},
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Stats",
+			Handler:    _SFU_Stats_Handler,
+		},
+		{
+			MethodName: "HealthCheck",
+			Handler:    _SFU_HealthCheck_Handler,
+		},
+		{
+			MethodName: "ListRouters",
+			Handler:    _SFU_ListRouters_Handler,
+		},
+	},
 	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "Publish",
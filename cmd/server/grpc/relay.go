@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lucsky/cuid"
+	"github.com/pion/ion-sfu/pkg/log"
+	sfu "github.com/pion/ion-sfu/pkg/node"
+	"github.com/pion/ion-sfu/pkg/rtc"
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+	"github.com/pion/webrtc/v2"
+
+	pb "github.com/pion/ion-sfu/cmd/server/grpc/proto"
+)
+
+const (
+	// wait between attempts to connect a lost relay again, doubled on
+	// every failure up to relayRetryMax
+	relayRetryMin = 100 * time.Millisecond
+	relayRetryMax = 5 * time.Second
+)
+
+var errRelayNoAnswer = errors.New("relay: remote sfu didn't answer")
+
+// relayLink is one subscription to the remote sfu, lost is closed when
+// the grpc stream or the ice connection breaks
+type relayLink struct {
+	t      *transport.WebRTCTransport
+	cancel context.CancelFunc
+	lost   chan struct{}
+	once   sync.Once
+}
+
+func (l *relayLink) lose() {
+	l.once.Do(func() {
+		close(l.lost)
+	})
+}
+
+// RelaySub subscribes to the pub mid of another sfu over its grpc Subscribe
+// and publishes it on the router mid of the local sfu, so local subs
+// receive it without connecting to the other sfu. The key frame requests of
+// the local subs reach the remote pub over the same link, and a lost link
+// is connected again until Close is called or the local router closes.
+type RelaySub struct {
+	client pb.SFUClient
+	mid    string
+	router *rtc.Router
+	ctx    context.Context
+	cancel context.CancelFunc
+	lock   sync.Mutex
+	link   *relayLink
+}
+
+// NewRelaySub subscribe to pub mid of the sfu client is connected to, and
+// add it to a new router mid of node
+func NewRelaySub(client pb.SFUClient, node *sfu.SFU, mid string) (*RelaySub, error) {
+	router, err := node.NewRouter(mid)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &RelaySub{
+		client: client,
+		mid:    mid,
+		router: router,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	link, err := r.connect()
+	if err != nil {
+		cancel()
+		router.Close()
+		return nil, err
+	}
+	r.link = link
+	if err := router.AddPub(link.t); err != nil {
+		cancel()
+		link.t.Close()
+		router.Close()
+		return nil, err
+	}
+	r.watch(link)
+	router.OnClose(r.cancel)
+	go r.run()
+	return r, nil
+}
+
+// Router return the local router publishing the relayed pub
+func (r *RelaySub) Router() *rtc.Router {
+	return r.router
+}
+
+// Close stop relaying and close the local router
+func (r *RelaySub) Close() {
+	r.cancel()
+	r.router.Close()
+}
+
+// run connect the link again each time it is lost
+func (r *RelaySub) run() {
+	for {
+		link := r.getLink()
+		select {
+		case <-r.ctx.Done():
+			link.cancel()
+			return
+		case <-link.lost:
+		}
+		log.Warnf("relay %s link lost, reconnecting", r.mid)
+		link.cancel()
+
+		wait := relayRetryMin
+		for {
+			next, err := r.connect()
+			if err == nil {
+				r.lock.Lock()
+				r.link = next
+				r.lock.Unlock()
+				// the remote sfu asks its pub for a key frame for the new sub
+				r.router.SwitchPub(next.t)
+				r.watch(next)
+				break
+			}
+			log.Errorf("relay %s reconnect err=%v, retrying in %v", r.mid, err, wait)
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			if wait *= 2; wait > relayRetryMax {
+				wait = relayRetryMax
+			}
+		}
+	}
+}
+
+func (r *RelaySub) getLink() *relayLink {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.link
+}
+
+// watch lose link as soon as its ice connection breaks. It replaces the
+// state handler of the router, the link is switched instead of waiting
+// for the transport to reconnect.
+func (r *RelaySub) watch(link *relayLink) {
+	link.t.OnConnectionStateChange(func(state int) {
+		if state == transport.StateDisconnected || state == transport.StateFailed {
+			link.lose()
+		}
+	})
+}
+
+// connect subscribe to the remote pub with a new transport, it returns
+// once the remote answered, ice connects in the background
+func (r *RelaySub) connect() (*relayLink, error) {
+	t := transport.NewWebRTCTransport(cuid.New(), transport.RTCOptions{Publish: true})
+	if t == nil {
+		return nil, errors.New("relay: transport.NewWebRTCTransport failed")
+	}
+	t.Receive()
+	offer, err := t.Offer()
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(r.ctx)
+	link := &relayLink{t: t, cancel: cancel, lost: make(chan struct{})}
+	fail := func(err error) (*relayLink, error) {
+		cancel()
+		t.Close()
+		return nil, err
+	}
+	stream, err := r.client.Subscribe(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	err = stream.Send(&pb.SubscribeRequest{
+		Mid: r.mid,
+		Payload: &pb.SubscribeRequest_Connect{
+			Connect: &pb.Connect{
+				Description: &pb.SessionDescription{
+					Type: offer.Type.String(),
+					Sdp:  []byte(offer.SDP),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fail(err)
+	}
+	reply, err := stream.Recv()
+	if err != nil {
+		return fail(err)
+	}
+	connect, ok := reply.Payload.(*pb.SubscribeReply_Connect)
+	if !ok {
+		return fail(errRelayNoAnswer)
+	}
+	err = t.SetRemoteSDP(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  string(connect.Connect.Description.Sdp),
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	// the remote candidates, the stream breaking loses the link
+	go func() {
+		defer link.lose()
+		for {
+			reply, err := stream.Recv()
+			if err != nil {
+				log.Debugf("relay %s recv err=%v", r.mid, err)
+				return
+			}
+			if trickle, ok := reply.Payload.(*pb.SubscribeReply_Trickle); ok {
+				if err := t.AddCandidate(trickle.Trickle.Candidate); err != nil {
+					log.Errorf("relay %s add candidate err=%v", r.mid, err)
+				}
+			}
+		}
+	}()
+
+	// the local candidates
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case c := <-t.GetCandidateChan():
+				if c == nil {
+					return
+				}
+				candidate, err := json.Marshal(c.ToJSON())
+				if err != nil {
+					log.Errorf("relay %s marshal candidate err=%v", r.mid, err)
+					continue
+				}
+				err = stream.Send(&pb.SubscribeRequest{
+					Mid: r.mid,
+					Payload: &pb.SubscribeRequest_Trickle{
+						Trickle: &pb.Trickle{Candidate: string(candidate)},
+					},
+				})
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return link, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+
+	pb "github.com/pion/ion-sfu/cmd/server/grpc/proto"
+	"github.com/pion/ion-sfu/internal/testhelper"
+)
+
+// relayTestSub is a local sub of the relay router counting what it is sent
+type relayTestSub struct {
+	rtcpCh  chan rtcp.Packet
+	lock    sync.Mutex
+	written int
+}
+
+func (s *relayTestSub) ID() string                        { return "local" }
+func (s *relayTestSub) Type() int                         { return -1 }
+func (s *relayTestSub) ReadRTP() (*rtp.Packet, error)     { select {} }
+func (s *relayTestSub) WriteRTCP(rtcp.Packet) error       { return nil }
+func (s *relayTestSub) GetRTCPChan() chan rtcp.Packet     { return s.rtcpCh }
+func (s *relayTestSub) Close()                            {}
+func (s *relayTestSub) OnClose(func())                    {}
+func (s *relayTestSub) OnConnectionStateChange(func(int)) {}
+func (s *relayTestSub) WriteErrTotal() int                { return 0 }
+func (s *relayTestSub) WriteErrReset()                    {}
+func (s *relayTestSub) GetBandwidth() uint32              { return 0 }
+
+func (s *relayTestSub) WriteRTP(*rtp.Packet) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.written++
+	return nil
+}
+
+func (s *relayTestSub) writtenTotal() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.written
+}
+
+// testPublish publish a vp8 track over client, the plis of the sfu go to plis
+func testPublish(t *testing.T, client pb.SFUClient, plis chan<- struct{}) (string, *webrtc.Track, func()) {
+	m := webrtc.MediaEngine{}
+	m.RegisterDefaultCodecs()
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	track, err := pc.NewTrack(webrtc.DefaultPayloadTypeVP8, 5000, "video", "pion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			pkts, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, pkt := range pkts {
+				if _, ok := pkt.(*rtcp.PictureLossIndication); ok {
+					select {
+					case plis <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.Publish(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// candidates wait for the offer, the stream takes one send at a time
+	var lock sync.Mutex
+	var pending []webrtc.ICECandidateInit
+	connected := false
+	trickle := func(c webrtc.ICECandidateInit) {
+		candidate, _ := json.Marshal(c)
+		_ = stream.Send(&pb.PublishRequest{Payload: &pb.PublishRequest_Trickle{Trickle: &pb.Trickle{Candidate: string(candidate)}}})
+	}
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if !connected {
+			pending = append(pending, c.ToJSON())
+			return
+		}
+		trickle(c.ToJSON())
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	err = stream.Send(&pb.PublishRequest{Payload: &pb.PublishRequest_Connect{Connect: &pb.Connect{
+		Description: &pb.SessionDescription{Type: offer.Type.String(), Sdp: []byte(offer.SDP)},
+	}}})
+	if err != nil {
+		lock.Unlock()
+		t.Fatal(err)
+	}
+	connected = true
+	for _, c := range pending {
+		trickle(c)
+	}
+	lock.Unlock()
+
+	reply, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  string(reply.GetConnect().Description.Sdp),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			reply, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			if trickle := reply.GetTrickle(); trickle != nil {
+				candidate := webrtc.ICECandidateInit{}
+				if json.Unmarshal([]byte(trickle.Candidate), &candidate) == nil {
+					_ = pc.AddICECandidate(candidate)
+				}
+			}
+		}
+	}()
+	return reply.Mid, track, func() {
+		cancel()
+		pc.Close()
+	}
+}
+
+func TestRelaySub(t *testing.T) {
+	remote := newTestSFU(t)
+	defer remote.Close()
+	remoteClient, stopRemote := startServer(t, newServer(remote))
+	defer stopRemote()
+	local := newTestSFU(t)
+	defer local.Close()
+
+	plis := make(chan struct{}, 1)
+	mid, track, unpublish := testPublish(t, remoteClient, plis)
+	defer unpublish()
+
+	// the pub streams until the test ends
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for sn := uint16(0); ; sn++ {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_ = track.WriteRTP(&rtp.Packet{
+					Header:  rtp.Header{Version: 2, SSRC: track.SSRC(), PayloadType: webrtc.DefaultPayloadTypeVP8, SequenceNumber: sn},
+					Payload: []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a},
+				})
+			}
+		}
+	}()
+
+	// subs can join once the remote sfu got the tracks of the pub
+	router := remote.GetRouter(mid)
+	testhelper.WaitFor(t, 10*time.Second, func() bool { return len(router.Stats().PubSSRCs) != 0 })
+
+	relay, err := NewRelaySub(remoteClient, local, mid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	if local.GetRouter(mid) != relay.Router() {
+		t.Fatal("relay router not on the local sfu")
+	}
+	sub := &relayTestSub{rtcpCh: make(chan rtcp.Packet, 10)}
+	relay.Router().AddSub(sub.ID(), sub)
+
+	waitWritten := func(n int) {
+		testhelper.WaitFor(t, 10*time.Second, func() bool { return sub.writtenTotal() >= n })
+	}
+	waitPLI := func() {
+		select {
+		case <-plis:
+		case <-time.After(5 * time.Second):
+			t.Fatal("pli of the local sub didn't reach the remote pub")
+		}
+	}
+	waitWritten(10)
+
+	// the key frame requests of local subs reach the remote pub
+	for len(plis) > 0 {
+		<-plis
+	}
+	time.Sleep(600 * time.Millisecond)
+	sub.rtcpCh <- &rtcp.PictureLossIndication{MediaSSRC: track.SSRC()}
+	waitPLI()
+
+	// a lost link is connected again without losing the local sub
+	old := relay.Router().GetPub()
+	relay.getLink().lose()
+	testhelper.WaitFor(t, 5*time.Second, func() bool { return relay.Router().GetPub() != old })
+	written := sub.writtenTotal()
+	waitWritten(written + 10)
+	if relay.Router().GetSub(sub.ID()) == nil {
+		t.Fatal("local sub lost with the link")
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/pion/ion-sfu/pkg/log"
+	signaling "github.com/pion/ion-sfu/pkg/signal"
+)
+
+type restConfig struct {
+	// serve the json http api when set
+	Port string `mapstructure:"port"`
+}
+
+// serveREST serve the rest api of the sfu of s on port, with the tls of
+// grpc when it is on
+func serveREST(s *server, port string, config *tls.Config) {
+	handler := signaling.NewRESTHandler(s.node)
+	if s.auth != nil {
+		handler.Authorize = s.authorizeRequest
+	}
+	srv := &http.Server{Addr: port, Handler: handler, TLSConfig: config}
+	log.Infof("SFU rest api at %s", port)
+	var err error
+	if config != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		log.Warnf("rest api is served without tls")
+		err = srv.ListenAndServe()
+	}
+	if err != nil {
+		log.Errorf("failed to serve rest api: %v", err)
+	}
+}
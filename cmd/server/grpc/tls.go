@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+type tlsConfig struct {
+	Cert     string `mapstructure:"cert"`
+	Key      string `mapstructure:"key"`
+	ClientCA string `mapstructure:"clientca"`
+}
+
+// enabled tell whether the grpc server is configured to serve tls
+func (c tlsConfig) enabled() bool {
+	return c.Cert != "" || c.Key != "" || c.ClientCA != ""
+}
+
+// serverTLS load the certificate of the grpc server, clients must present
+// a certificate signed by clientca when it is set
+func serverTLS(c tlsConfig) (*tls.Config, error) {
+	if c.Cert == "" || c.Key == "" {
+		return nil, errors.New("grpc.tls needs both cert and key")
+	}
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("grpc.tls load cert: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCA == "" {
+		return config, nil
+	}
+
+	pem, err := ioutil.ReadFile(c.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("grpc.tls read clientca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("grpc.tls clientca %s has no certificate", c.ClientCA)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	pb "github.com/pion/ion-sfu/cmd/server/grpc/proto"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey err=%v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate err=%v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate err=%v", err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue return a cert and key in pem signed by the ca, valid for 127.0.0.1
+func (ca *testCA) issue(t *testing.T, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey err=%v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "sfu"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("CreateCertificate err=%v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey err=%v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, dir, name string, content []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatalf("WriteFile err=%v", err)
+	}
+	return path
+}
+
+// startTLSServer serve grpc with config and return its address
+func startTLSServer(t *testing.T, config tlsConfig) (string, func()) {
+	tlsConf, err := serverTLS(config)
+	if err != nil {
+		t.Fatalf("serverTLS err=%v", err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen err=%v", err)
+	}
+	s := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConf)))
+	pb.RegisterSFUServer(s, newServer(nil))
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	return lis.Addr().String(), s.Stop
+}
+
+// healthCheck call the server at addr over tls with config
+func healthCheck(t *testing.T, addr string, config *tls.Config) error {
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+	if err != nil {
+		t.Fatalf("dial err=%v", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = pb.NewSFUClient(conn).HealthCheck(ctx, &pb.HealthCheckRequest{})
+	return err
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sfu-tls")
+	if err != nil {
+		t.Fatalf("TempDir err=%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, other := newTestCA(t, "ca"), newTestCA(t, "other")
+	cert, key := ca.issue(t, x509.ExtKeyUsageServerAuth)
+	config := tlsConfig{
+		Cert: writeFile(t, dir, "cert.pem", cert),
+		Key:  writeFile(t, dir, "key.pem", key),
+	}
+	addr, stop := startTLSServer(t, config)
+	defer stop()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	if err := healthCheck(t, addr, &tls.Config{RootCAs: roots}); err != nil {
+		t.Errorf("HealthCheck with the server ca err=%v", err)
+	}
+	otherRoots := x509.NewCertPool()
+	otherRoots.AppendCertsFromPEM(other.pem)
+	if err := healthCheck(t, addr, &tls.Config{RootCAs: otherRoots}); err == nil {
+		t.Error("HealthCheck succeeded with another ca")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sfu-tls")
+	if err != nil {
+		t.Fatalf("TempDir err=%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, other := newTestCA(t, "ca"), newTestCA(t, "other")
+	cert, key := ca.issue(t, x509.ExtKeyUsageServerAuth)
+	addr, stop := startTLSServer(t, tlsConfig{
+		Cert:     writeFile(t, dir, "cert.pem", cert),
+		Key:      writeFile(t, dir, "key.pem", key),
+		ClientCA: writeFile(t, dir, "ca.pem", ca.pem),
+	})
+	defer stop()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	clientCert := func(ca *testCA) []tls.Certificate {
+		cert, err := tls.X509KeyPair(ca.issue(t, x509.ExtKeyUsageClientAuth))
+		if err != nil {
+			t.Fatalf("X509KeyPair err=%v", err)
+		}
+		return []tls.Certificate{cert}
+	}
+
+	if err := healthCheck(t, addr, &tls.Config{RootCAs: roots, Certificates: clientCert(ca)}); err != nil {
+		t.Errorf("HealthCheck with a client cert err=%v", err)
+	}
+	if err := healthCheck(t, addr, &tls.Config{RootCAs: roots}); err == nil {
+		t.Error("HealthCheck succeeded without a client cert")
+	}
+	if err := healthCheck(t, addr, &tls.Config{RootCAs: roots, Certificates: clientCert(other)}); err == nil {
+		t.Error("HealthCheck succeeded with a client cert of another ca")
+	}
+}
+
+func TestServerTLSInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sfu-tls")
+	if err != nil {
+		t.Fatalf("TempDir err=%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, key := newTestCA(t, "ca").issue(t, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := writeFile(t, dir, "cert.pem", cert), writeFile(t, dir, "key.pem", key)
+	for _, config := range []tlsConfig{
+		{Cert: certFile},
+		{Cert: certFile, Key: certFile},
+		{Cert: filepath.Join(dir, "missing.pem"), Key: keyFile},
+		{Cert: certFile, Key: keyFile, ClientCA: keyFile},
+	} {
+		if _, err := serverTLS(config); err == nil {
+			t.Errorf("serverTLS(%+v) succeeded", config)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pion/ion-sfu/pkg/log"
+	signaling "github.com/pion/ion-sfu/pkg/signal"
+)
+
+// query parameter of the token of a websocket, browsers can't set its headers
+const tokenQueryKey = "token"
+
+type websocketConfig struct {
+	// serve the json signaling over websocket when set
+	Port string `mapstructure:"port"`
+}
+
+// serveWebSocket serve the websocket signaling of the sfu of s on port,
+// with the tls of grpc when it is on
+func serveWebSocket(s *server, port string, config *tls.Config) {
+	handler := signaling.NewHandler(s.node)
+	if s.auth != nil {
+		handler.Authorize = s.authorizeRequest
+	}
+	srv := &http.Server{Addr: port, Handler: handler, TLSConfig: config}
+	log.Infof("SFU websocket signaling at %s", port)
+	var err error
+	if config != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		log.Warnf("websocket is served without tls")
+		err = srv.ListenAndServe()
+	}
+	if err != nil {
+		log.Errorf("failed to serve websocket: %v", err)
+	}
+}
+
+// authorizeRequest check the token of a websocket or rest request allows
+// op on mid, the token is ?token= or "authorization: Bearer <token>"
+func (s *server) authorizeRequest(req *http.Request, op, mid string) error {
+	token := req.URL.Query().Get(tokenQueryKey)
+	if auth := req.Header.Get(authMetadataKey); token == "" && strings.HasPrefix(strings.ToLower(auth), bearerPrefix) {
+		token = strings.TrimSpace(auth[len(bearerPrefix):])
+	}
+	claims, err := s.auth.Authenticate(token)
+	if err != nil {
+		return fmt.Errorf("invalid token: %v", err)
+	}
+	if s.authorizer != nil && !s.authorizer(claims, op, mid) {
+		return fmt.Errorf("%s %s not allowed", op, mid)
+	}
+	return nil
+}
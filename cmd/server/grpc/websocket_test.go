@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	signaling "github.com/pion/ion-sfu/pkg/signal"
+)
+
+func TestAuthorizeRequest(t *testing.T) {
+	srv := newServer(nil)
+	srv.auth = NewJWTAuthenticator(testSecret)
+	srv.authorizer = ClaimsAuthorizer
+	token := signToken(t, testSecret, &Claims{Mids: []string{"a"}})
+
+	// the rest clients may send it as a header
+	req := httptest.NewRequest("GET", "/routers", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if err := srv.authorizeRequest(req, signaling.OpList, "a"); err != nil {
+		t.Errorf("authorizeRequest with a bearer header err=%v", err)
+	}
+
+	for _, tc := range []struct {
+		query   string
+		op, mid string
+		allowed bool
+	}{
+		{"?token=" + token, signaling.OpSubscribe, "a", true},
+		{"?token=" + token, signaling.OpSubscribe, "b", false},
+		{"?token=" + token, signaling.OpPublish, "", false},
+		{"?token=" + signToken(t, "other", &Claims{Publish: true}), signaling.OpPublish, "", false},
+		{"", signaling.OpSubscribe, "a", false},
+	} {
+		req := httptest.NewRequest("GET", "/"+tc.query, nil)
+		if err := srv.authorizeRequest(req, tc.op, tc.mid); (err == nil) != tc.allowed {
+			t.Errorf("authorizeRequest(%q, %s, %s) err=%v, want allowed=%v", tc.query, tc.op, tc.mid, err, tc.allowed)
+		}
+	}
+}
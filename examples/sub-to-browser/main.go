@@ -4,6 +4,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -53,6 +54,27 @@ func main() {
 		log.Fatalf("Error sending subscribe request: %v", err)
 	}
 
+	// Every further line on stdin is a browser ICE candidate in base64,
+	// forward them as they are found
+	go func() {
+		for {
+			candidate := webrtc.ICECandidateInit{}
+			signal.Decode(signal.MustReadStdin(), &candidate)
+			b, err := json.Marshal(candidate)
+			if err != nil {
+				log.Fatalf("Error marshaling candidate: %v", err)
+			}
+			err = stream.Send(&sfu.SubscribeRequest{Mid: mid, Payload: &sfu.SubscribeRequest_Trickle{
+				Trickle: &sfu.Trickle{
+					Candidate: string(b),
+				},
+			}})
+			if err != nil {
+				log.Fatalf("Error sending trickle request: %v", err)
+			}
+		}
+	}()
+
 	for {
 		res, err := stream.Recv()
 		if err == io.EOF {
@@ -73,6 +95,14 @@ func main() {
 				Type: webrtc.SDPTypeAnswer,
 				SDP:  string(payload.Connect.Description.Sdp),
 			}))
+		case *sfu.SubscribeReply_Trickle:
+			// Output the sfu candidate in base64 so we can paste it in browser
+			candidate := webrtc.ICECandidateInit{}
+			if err := json.Unmarshal([]byte(payload.Trickle.Candidate), &candidate); err != nil {
+				log.Printf("Error parsing candidate: %v", err)
+				continue
+			}
+			fmt.Printf("\nsub candidate: %s", signal.Encode(candidate))
 		}
 	}
 }
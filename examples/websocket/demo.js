@@ -0,0 +1,123 @@
+/* eslint-env browser */
+var log = msg =>
+  document.getElementById('logs').innerHTML += msg + '<br>'
+
+let ws = null
+// the pcs by the id of their transport on the sfu
+let pcs = {}
+
+// connect once, every publish and subscribe shares the websocket
+let connect = () => {
+  if (ws !== null) {
+    return Promise.resolve(ws)
+  }
+  return new Promise((resolve, reject) => {
+    ws = new WebSocket(document.getElementById('url').value)
+    ws.onopen = () => resolve(ws)
+    ws.onerror = reject
+    ws.onclose = () => {
+      log('websocket closed')
+      ws = null
+    }
+    ws.onmessage = event => {
+      let msg = JSON.parse(event.data)
+      switch (msg.method) {
+        case 'answer':
+          pending.shift()(msg)
+          break
+        case 'candidate':
+          if (pcs[msg.id]) {
+            pcs[msg.id].addIceCandidate(msg.candidate).catch(log)
+          }
+          break
+        case 'leave':
+          log('left ' + msg.id)
+          delete pcs[msg.id]
+          break
+        case 'error':
+          log('error: ' + msg.error)
+          break
+      }
+    }
+  })
+}
+
+// the answers come in the order of the offers
+let pending = []
+
+// negotiate send the offer of pc with method, and trickle its candidates
+// once the sfu named the transport
+let negotiate = (pc, method, mid) => {
+  let id = null
+  let candidates = []
+  pc.onicecandidate = event => {
+    if (event.candidate === null) {
+      return
+    }
+    if (id === null) {
+      candidates.push(event.candidate)
+      return
+    }
+    ws.send(JSON.stringify({ method: 'candidate', id: id, candidate: event.candidate }))
+  }
+  pc.oniceconnectionstatechange = () => log(method + ' ' + pc.iceConnectionState)
+  return connect()
+    .then(() => pc.createOffer())
+    .then(offer => pc.setLocalDescription(offer))
+    .then(() => new Promise(resolve => {
+      pending.push(resolve)
+      ws.send(JSON.stringify({ method: method, mid: mid, description: pc.localDescription }))
+    }))
+    .then(answer => {
+      id = answer.id
+      pcs[id] = pc
+      candidates.forEach(c => ws.send(JSON.stringify({ method: 'candidate', id: id, candidate: c })))
+      return pc.setRemoteDescription(answer.description).then(() => answer)
+    })
+}
+
+let newPC = () => new RTCPeerConnection({
+  iceServers: [{ urls: 'stun:stun.l.google.com:19302' }]
+})
+
+window.publish = () => {
+  let pc = newPC()
+  navigator.mediaDevices.getUserMedia({ video: true, audio: true })
+    .then(stream => {
+      let el = document.createElement('video')
+      el.srcObject = stream
+      el.autoplay = true
+      el.muted = true
+      document.getElementById('localVideos').appendChild(el)
+      stream.getTracks().forEach(track => pc.addTrack(track, stream))
+      return negotiate(pc, 'offer')
+    })
+    .then(answer => {
+      document.getElementById('mid').value = answer.mid
+      log('published ' + answer.mid)
+    })
+    .catch(log)
+}
+
+window.subscribe = () => {
+  let mid = document.getElementById('mid').value
+  if (mid === '') {
+    return alert('mid must not be empty')
+  }
+  let pc = newPC()
+  pc.addTransceiver('video', { direction: 'recvonly' })
+  pc.addTransceiver('audio', { direction: 'recvonly' })
+  pc.ontrack = event => {
+    if (event.track.kind !== 'video') {
+      return
+    }
+    let el = document.createElement('video')
+    el.srcObject = event.streams[0]
+    el.autoplay = true
+    el.controls = true
+    document.getElementById('remoteVideos').appendChild(el)
+  }
+  negotiate(pc, 'join', mid)
+    .then(answer => log('subscribed ' + answer.id))
+    .catch(log)
+}
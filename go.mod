@@ -3,12 +3,19 @@ module github.com/pion/ion-sfu
 go 1.13
 
 require (
+	github.com/desertbit/timer v0.0.0-20180107155436-c41aec40b27f // indirect
+	github.com/fsnotify/fsnotify v1.4.7
+	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/golang/protobuf v1.4.2
+	github.com/gorilla/websocket v1.4.2
+	github.com/improbable-eng/grpc-web v0.13.0
 	github.com/klauspost/cpuid v1.2.3 // indirect
 	github.com/klauspost/reedsolomon v1.9.3 // indirect
 	github.com/lucsky/cuid v1.0.2
 	github.com/onsi/ginkgo v1.10.1 // indirect
 	github.com/onsi/gomega v1.7.0 // indirect
+	github.com/pion/dtls/v2 v2.0.1
+	github.com/pion/ice v0.7.15
 	github.com/pion/rtcp v1.2.3
 	github.com/pion/rtp v1.5.5
 	github.com/pion/sdp/v2 v2.3.9
@@ -16,6 +23,8 @@ require (
 	github.com/pion/transport v0.10.1
 	github.com/pion/webrtc/v2 v2.2.19
 	github.com/pion/webrtc/v3 v3.0.0-20200625164527-89d7de178734
+	github.com/prometheus/client_golang v1.7.1
+	github.com/rs/cors v1.7.0 // indirect
 	github.com/rs/zerolog v1.19.0
 	github.com/spf13/viper v1.7.0
 	github.com/templexxx/cpufeat v0.0.0-20180724012125-cef66df7f161 // indirect
@@ -0,0 +1,19 @@
+// Package testhelper holds the helpers shared by the tests of the sfu
+package testhelper
+
+import (
+	"testing"
+	"time"
+)
+
+// WaitFor fail t unless cond is met within timeout, cond is polled until then
+func WaitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met within %v", timeout)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -1,25 +1,83 @@
 package log
 
 import (
+	"io"
 	"os"
+	"sync/atomic"
 
 	"github.com/rs/zerolog"
 )
 
-var log zerolog.Logger
+var (
+	// the *zerolog.Logger of logger, replaced by InitWithConfig while the
+	// routers log
+	current atomic.Value
+	// errors logged so far, accessed atomically
+	errCount uint64
+	// ssrc traced with traceSSRCOn set, 0 when off, accessed atomically
+	traceSSRC uint64
+)
+
+// traceSSRCOn tells the traced ssrc 0 from no trace
+const traceSSRCOn = 1 << 32
 
 const (
 	timeFormat = "2006-01-02 15:04:05.999"
+
+	// FormatText human readable lines, the default
+	FormatText = "text"
+	// FormatJSON a json object per line, with the fields as keys
+	FormatJSON = "json"
 )
 
 // Config defines parameters for the logger
 type Config struct {
-	Level string `mapstructure:"level"`
+	Level  string `mapstructure:"level"`
+	Format string `mapstructure:"format"`
 }
 
-// Init initializes the package logger.
+func init() {
+	zerolog.TimeFieldFormat = timeFormat
+	current.Store(&zerolog.Logger{})
+}
+
+// logger return the package logger
+func logger() *zerolog.Logger {
+	return current.Load().(*zerolog.Logger)
+}
+
+// setLogger replace the package logger, return the one replaced
+func setLogger(l zerolog.Logger) *zerolog.Logger {
+	old := logger()
+	current.Store(&l)
+	return old
+}
+
+// Fields are the key values a scoped logger adds to every line
+type Fields map[string]interface{}
+
+// Init initializes the package logger with text output.
 // Supported levels are: ["debug", "info", "warn", "error"]
 func Init(level string) {
+	InitWithConfig(Config{Level: level})
+}
+
+// InitWithConfig initializes the package logger with the level and format of config
+func InitWithConfig(config Config) {
+	setLogger(newLogger(os.Stdout, config.Format))
+	SetLevel(config.Level)
+}
+
+func newLogger(out io.Writer, format string) zerolog.Logger {
+	if format != FormatJSON {
+		out = zerolog.ConsoleWriter{Out: out, NoColor: false, TimeFormat: timeFormat}
+	}
+	return zerolog.New(out).With().Timestamp().Logger()
+}
+
+// SetLevel changes the log level, it is safe to call while logging.
+// Unknown levels keep the current one.
+func SetLevel(level string) {
 	l := zerolog.GlobalLevel()
 	switch level {
 	case "trace":
@@ -33,38 +91,122 @@ func Init(level string) {
 	case "error":
 		l = zerolog.ErrorLevel
 	}
-	zerolog.TimeFieldFormat = timeFormat
-	output := zerolog.ConsoleWriter{Out: os.Stdout, NoColor: false, TimeFormat: timeFormat}
-	log = zerolog.New(output).Level(l).With().Timestamp().Logger()
+	zerolog.SetGlobalLevel(l)
 }
 
 // Infof logs a formatted info level log to the console
 func Infof(format string, v ...interface{}) {
-	log.Info().Msgf(format, v...)
+	logger().Info().Msgf(format, v...)
 }
 
 // Tracef logs a formatted debug level log to the console
 func Tracef(format string, v ...interface{}) {
-	log.Trace().Msgf(format, v...)
+	logger().Trace().Msgf(format, v...)
 }
 
 // Debugf logs a formatted debug level log to the console
 func Debugf(format string, v ...interface{}) {
-	log.Debug().Msgf(format, v...)
+	logger().Debug().Msgf(format, v...)
 }
 
 // Warnf logs a formatted warn level log to the console
 func Warnf(format string, v ...interface{}) {
-	log.Warn().Msgf(format, v...)
+	logger().Warn().Msgf(format, v...)
 }
 
 // Errorf logs a formatted error level log to the console
 func Errorf(format string, v ...interface{}) {
-	log.Error().Msgf(format, v...)
+	atomic.AddUint64(&errCount, 1)
+	logger().Error().Msgf(format, v...)
+}
+
+// ErrorCount returns the number of errors logged since start
+func ErrorCount() uint64 {
+	return atomic.LoadUint64(&errCount)
 }
 
 // Panicf logs a formatted panic level log to the console.
 // The panic() function is called, which stops the ordinary flow of a goroutine.
 func Panicf(format string, v ...interface{}) {
-	log.Panic().Msgf(format, v...)
+	logger().Panic().Msgf(format, v...)
+}
+
+// TraceSSRC logs the rtp and rtcp of ssrc the router handles, whatever the
+// level, until StopTraceSSRC. It replaces the ssrc traced before.
+func TraceSSRC(ssrc uint32) {
+	atomic.StoreUint64(&traceSSRC, traceSSRCOn|uint64(ssrc))
+}
+
+// StopTraceSSRC stops the trace of TraceSSRC
+func StopTraceSSRC() {
+	atomic.StoreUint64(&traceSSRC, 0)
+}
+
+// TracedSSRC return the ssrc of TraceSSRC, false when none is traced
+func TracedSSRC() (uint32, bool) {
+	traced := atomic.LoadUint64(&traceSSRC)
+	return uint32(traced), traced&traceSSRCOn != 0
+}
+
+// TracingSSRC report if ssrc is traced, cheap enough for every packet. The
+// hot paths check it before building the arguments of SSRCf.
+func TracingSSRC(ssrc uint32) bool {
+	return atomic.LoadUint64(&traceSSRC) == traceSSRCOn|uint64(ssrc)
+}
+
+// Logger adds its fields to every line it logs
+type Logger struct {
+	fields Fields
+}
+
+// With return a logger adding fields to every line, e.g. the router id
+func With(fields Fields) *Logger {
+	return &Logger{fields: fields}
+}
+
+// With return a logger adding fields to the ones of l
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{fields: merged}
+}
+
+// Infof logs a formatted info level log with the fields of l
+func (l *Logger) Infof(format string, v ...interface{}) {
+	logger().Info().Fields(l.fields).Msgf(format, v...)
+}
+
+// Tracef logs a formatted trace level log with the fields of l
+func (l *Logger) Tracef(format string, v ...interface{}) {
+	logger().Trace().Fields(l.fields).Msgf(format, v...)
+}
+
+// Debugf logs a formatted debug level log with the fields of l
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	logger().Debug().Fields(l.fields).Msgf(format, v...)
+}
+
+// Warnf logs a formatted warn level log with the fields of l
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	logger().Warn().Fields(l.fields).Msgf(format, v...)
+}
+
+// Errorf logs a formatted error level log with the fields of l
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	atomic.AddUint64(&errCount, 1)
+	logger().Error().Fields(l.fields).Msgf(format, v...)
+}
+
+// SSRCf logs a formatted trace of ssrc with the fields of l when ssrc is
+// traced, whatever the level
+func (l *Logger) SSRCf(ssrc uint32, format string, v ...interface{}) {
+	if !TracingSSRC(ssrc) {
+		return
+	}
+	logger().Log().Str(zerolog.LevelFieldName, zerolog.TraceLevel.String()).Fields(l.fields).Uint32("trace_ssrc", ssrc).Msgf(format, v...)
 }
@@ -0,0 +1,93 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestWithJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	old := setLogger(newLogger(buf, FormatJSON))
+	defer setLogger(*old)
+
+	logger := With(Fields{"router_id": "room1"})
+	logger.Infof("Router.AddSub id=%s", "sub1")
+	logger.With(Fields{"ssrc": 1234}).Errorf("write err")
+	Infof("no fields")
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 3 {
+		t.Fatalf("lines=%d, want 3\n%s", len(lines), buf.String())
+	}
+	var entries []map[string]interface{}
+	for _, line := range lines {
+		entry := make(map[string]interface{})
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("line %s err=%v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if entries[0]["level"] != "info" || entries[0]["router_id"] != "room1" || entries[0]["message"] != "Router.AddSub id=sub1" {
+		t.Fatalf("unexpected entry %v", entries[0])
+	}
+	if entries[1]["level"] != "error" || entries[1]["router_id"] != "room1" || entries[1]["ssrc"] != float64(1234) {
+		t.Fatalf("unexpected entry %v", entries[1])
+	}
+	if _, ok := entries[2]["router_id"]; ok {
+		t.Fatalf("package logger has router_id %v", entries[2])
+	}
+}
+
+func TestTraceSSRC(t *testing.T) {
+	buf := &bytes.Buffer{}
+	old := setLogger(newLogger(buf, FormatJSON))
+	defer setLogger(*old)
+	level := zerolog.GlobalLevel()
+	defer zerolog.SetGlobalLevel(level)
+	SetLevel("error")
+	defer StopTraceSSRC()
+
+	logger := With(Fields{"router_id": "room1"})
+	if _, ok := TracedSSRC(); ok {
+		t.Fatal("ssrc traced before TraceSSRC")
+	}
+	logger.SSRCf(0, "untraced")
+
+	TraceSSRC(1234)
+	if ssrc, ok := TracedSSRC(); !ok || ssrc != 1234 {
+		t.Fatalf("traced ssrc=%d ok=%v, want 1234", ssrc, ok)
+	}
+	if TracingSSRC(0) || TracingSSRC(4321) || !TracingSSRC(1234) {
+		t.Fatal("only ssrc 1234 should be traced")
+	}
+	logger.SSRCf(4321, "other sn=%d", 1)
+	logger.SSRCf(1234, "traced sn=%d", 2)
+	Debugf("below the level")
+
+	TraceSSRC(0)
+	logger.SSRCf(1234, "replaced sn=%d", 3)
+	logger.SSRCf(0, "zero sn=%d", 4)
+	StopTraceSSRC()
+	logger.SSRCf(0, "stopped")
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("lines=%d, want 2\n%s", len(lines), buf.String())
+	}
+	for i, want := range []struct {
+		ssrc float64
+		msg  string
+	}{{1234, "traced sn=2"}, {0, "zero sn=4"}} {
+		entry := make(map[string]interface{})
+		if err := json.Unmarshal(lines[i], &entry); err != nil {
+			t.Fatalf("line %s err=%v", lines[i], err)
+		}
+		if entry["level"] != "trace" || entry["router_id"] != "room1" || entry["trace_ssrc"] != want.ssrc || entry["message"] != want.msg {
+			t.Fatalf("unexpected entry %v", entry)
+		}
+	}
+}
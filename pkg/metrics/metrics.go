@@ -0,0 +1,120 @@
+// Package metrics exports the sfu counters and gauges for prometheus.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/pion/ion-sfu/pkg/log"
+)
+
+const namespace = "sfu"
+
+// Config defines parameters for the metrics endpoint
+type Config struct {
+	Port string `mapstructure:"port"`
+}
+
+// the collectors are atomic, so the router hot paths update them without locks
+var (
+	// Routers running routers
+	Routers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "routers",
+		Help:      "Number of running routers.",
+	})
+	// Subs subs of all routers
+	Subs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "subs",
+		Help:      "Number of subs of all routers.",
+	})
+	// PacketsRouted packets queued to subs, counted once per sub
+	PacketsRouted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "packets_routed_total",
+		Help:      "Packets queued to subs, counted once per sub.",
+	})
+	// PacketsDropped packets dropped because a sub queue was full
+	PacketsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "packets_dropped_total",
+		Help:      "Packets dropped because a sub queue was full.",
+	})
+	// BytesForwarded rtp bytes written to subs
+	BytesForwarded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_forwarded_total",
+		Help:      "RTP bytes written to subs.",
+	})
+	// PLIs key frame requests sent to pubs
+	PLIs = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pli_total",
+		Help:      "Key frame requests sent to pubs.",
+	})
+	// NACKs nacks received from subs
+	NACKs = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "nack_total",
+		Help:      "NACKs received from subs.",
+	})
+	// NACKsLimited nacks of subs not forwarded to the pub, the packet was
+	// nacked recently or the pub got too many nacks
+	NACKsLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "nack_limited_total",
+		Help:      "NACKs of subs not forwarded to pubs by the rate limit.",
+	})
+	// SubsRefused subs refused because their router had MaxSubs subs
+	SubsRefused = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "subs_refused_total",
+		Help:      "Subs refused because their router had the maximum number of subs.",
+	})
+	// REMBTarget last bitrate sent to a pub by remb feedback
+	REMBTarget = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "remb_target_bits_per_second",
+		Help:      "Last bitrate sent to a pub by REMB feedback.",
+	})
+
+	registry = prometheus.NewRegistry()
+)
+
+func init() {
+	registry.MustRegister(
+		Routers,
+		Subs,
+		PacketsRouted,
+		PacketsDropped,
+		BytesForwarded,
+		PLIs,
+		NACKs,
+		NACKsLimited,
+		SubsRefused,
+		REMBTarget,
+	)
+}
+
+// Handler return the /metrics handler
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Init serve /metrics on config.Port, nothing is served when it is empty
+func Init(config Config) {
+	if config.Port == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	log.Infof("Metrics Listening at %s", config.Port)
+	go func() {
+		if err := http.ListenAndServe(config.Port, mux); err != nil {
+			log.Errorf("metrics serve err=%v", err)
+		}
+	}()
+}
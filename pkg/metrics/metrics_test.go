@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	s := httptest.NewServer(Handler())
+	defer s.Close()
+
+	PacketsRouted.Add(3)
+	resp, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{
+		"sfu_routers",
+		"sfu_subs",
+		"sfu_packets_routed_total",
+		"sfu_packets_dropped_total",
+		"sfu_bytes_forwarded_total",
+		"sfu_pli_total",
+		"sfu_nack_total",
+		"sfu_subs_refused_total",
+		"sfu_remb_target_bits_per_second",
+	} {
+		if !strings.Contains(string(body), "\n"+name+" ") {
+			t.Fatalf("metric %s missing from\n%s", name, body)
+		}
+	}
+	if !strings.Contains(string(body), "\nsfu_packets_routed_total 3\n") {
+		t.Fatalf("sfu_packets_routed_total not 3 in\n%s", body)
+	}
+}
@@ -1,9 +1,27 @@
 package sfu
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/pion/ion-sfu/pkg/rtc"
+)
 
 var (
+	// ErrShutdown is returned by the calls made once the sfu shuts down
+	ErrShutdown = errors.New("sfu is shutting down")
+	// ErrRouterFull is returned by Subscribe when the router has MaxSubs subs
+	ErrRouterFull = errors.New("router has too many subs")
+	// ErrRouterNotFound is returned by the calls on a router id no router has
+	ErrRouterNotFound = errors.New("router not found")
+	// ErrRouterHasPub is returned by PublishTo when the router has a pub
+	ErrRouterHasPub = rtc.ErrRouterHasPub
+	// ErrNoPub is returned by Subscribe when the router has no webrtc pub
+	ErrNoPub = errors.New("router has no webrtc pub")
+	// ErrRouterExists is returned by NewRouter when a router has the id
+	ErrRouterExists = rtc.ErrRouterExists
+
 	errSdpParseFailed              = errors.New("sdp parse failed")
 	errWebRTCTransportInitFailed   = errors.New("WebRTCTransport init failed")
 	errWebRTCTransportAnswerFailed = errors.New("creating answer failed")
+	errRouterClosed                = errors.New("router is closed")
 )
@@ -36,11 +36,13 @@ func getPubCodecs(sdp sdp.SessionDescription) ([]uint8, error) {
 				return nil, fmt.Errorf("could not find codec for payload type %d", payloadType)
 			}
 
+			// disabled by webrtc.codecs
+			if !transport.CodecEnabled(payloadCodec.Name) {
+				continue
+			}
 			if md.MediaName.Media == "audio" {
-				if payloadCodec.Name == webrtc.Opus {
-					allowedCodecs = append(allowedCodecs, payloadType)
-					break
-				}
+				allowedCodecs = append(allowedCodecs, payloadType)
+				break
 			} else {
 				// skip 126 for pub, chrome sub decode will fail when H264 playload type is 126
 				if payloadCodec.Name == webrtc.H264 && payloadType == 126 {
@@ -55,9 +57,43 @@ func getPubCodecs(sdp sdp.SessionDescription) ([]uint8, error) {
 	return allowedCodecs, nil
 }
 
-// Publish a webrtc stream
-func Publish(offer webrtc.SessionDescription) (*transport.WebRTCTransport, *webrtc.SessionDescription, error) {
-	mid := cuid.New()
+// hasDataChannel check the offer negotiates data channels
+func hasDataChannel(sdp sdp.SessionDescription) bool {
+	for _, md := range sdp.MediaDescriptions {
+		if md.MediaName.Media == "application" {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish a webrtc stream, the pub gets a new router
+func (s *SFU) Publish(offer webrtc.SessionDescription) (*transport.WebRTCTransport, *webrtc.SessionDescription, error) {
+	return s.publish("", offer)
+}
+
+// PublishTo publish a webrtc stream to router mid created by NewRouter,
+// which has no pub yet or whose pub closed within the rejoin grace
+func (s *SFU) PublishTo(mid string, offer webrtc.SessionDescription) (*transport.WebRTCTransport, *webrtc.SessionDescription, error) {
+	router := s.GetRouter(mid)
+	if router == nil {
+		return nil, nil, ErrRouterNotFound
+	}
+	if router.GetPub() != nil {
+		return nil, nil, ErrRouterHasPub
+	}
+	return s.publish(mid, offer)
+}
+
+// publish offer to router mid, to a new router when mid is empty
+func (s *SFU) publish(mid string, offer webrtc.SessionDescription) (*transport.WebRTCTransport, *webrtc.SessionDescription, error) {
+	if s.isShutdown() {
+		return nil, nil, ErrShutdown
+	}
+	existing := mid != ""
+	if !existing {
+		mid = cuid.New()
+	}
 	parsed := sdp.SessionDescription{}
 	err := parsed.Unmarshal([]byte(offer.SDP))
 
@@ -66,8 +102,13 @@ func Publish(offer webrtc.SessionDescription) (*transport.WebRTCTransport, *webr
 		return nil, nil, errSdpParseFailed
 	}
 
+	// transport-cc is offered when the jitter buffer sends its feedback
+	plugins := s.routers.Plugins()
 	rtcOptions := transport.RTCOptions{
-		Publish: true,
+		Publish:          true,
+		DataChannel:      hasDataChannel(parsed),
+		TransportCC:      plugins.On && plugins.JitterBuffer.On && plugins.JitterBuffer.TCCOn,
+		HeaderExtensions: transport.ForwardedExtensions,
 	}
 
 	codecs, err := getPubCodecs(parsed)
@@ -83,18 +124,41 @@ func Publish(offer webrtc.SessionDescription) (*transport.WebRTCTransport, *webr
 		return nil, nil, errWebRTCTransportInitFailed
 	}
 
-	router := rtc.AddRouter(mid)
+	var router *rtc.Router
+	if existing {
+		if router = s.GetRouter(mid); router == nil {
+			pub.Close()
+			return nil, nil, ErrRouterNotFound
+		}
+	} else if router, err = s.NewRouter(mid); err != nil {
+		log.Debugf("publish->connect: error adding router %v", err)
+		pub.Close()
+		return nil, nil, err
+	}
+
+	// the router publish added goes with the pub it failed to add
+	fail := func(err error) (*transport.WebRTCTransport, *webrtc.SessionDescription, error) {
+		pub.Close()
+		if !existing {
+			router.Close()
+		}
+		return nil, nil, err
+	}
 
 	answer, err := pub.Answer(offer, rtcOptions)
 
 	if err != nil {
 		log.Debugf("publish->connect: error creating answer %v", err)
-		return nil, nil, errWebRTCTransportAnswerFailed
+		return fail(errWebRTCTransportAnswerFailed)
 	}
 
 	log.Debugf("publish->connect: answer => %v", answer)
 
-	router.AddPub(pub)
+	// a concurrent PublishTo may have added its pub since the check
+	if err := router.AddPub(pub); err != nil {
+		log.Debugf("publish->connect: error adding pub %v", err)
+		return fail(err)
+	}
 
 	return pub, &answer, nil
 }
@@ -1,14 +1,20 @@
 package sfu
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/pion/sdp/v2"
 	"github.com/pion/webrtc/v2"
+
+	"github.com/pion/ion-sfu/pkg/rtc"
+	"github.com/pion/ion-sfu/pkg/rtc/plugins"
+	transport "github.com/pion/ion-sfu/pkg/rtc/transport"
 )
 
 func TestPublishReturnsErrorWithInvalidSDP(t *testing.T) {
-	_, _, err := Publish(webrtc.SessionDescription{
+	_, _, err := newTestSFU(t).Publish(webrtc.SessionDescription{
 		Type: webrtc.SDPTypeOffer,
 		SDP:  "invalid",
 	})
@@ -33,7 +39,7 @@ func TestPublishReturnsErrorWithInvalidCodecsInSDP(t *testing.T) {
 
 	marshalled, _ := offer.Marshal()
 
-	_, _, err := Publish(webrtc.SessionDescription{
+	_, _, err := newTestSFU(t).Publish(webrtc.SessionDescription{
 		Type: webrtc.SDPTypeOffer,
 		SDP:  string(marshalled),
 	})
@@ -91,6 +97,46 @@ func TestGetPubCodecsReturnsCorrectVideoCodec(t *testing.T) {
 	}
 }
 
+func TestGetPubCodecsSkipsDisabledCodecs(t *testing.T) {
+	if err := transport.InitWebRTC(transport.WebRTCConfig{Codecs: []transport.CodecConfig{
+		{Name: "vp8", Disabled: true},
+		{Name: "g722"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	defer transport.InitWebRTC(transport.WebRTCConfig{})
+
+	offer := sdp.SessionDescription{
+		MediaDescriptions: []*sdp.MediaDescription{
+			{
+				MediaName: sdp.MediaName{
+					Media:   "audio",
+					Formats: []string{"9"},
+				},
+				Attributes: []sdp.Attribute{
+					sdp.NewAttribute("rtpmap:9 G722/8000", ""),
+				},
+			},
+			{
+				MediaName: sdp.MediaName{
+					Media:   "video",
+					Formats: []string{"120", "121"},
+				},
+				Attributes: []sdp.Attribute{
+					sdp.NewAttribute("rtpmap:120 VP8/90000", ""),
+					sdp.NewAttribute("rtpmap:121 VP9/90000", ""),
+				},
+			},
+		},
+	}
+
+	allowedCodecs, _ := getPubCodecs(offer)
+
+	if len(allowedCodecs) != 2 || allowedCodecs[0] != 9 || allowedCodecs[1] != 121 {
+		t.Fatalf("codecs=%v, want g722 and VP9", allowedCodecs)
+	}
+}
+
 func TestGetPubCodecsIgnoresH264PT126Codec(t *testing.T) {
 	offer := sdp.SessionDescription{
 		MediaDescriptions: []*sdp.MediaDescription{
@@ -144,3 +190,105 @@ func TestGetPubCodecsReturnsVideoAndAudio(t *testing.T) {
 		t.Fatal("Should return VP8 codec type")
 	}
 }
+
+// newPubOffer return a peer connection offering a vp8 track and its offer
+func newPubOffer(t *testing.T) (*webrtc.PeerConnection, webrtc.SessionDescription) {
+	m := webrtc.MediaEngine{}
+	m.RegisterDefaultCodecs()
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	track, err := pc.NewTrack(webrtc.DefaultPayloadTypeVP8, 5000, "video", "pion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pc, offer
+}
+
+func TestPublishToRejoin(t *testing.T) {
+	s, err := New(Config{
+		Router:  rtc.RouterConfig{PubRejoinGrace: 200},
+		Plugins: plugins.Config{On: true, JitterBuffer: plugins.JitterBufferConfig{On: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtc.InitRouter(rtc.RouterConfig{})
+	defer s.Close()
+
+	router, err := s.NewRouter("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	router.OnClose(func() { close(closed) })
+	sub := newMemTransport("sub")
+	router.AddSub(sub.ID(), sub)
+	pc, offer := newPubOffer(t)
+	defer pc.Close()
+
+	pub, _, err := s.PublishTo("room", offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.PublishTo("room", offer); err != ErrRouterHasPub {
+		t.Fatalf("second publish err=%v, want ErrRouterHasPub", err)
+	}
+
+	// the publisher publishes again after its pub closed
+	pub.Close()
+	newPub, _, err := s.PublishTo("room", offer)
+	if err != nil {
+		t.Fatalf("publish after the pub closed err=%v", err)
+	}
+	if s.GetRouter("room") != router || router.GetPub() != newPub || router.GetSub("sub") == nil {
+		t.Fatal("router and its sub not kept for the rejoined pub")
+	}
+	select {
+	case <-closed:
+		t.Fatal("router closed after the pub rejoined")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// no pub rejoins
+	newPub.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("router not closed after the grace")
+	}
+	if s.GetRouter("room") != nil || !sub.isClosed() {
+		t.Fatal("router or sub left after the grace")
+	}
+}
+
+func TestPublishAnswerFailsClosesRouter(t *testing.T) {
+	s := newTestSFU(t)
+	defer s.Close()
+
+	pc, offer := newPubOffer(t)
+	defer pc.Close()
+	// no ice credentials, the pub can't answer
+	var lines []string
+	for _, line := range strings.Split(offer.SDP, "\r\n") {
+		if !strings.HasPrefix(line, "a=ice-ufrag:") {
+			lines = append(lines, line)
+		}
+	}
+	offer.SDP = strings.Join(lines, "\r\n")
+
+	if _, _, err := s.Publish(offer); err != errWebRTCTransportAnswerFailed {
+		t.Fatalf("Publish=%v, want errWebRTCTransportAnswerFailed", err)
+	}
+	if routers := s.Routers(); len(routers) != 0 {
+		t.Fatalf("routers=%v left by the failed publish", routers)
+	}
+}
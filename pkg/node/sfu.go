@@ -1,9 +1,14 @@
 package sfu
 
 import (
+	"context"
+	"sync/atomic"
+
 	"github.com/pion/ion-sfu/pkg/log"
+	"github.com/pion/ion-sfu/pkg/metrics"
 	"github.com/pion/ion-sfu/pkg/rtc"
 	"github.com/pion/ion-sfu/pkg/rtc/plugins"
+	"github.com/pion/ion-sfu/pkg/rtc/rtpengine"
 	transport "github.com/pion/ion-sfu/pkg/rtc/transport"
 )
 
@@ -14,23 +19,110 @@ type Config struct {
 	WebRTC  transport.WebRTCConfig `mapstructure:"webrtc"`
 	Rtp     rtc.RTPConfig          `mapstructure:"rtp"`
 	Log     log.Config             `mapstructure:"log"`
+	Metrics metrics.Config         `mapstructure:"metrics"`
+}
+
+// SFU is an sfu driven from go, it owns its routers. The log, webrtc,
+// router and metrics settings are process wide, the last SFU created or
+// reloaded sets them.
+type SFU struct {
+	// accessed atomically
+	shutdown int32
+
+	routers   *rtc.Registry
+	servedRTP bool
 }
 
-// Init initialized the sfu
-func Init(config Config) {
-	log.Init(config.Log.Level)
+// New apply config and return a new SFU, rtp pubs are accepted when
+// config.Rtp.Port is set
+func New(config Config) (*SFU, error) {
+	log.InitWithConfig(config.Log)
 
 	if err := transport.InitWebRTC(config.WebRTC); err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	if err := rtc.InitRTP(config.Rtp); err != nil {
-		panic(err)
+	if err := rtc.CheckPlugins(config.Plugins); err != nil {
+		return nil, err
+	}
+	if err := rtc.CheckRouter(config.Router); err != nil {
+		return nil, err
 	}
+	rtc.InitRouter(config.Router)
+	metrics.Init(config.Metrics)
 
+	s := &SFU{routers: rtc.NewRegistry()}
+	s.routers.SetPlugins(config.Plugins)
+	if config.Rtp.Port != 0 {
+		if err := s.routers.ServeRTP(config.Rtp); err != nil {
+			return nil, err
+		}
+		s.servedRTP = true
+	}
+	return s, nil
+}
+
+// Reload applies the settings that can change without a restart, routers
+// created from now on use the new plugins config
+func (s *SFU) Reload(config Config) error {
 	if err := rtc.CheckPlugins(config.Plugins); err != nil {
-		panic(err)
+		return err
 	}
-	rtc.InitPlugins(config.Plugins)
+	if err := rtc.CheckRouter(config.Router); err != nil {
+		return err
+	}
+	log.SetLevel(config.Log.Level)
+	s.routers.SetPlugins(config.Plugins)
 	rtc.InitRouter(config.Router)
+	return nil
+}
+
+// NewRouter add a router, ErrRouterExists if there is one with id
+func (s *SFU) NewRouter(id string) (*rtc.Router, error) {
+	return s.routers.AddRouter(id)
+}
+
+// GetRouter return the router with id, nil if there is none
+func (s *SFU) GetRouter(id string) *rtc.Router {
+	return s.routers.GetRouter(id)
+}
+
+// Routers return the running routers sorted by id
+func (s *SFU) Routers() []*rtc.Router {
+	return s.routers.Routers()
+}
+
+// Stats return the stats of all routers
+func (s *SFU) Stats() rtc.Stats {
+	return s.routers.Stats()
+}
+
+// ListRouters describe the running routers sorted by id
+func (s *SFU) ListRouters() []rtc.RouterInfo {
+	return s.routers.List()
+}
+
+// Close close all routers and stop accepting rtp pubs
+func (s *SFU) Close() {
+	atomic.StoreInt32(&s.shutdown, 1)
+	if s.servedRTP {
+		rtpengine.Close()
+	}
+	s.routers.Close()
+}
+
+// Shutdown stop accepting pubs and subs, then close all routers once their
+// subs were sent what is queued for them or when ctx is done
+func (s *SFU) Shutdown(ctx context.Context) error {
+	log.Infof("SFU.Shutdown")
+	atomic.StoreInt32(&s.shutdown, 1)
+	if s.servedRTP {
+		rtpengine.Close()
+	}
+	return s.routers.Shutdown(ctx)
+}
+
+// isShutdown report if Close or Shutdown was called
+func (s *SFU) isShutdown() bool {
+	return atomic.LoadInt32(&s.shutdown) == 1
 }
@@ -0,0 +1,211 @@
+package sfu
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+	"github.com/pion/ion-sfu/pkg/rtc/plugins"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+)
+
+// memTransport is an in-memory transport.Transport, a pub reads what is
+// pushed to rtpCh and a sub keeps what it is written
+type memTransport struct {
+	id      string
+	rtpCh   chan *rtp.Packet
+	rtcpCh  chan rtcp.Packet
+	lock    sync.Mutex
+	written []*rtp.Packet
+	closed  bool
+	onClose func()
+}
+
+func newMemTransport(id string) *memTransport {
+	return &memTransport{
+		id:     id,
+		rtpCh:  make(chan *rtp.Packet, 100),
+		rtcpCh: make(chan rtcp.Packet, 100),
+	}
+}
+
+func (m *memTransport) ID() string                        { return m.id }
+func (m *memTransport) Type() int                         { return -1 }
+func (m *memTransport) GetRTCPChan() chan rtcp.Packet     { return m.rtcpCh }
+func (m *memTransport) WriteRTCP(rtcp.Packet) error       { return nil }
+func (m *memTransport) OnConnectionStateChange(func(int)) {}
+func (m *memTransport) WriteErrTotal() int                { return 0 }
+func (m *memTransport) WriteErrReset()                    {}
+func (m *memTransport) GetBandwidth() uint32              { return 0 }
+
+func (m *memTransport) ReadRTP() (*rtp.Packet, error) {
+	pkt, ok := <-m.rtpCh
+	if !ok {
+		return nil, errors.New("mem transport closed")
+	}
+	return pkt, nil
+}
+
+func (m *memTransport) WriteRTP(pkt *rtp.Packet) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.written = append(m.written, pkt)
+	return nil
+}
+
+func (m *memTransport) OnClose(f func()) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.onClose = f
+}
+
+func (m *memTransport) Close() {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return
+	}
+	m.closed = true
+	f := m.onClose
+	m.lock.Unlock()
+	if f != nil {
+		f()
+	}
+}
+
+func (m *memTransport) writtenTotal() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.written)
+}
+
+func (m *memTransport) isClosed() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.closed
+}
+
+func newTestSFU(t *testing.T) *SFU {
+	s, err := New(Config{
+		Plugins: plugins.Config{On: true, JitterBuffer: plugins.JitterBufferConfig{On: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSFUEmbedded(t *testing.T) {
+	s := newTestSFU(t)
+
+	router, err := s.NewRouter("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.GetRouter("room") != router {
+		t.Fatal("GetRouter doesn't return the new router")
+	}
+	pub := newMemTransport("pub")
+	router.AddPub(pub)
+	subs := []*memTransport{newMemTransport("sub1"), newMemTransport("sub2")}
+	for _, sub := range subs {
+		router.AddSub(sub.ID(), sub)
+	}
+
+	for i := 0; i < 5; i++ {
+		pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 1, PayloadType: 111, SequenceNumber: uint16(i)}}
+	}
+	for _, sub := range subs {
+		testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() == 5 })
+	}
+
+	other, err := s.NewRouter("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routers := s.Routers(); len(routers) != 2 || routers[0] != other || routers[1] != router {
+		t.Fatalf("routers=%v, want other and room", routers)
+	}
+	if stats := s.Stats(); stats.Routers != 2 || stats.Pubs != 1 || stats.Subs != 2 {
+		t.Fatalf("stats=%+v, want 2 routers, 1 pub and 2 subs", stats)
+	}
+	infos := s.ListRouters()
+	if len(infos) != 2 || infos[1].ID != "room" || infos[1].Pub != "pub" || len(infos[1].Subs) != 2 {
+		t.Fatalf("infos=%+v", infos)
+	}
+
+	// a closed router leaves the sfu
+	other.Close()
+	if s.GetRouter("other") != nil || len(s.Routers()) != 1 {
+		t.Fatal("closed router still listed")
+	}
+
+	s.Close()
+	if len(s.Routers()) != 0 {
+		t.Fatal("routers left after Close")
+	}
+	if !pub.isClosed() || !subs[0].isClosed() {
+		t.Fatal("transports not closed with the sfu")
+	}
+	if _, err := s.NewRouter("late"); err == nil {
+		t.Fatal("NewRouter succeeded after Close")
+	}
+}
+
+func TestSFUsOwnTheirRouters(t *testing.T) {
+	a, b := newTestSFU(t), newTestSFU(t)
+	defer a.Close()
+	defer b.Close()
+	if _, err := a.NewRouter("room"); err != nil {
+		t.Fatal(err)
+	}
+	if b.GetRouter("room") != nil || len(b.Routers()) != 0 {
+		t.Fatal("router of one sfu seen by another")
+	}
+}
+
+func TestSFUShutdown(t *testing.T) {
+	s := newTestSFU(t)
+
+	var transports []*memTransport
+	for _, id := range []string{"a", "b"} {
+		router, err := s.NewRouter(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub := newMemTransport(id + "pub")
+		sub := newMemTransport(id + "sub")
+		router.AddPub(pub)
+		router.AddSub(sub.ID(), sub)
+		transports = append(transports, pub, sub)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown=%v, want nil", err)
+	}
+	if len(s.Routers()) != 0 {
+		t.Fatal("routers left after Shutdown")
+	}
+	for _, tr := range transports {
+		if !tr.isClosed() {
+			t.Fatalf("%s not closed with the sfu", tr.ID())
+		}
+	}
+	if _, err := s.NewRouter("late"); err == nil {
+		t.Fatal("NewRouter succeeded after Shutdown")
+	}
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer}
+	if _, _, err := s.Publish(offer); err != ErrShutdown {
+		t.Fatalf("Publish=%v, want ErrShutdown", err)
+	}
+	if _, _, err := s.Subscribe("a", offer); err != ErrShutdown {
+		t.Fatalf("Subscribe=%v, want ErrShutdown", err)
+	}
+}
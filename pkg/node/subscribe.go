@@ -2,6 +2,8 @@ package sfu
 
 import (
 	"errors"
+	"fmt"
+	"math/rand"
 	"strconv"
 	"strings"
 
@@ -32,17 +34,16 @@ func getSubCodec(track *webrtc.Track, parsed sdp.SessionDescription) uint8 {
 			}
 
 			payloadType := uint8(pt)
-
-			// 	If offer contains pub payload type, use that
-			if track.PayloadType() == payloadType {
-				return payloadType
-			}
-
 			payloadCodec, err := parsed.GetCodecForPayloadType(payloadType)
 			if err != nil {
 				return 0
 			}
 
+			// If offer contains pub payload type for the same codec, use that
+			if track.PayloadType() == payloadType && strings.EqualFold(payloadCodec.Name, track.Codec().Name) {
+				return payloadType
+			}
+
 			// Otherwise look for first supported pt that can be transformed from pub
 			log.Infof("%s %s", payloadCodec.Name, track.Codec().Name)
 			if strings.EqualFold(payloadCodec.Name, track.Codec().Name) {
@@ -58,8 +59,48 @@ func getSubCodec(track *webrtc.Track, parsed sdp.SessionDescription) uint8 {
 	return 0
 }
 
-// Subscribe to a mid
-func Subscribe(mid string, offer webrtc.SessionDescription) (*transport.WebRTCTransport, *webrtc.SessionDescription, error) {
+// getSubRTX return the rtx payload type the offer has for video payload
+// type pt, false if it has none
+func getSubRTX(pt uint8, parsed sdp.SessionDescription) (uint8, bool) {
+	apt := "apt=" + strconv.Itoa(int(pt))
+	for _, md := range parsed.MediaDescriptions {
+		if md.MediaName.Media != "video" {
+			continue
+		}
+		for _, format := range md.MediaName.Formats {
+			rtxPT, err := strconv.Atoi(format)
+			if err != nil || rtxPT < 0 || rtxPT > 255 {
+				continue
+			}
+			codec, err := parsed.GetCodecForPayloadType(uint8(rtxPT))
+			if err != nil || !strings.EqualFold(codec.Name, "rtx") {
+				continue
+			}
+			for _, param := range strings.Split(codec.Fmtp, ";") {
+				if strings.TrimSpace(param) == apt {
+					return uint8(rtxPT), true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+// getSubExtensions return the header extension id of the sub for each one
+// of the pub, 0 for the extensions the sub didn't negotiate
+func getSubExtensions(pubExts, subExts map[string]uint8) map[uint8]uint8 {
+	ids := make(map[uint8]uint8, len(pubExts))
+	for uri, pubID := range pubExts {
+		ids[pubID] = subExts[uri]
+	}
+	return ids
+}
+
+// Subscribe to the pub of router mid
+func (s *SFU) Subscribe(mid string, offer webrtc.SessionDescription) (*transport.WebRTCTransport, *webrtc.SessionDescription, error) {
+	if s.isShutdown() {
+		return nil, nil, ErrShutdown
+	}
 	parsed := sdp.SessionDescription{}
 	err := parsed.Unmarshal([]byte(offer.SDP))
 
@@ -69,17 +110,32 @@ func Subscribe(mid string, offer webrtc.SessionDescription) (*transport.WebRTCTr
 	}
 
 	log.Infof("subscribe->connect called: %v", parsed)
-	router := rtc.GetRouter(mid)
+	router := s.GetRouter(mid)
 
 	if router == nil {
-		return nil, nil, errors.New("subscribe->connect: router not found")
+		return nil, nil, fmt.Errorf("subscribe->connect: %w", ErrRouterNotFound)
+	}
+	// refused before negotiating, the caller can pick another sfu
+	if router.Full() {
+		return nil, nil, ErrRouterFull
 	}
 
-	pub := router.GetPub().(*transport.WebRTCTransport)
+	// a router created empty or fed over rtp
+	pub, ok := router.GetPub().(*transport.WebRTCTransport)
+	if !ok {
+		return nil, nil, ErrNoPub
+	}
 
 	rtcOptions := transport.RTCOptions{
-		Subscribe: true,
-		Ssrcpt:    make(map[uint32]uint8),
+		Subscribe:   true,
+		DataChannel: hasDataChannel(parsed),
+		Ssrcpt:      make(map[uint32]uint8),
+		RTX:         make(map[uint8]uint8),
+	}
+	// the sub is offered the header extensions the pub sends
+	pubExts := pub.ExtMaps()
+	for uri := range pubExts {
+		rtcOptions.HeaderExtensions = append(rtcOptions.HeaderExtensions, uri)
 	}
 
 	tracks := pub.GetInTracks()
@@ -88,11 +144,17 @@ func Subscribe(mid string, offer webrtc.SessionDescription) (*transport.WebRTCTr
 	allowedCodecs := make([]uint8, 0, len(tracks))
 
 	for ssrc, track := range tracks {
-		rtcOptions.Ssrcpt[ssrc] = uint8(track.PayloadType())
+		// the sub tracks use the ssrcs the router writes to subs
+		rtcOptions.Ssrcpt[router.SubSSRC(ssrc, track.PayloadType())] = uint8(track.PayloadType())
 
 		// Find pt for track given track.Payload and sdp
 		ssrcPTMap[ssrc] = getSubCodec(track, parsed)
 		allowedCodecs = append(allowedCodecs, ssrcPTMap[ssrc])
+		if pt := ssrcPTMap[ssrc]; pt != 0 && transport.IsVideo(track.PayloadType()) {
+			if rtxPT, ok := getSubRTX(pt, parsed); ok {
+				rtcOptions.RTX[pt] = rtxPT
+			}
+		}
 	}
 
 	// Set media engine codecs based on found pts
@@ -105,6 +167,7 @@ func Subscribe(mid string, offer webrtc.SessionDescription) (*transport.WebRTCTr
 		return nil, nil, errors.New("subscribe->connect: transport.NewWebRTCTransport failed")
 	}
 
+	rtx := make(map[uint32]rtc.RTXStream)
 	for ssrc, track := range tracks {
 		// Get payload type from request track
 		pt := track.PayloadType()
@@ -116,9 +179,18 @@ func Subscribe(mid string, offer webrtc.SessionDescription) (*transport.WebRTCTr
 		// I2AacsRLsZZriGapnvPKiKBcLi8rTrO1jOpq c84ded42-d2b0-4351-88d2-b7d240c33435
 		//                streamID                        trackID
 		log.Debugf("AddTrack: codec:%s, ssrc:%d, pt:%d, streamID %s, trackID %s", track.Codec().MimeType, ssrc, pt, pub.ID(), track.ID())
-		_, err := sub.AddSendTrack(ssrc, pt, pub.ID(), track.ID())
+		subSSRC := router.SubSSRC(ssrc, track.PayloadType())
+		_, err := sub.AddSendTrack(subSSRC, pt, pub.ID(), track.ID())
 		if err != nil {
 			log.Errorf("err=%v", err)
+			continue
+		}
+
+		// the sub negotiated rtx, the router resends on an rtx ssrc of the track
+		if rtxPT, ok := rtcOptions.RTX[pt]; ok {
+			rtxSSRC := rand.Uint32()
+			sub.AddRTX(subSSRC, rtxSSRC)
+			rtx[subSSRC] = rtc.RTXStream{SSRC: rtxSSRC, PayloadType: rtxPT}
 		}
 	}
 
@@ -126,10 +198,32 @@ func Subscribe(mid string, offer webrtc.SessionDescription) (*transport.WebRTCTr
 
 	if err != nil {
 		log.Debugf("subscribe->connect: error creating answer %v", err)
+		sub.Close()
 		return nil, nil, errWebRTCTransportAnswerFailed
 	}
 
-	router.AddSub(sub.ID(), sub)
+	// the router writes the packets of the pub with the payload types the sub negotiated
+	pts := make(map[uint8]uint8, len(tracks))
+	for ssrc, track := range tracks {
+		if pt := ssrcPTMap[ssrc]; pt != 0 {
+			pts[track.PayloadType()] = pt
+		}
+	}
+	router.SetSubPayloadTypes(sub.ID(), pts)
+	router.SetSubExtensions(sub.ID(), getSubExtensions(pubExts, sub.ExtMaps()))
+	if len(rtx) > 0 {
+		router.SetSubRTX(sub.ID(), rtx)
+	}
+	// set first, the router writes to the sub as soon as it is added
+	if router.AddSub(sub.ID(), sub) == nil {
+		// drops what was set for the refused sub
+		router.RemoveSub(sub.ID())
+		sub.Close()
+		if router.Full() {
+			return nil, nil, ErrRouterFull
+		}
+		return nil, nil, errRouterClosed
+	}
 
 	log.Debugf("subscribe->connect: mid %s, answer = %v", sub.ID(), answer)
 	return sub, &answer, nil
@@ -104,3 +104,74 @@ func TestGetSubCodecsIgnoresH264PT126Codec(t *testing.T) {
 		t.Fatal("Should return VP8 codec type")
 	}
 }
+
+func TestGetSubCodecsMatchesCodecName(t *testing.T) {
+	// the sub offers the pub payload type for another codec
+	offer := sdp.SessionDescription{
+		MediaDescriptions: []*sdp.MediaDescription{
+			{
+				MediaName: sdp.MediaName{
+					Media:   "video",
+					Formats: []string{"96", "120"},
+				},
+				Attributes: []sdp.Attribute{
+					sdp.NewAttribute("rtpmap:96 VP9/90000", ""),
+					sdp.NewAttribute("rtpmap:120 VP8/90000", ""),
+				},
+			},
+		},
+	}
+
+	c := webrtc.NewRTPCodec(webrtc.RTPCodecTypeVideo,
+		"VP8",
+		90000,
+		0,
+		"",
+		webrtc.DefaultPayloadTypeVP8,
+		&codecs.VP8Payloader{})
+	track, _ := webrtc.NewTrack(webrtc.DefaultPayloadTypeVP8, 1111, "msid", "label", c)
+
+	if codec := getSubCodec(track, offer); codec != 120 {
+		t.Fatalf("codec=%d, want 120 the sub negotiated for VP8", codec)
+	}
+}
+
+func TestGetSubRTX(t *testing.T) {
+	offer := sdp.SessionDescription{
+		MediaDescriptions: []*sdp.MediaDescription{
+			{
+				MediaName: sdp.MediaName{
+					Media:   "video",
+					Formats: []string{"96", "97", "98", "99"},
+				},
+				Attributes: []sdp.Attribute{
+					sdp.NewAttribute("rtpmap:96 VP8/90000", ""),
+					sdp.NewAttribute("rtpmap:97 rtx/90000", ""),
+					sdp.NewAttribute("fmtp:97 apt=96", ""),
+					sdp.NewAttribute("rtpmap:98 VP9/90000", ""),
+					sdp.NewAttribute("rtpmap:99 rtx/90000", ""),
+					sdp.NewAttribute("fmtp:99 apt=98", ""),
+				},
+			},
+		},
+	}
+
+	if pt, ok := getSubRTX(96, offer); !ok || pt != 97 {
+		t.Fatalf("rtx=%d,%v, want 97 for VP8", pt, ok)
+	}
+	if pt, ok := getSubRTX(98, offer); !ok || pt != 99 {
+		t.Fatalf("rtx=%d,%v, want 99 for VP9", pt, ok)
+	}
+	if _, ok := getSubRTX(120, offer); ok {
+		t.Fatal("rtx found for a payload type without one")
+	}
+}
+
+func TestGetSubExtensions(t *testing.T) {
+	pubExts := map[string]uint8{"urn:ietf:params:rtp-hdrext:ssrc-audio-level": 1, "urn:3gpp:video-orientation": 4}
+	subExts := map[string]uint8{"urn:ietf:params:rtp-hdrext:ssrc-audio-level": 10}
+	ids := getSubExtensions(pubExts, subExts)
+	if len(ids) != 2 || ids[1] != 10 || ids[4] != 0 {
+		t.Fatalf("ids=%v, want audio level as 10 and video orientation dropped", ids)
+	}
+}
@@ -0,0 +1,54 @@
+package rtc
+
+import (
+	"sync/atomic"
+
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+	"github.com/pion/rtp"
+)
+
+const (
+	// audioLevelSilence is -127 dBov, the lowest rfc6464 level
+	audioLevelSilence = 127
+
+	defaultAudioLevelExtID = 1
+)
+
+// updateAudioLevel read the rfc6464 audio level of a pub audio packet,
+// packets without the extension count as silence
+func (r *Router) updateAudioLevel(pkt *rtp.Packet) {
+	if transport.IsVideo(pkt.PayloadType) {
+		return
+	}
+	id := getRouterConfig().AudioLevelExtID
+	if id <= 0 {
+		id = defaultAudioLevelExtID
+	}
+	level := uint8(audioLevelSilence)
+	if ext := pkt.GetExtension(uint8(id)); len(ext) > 0 {
+		// first bit is the voice activity flag
+		level = ext[0] & 0x7f
+	}
+	if old := atomic.SwapUint32(&r.audioLevel, uint32(level)); old == uint32(level) {
+		return
+	}
+
+	r.audioLock.RLock()
+	f := r.onAudioLevel
+	r.audioLock.RUnlock()
+	if f != nil {
+		f(level)
+	}
+}
+
+// AudioLevel return the last audio level of the pub in -dBov, 127 is silence
+func (r *Router) AudioLevel() uint8 {
+	return uint8(atomic.LoadUint32(&r.audioLevel))
+}
+
+// OnAudioLevel set a handler called when the pub audio level changes
+func (r *Router) OnAudioLevel(f func(uint8)) {
+	r.audioLock.Lock()
+	defer r.audioLock.Unlock()
+	r.onAudioLevel = f
+}
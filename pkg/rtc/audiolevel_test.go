@@ -0,0 +1,62 @@
+package rtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func TestRouterAudioLevel(t *testing.T) {
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	defer router.Close()
+
+	levels := make(chan uint8, 10)
+	router.OnAudioLevel(func(level uint8) {
+		levels <- level
+	})
+
+	if level := router.AudioLevel(); level != audioLevelSilence {
+		t.Fatalf("level=%d, want silence before any packet", level)
+	}
+
+	waitLevel := func(want uint8) {
+		select {
+		case level := <-levels:
+			if level != want {
+				t.Fatalf("OnAudioLevel got %d, want %d", level, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("OnAudioLevel not called, want %d", want)
+		}
+		if level := router.AudioLevel(); level != want {
+			t.Fatalf("AudioLevel=%d, want %d", level, want)
+		}
+	}
+
+	// voice activity flag set, level 30
+	pkt := &rtp.Packet{Header: rtp.Header{SSRC: 1, PayloadType: 111, SequenceNumber: 1}}
+	if err := pkt.SetExtension(defaultAudioLevelExtID, []byte{0x80 | 30}); err != nil {
+		t.Fatal(err)
+	}
+	pub.rtpCh <- pkt
+	waitLevel(30)
+
+	// a stream without the extension is silence
+	pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 1, PayloadType: 111, SequenceNumber: 2}}
+	waitLevel(audioLevelSilence)
+
+	// video packets are ignored
+	pkt = &rtp.Packet{Header: rtp.Header{SSRC: 2, PayloadType: 96, SequenceNumber: 1}}
+	if err := pkt.SetExtension(defaultAudioLevelExtID, []byte{10}); err != nil {
+		t.Fatal(err)
+	}
+	pub.rtpCh <- pkt
+	select {
+	case level := <-levels:
+		t.Fatalf("OnAudioLevel got %d from a video packet", level)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
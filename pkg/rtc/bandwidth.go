@@ -0,0 +1,146 @@
+package rtc
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+const (
+	pubRateWindow  = time.Second
+	pubRateBuckets = 10
+
+	// min interval between rembs sent to a pub over MaxBandwidth
+	capREMBInterval = 200 * time.Millisecond
+	// video is dropped above MaxBandwidth * capDropFactor, below it the
+	// remb alone has to bring the pub down
+	capDropFactor = 1.2
+)
+
+// slidingMeter measures a bitrate over the last pubRateWindow, only routeLoop calls add
+type slidingMeter struct {
+	// bits per second, accessed atomically
+	rate    uint64
+	buckets [pubRateBuckets]uint64
+	cur     int
+	start   time.Time
+}
+
+func (m *slidingMeter) add(n int, now time.Time) {
+	bucketTime := pubRateWindow / pubRateBuckets
+	if m.start.IsZero() {
+		m.start = now
+	}
+	// move to the bucket of now, clearing the ones skipped
+	for i := 0; now.Sub(m.start) >= bucketTime; i++ {
+		m.start = m.start.Add(bucketTime)
+		m.cur = (m.cur + 1) % pubRateBuckets
+		m.buckets[m.cur] = 0
+		if i >= pubRateBuckets {
+			m.start = now
+			break
+		}
+	}
+	m.buckets[m.cur] += uint64(n)
+
+	var bytes uint64
+	for _, b := range m.buckets {
+		bytes += b
+	}
+	atomic.StoreUint64(&m.rate, bytes*8*uint64(time.Second)/uint64(pubRateWindow))
+}
+
+func (m *slidingMeter) bitrate() uint64 {
+	return atomic.LoadUint64(&m.rate)
+}
+
+// capState tracks the packets of a video ssrc dropped to enforce MaxBandwidth
+type capState struct {
+	// dropping until the next key frame
+	dropping bool
+	// forwarding a key frame until its last packet
+	inKeyFrame bool
+}
+
+// capPacket enforce MaxBandwidth on the pub, it return false when pkt has to
+// be dropped. Only routeLoop calls it.
+//
+// Above the cap the pub gets a remb asking it to scale down. Video is only
+// dropped when the pub stays well above the cap, and then whole frames until
+// the next key frame, so subs never decode a partial frame. Key frames and
+// audio are never dropped.
+func (r *Router) capPacket(pkt *rtp.Packet, now time.Time) bool {
+	max := getRouterConfig().MaxBandwidth
+	if max == 0 {
+		return true
+	}
+	rate := r.pubMeter.bitrate()
+	if rate > max && now.Sub(r.lastCapREMB) >= capREMBInterval {
+		r.lastCapREMB = now
+		r.sendCapREMB(max * max / rate)
+	}
+
+	if !transport.IsVideo(pkt.PayloadType) {
+		return true
+	}
+	st := r.capStates[pkt.SSRC]
+	if st == nil {
+		st = &capState{}
+		r.capStates[pkt.SSRC] = st
+	}
+	over := float64(rate) > float64(max)*capDropFactor
+
+	if transport.IsKeyFrame(pkt.PayloadType, pkt.Payload) {
+		st.inKeyFrame = true
+	}
+	if st.inKeyFrame {
+		if pkt.Marker {
+			st.inKeyFrame = false
+			st.dropping = over
+		}
+		return true
+	}
+	if !st.dropping && over {
+		r.logger.Infof("Router.capPacket bitrate=%d over %d, dropping video ssrc=%d", rate, max, pkt.SSRC)
+		st.dropping = true
+	}
+	if st.dropping && !over {
+		// back under the cap, ask for a key frame to resume
+		r.requestKeyFrame()
+	}
+	if st.dropping {
+		atomic.AddUint64(&r.packetsCapped, 1)
+		return false
+	}
+	return true
+}
+
+// sendCapREMB ask the pub to send at most bitrate
+func (r *Router) sendCapREMB(bitrate uint64) {
+	pub := r.GetPub()
+	if pub == nil {
+		return
+	}
+	r.ssrcLock.RLock()
+	ssrcs := make([]uint32, 0, len(r.ssrcs))
+	for ssrc, pt := range r.ssrcs {
+		if transport.IsVideo(pt) {
+			ssrcs = append(ssrcs, ssrc)
+		}
+	}
+	r.ssrcLock.RUnlock()
+	if len(ssrcs) == 0 {
+		return
+	}
+	remb := &rtcp.ReceiverEstimatedMaximumBitrate{
+		Bitrate:    bitrate,
+		SenderSSRC: 1,
+		SSRCs:      ssrcs,
+	}
+	if err := pub.WriteRTCP(remb); err != nil {
+		r.logger.Errorf("Router.sendCapREMB err => %+v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package rtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+func TestSlidingMeter(t *testing.T) {
+	m := &slidingMeter{}
+	start := time.Now()
+	// 1000 bytes every 10ms is 800kbps
+	for i := 0; i < 100; i++ {
+		m.add(1000, start.Add(time.Duration(i)*10*time.Millisecond))
+	}
+	if m.bitrate() != 800000 {
+		t.Fatalf("bitrate=%d, want 800000", m.bitrate())
+	}
+
+	// the window slides, the first 100ms falls out of it
+	m.add(1000, start.Add(1050*time.Millisecond))
+	if m.bitrate() != 728000 {
+		t.Fatalf("bitrate=%d, want 728000", m.bitrate())
+	}
+
+	// after a long gap only the new packet counts
+	m.add(1000, start.Add(5*time.Second))
+	if m.bitrate() != 8000 {
+		t.Fatalf("bitrate=%d, want 8000", m.bitrate())
+	}
+}
+
+// capPkt return a packet of 1000 bytes
+func capPkt(sn uint16, pt uint8, key bool) *rtp.Packet {
+	payload := make([]byte, 1000-12)
+	if pt == 96 {
+		// vp8 descriptor with S set, then the frame header P bit
+		payload[0] = 0x10
+		if !key {
+			payload[1] = 0x01
+		}
+	}
+	return &rtp.Packet{
+		Header:  rtp.Header{SSRC: 1234, PayloadType: pt, SequenceNumber: sn, Marker: true},
+		Payload: payload,
+	}
+}
+
+func TestRouterCapPacket(t *testing.T) {
+	InitRouter(RouterConfig{MaxBandwidth: 400000})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.pub = pub
+	router.addSSRC(1234, 96)
+
+	now := time.Now()
+	var sn uint16
+	// push a packet, every step ms later, and return if it was forwarded
+	push := func(pt uint8, key bool, step time.Duration) bool {
+		now = now.Add(step)
+		sn++
+		pkt := capPkt(sn, pt, key)
+		router.pubMeter.add(pkt.MarshalSize(), now)
+		return router.capPacket(pkt, now)
+	}
+
+	// a key frame of 3 packets, only the last one has the marker
+	pushKeyFrame := func(step time.Duration) {
+		for i := 0; i < 3; i++ {
+			now = now.Add(step)
+			sn++
+			pkt := capPkt(sn, 96, i == 0)
+			pkt.Marker = i == 2
+			router.pubMeter.add(pkt.MarshalSize(), now)
+			if !router.capPacket(pkt, now) {
+				t.Fatalf("key frame packet %d dropped", i)
+			}
+		}
+	}
+
+	// 800kbps, twice the cap
+	pushKeyFrame(10 * time.Millisecond)
+	dropped := 0
+	for i := 0; i < 100; i++ {
+		if !push(96, false, 10*time.Millisecond) {
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		t.Fatal("no video dropped at twice the cap")
+	}
+	if bitrate := router.Stats().Bitrate; bitrate < 700000 || bitrate > 900000 {
+		t.Fatalf("bitrate=%d, want about 800000", bitrate)
+	}
+	if !push(111, false, 10*time.Millisecond) {
+		t.Fatal("audio dropped")
+	}
+
+	// the pub was asked to go under the cap
+	var remb *rtcp.ReceiverEstimatedMaximumBitrate
+	pub.lock.Lock()
+	for _, pkt := range pub.writtenRTCP {
+		if p, ok := pkt.(*rtcp.ReceiverEstimatedMaximumBitrate); ok {
+			remb = p
+		}
+	}
+	pub.lock.Unlock()
+	if remb == nil || remb.Bitrate >= 400000 {
+		t.Fatalf("remb=%v, want one under the cap", remb)
+	}
+
+	// key frames still pass, the frames after them don't
+	pushKeyFrame(10 * time.Millisecond)
+	if push(96, false, 10*time.Millisecond) {
+		t.Fatal("delta frame forwarded over the cap")
+	}
+
+	// back under the cap, video waits for a key frame and one is requested
+	for i := 0; i < 10; i++ {
+		if push(96, false, 200*time.Millisecond) {
+			t.Fatal("delta frame forwarded before a key frame")
+		}
+	}
+	if router.Stats().Bitrate >= 400000 {
+		t.Fatalf("bitrate=%d, want under the cap", router.Stats().Bitrate)
+	}
+	pli := false
+	pub.lock.Lock()
+	for _, pkt := range pub.writtenRTCP {
+		if _, ok := pkt.(*rtcp.PictureLossIndication); ok {
+			pli = true
+		}
+	}
+	pub.lock.Unlock()
+	if !pli {
+		t.Fatal("no key frame requested")
+	}
+
+	pushKeyFrame(200 * time.Millisecond)
+	if !push(96, false, 200*time.Millisecond) {
+		t.Fatal("delta frame dropped after the key frame")
+	}
+	if router.Stats().PacketsCapped == 0 {
+		t.Fatal("capped packets not counted")
+	}
+}
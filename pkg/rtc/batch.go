@@ -0,0 +1,111 @@
+package rtc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/metrics"
+	"github.com/pion/ion-sfu/pkg/util"
+)
+
+// defaultSubBatchDelay is how long a packet may wait for its batch to fill
+const defaultSubBatchDelay = 5 * time.Millisecond
+
+// subBatch is the packets routed to a sub not queued yet
+type subBatch struct {
+	sub  subRoute
+	pkts []*routedPacket
+}
+
+// batcher group the packets routed to each sub, a batch is queued to the
+// sub once it holds size packets or on the next flush, so one operation on
+// the sub queue carries several packets
+type batcher struct {
+	lock    sync.Mutex
+	size    int
+	pending map[chan []*routedPacket]*subBatch
+}
+
+func newBatcher(size int) *batcher {
+	return &batcher{size: size, pending: make(map[chan []*routedPacket]*subBatch)}
+}
+
+// add p to the batch of sub, queued once full
+func (b *batcher) add(r *Router, sub subRoute, p *routedPacket) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	batch := b.pending[sub.batch]
+	if batch == nil {
+		batch = &subBatch{sub: sub, pkts: make([]*routedPacket, 0, b.size)}
+		b.pending[sub.batch] = batch
+	}
+	batch.pkts = append(batch.pkts, p)
+	if len(batch.pkts) >= b.size {
+		delete(b.pending, sub.batch)
+		r.queueBatch(batch)
+	}
+}
+
+// flush queue every batch, full or not
+func (b *batcher) flush(r *Router) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for ch, batch := range b.pending {
+		delete(b.pending, ch)
+		r.queueBatch(batch)
+	}
+}
+
+// subBatchLimits return the packets per batch, 0 when the subs aren't
+// batched, and how long a packet may wait for its batch
+func subBatchLimits(config RouterConfig) (int, time.Duration) {
+	if config.SubBatchSize <= 1 {
+		return 0, 0
+	}
+	delay := defaultSubBatchDelay
+	if config.SubBatchDelay > 0 {
+		delay = time.Duration(config.SubBatchDelay) * time.Millisecond
+	}
+	return config.SubBatchSize, delay
+}
+
+// queueBatch push batch to the queue of its sub without blocking, the
+// packets are dropped when it is full
+func (r *Router) queueBatch(batch *subBatch) {
+	n := uint64(len(batch.pkts))
+	select {
+	case <-batch.sub.done:
+		for _, p := range batch.pkts {
+			p.release()
+		}
+	case batch.sub.batch <- batch.pkts:
+		atomic.AddUint64(&r.packetsRouted, n)
+		metrics.PacketsRouted.Add(float64(n))
+	default:
+		for _, p := range batch.pkts {
+			p.release()
+		}
+		atomic.AddUint64(batch.sub.dropped, n)
+		atomic.AddUint64(&r.packetsDropped, n)
+		metrics.PacketsDropped.Add(float64(n))
+		r.logger.Errorf("Sub consumer is backed up. Dropping %d packets", n)
+	}
+}
+
+// batchLoop queue the batches every delay so no packet waits longer for
+// its batch to fill, the last ones are released once the router closed
+func (r *Router) batchLoop(delay time.Duration) {
+	defer util.Recover("[Router.batchLoop]")
+	ticker := time.NewTicker(delay)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.batcher.flush(r)
+		case <-r.done:
+			r.batcher.flush(r)
+			return
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package rtc
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+)
+
+func TestRouterSubBatchOrder(t *testing.T) {
+	InitRouter(RouterConfig{SubBatchSize: 8, SubBatchDelay: 200})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	defer router.Close()
+
+	// less than a batch waits for the flush
+	for sn := uint16(0); sn < 3; sn++ {
+		pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: sn}}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := sub.writtenTotal(); n != 0 {
+		t.Fatalf("written=%d before the batch is full or flushed", n)
+	}
+	waitWritten := func(n int) {
+		testhelper.WaitFor(t, 2*time.Second, func() bool { return sub.writtenTotal() >= n })
+	}
+	waitWritten(3)
+
+	// full batches don't wait, the last packets are flushed
+	for sn := uint16(3); sn < 30; sn++ {
+		pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: sn}}
+	}
+	waitWritten(27)
+	waitWritten(30)
+
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	for i, pkt := range sub.written {
+		if pkt.SequenceNumber != uint16(i) {
+			t.Fatalf("written[%d] sn=%d, want %d", i, pkt.SequenceNumber, i)
+		}
+	}
+	if routed := router.Stats().PacketsRouted; routed != 30 {
+		t.Fatalf("routed=%d, want 30", routed)
+	}
+}
+
+func TestRouterSubBatchCloseGraceful(t *testing.T) {
+	InitRouter(RouterConfig{SubBatchSize: 8, SubBatchDelay: 10000})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+
+	for sn := uint16(0); sn < 3; sn++ {
+		pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: sn}}
+	}
+	testhelper.WaitFor(t, time.Second, func() bool { return len(pub.rtpCh) == 0 })
+	time.Sleep(20 * time.Millisecond)
+	if routed := atomic.LoadUint64(&router.packetsRouted); routed != 0 {
+		t.Fatalf("routed=%d, want the packets waiting for their batch", routed)
+	}
+
+	// the packets waiting for their batch are written before closing
+	router.CloseGraceful(time.Second)
+	if n := sub.writtenTotal(); n != 3 {
+		t.Fatalf("written=%d, want 3", n)
+	}
+}
+
+// BenchmarkRouterSubBatch route packets to 10 subs and report the queue
+// operations per packet a sub received
+func BenchmarkRouterSubBatch(b *testing.B) {
+	for _, size := range []int{0, 8, 32} {
+		b.Run(fmt.Sprintf("batch%d", size), func(b *testing.B) {
+			InitRouter(RouterConfig{SubBatchSize: size})
+			defer InitRouter(RouterConfig{})
+			router := NewRouter("router")
+
+			// the subs are only queues, counting what they receive
+			var ops, pkts int64
+			var wg sync.WaitGroup
+			done := make(chan struct{})
+			snap := &routeSnapshot{}
+			for i := 0; i < 10; i++ {
+				sub := subRoute{
+					id:      fmt.Sprintf("sub%d", i),
+					ch:      make(chan *routedPacket, 1000),
+					done:    make(chan struct{}),
+					dropped: new(uint64),
+				}
+				if router.batcher != nil {
+					sub.batch = make(chan []*routedPacket, 1000)
+				}
+				snap.subs = append(snap.subs, sub)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case p := <-sub.ch:
+							p.release()
+							atomic.AddInt64(&ops, 1)
+							atomic.AddInt64(&pkts, 1)
+						case batch := <-sub.batch:
+							for _, p := range batch {
+								p.release()
+							}
+							atomic.AddInt64(&ops, 1)
+							atomic.AddInt64(&pkts, int64(len(batch)))
+						case <-done:
+							return
+						}
+					}
+				}()
+			}
+			router.routes.Store(snap)
+
+			pkt := &rtp.Packet{Header: rtp.Header{SSRC: 1234}}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				router.routePacket(pkt, nil)
+			}
+			if router.batcher != nil {
+				router.batcher.flush(router)
+			}
+			for atomic.LoadInt64(&pkts)+int64(atomic.LoadUint64(&router.packetsDropped)) < int64(b.N*10) {
+				time.Sleep(time.Millisecond)
+			}
+			b.StopTimer()
+			close(done)
+			wg.Wait()
+			b.ReportMetric(float64(atomic.LoadInt64(&ops))/float64(atomic.LoadInt64(&pkts)), "queueops/pkt")
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package rtc
+
+import (
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// rfc 8285 header extension profiles
+	extensionProfileOneByte = 0xBEDE
+	extensionProfileTwoByte = 0x1000
+	maxOneByteExtensionID   = 14
+	maxOneByteExtensionSize = 16
+)
+
+// extensionIDs map the header extension ids of the pub to the ones a sub
+// negotiated for the same extensions
+type extensionIDs struct {
+	// map[uint8]uint8, replaced as a whole
+	ids atomic.Value
+}
+
+// rewrite return pkt with the header extension ids of the sub. An id mapped
+// to 0 is dropped, an id not mapped is kept unless a mapped extension takes
+// it. The payloads are shared.
+func (e *extensionIDs) rewrite(pkt *rtp.Packet) *rtp.Packet {
+	if e == nil || !pkt.Extension {
+		return pkt
+	}
+	ids, _ := e.ids.Load().(map[uint8]uint8)
+	if len(ids) == 0 {
+		return pkt
+	}
+	maxID := uint8(maxOneByteExtensionID)
+	switch pkt.ExtensionProfile {
+	case extensionProfileOneByte:
+	case extensionProfileTwoByte:
+		maxID = 255
+	default:
+		// rfc 3550 extension, no ids to map
+		return pkt
+	}
+
+	type extension struct {
+		id      uint8
+		payload []byte
+	}
+	var mapped, kept []extension
+	taken := make(map[uint8]bool)
+	changed := false
+	for id := uint8(1); id != 0 && id <= maxID; id++ {
+		payload := pkt.GetExtension(id)
+		if payload == nil {
+			continue
+		}
+		subID, found := ids[id]
+		switch {
+		case !found:
+			kept = append(kept, extension{id, payload})
+		case subID == 0:
+			changed = true
+		default:
+			mapped = append(mapped, extension{subID, payload})
+			taken[subID] = true
+			changed = changed || subID != id
+		}
+	}
+	if !changed {
+		return pkt
+	}
+
+	out := *pkt
+	out.Extensions = nil
+	out.ExtensionProfile = extensionProfileOneByte
+	for _, ext := range kept {
+		if taken[ext.id] {
+			continue
+		}
+		mapped = append(mapped, ext)
+	}
+	for _, ext := range mapped {
+		if ext.id > maxOneByteExtensionID || len(ext.payload) > maxOneByteExtensionSize {
+			out.ExtensionProfile = extensionProfileTwoByte
+		}
+	}
+	out.Extension = len(mapped) > 0
+	for _, ext := range mapped {
+		// the ids and sizes fit the profile
+		_ = out.SetExtension(ext.id, ext.payload)
+	}
+	return &out
+}
+
+// SetSubExtensions set the header extension id sub id negotiated for each
+// header extension id of the pub, 0 for the extensions the sub didn't
+// negotiate. The extensions of other ids are written as they are. It may be
+// called before AddSub.
+func (r *Router) SetSubExtensions(id string, ids map[uint8]uint8) {
+	r.logger.Infof("Router.SetSubExtensions id=%s ids=%v", id, ids)
+	m := make(map[uint8]uint8, len(ids))
+	for pubID, subID := range ids {
+		m[pubID] = subID
+	}
+	r.subLock.Lock()
+	defer r.subLock.Unlock()
+	r.subExtensionIDs(id).ids.Store(m)
+}
+
+// subExtensionIDs return the header extension ids of sub id, created when
+// missing, subLock must be held
+func (r *Router) subExtensionIDs(id string) *extensionIDs {
+	e := r.subExts[id]
+	if e == nil {
+		e = &extensionIDs{}
+		r.subExts[id] = e
+	}
+	return e
+}
@@ -0,0 +1,94 @@
+package rtc
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+)
+
+func TestExtensionIDsRewrite(t *testing.T) {
+	e := &extensionIDs{}
+	e.ids.Store(map[uint8]uint8{1: 3, 2: 0, 4: 20})
+	pkt := &rtp.Packet{Header: rtp.Header{SSRC: 1}}
+	for id, payload := range map[uint8][]byte{1: {0xa}, 2: {0xb}, 3: {0xc}, 4: {0xd}, 5: {0xe}} {
+		if err := pkt.SetExtension(id, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := e.rewrite(pkt)
+	// 3 is taken by the mapped 1, 20 needs the two byte profile
+	want := map[uint8][]byte{3: {0xa}, 5: {0xe}, 20: {0xd}}
+	if out.ExtensionProfile != extensionProfileTwoByte || len(out.Extensions) != len(want) {
+		t.Fatalf("profile=%x extensions=%d, want two byte with %d", out.ExtensionProfile, len(out.Extensions), len(want))
+	}
+	for id, payload := range want {
+		if got := out.GetExtension(id); !bytes.Equal(got, payload) {
+			t.Errorf("extension %d=%v, want %v", id, got, payload)
+		}
+	}
+	if got := pkt.GetExtension(1); !bytes.Equal(got, []byte{0xa}) || len(pkt.Extensions) != 5 {
+		t.Fatal("packet of the pub changed")
+	}
+	if _, err := out.Marshal(); err != nil {
+		t.Fatalf("rewritten packet doesn't marshal: %v", err)
+	}
+
+	// nothing to map
+	plain := &rtp.Packet{Header: rtp.Header{SSRC: 1}}
+	if e.rewrite(plain) != plain {
+		t.Fatal("packet without extensions copied")
+	}
+	same := &rtp.Packet{Header: rtp.Header{SSRC: 1}}
+	_ = same.SetExtension(5, []byte{1})
+	if e.rewrite(same) != same {
+		t.Fatal("packet with unmapped extensions copied")
+	}
+}
+
+func TestRouterRewritesSubExtensions(t *testing.T) {
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	defer router.Close()
+
+	// the pub sent audio level as 1 and video orientation as 4, the sub
+	// negotiated them as 4 and 1 and no transport-cc
+	router.SetSubExtensions("sub", map[uint8]uint8{1: 4, 4: 1, 3: 0})
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	same := newFakeTransport("same")
+	router.AddSub("same", same)
+
+	pkt := &rtp.Packet{Header: rtp.Header{SSRC: 1000, PayloadType: 96}}
+	_ = pkt.SetExtension(1, []byte{0x7f})
+	_ = pkt.SetExtension(3, []byte{0, 1})
+	_ = pkt.SetExtension(4, []byte{0x2})
+	pub.rtpCh <- pkt
+	testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= 1 && same.writtenTotal() >= 1 })
+
+	sub.lock.Lock()
+	out := sub.written[0]
+	sub.lock.Unlock()
+	if !bytes.Equal(out.GetExtension(4), []byte{0x7f}) || !bytes.Equal(out.GetExtension(1), []byte{0x2}) || out.GetExtension(3) != nil {
+		t.Fatalf("sub got extensions %v, want them with its ids", out.Extensions)
+	}
+	same.lock.Lock()
+	out = same.written[0]
+	same.lock.Unlock()
+	if !bytes.Equal(out.GetExtension(1), []byte{0x7f}) || out.GetExtension(3) == nil {
+		t.Fatal("extensions changed for a sub without mapping")
+	}
+
+	sub.Close()
+	router.subLock.RLock()
+	_, found := router.subExts["sub"]
+	router.subLock.RUnlock()
+	if found {
+		t.Fatal("extension ids of a removed sub kept")
+	}
+}
@@ -0,0 +1,49 @@
+package rtc
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+// sendHistory keeps the last packets written to a sub so NACKs can be
+// answered without relying on the pub jitter buffer
+type sendHistory struct {
+	size  int
+	pkts  map[uint32][]*rtp.Packet
+	mutex sync.RWMutex
+}
+
+func newSendHistory(size int) *sendHistory {
+	return &sendHistory{
+		size: size,
+		pkts: make(map[uint32][]*rtp.Packet),
+	}
+}
+
+// Push add a packet, overwriting the oldest one in its slot
+func (h *sendHistory) Push(pkt *rtp.Packet) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	ring := h.pkts[pkt.SSRC]
+	if ring == nil {
+		ring = make([]*rtp.Packet, h.size)
+		h.pkts[pkt.SSRC] = ring
+	}
+	ring[int(pkt.SequenceNumber)%h.size] = pkt
+}
+
+// Get return the packet by ssrc and sequence number, nil if it is gone
+func (h *sendHistory) Get(ssrc uint32, sn uint16) *rtp.Packet {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	ring := h.pkts[ssrc]
+	if ring == nil {
+		return nil
+	}
+	pkt := ring[int(sn)%h.size]
+	if pkt == nil || pkt.SequenceNumber != sn {
+		return nil
+	}
+	return pkt
+}
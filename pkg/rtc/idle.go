@@ -0,0 +1,80 @@
+package rtc
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/util"
+)
+
+// idleCheckInterval is how often a router checks it is idle, a quarter of
+// timeout between 10ms and a second, a second when the check is off
+func idleCheckInterval(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return time.Second
+	}
+	interval := timeout / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	if interval > time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// touch record the router was active at now
+func (r *Router) touch(now time.Time) {
+	atomic.StoreInt64(&r.lastActive, now.UnixNano())
+}
+
+// idleTimeout return RouterConfig.IdleTimeout, 0 when off
+func idleTimeout() time.Duration {
+	return time.Duration(getRouterConfig().IdleTimeout) * time.Millisecond
+}
+
+// idleLoop close the router once it had no sub or routed no packet to its
+// subs for RouterConfig.IdleTimeout, e.g. the pub of an abandoned call or a
+// router created without a pub. The timeout is read on every check, 0
+// stops checking until it is set again, the router is idle from then on.
+// timeout is the one the router was created with.
+func (r *Router) idleLoop(timeout time.Duration) {
+	defer util.Recover("[Router.idleLoop]")
+	checking := timeout > 0
+	// packets routed when the router was last active, none when created
+	var routed uint64
+	timer := time.NewTimer(idleCheckInterval(timeout))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-r.done:
+			return
+		}
+		timeout = idleTimeout()
+		timer.Reset(idleCheckInterval(timeout))
+		if timeout <= 0 {
+			checking = false
+			continue
+		}
+
+		// the packets are counted before the time is read, so they were
+		// routed by now
+		n := atomic.LoadUint64(&r.packetsRouted)
+		r.subLock.RLock()
+		subs := len(r.subs)
+		r.subLock.RUnlock()
+		now := r.now()
+		if !checking || (n != routed && subs > 0) {
+			checking = true
+			routed = n
+			r.touch(now)
+			continue
+		}
+		if idle := now.Sub(time.Unix(0, atomic.LoadInt64(&r.lastActive))); idle >= timeout {
+			r.logger.Infof("Router idle for %v with %d subs, closing", idle, subs)
+			r.Close()
+			return
+		}
+	}
+}
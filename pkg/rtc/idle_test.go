@@ -0,0 +1,130 @@
+package rtc
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+)
+
+// idleRouter return a started router with a fake clock moved by advance,
+// closed is closed once the router is
+func idleRouter(t *testing.T) (*Router, *fakeTransport, func(time.Duration), chan struct{}) {
+	var lock sync.Mutex
+	clock := time.Now()
+	router := newRouter("router", func() time.Time {
+		lock.Lock()
+		defer lock.Unlock()
+		return clock
+	})
+	closed := make(chan struct{})
+	router.OnClose(func() { close(closed) })
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	return router, pub, func(d time.Duration) {
+		lock.Lock()
+		clock = clock.Add(d)
+		lock.Unlock()
+	}, closed
+}
+
+// checkOpen fail if the router closes within a few idle checks
+func checkOpen(t *testing.T, closed chan struct{}) {
+	select {
+	case <-closed:
+		t.Fatal("active router closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func waitClosed(t *testing.T, closed chan struct{}) {
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle router not closed")
+	}
+}
+
+func TestRouterIdleTimeout(t *testing.T) {
+	InitRouter(RouterConfig{IdleTimeout: 100})
+	defer InitRouter(RouterConfig{})
+
+	// a pub without subs
+	router, _, advance, closed := idleRouter(t)
+	defer router.Close()
+	advance(90 * time.Millisecond)
+	checkOpen(t, closed)
+	advance(10 * time.Millisecond)
+	waitClosed(t, closed)
+}
+
+func TestRouterIdleTimeoutActivity(t *testing.T) {
+	InitRouter(RouterConfig{IdleTimeout: 100})
+	defer InitRouter(RouterConfig{})
+
+	router, pub, advance, closed := idleRouter(t)
+	defer router.Close()
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+
+	// routing a packet to the sub keeps the router open
+	advance(80 * time.Millisecond)
+	pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: 1}}
+	testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= 1 })
+	checkOpen(t, closed)
+	advance(80 * time.Millisecond)
+	checkOpen(t, closed)
+
+	// no packet since
+	advance(20 * time.Millisecond)
+	waitClosed(t, closed)
+}
+
+func TestRouterIdleTimeoutOff(t *testing.T) {
+	router, _, advance, closed := idleRouter(t)
+	defer router.Close()
+	advance(time.Hour)
+	checkOpen(t, closed)
+	if n := router.Stats().Goroutines; n != 3 {
+		t.Fatalf("goroutines=%d, want the 2 loops of the pub and the idle check", n)
+	}
+}
+
+func TestRouterIdleTimeoutWithoutPub(t *testing.T) {
+	InitRouter(RouterConfig{IdleTimeout: 100})
+	defer InitRouter(RouterConfig{})
+
+	clock := time.Now().UnixNano()
+	router := newRouter("router", func() time.Time {
+		return time.Unix(0, atomic.LoadInt64(&clock))
+	})
+	defer router.Close()
+	closed := make(chan struct{})
+	router.OnClose(func() { close(closed) })
+
+	// a sub joining is activity
+	atomic.AddInt64(&clock, int64(90*time.Millisecond))
+	router.AddSub("sub", newFakeTransport("sub"))
+	atomic.AddInt64(&clock, int64(90*time.Millisecond))
+	checkOpen(t, closed)
+	atomic.AddInt64(&clock, int64(10*time.Millisecond))
+	waitClosed(t, closed)
+}
+
+func TestRouterIdleTimeoutReloaded(t *testing.T) {
+	defer InitRouter(RouterConfig{})
+
+	router, _, advance, closed := idleRouter(t)
+	defer router.Close()
+	advance(time.Hour)
+	// idle from when the timeout is seen, not from the start
+	InitRouter(RouterConfig{IdleTimeout: 100})
+	time.Sleep(idleCheckInterval(0))
+	checkOpen(t, closed)
+	advance(100 * time.Millisecond)
+	waitClosed(t, closed)
+}
@@ -0,0 +1,82 @@
+package rtc
+
+import "sync"
+
+const (
+	// a gap this far behind the newest packet of its ssrc isn't filled
+	// anymore, its packets stay lost
+	lossReorderWindow = 512
+	// a jump this far ahead or behind restarts the sequence of the ssrc,
+	// the packets between aren't lost
+	lossMaxGap = 3000
+)
+
+// lossTracker count the packets of the pub lost on the way to the router
+// from the gaps in the sequence numbers of each ssrc. A packet arriving late
+// fills its gap again, reordering isn't loss.
+type lossTracker struct {
+	lock     sync.Mutex
+	streams  map[uint32]*lossStream
+	lost     uint64
+	expected uint64
+}
+
+type lossStream struct {
+	// highest sequence number received
+	highest uint16
+	// sequence numbers missing behind highest
+	missing map[uint16]struct{}
+}
+
+func newLossTracker() *lossTracker {
+	return &lossTracker{streams: make(map[uint32]*lossStream)}
+}
+
+// push count sequence number sn of ssrc
+func (l *lossTracker) push(ssrc uint32, sn uint16) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	s := l.streams[ssrc]
+	if s == nil {
+		l.streams[ssrc] = &lossStream{highest: sn, missing: make(map[uint16]struct{})}
+		l.expected++
+		return
+	}
+
+	diff := int(int16(sn - s.highest))
+	switch {
+	case diff > lossMaxGap || diff < -lossMaxGap:
+		s.highest = sn
+		s.missing = make(map[uint16]struct{})
+		l.expected++
+	case diff > 0:
+		for m := s.highest + 1; m != sn; m++ {
+			s.missing[m] = struct{}{}
+		}
+		l.lost += uint64(diff - 1)
+		l.expected += uint64(diff)
+		s.highest = sn
+		for m := range s.missing {
+			if sn-m > lossReorderWindow {
+				delete(s.missing, m)
+			}
+		}
+	case diff < 0:
+		// a duplicate or a packet too late is ignored
+		if _, found := s.missing[sn]; found {
+			delete(s.missing, sn)
+			l.lost--
+		}
+	}
+}
+
+// stats return the packets lost and the fraction of the packets expected
+// they are
+func (l *lossTracker) stats() (uint64, float64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.expected == 0 {
+		return 0, 0
+	}
+	return l.lost, float64(l.lost) / float64(l.expected)
+}
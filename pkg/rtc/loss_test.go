@@ -0,0 +1,33 @@
+package rtc
+
+import "testing"
+
+func TestLossTracker(t *testing.T) {
+	l := newLossTracker()
+	// 65535 and 2 lost across the wrap, 0 arrives late
+	for _, sn := range []uint16{65533, 65534, 1, 0, 3, 3} {
+		l.push(1, sn)
+	}
+	if lost, rate := l.stats(); lost != 2 || rate != 2.0/7 {
+		t.Fatalf("lost=%d rate=%v, want 2 and 2/7", lost, rate)
+	}
+
+	// a gap out of the reorder window isn't filled anymore
+	l.push(1, 5)
+	l.push(1, 5+lossReorderWindow+1)
+	l.push(1, 4)
+	if lost, _ := l.stats(); lost != 3+lossReorderWindow {
+		t.Fatalf("lost=%d, want %d", lost, 3+lossReorderWindow)
+	}
+
+	// a restart of the sequence and another ssrc add no loss
+	l = newLossTracker()
+	l.push(1, 10)
+	l.push(1, 10+lossMaxGap+1)
+	l.push(1, 10+lossMaxGap+2)
+	l.push(2, 500)
+	l.push(2, 501)
+	if lost, rate := l.stats(); lost != 0 || rate != 0 {
+		t.Fatalf("lost=%d rate=%v, want 0", lost, rate)
+	}
+}
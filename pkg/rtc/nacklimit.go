@@ -0,0 +1,87 @@
+package rtc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+const (
+	// a packet nacked upstream isn't nacked again before the pub could
+	// resend it
+	defaultUpstreamNackWindow = 100 * time.Millisecond
+	// nacks per second forwarded to the pub
+	defaultUpstreamNackRate = 500
+)
+
+type nackKey struct {
+	ssrc uint32
+	sn   uint16
+}
+
+// nackLimiter decide which nacks of the subs reach the pub. A packet is
+// nacked once per window whichever sub lost it, and the nacks are limited
+// to rate per second by a token bucket.
+type nackLimiter struct {
+	lock   sync.Mutex
+	sent   map[nackKey]time.Time
+	pruned time.Time
+	tokens float64
+	filled time.Time
+}
+
+func newNackLimiter() *nackLimiter {
+	return &nackLimiter{sent: make(map[nackKey]time.Time)}
+}
+
+// allow report if sn of ssrc may be nacked to the pub at now
+func (l *nackLimiter) allow(ssrc uint32, sn uint16, now time.Time, window time.Duration, rate int) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if now.Sub(l.pruned) >= window {
+		for key, at := range l.sent {
+			if now.Sub(at) >= window {
+				delete(l.sent, key)
+			}
+		}
+		l.pruned = now
+	}
+	key := nackKey{ssrc: ssrc, sn: sn}
+	if at, found := l.sent[key]; found && now.Sub(at) < window {
+		return false
+	}
+
+	// the bucket holds a second of nacks
+	if l.filled.IsZero() {
+		l.tokens = float64(rate)
+	} else {
+		l.tokens += now.Sub(l.filled).Seconds() * float64(rate)
+		if l.tokens > float64(rate) {
+			l.tokens = float64(rate)
+		}
+	}
+	l.filled = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	l.sent[key] = now
+	return true
+}
+
+// nackPairs pack sns into nack pairs, the ones following a pair within 16
+// go in its bitmask
+func nackPairs(sns []uint16) []rtcp.NackPair {
+	var pairs []rtcp.NackPair
+	for _, sn := range sns {
+		if n := len(pairs); n > 0 {
+			if d := sn - pairs[n-1].PacketID; d > 0 && d <= 16 {
+				pairs[n-1].LostPackets |= rtcp.PacketBitmap(1 << (d - 1))
+				continue
+			}
+		}
+		pairs = append(pairs, rtcp.NackPair{PacketID: sn})
+	}
+	return pairs
+}
@@ -0,0 +1,164 @@
+package rtc
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+)
+
+const (
+	// opus packets remembered per ssrc to answer nacks
+	opusHistorySize = 512
+	// a dtx packet carries at most the toc byte and one byte of comfort noise
+	maxOpusDTXSize = 2
+)
+
+// isOpus report if pt is one of the opus payload types of the sfu
+func isOpus(pt uint8) bool {
+	return pt == webrtc.DefaultPayloadTypeOpus || pt == 109
+}
+
+// opusIsDTX report if payload is a dtx packet, sent in silence instead of
+// speech frames
+func opusIsDTX(payload []byte) bool {
+	return len(payload) <= maxOpusDTXSize
+}
+
+// opusHasFEC report if payload carries the in-band fec of the previous
+// packet, i.e. the lbrr flag of one of its silk channels is set. Only
+// packets whose first frame starts after the toc byte are parsed.
+//https://tools.ietf.org/html/rfc6716#section-4.2.3
+func opusHasFEC(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+	toc := payload[0]
+	config := toc >> 3
+	// celt only modes have no silk layer
+	if config >= 16 {
+		return false
+	}
+	// code 0 and 1 packets, one frame or two of the same size
+	if toc&0x3 > 1 {
+		return false
+	}
+	// the silk frames per opus frame of 10, 20, 40 or 60ms
+	silkFrames := 1
+	if config < 12 {
+		switch config & 0x3 {
+		case 2:
+			silkFrames = 2
+		case 3:
+			silkFrames = 3
+		}
+	}
+	channels := 1
+	if toc&0x4 != 0 {
+		channels = 2
+	}
+	// every channel starts with a vad flag per silk frame then the lbrr flag,
+	// they are coded as plain bits
+	for c := 1; c <= channels; c++ {
+		if payload[1]&(0x80>>uint(c*(silkFrames+1)-1)) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// opusPacket is what the router remembers of an opus packet of the pub
+type opusPacket struct {
+	sn    uint16
+	valid bool
+	dtx   bool
+	fec   bool
+}
+
+// opusTracker remember the recent opus packets of the pub, so the nacks of
+// the subs for packets their decoder doesn't miss aren't answered
+type opusTracker struct {
+	pkts map[uint32]*[opusHistorySize]opusPacket
+	lock sync.RWMutex
+}
+
+func newOpusTracker() *opusTracker {
+	return &opusTracker{pkts: make(map[uint32]*[opusHistorySize]opusPacket)}
+}
+
+func (t *opusTracker) push(pkt *rtp.Packet) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ring := t.pkts[pkt.SSRC]
+	if ring == nil {
+		ring = new([opusHistorySize]opusPacket)
+		t.pkts[pkt.SSRC] = ring
+	}
+	ring[int(pkt.SequenceNumber)%opusHistorySize] = opusPacket{
+		sn:    pkt.SequenceNumber,
+		valid: true,
+		dtx:   opusIsDTX(pkt.Payload),
+		fec:   opusHasFEC(pkt.Payload),
+	}
+}
+
+// get return the packet sn of ssrc, false if it is unknown
+func (t *opusTracker) get(ssrc uint32, sn uint16) (opusPacket, bool) {
+	ring := t.pkts[ssrc]
+	if ring == nil {
+		return opusPacket{}, false
+	}
+	pkt := ring[int(sn)%opusHistorySize]
+	return pkt, pkt.valid && pkt.sn == sn
+}
+
+// needsResend report if a nack for sn of ssrc has to be answered, a dtx
+// packet only carries comfort noise and the packet before one carrying
+// fec is recovered by the decoder. Packets of other ssrcs always need it.
+func (t *opusTracker) needsResend(ssrc uint32, sn uint16) bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if t.pkts[ssrc] == nil {
+		return true
+	}
+	if pkt, found := t.get(ssrc, sn); found && pkt.dtx {
+		return false
+	}
+	if next, found := t.get(ssrc, sn+1); found && next.fec {
+		return false
+	}
+	return true
+}
+
+// SetOpusAware turn on or off the opus aware nack handling of the router,
+// nacks of the subs for dtx packets or packets the next one carries the fec
+// of are dropped
+func (r *Router) SetOpusAware(on bool) {
+	var v uint32
+	if on {
+		v = 1
+	}
+	atomic.StoreUint32(&r.opusAware, v)
+}
+
+// OpusAware report if the opus aware nack handling is on
+func (r *Router) OpusAware() bool {
+	return atomic.LoadUint32(&r.opusAware) == 1
+}
+
+// trackOpus remember pkt when it is opus and the router is opus aware
+func (r *Router) trackOpus(pkt *rtp.Packet) {
+	if r.OpusAware() && isOpus(pkt.PayloadType) {
+		r.opus.push(pkt)
+	}
+}
+
+// needsResend report if the nack of a sub for sn of the pub ssrc has to be
+// answered
+func (r *Router) needsResend(ssrc uint32, sn uint16) bool {
+	if !r.OpusAware() {
+		return true
+	}
+	return r.opus.needsResend(ssrc, sn)
+}
@@ -0,0 +1,117 @@
+package rtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+)
+
+func TestOpusHasFEC(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		fec     bool
+	}{
+		{"silk 20ms mono lbrr", []byte{1 << 3, 0xc0, 0}, true},
+		{"silk 20ms mono no lbrr", []byte{1 << 3, 0x80, 0}, false},
+		// vad, vad, lbrr
+		{"silk 40ms mono lbrr", []byte{2 << 3, 0x20, 0}, true},
+		{"silk 60ms mono vad only", []byte{3 << 3, 0xe0, 0}, false},
+		// mid vad, mid lbrr, side vad, side lbrr
+		{"silk 20ms stereo side lbrr", []byte{1<<3 | 0x4, 0x10, 0}, true},
+		{"hybrid 20ms lbrr", []byte{13 << 3, 0x40, 0}, true},
+		{"celt", []byte{16 << 3, 0xff, 0}, false},
+		{"code 3 packet", []byte{1<<3 | 0x3, 0xff, 0}, false},
+		{"dtx", []byte{1 << 3}, false},
+	}
+	for _, tt := range tests {
+		if fec := opusHasFEC(tt.payload); fec != tt.fec {
+			t.Errorf("%s: opusHasFEC=%v, want %v", tt.name, fec, tt.fec)
+		}
+	}
+}
+
+// sendOpus write a synthetic opus stream to pub: speech with fec, a dtx
+// gap, then celt speech which has no fec with packet 25 lost
+func sendOpus(pub *fakeTransport) int {
+	sent := 0
+	for sn := uint16(0); sn < 30; sn++ {
+		payload := []byte{1 << 3, 0xc0, 0x12, 0x34}
+		switch {
+		case sn >= 10 && sn < 20:
+			payload = []byte{1 << 3}
+		case sn == 25:
+			continue
+		case sn >= 20:
+			payload = []byte{16 << 3, 0x12, 0x34}
+		}
+		pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 5678, PayloadType: 111, SequenceNumber: sn}, Payload: payload}
+		sent++
+	}
+	return sent
+}
+
+func TestRouterOpusAwareNacks(t *testing.T) {
+	for _, aware := range []bool{true, false} {
+		InitRouter(RouterConfig{OpusAware: aware})
+		router := NewRouter("router")
+		pub := newFakeTransport("pub")
+		router.AddPub(pub)
+		sub := newFakeTransport("sub")
+		router.AddSub("sub", sub)
+
+		sent := sendOpus(pub)
+		testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= sent })
+
+		// a receiver nacking the dtx gap again and again, and a packet the
+		// next one carries the fec of
+		for i := 0; i < 5; i++ {
+			for sn := uint16(10); sn < 20; sn++ {
+				sub.rtcpCh <- &rtcp.TransportLayerNack{MediaSSRC: 5678, Nacks: []rtcp.NackPair{{PacketID: sn}}}
+			}
+		}
+		sub.rtcpCh <- &rtcp.TransportLayerNack{MediaSSRC: 5678, Nacks: []rtcp.NackPair{{PacketID: 5}}}
+		// the lost celt packet has to be resent
+		sub.rtcpCh <- &rtcp.TransportLayerNack{MediaSSRC: 5678, Nacks: []rtcp.NackPair{{PacketID: 25}}}
+
+		// the repeats of the dtx gap are nacked upstream once
+		want := 1
+		if !aware {
+			want = 12
+		}
+		testhelper.WaitFor(t, time.Second, func() bool { return len(sub.rtcpCh) == 0 && pub.writtenRTCPTotal() >= want })
+		time.Sleep(20 * time.Millisecond)
+		if total := pub.writtenRTCPTotal(); total != want {
+			t.Fatalf("aware=%v nacks to pub=%d, want %d", aware, total, want)
+		}
+		if aware {
+			pub.lock.Lock()
+			nack, ok := pub.writtenRTCP[0].(*rtcp.TransportLayerNack)
+			pub.lock.Unlock()
+			if !ok || nack.Nacks[0].PacketID != 25 {
+				t.Fatalf("pub got %+v, want the nack of 25", nack)
+			}
+		}
+		router.Close()
+	}
+	InitRouter(RouterConfig{})
+}
+
+func TestRouterSetOpusAware(t *testing.T) {
+	router := NewRouter("router")
+	if router.OpusAware() {
+		t.Fatal("opus aware by default")
+	}
+	router.SetOpusAware(true)
+	if !router.OpusAware() {
+		t.Fatal("SetOpusAware(true) not applied")
+	}
+	// a video nack is always answered
+	if !router.needsResend(1234, 1) {
+		t.Fatal("nack of an unknown ssrc dropped")
+	}
+}
@@ -0,0 +1,92 @@
+package rtc
+
+import (
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+	"github.com/pion/rtp"
+)
+
+const (
+	// the subs are paced faster than their target so the encoder of the
+	// pub isn't held back, like the pacer of webrtc
+	pacingFactor = 2.5
+	// target of a sub that sent no estimate yet, in bps
+	defaultPacingRate = 1000000
+)
+
+// pacer spaces the packets written to a sub, a leaky bucket draining at
+// rate bps. The packets of key frames are written at once, the ones after
+// them wait for them to drain.
+type pacer struct {
+	rate func() uint64
+	now  func() time.Time
+	// when the packets accounted so far are drained
+	drained time.Time
+	// timestamp of the key frame being written by ssrc
+	keyFrames map[uint32]uint32
+}
+
+func newPacer(rate func() uint64, now func() time.Time) *pacer {
+	return &pacer{rate: rate, now: now, keyFrames: make(map[uint32]uint32)}
+}
+
+// delay account pkt and return how long to wait before writing it
+func (p *pacer) delay(pkt *rtp.Packet) time.Duration {
+	if p == nil {
+		return 0
+	}
+	now := p.now()
+	if p.drained.Before(now) {
+		p.drained = now
+	}
+	wait := p.drained.Sub(now)
+	rate := float64(p.rate())
+	if rate <= 0 {
+		rate = defaultPacingRate * pacingFactor
+	}
+	p.drained = p.drained.Add(time.Duration(float64(pkt.MarshalSize()*8) / rate * float64(time.Second)))
+	if p.keyFrame(pkt) {
+		return 0
+	}
+	return wait
+}
+
+// keyFrame report if pkt is part of a key frame, only the first packet of
+// a frame tells it
+func (p *pacer) keyFrame(pkt *rtp.Packet) bool {
+	if transport.IsKeyFrame(pkt.PayloadType, pkt.Payload) {
+		p.keyFrames[pkt.SSRC] = pkt.Timestamp
+		return true
+	}
+	ts, ok := p.keyFrames[pkt.SSRC]
+	if ok && ts != pkt.Timestamp {
+		delete(p.keyFrames, pkt.SSRC)
+		return false
+	}
+	return ok
+}
+
+// subPacer return the pacer of sub id, nil when pacing is off. It paces at
+// pacingFactor times the last estimate of the sub, or PacingRate until it
+// sent one, and at most at the cap of the sub.
+func (r *Router) subPacer(id string, config RouterConfig) *pacer {
+	if !config.Pacing {
+		return nil
+	}
+	initial := config.PacingRate
+	if initial == 0 {
+		initial = defaultPacingRate
+	}
+	return newPacer(func() uint64 {
+		bitrate := r.SubBitrate(id)
+		if bitrate == 0 {
+			bitrate = initial
+		}
+		rate := uint64(float64(bitrate) * pacingFactor)
+		if max := r.SubMaxBitrate(id); max > 0 && rate > max {
+			return max
+		}
+		return rate
+	}, r.now)
+}
@@ -0,0 +1,84 @@
+package rtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+	"github.com/pion/rtp"
+)
+
+// pacedPkt return a vp8 packet of 1250 bytes, 10ms at 1Mbps
+func pacedPkt(ts uint32, first byte) *rtp.Packet {
+	payload := make([]byte, 1250-12)
+	payload[0], payload[1] = first, 0x01
+	return &rtp.Packet{Header: rtp.Header{Version: 2, SSRC: 1, PayloadType: 96, Timestamp: ts}, Payload: payload}
+}
+
+func TestPacerSpacing(t *testing.T) {
+	now := time.Now()
+	p := newPacer(func() uint64 { return 1000000 }, func() time.Time { return now })
+
+	// a burst of delta frame packets leaves 10ms apart
+	for i := 0; i < 5; i++ {
+		wait := p.delay(pacedPkt(1, 0x10))
+		if want := time.Duration(i) * 10 * time.Millisecond; wait != want {
+			t.Fatalf("packet %d wait=%v, want %v", i, wait, want)
+		}
+	}
+	// once drained the next packet goes at once
+	now = now.Add(100 * time.Millisecond)
+	if wait := p.delay(pacedPkt(2, 0x10)); wait != 0 {
+		t.Fatalf("wait=%v after the bucket drained", wait)
+	}
+
+	// the packets of a key frame skip the queue, the ones after them wait
+	// for them to drain
+	key := pacedPkt(3, 0x10)
+	key.Payload[1] = 0x00
+	for i, pkt := range []*rtp.Packet{key, pacedPkt(3, 0x00), pacedPkt(3, 0x00)} {
+		if wait := p.delay(pkt); wait != 0 {
+			t.Fatalf("key frame packet %d wait=%v", i, wait)
+		}
+	}
+	if wait := p.delay(pacedPkt(4, 0x10)); wait != 40*time.Millisecond {
+		t.Fatalf("wait=%v after the key frame, want 40ms", wait)
+	}
+}
+
+func TestRouterPacesSubs(t *testing.T) {
+	// 10 gaps of 10ms at 2.5 * 400kbps
+	if elapsed := pacedBurst(t, 0); elapsed < 100*time.Millisecond || elapsed > 300*time.Millisecond {
+		t.Fatalf("burst written in %v, want about 100ms", elapsed)
+	}
+	// 10 gaps of 20ms under a cap of 500kbps
+	if elapsed := pacedBurst(t, 500000); elapsed < 200*time.Millisecond || elapsed > 400*time.Millisecond {
+		t.Fatalf("burst written in %v under the cap, want about 200ms", elapsed)
+	}
+}
+
+// pacedBurst write 11 packets of 1250 bytes at once to a sub paced at
+// 400kbps capped at max and return how long they took to be written
+func pacedBurst(t *testing.T, max uint64) time.Duration {
+	InitRouter(RouterConfig{Pacing: true, PacingRate: 400000})
+	defer InitRouter(RouterConfig{})
+	router := NewRouter("router")
+	defer router.Close()
+	pub := transport.NewMemoryTransport("pub")
+	router.AddPub(pub)
+	sub := transport.NewMemoryTransport("sub")
+	router.AddSub(sub.ID(), sub)
+	router.SetSubMaxBitrate(sub.ID(), max)
+
+	start := time.Now()
+	for sn := uint16(0); sn < 11; sn++ {
+		pkt := pacedPkt(uint32(sn), 0x10)
+		pkt.SequenceNumber = sn
+		if err := pub.PushRTP(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testhelper.WaitFor(t, time.Second, func() bool { return len(sub.Written()) >= 11 })
+	return time.Since(start)
+}
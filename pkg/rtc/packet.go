@@ -0,0 +1,47 @@
+package rtc
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+	"github.com/pion/rtp"
+)
+
+var routedPool = sync.Pool{
+	New: func() interface{} {
+		return &routedPacket{}
+	},
+}
+
+// routedPacket is a packet queued to the subs, every queue holds a
+// reference and the last one released gives a pooled packet back to owner
+type routedPacket struct {
+	pkt   *rtp.Packet
+	owner transport.PooledTransport
+	refs  int32
+}
+
+// newRoutedPacket wrap pkt, owner is nil when pkt must not be given back
+func newRoutedPacket(pkt *rtp.Packet, owner transport.PooledTransport) *routedPacket {
+	p := routedPool.Get().(*routedPacket)
+	p.pkt = pkt
+	p.owner = owner
+	return p
+}
+
+func (p *routedPacket) hold() {
+	atomic.AddInt32(&p.refs, 1)
+}
+
+func (p *routedPacket) release() {
+	if atomic.AddInt32(&p.refs, -1) != 0 {
+		return
+	}
+	if p.owner != nil {
+		p.owner.ReleaseRTP(p.pkt)
+	}
+	p.pkt = nil
+	p.owner = nil
+	routedPool.Put(p)
+}
@@ -0,0 +1,163 @@
+package rtc
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+)
+
+// fakePooledTransport is a fakeTransport pub recording the packets given back
+type fakePooledTransport struct {
+	*fakeTransport
+	releaseLock sync.Mutex
+	released    []*rtp.Packet
+	// subs which must have written a packet before it is released
+	subs  []*fakeTransport
+	early int
+	pool  *sync.Pool
+}
+
+func newFakePooledTransport(id string) *fakePooledTransport {
+	return &fakePooledTransport{fakeTransport: newFakeTransport(id)}
+}
+
+func (f *fakePooledTransport) ReleaseRTP(pkt *rtp.Packet) {
+	if f.pool != nil {
+		f.pool.Put(pkt)
+		return
+	}
+	f.releaseLock.Lock()
+	defer f.releaseLock.Unlock()
+	for _, sub := range f.subs {
+		if !sub.wrote(pkt) {
+			f.early++
+		}
+	}
+	f.released = append(f.released, pkt)
+}
+
+func (f *fakePooledTransport) releasedTotal() int {
+	f.releaseLock.Lock()
+	defer f.releaseLock.Unlock()
+	return len(f.released)
+}
+
+func (f *fakeTransport) wrote(pkt *rtp.Packet) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, p := range f.written {
+		if p == pkt {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRouterReleasesPacketAfterAllSubs(t *testing.T) {
+	router := NewRouter("router")
+	pub := newFakePooledTransport("pub")
+	router.AddPub(pub)
+	defer router.Close()
+
+	// nobody to route to, the packet goes back right away
+	first := &rtp.Packet{Header: rtp.Header{SSRC: 1234, SequenceNumber: 1}}
+	pub.rtpCh <- first
+	testhelper.WaitFor(t, time.Second, func() bool { return pub.releasedTotal() == 1 })
+
+	var subs []*fakeTransport
+	for _, id := range []string{"sub1", "sub2", "sub3"} {
+		sub := newFakeTransport(id)
+		router.AddSub(id, sub)
+		subs = append(subs, sub)
+	}
+	slow := subs[2]
+	slow.writeStarted = make(chan struct{}, 1)
+	slow.writeBlock = make(chan struct{})
+	pub.releaseLock.Lock()
+	pub.subs = subs
+	pub.releaseLock.Unlock()
+
+	pkt := &rtp.Packet{Header: rtp.Header{SSRC: 1234, SequenceNumber: 2}}
+	pub.rtpCh <- pkt
+	<-slow.writeStarted
+	testhelper.WaitFor(t, time.Second, func() bool { return subs[0].writtenTotal() == 1 && subs[1].writtenTotal() == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if total := pub.releasedTotal(); total != 1 {
+		t.Fatalf("released=%d while a sub is writing, want 1", total)
+	}
+
+	close(slow.writeBlock)
+	testhelper.WaitFor(t, time.Second, func() bool { return pub.releasedTotal() == 2 })
+	pub.releaseLock.Lock()
+	defer pub.releaseLock.Unlock()
+	if pub.released[1] != pkt || pub.early != 0 {
+		t.Fatalf("released %v early=%d", pub.released[1], pub.early)
+	}
+}
+
+func TestRouterKeepsPacketsForSubHistory(t *testing.T) {
+	InitRouter(RouterConfig{SubNackBufferSize: 16})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakePooledTransport("pub")
+	router.AddPub(pub)
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	defer router.Close()
+
+	for i := 0; i < 5; i++ {
+		pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 1234, SequenceNumber: uint16(i)}}
+	}
+	testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= 5 })
+	time.Sleep(50 * time.Millisecond)
+	if total := pub.releasedTotal(); total != 0 {
+		t.Fatalf("released=%d packets kept for nacks", total)
+	}
+}
+
+func BenchmarkRouterPacketPool(b *testing.B) {
+	for _, pooled := range []bool{false, true} {
+		name := "unpooled"
+		if pooled {
+			name = "pooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			pool := &sync.Pool{New: func() interface{} {
+				return &rtp.Packet{Payload: make([]byte, 1200)}
+			}}
+			router := NewRouter("router")
+			router.OnClose(func() {})
+			pub := newFakePooledTransport("pub")
+			pub.pool = pool
+			if pooled {
+				router.AddPub(pub)
+			} else {
+				router.AddPub(pub.fakeTransport)
+			}
+			for _, id := range []string{"sub1", "sub2", "sub3", "sub4"} {
+				sub := newFakeTransport(id)
+				sub.discard = true
+				router.AddSub(id, sub)
+			}
+			defer router.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pkt := pool.Get().(*rtp.Packet)
+				pkt.SSRC = 1234
+				pkt.SequenceNumber = uint16(i)
+				pub.rtpCh <- pkt
+			}
+			for len(pub.rtpCh) > 0 {
+				runtime.Gosched()
+			}
+		})
+	}
+}
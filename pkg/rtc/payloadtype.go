@@ -0,0 +1,54 @@
+package rtc
+
+import (
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+)
+
+// payloadTypes map the payload types of the pub to the ones a sub
+// negotiated for the same codecs
+type payloadTypes struct {
+	// map[uint8]uint8, replaced as a whole
+	pts atomic.Value
+}
+
+// rewrite return pkt with the payload type of the sub, the payload is shared
+func (p *payloadTypes) rewrite(pkt *rtp.Packet) *rtp.Packet {
+	if p == nil {
+		return pkt
+	}
+	pts, _ := p.pts.Load().(map[uint8]uint8)
+	pt, found := pts[pkt.PayloadType]
+	if !found || pt == pkt.PayloadType {
+		return pkt
+	}
+	newPkt := *pkt
+	newPkt.PayloadType = pt
+	return &newPkt
+}
+
+// SetSubPayloadTypes set the payload type sub id negotiated for each
+// payload type of the pub, the packets of other payload types are written
+// as they are. It may be called before AddSub.
+func (r *Router) SetSubPayloadTypes(id string, pts map[uint8]uint8) {
+	r.logger.Infof("Router.SetSubPayloadTypes id=%s pts=%v", id, pts)
+	m := make(map[uint8]uint8, len(pts))
+	for pubPT, subPT := range pts {
+		m[pubPT] = subPT
+	}
+	r.subLock.Lock()
+	defer r.subLock.Unlock()
+	r.subPayloadTypes(id).pts.Store(m)
+}
+
+// subPayloadTypes return the payload types of sub id, created when missing,
+// subLock must be held
+func (r *Router) subPayloadTypes(id string) *payloadTypes {
+	p := r.subPTs[id]
+	if p == nil {
+		p = &payloadTypes{}
+		r.subPTs[id] = p
+	}
+	return p
+}
@@ -0,0 +1,55 @@
+package rtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+)
+
+func TestRouterRewritesSubPayloadTypes(t *testing.T) {
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	defer router.Close()
+
+	// the mapping can be set before the sub is added
+	router.SetSubPayloadTypes("sub", map[uint8]uint8{96: 120, 98: 121, 102: 97, 111: 109})
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	same := newFakeTransport("same")
+	router.AddSub("same", same)
+
+	pts := []uint8{96, 98, 102, 111, 100}
+	for i, pt := range pts {
+		pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: uint32(1000 + i), PayloadType: pt}}
+	}
+	testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= len(pts) && same.writtenTotal() >= len(pts) })
+
+	want := map[uint32]uint8{1000: 120, 1001: 121, 1002: 97, 1003: 109, 1004: 100}
+	sub.lock.Lock()
+	for _, pkt := range sub.written {
+		if pkt.PayloadType != want[pkt.SSRC] {
+			t.Errorf("ssrc %d written with pt %d, want %d", pkt.SSRC, pkt.PayloadType, want[pkt.SSRC])
+		}
+	}
+	sub.lock.Unlock()
+	// the packets of the pub are not changed for the other subs
+	same.lock.Lock()
+	for i, pkt := range same.written {
+		if pkt.PayloadType != pts[i] {
+			t.Errorf("ssrc %d written with pt %d to a sub without mapping, want %d", pkt.SSRC, pkt.PayloadType, pts[i])
+		}
+	}
+	same.lock.Unlock()
+
+	sub.Close()
+	router.subLock.RLock()
+	_, found := router.subPTs["sub"]
+	router.subLock.RUnlock()
+	if found {
+		t.Fatal("payload types of a removed sub kept")
+	}
+}
@@ -2,6 +2,8 @@ package plugins
 
 import (
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/pion/ion-sfu/pkg/log"
@@ -16,48 +18,54 @@ const (
 	// kProcessIntervalMs=20 ms
 	//https://chromium.googlesource.com/external/webrtc/+/ad34dbe934/webrtc/modules/video_coding/nack_module.cc#28
 
-	// vp8 vp9 h264 clock rate 90000Hz
-	videoClock = 90000
-
 	//1+16(FSN+BLP) https://tools.ietf.org/html/rfc2032#page-9
 	maxNackLostSize = 17
 
+	// a bigger gap is a stream restart, not loss
+	maxNackGap = 512
+
 	//default buffer time by ms
 	defaultBufferTime = 1000
-
-	tccExtMapID = 3
-	//64ms = 64000us = 250 << 8
-	//https://webrtc.googlesource.com/src/webrtc/+/f54860e9ef0b68e182a01edc994626d21961bc4b/modules/rtp_rtcp/source/rtcp_packet/transport_feedback.cc#41
-	baseScaleFactor = 64000
-	//https://webrtc.googlesource.com/src/webrtc/+/f54860e9ef0b68e182a01edc994626d21961bc4b/modules/rtp_rtcp/source/rtcp_packet/transport_feedback.cc#43
-	timeWrapPeriodUs = (int64(1) << 24) * baseScaleFactor
-
-	//experiment cycle
-	tccCycle = 10 * time.Millisecond
 )
 
-func tsDelta(x, y uint32) uint32 {
-	if x > y {
-		return x - y
-	}
-	return y - x
+// nackEntry is a missing packet waiting to be nacked
+type nackEntry struct {
+	retries  int
+	lastSent time.Time
 }
 
-type rtpExtInfo struct {
-	//transport sequence num
-	TSN       uint16
-	Timestamp int64
+// bufferedPkt is a packet in arrival order, used for eviction
+type bufferedPkt struct {
+	pkt     *rtp.Packet
+	arrival time.Time
+}
+
+// BufferStats counts the packets pushed to a buffer
+type BufferStats struct {
+	Received  uint64
+	Lost      uint64
+	Recovered uint64
+	Duplicate uint64
 }
 
 // Buffer contains all packets
 type Buffer struct {
-	pktBuffer   [maxSN]*rtp.Packet
-	lastNackSN  uint16
-	lastClearTS uint32
-	lastClearSN uint16
+	pktBuffer [maxSN]*rtp.Packet
+	// packets in arrival order, oldest first
+	arrivals []bufferedPkt
+	// packets currently in pktBuffer
+	occupancy int
+	pktLock   sync.Mutex
+	now       func() time.Time
 
 	// Last seqnum that has been added to buffer
 	lastPushSN uint16
+	started    bool
+
+	// missing packets by sequence number
+	nackPending map[uint16]*nackEntry
+	stats       BufferStats
+	nackLock    sync.Mutex
 
 	ssrc        uint32
 	payloadType uint8
@@ -71,163 +79,37 @@ type Buffer struct {
 
 	//calc bandwidth
 	totalByte uint64
+	// result of the last GetLostRateBandwidth
+	lastLostRate  float64
+	lastBandwidth uint64
 
 	//buffer time
-	maxBufferTS uint32
+	maxBufferTime time.Duration
 
 	stop bool
-
-	feedbackPacketCount uint8
-
-	rtpExtInfoChan chan rtpExtInfo
-	// lastTCCSN      uint16
-	// bufferStartTS time.Time
 }
 
+// BufferOptions defines parameters for a new Buffer
 type BufferOptions struct {
-	TCCOn      bool
 	BufferTime int
 }
 
 // NewBuffer constructs a new Buffer
 func NewBuffer(o BufferOptions) *Buffer {
 	b := &Buffer{
-		rtcpCh:         make(chan rtcp.Packet, maxPktSize),
-		rtpExtInfoChan: make(chan rtpExtInfo, maxPktSize),
-	}
-
-	if o.TCCOn {
-		b.calcTCCLoop()
+		rtcpCh:      make(chan rtcp.Packet, maxPktSize),
+		nackPending: make(map[uint16]*nackEntry),
+		now:         time.Now,
 	}
 
 	if o.BufferTime <= 0 {
 		o.BufferTime = defaultBufferTime
 	}
-	b.maxBufferTS = uint32(o.BufferTime) * videoClock / 1000
-	// b.bufferStartTS = time.Now()
+	b.maxBufferTime = time.Duration(o.BufferTime) * time.Millisecond
 	log.Infof("NewBuffer BufferOptions=%v", o)
 	return b
 }
 
-func (b *Buffer) calcTCCLoop() {
-	go func() {
-		t := time.NewTicker(tccCycle)
-		defer t.Stop()
-		for {
-			if b.stop {
-				return
-			}
-			<-t.C
-			b.calcTCC()
-		}
-	}()
-}
-
-func (b *Buffer) calcTCC() {
-	cap := len(b.rtpExtInfoChan)
-	if cap == 0 {
-		return
-	}
-
-	//get all rtp extension infos from channel
-	rtpExtInfo := make(map[uint16]int64)
-	for i := 0; i < cap; i++ {
-		info := <-b.rtpExtInfoChan
-		rtpExtInfo[info.TSN] = info.Timestamp
-	}
-
-	//find the min and max transport sn
-	var minTSN, maxTSN uint16
-	for tsn := range rtpExtInfo {
-
-		//init
-		if minTSN == 0 {
-			minTSN = tsn
-		}
-
-		if minTSN > tsn {
-			minTSN = tsn
-		}
-
-		if maxTSN < tsn {
-			maxTSN = tsn
-		}
-	}
-
-	//force small deta rtcp.RunLengthChunk
-	chunk := &rtcp.RunLengthChunk{
-		Type:               rtcp.TypeTCCRunLengthChunk,
-		PacketStatusSymbol: rtcp.TypeTCCPacketReceivedSmallDelta,
-		RunLength:          maxTSN - minTSN + 1,
-	}
-
-	//gather deltas
-	var recvDeltas []*rtcp.RecvDelta
-	var refTime uint32
-	var lastTS int64
-	var baseTimeTicks int64
-	for i := minTSN; i <= maxTSN; i++ {
-		ts, ok := rtpExtInfo[i]
-
-		//lost packet
-		if !ok {
-			recvDelta := &rtcp.RecvDelta{
-				Type: rtcp.TypeTCCPacketReceivedSmallDelta,
-			}
-			recvDeltas = append(recvDeltas, recvDelta)
-			continue
-		}
-
-		// init lastTS
-		if lastTS == 0 {
-			lastTS = ts
-		}
-
-		//received packet
-		if baseTimeTicks == 0 {
-			baseTimeTicks = (ts % timeWrapPeriodUs) / baseScaleFactor
-		}
-
-		var delta int64
-		if lastTS == ts {
-			delta = ts%timeWrapPeriodUs - baseTimeTicks*baseScaleFactor
-		} else {
-			delta = (ts - lastTS) % timeWrapPeriodUs
-		}
-
-		if refTime == 0 {
-			refTime = uint32(baseTimeTicks) & 0x007FFFFF
-		}
-
-		recvDelta := &rtcp.RecvDelta{
-			Type:  rtcp.TypeTCCPacketReceivedSmallDelta,
-			Delta: delta,
-		}
-		recvDeltas = append(recvDeltas, recvDelta)
-	}
-	rtcpTCC := &rtcp.TransportLayerCC{
-		Header: rtcp.Header{
-			Padding: false,
-			Count:   rtcp.FormatTCC,
-			Type:    rtcp.TypeTransportSpecificFeedback,
-			// Length:  5, //need calc
-		},
-		// SenderSSRC:         b.ssrc,
-		MediaSSRC:          b.ssrc,
-		BaseSequenceNumber: minTSN,
-		PacketStatusCount:  maxTSN - minTSN + 1,
-		ReferenceTime:      refTime,
-		FbPktCount:         b.feedbackPacketCount,
-		RecvDeltas:         recvDeltas,
-		PacketChunks:       []rtcp.PacketStatusChunk{chunk},
-	}
-	rtcpTCC.Header.Length = rtcpTCC.Len()/4 - 1
-	if !b.stop {
-		b.rtcpCh <- rtcpTCC
-		b.feedbackPacketCount++
-	}
-}
-
 // Push adds a RTP Packet, out of order, new packet may be arrived later
 func (b *Buffer) Push(p *rtp.Packet) {
 	b.receivedPkt++
@@ -239,109 +121,135 @@ func (b *Buffer) Push(p *rtp.Packet) {
 		b.payloadType = p.PayloadType
 	}
 
-	// init lastClearTS
-	if b.lastClearTS == 0 {
-		b.lastClearTS = p.Timestamp
+	now := b.now()
+	b.pktLock.Lock()
+	dup := b.pktBuffer[p.SequenceNumber] != nil
+	if !dup {
+		b.occupancy++
 	}
+	b.pktBuffer[p.SequenceNumber] = p
+	b.arrivals = append(b.arrivals, bufferedPkt{pkt: p, arrival: now})
+	// clear old packet by arrival time
+	b.evictOldPkt(now)
+	b.pktLock.Unlock()
+	b.trackSN(p.SequenceNumber, dup)
+}
 
-	// init lastClearSN
-	if b.lastClearSN == 0 {
-		b.lastClearSN = p.SequenceNumber
+// trackSN record the packets skipped before sn as missing, forget sn
+// if it was missing, and update the stats
+func (b *Buffer) trackSN(sn uint16, dup bool) {
+	b.nackLock.Lock()
+	defer b.nackLock.Unlock()
+	if dup {
+		b.stats.Duplicate++
+		return
 	}
-
-	// init lastNackSN
-	if b.lastNackSN == 0 {
-		b.lastNackSN = p.SequenceNumber
+	b.stats.Received++
+	if !b.started {
+		b.started = true
+		b.lastPushSN = sn
+		return
 	}
 
-	b.pktBuffer[p.SequenceNumber] = p
-	b.lastPushSN = p.SequenceNumber
-
-	//store arrival time
-	timestampUs := time.Now().UnixNano() / 1000
-	rtpTCC := rtp.TransportCCExtension{}
-	err := rtpTCC.Unmarshal(p.GetExtension(tccExtMapID))
-	if err == nil {
-		// if time.Now().Sub(b.bufferStartTS) > time.Second {
-
-		//only calc the packet which rtpTCC.TransportSequence > b.lastTCCSN
-		//https://webrtc.googlesource.com/src/webrtc/+/f54860e9ef0b68e182a01edc994626d21961bc4b/modules/rtp_rtcp/source/rtcp_packet/transport_feedback.cc#353
-		// if rtpTCC.TransportSequence > b.lastTCCSN {
-		b.rtpExtInfoChan <- rtpExtInfo{
-			TSN:       rtpTCC.TransportSequence,
-			Timestamp: timestampUs,
+	diff := sn - b.lastPushSN
+	if diff == 0 {
+		// the newest packet again, its slot was evicted
+		return
+	}
+	if diff >= maxSN/2 {
+		// retransmission, reordered or late packet, never a restart
+		if _, found := b.nackPending[sn]; found {
+			delete(b.nackPending, sn)
+			b.stats.Recovered++
 		}
-		// b.lastTCCSN = rtpTCC.TransportSequence
-		// }
+		return
 	}
-	// }
-
-	// clear old packet by timestamp
-	b.clearOldPkt(p.Timestamp, p.SequenceNumber)
-
-	// limit nack range
-	if b.lastPushSN-b.lastNackSN >= maxNackLostSize {
-		b.lastNackSN = b.lastPushSN - maxNackLostSize
+	if diff > maxNackGap {
+		// the stream restarted, the gap is not loss
+		b.nackPending = make(map[uint16]*nackEntry)
+		b.lastPushSN = sn
+		return
 	}
-
-	if b.lastPushSN-b.lastNackSN >= maxNackLostSize {
-		// calc [lastNackSN, lastpush-8] if has keyframe
-		nackPair, lostPkt := b.GetNackPair(b.pktBuffer, b.lastNackSN, b.lastPushSN)
-		b.lastNackSN = b.lastPushSN
-		// log.Infof("b.lastNackSN=%v, b.lastPushSN=%v, lostPkt=%v, nackPair=%v", b.lastNackSN, b.lastPushSN, lostPkt, nackPair)
-		if lostPkt > 0 {
-			b.lostPkt += lostPkt
-			nack := &rtcp.TransportLayerNack{
-				//origin ssrc
-				// SenderSSRC: b.ssrc,
-				MediaSSRC: b.ssrc,
-				Nacks: []rtcp.NackPair{
-					nackPair,
-				},
-			}
-			b.rtcpCh <- nack
+	for i := b.lastPushSN + 1; i != sn; i++ {
+		if _, found := b.nackPending[i]; !found {
+			b.nackPending[i] = &nackEntry{}
+			b.lostPkt++
+			b.stats.Lost++
 		}
 	}
+	b.lastPushSN = sn
+}
+
+// Stats return the packet counters since the buffer was created
+func (b *Buffer) Stats() BufferStats {
+	b.nackLock.Lock()
+	defer b.nackLock.Unlock()
+	return b.stats
 }
 
-// clearOldPkt clear old packet
-func (b *Buffer) clearOldPkt(pushPktTS uint32, pushPktSN uint16) {
-	clearTS := b.lastClearTS
-	clearSN := b.lastClearSN
-	// log.Infof("clearOldPkt pushPktTS=%d pushPktSN=%d     clearTS=%d  clearSN=%d ", pushPktTS, pushPktSN, clearTS, clearSN)
-	if tsDelta(pushPktTS, clearTS) >= b.maxBufferTS {
-		//pushPktSN will loop from 0 to 65535
-		if pushPktSN == 0 {
-			//make sure clear the old packet from 655xx to 65535
-			pushPktSN = maxSN - 1
+// GetNackPairs return the nack pairs for the missing packets due now.
+// A packet is nacked at most once per interval and maxRetries times in total.
+func (b *Buffer) GetNackPairs(now time.Time, interval time.Duration, maxRetries int) []rtcp.NackPair {
+	b.nackLock.Lock()
+	var sns []uint16
+	for sn, e := range b.nackPending {
+		if e.retries >= maxRetries {
+			delete(b.nackPending, sn)
+			continue
+		}
+		if !e.lastSent.IsZero() && now.Sub(e.lastSent) < interval {
+			continue
 		}
-		var skipCount int
-		for i := clearSN + 1; i <= pushPktSN; i++ {
-			if b.pktBuffer[i] == nil {
-				skipCount++
+		e.retries++
+		e.lastSent = now
+		sns = append(sns, sn)
+	}
+	last := b.lastPushSN
+	b.nackLock.Unlock()
+
+	if len(sns) == 0 {
+		return nil
+	}
+	// oldest first, sequence numbers may wrap
+	sort.Slice(sns, func(i, j int) bool {
+		return last-sns[i] > last-sns[j]
+	})
+
+	var pairs []rtcp.NackPair
+	for _, sn := range sns {
+		if n := len(pairs); n > 0 {
+			if d := sn - pairs[n-1].PacketID; d > 0 && d < maxNackLostSize {
+				pairs[n-1].LostPackets |= rtcp.PacketBitmap(1 << (d - 1))
 				continue
 			}
-			if tsDelta(pushPktTS, b.pktBuffer[i].Timestamp) >= b.maxBufferTS {
-				b.lastClearTS = b.pktBuffer[i].Timestamp
-				b.lastClearSN = i
-				b.pktBuffer[i] = nil
-			} else {
-				break
-			}
 		}
-		if skipCount > 0 {
-			log.Infof("b.pktBuffer nil count : %d", skipCount)
+		pairs = append(pairs, rtcp.NackPair{PacketID: sn})
+	}
+	return pairs
+}
+
+// evictOldPkt drop the packets buffered longer than maxBufferTime, pktLock must be held
+func (b *Buffer) evictOldPkt(now time.Time) {
+	n := 0
+	for ; n < len(b.arrivals); n++ {
+		a := b.arrivals[n]
+		if now.Sub(a.arrival) < b.maxBufferTime {
+			break
 		}
-		if pushPktSN == maxSN-1 {
-			b.lastClearSN = 0
-			b.lastNackSN = 0
+		// the slot may hold a newer packet with the same sequence number
+		if b.pktBuffer[a.pkt.SequenceNumber] == a.pkt {
+			b.pktBuffer[a.pkt.SequenceNumber] = nil
+			b.occupancy--
 		}
 	}
+	if n > 0 {
+		b.arrivals = b.arrivals[n:]
+	}
 }
 
 // FindPacket find packet from buffer
 func (b *Buffer) FindPacket(sn uint16) *rtp.Packet {
-	return b.pktBuffer[sn]
+	return b.GetPacket(sn)
 }
 
 // Stop buffer
@@ -352,9 +260,13 @@ func (b *Buffer) Stop() {
 }
 
 func (b *Buffer) clear() {
+	b.pktLock.Lock()
+	defer b.pktLock.Unlock()
 	for i := range b.pktBuffer {
 		b.pktBuffer[i] = nil
 	}
+	b.arrivals = nil
+	b.occupancy = 0
 }
 
 // GetPayloadType get payloadtype
@@ -364,7 +276,10 @@ func (b *Buffer) GetPayloadType() uint8 {
 
 // GetStat get status from buffer
 func (b *Buffer) GetStat() string {
-	out := fmt.Sprintf("buffer:[%d, %d] | lastNackSN:%d | lostRate:%.2f |\n", b.lastClearSN, b.lastPushSN, b.lastNackSN, float64(b.lostPkt)/float64(b.receivedPkt+b.lostPkt))
+	b.nackLock.Lock()
+	pending := len(b.nackPending)
+	b.nackLock.Unlock()
+	out := fmt.Sprintf("buffer:%d lastSN:%d | nackPending:%d | lostRate:%.2f |\n", b.GetOccupancy(), b.lastPushSN, pending, float64(b.lostPkt)/float64(b.receivedPkt+b.lostPkt))
 	return out
 }
 
@@ -430,10 +345,26 @@ func (b *Buffer) GetLostRateBandwidth(cycle uint64) (float64, uint64) {
 	byteRate := b.totalByte / cycle
 	log.Tracef("Buffer.CalcLostRateByteRate b.receivedPkt=%d b.lostPkt=%d   lostRate=%v byteRate=%v", b.receivedPkt, b.lostPkt, lostRate, byteRate)
 	b.receivedPkt, b.lostPkt, b.totalByte = 0, 0, 0
-	return lostRate, byteRate * 8 / 1000
+	b.lastLostRate, b.lastBandwidth = lostRate, byteRate*8/1000
+	return b.lastLostRate, b.lastBandwidth
+}
+
+// LastLostRateBandwidth return the lostRate and bandwidth of the last cycle
+func (b *Buffer) LastLostRateBandwidth() (float64, uint64) {
+	return b.lastLostRate, b.lastBandwidth
 }
 
-// GetPacket get packet by sequence number
+// GetPacket get packet by sequence number, nil if it was evicted
 func (b *Buffer) GetPacket(sn uint16) *rtp.Packet {
+	b.pktLock.Lock()
+	defer b.pktLock.Unlock()
+	b.evictOldPkt(b.now())
 	return b.pktBuffer[sn]
 }
+
+// GetOccupancy return how many packets are buffered
+func (b *Buffer) GetOccupancy() int {
+	b.pktLock.Lock()
+	defer b.pktLock.Unlock()
+	return b.occupancy
+}
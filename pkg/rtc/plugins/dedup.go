@@ -0,0 +1,130 @@
+package plugins
+
+import (
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+
+	"github.com/pion/ion-sfu/pkg/log"
+)
+
+const (
+	// sequence numbers remembered per ssrc, a power of two so the window
+	// stays aligned when the sequence numbers wrap
+	dedupWindow = 1024
+)
+
+// DedupConfig describes configuration parameters for the dedup plugin.
+type DedupConfig struct {
+	On bool `mapstructure:"on"`
+}
+
+// seqWindow remember which of the last dedupWindow sequence numbers of an
+// ssrc were seen
+type seqWindow struct {
+	started bool
+	highest uint16
+	seen    [dedupWindow / 64]uint64
+}
+
+func (w *seqWindow) bit(sn uint16) (int, uint64) {
+	i := int(sn % dedupWindow)
+	return i / 64, 1 << uint(i%64)
+}
+
+// add report if sn was seen already, and remember it otherwise. A packet
+// older than the window can't be told apart and passes.
+func (w *seqWindow) add(sn uint16) bool {
+	if !w.started {
+		w.started = true
+		w.highest = sn
+		word, mask := w.bit(sn)
+		w.seen[word] |= mask
+		return false
+	}
+	diff := int16(sn - w.highest)
+	if diff > 0 {
+		// forget the numbers the window moves past
+		if int(diff) >= dedupWindow {
+			w.seen = [dedupWindow / 64]uint64{}
+		} else {
+			for s := w.highest + 1; s != sn; s++ {
+				word, mask := w.bit(s)
+				w.seen[word] &^= mask
+			}
+		}
+		w.highest = sn
+	} else if -int(diff) >= dedupWindow {
+		return false
+	}
+	word, mask := w.bit(sn)
+	if diff <= 0 && w.seen[word]&mask != 0 {
+		return true
+	}
+	w.seen[word] |= mask
+	return false
+}
+
+// Dedup represents a Dedup plugin.
+// The Dedup plugin drops the packets whose sequence number of the same ssrc
+// passed it recently, e.g. a retransmission arriving after the original or
+// a packet duplicated by the network.
+type Dedup struct {
+	// accessed atomically
+	dropped uint64
+
+	id         string
+	stop       bool
+	outRTPChan chan *rtp.Packet
+	// only WriteRTP touches it
+	windows map[uint32]*seqWindow
+}
+
+// NewDedup create new Dedup
+func NewDedup(id string, config DedupConfig) *Dedup {
+	log.Infof("New Dedup Plugin with id %s", id)
+	return &Dedup{
+		id:         id,
+		outRTPChan: make(chan *rtp.Packet, maxSize),
+		windows:    make(map[uint32]*seqWindow),
+	}
+}
+
+// ID returns the configured Dedup ID.
+func (d *Dedup) ID() string {
+	return d.id
+}
+
+// WriteRTP pass the packet on unless it is a duplicate
+func (d *Dedup) WriteRTP(pkt *rtp.Packet) error {
+	if d.stop {
+		return nil
+	}
+	w := d.windows[pkt.SSRC]
+	if w == nil {
+		w = &seqWindow{}
+		d.windows[pkt.SSRC] = w
+	}
+	if w.add(pkt.SequenceNumber) {
+		atomic.AddUint64(&d.dropped, 1)
+		return nil
+	}
+	d.outRTPChan <- pkt
+	return nil
+}
+
+// ReadRTP can be used to read RTP packets written to the
+// Dedup plugin after processing.
+func (d *Dedup) ReadRTP() <-chan *rtp.Packet {
+	return d.outRTPChan
+}
+
+// Dropped return how many duplicates were dropped
+func (d *Dedup) Dropped() uint64 {
+	return atomic.LoadUint64(&d.dropped)
+}
+
+// Stop halts deduplication.
+func (d *Dedup) Stop() {
+	d.stop = true
+}
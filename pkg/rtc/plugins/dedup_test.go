@@ -0,0 +1,84 @@
+package plugins
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func TestSeqWindow(t *testing.T) {
+	w := &seqWindow{}
+	for _, c := range []struct {
+		sn  uint16
+		dup bool
+	}{
+		{65534, false},
+		{65535, false},
+		{65534, true},
+		// wraps around
+		{0, false},
+		{1, false},
+		{65535, true},
+		{1, true},
+		// late but not seen
+		{5, false},
+		{3, false},
+		{3, true},
+		// the window moves past the old numbers
+		{5 + dedupWindow, false},
+		{5, false},
+		{6 + dedupWindow, false},
+		{6 + dedupWindow, true},
+	} {
+		if dup := w.add(c.sn); dup != c.dup {
+			t.Fatalf("add(%d)=%v, want %v", c.sn, dup, c.dup)
+		}
+	}
+}
+
+func TestDedup(t *testing.T) {
+	d := NewDedup(TypeDedup, DedupConfig{On: true})
+	defer d.Stop()
+
+	send := []struct {
+		ssrc uint32
+		sn   uint16
+	}{
+		{1, 10}, {1, 11}, {1, 10}, {2, 10}, {1, 12}, {1, 11}, {2, 10}, {2, 11},
+	}
+	for _, s := range send {
+		if err := d.WriteRTP(&rtp.Packet{Header: rtp.Header{SSRC: s.ssrc, SequenceNumber: s.sn}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the first copy of each passes
+	for _, i := range []int{0, 1, 3, 4, 7} {
+		w := send[i]
+		pkt := <-d.ReadRTP()
+		if pkt.SSRC != w.ssrc || pkt.SequenceNumber != w.sn {
+			t.Fatalf("got ssrc=%d sn=%d, want ssrc=%d sn=%d", pkt.SSRC, pkt.SequenceNumber, w.ssrc, w.sn)
+		}
+	}
+	if len(d.ReadRTP()) != 0 {
+		t.Fatal("duplicate passed")
+	}
+	if d.Dropped() != 3 {
+		t.Fatalf("dropped=%d, want 3", d.Dropped())
+	}
+}
+
+func TestPluginChainDedup(t *testing.T) {
+	p := NewPluginChain("mid")
+	if err := p.Init(Config{On: true, Dedup: DedupConfig{On: true}}); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	dedup := p.GetPlugin(TypeDedup)
+	for i := 0; i < 2; i++ {
+		_ = dedup.WriteRTP(&rtp.Packet{Header: rtp.Header{SSRC: 1, SequenceNumber: 7}})
+	}
+	if pkt := p.ReadRTP(); pkt.SequenceNumber != 7 || p.DuplicatesDropped() != 1 {
+		t.Fatalf("sn=%d duplicates=%d, want 7 and 1", pkt.SequenceNumber, p.DuplicatesDropped())
+	}
+}
@@ -0,0 +1,102 @@
+package plugins
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/log"
+)
+
+// BufferDump is a snapshot of the packets of a buffer, for debugging
+type BufferDump struct {
+	SSRC        uint32
+	PayloadType uint8
+	// packets buffered
+	Occupancy int
+	// sequence numbers of the oldest and newest packets, and their rtp
+	// timestamps
+	FirstSN        uint16
+	LastSN         uint16
+	FirstTimestamp uint32
+	LastTimestamp  uint32
+	// arrival of the packets received first and last
+	OldestArrival time.Time
+	NewestArrival time.Time
+	// sequence numbers missing between FirstSN and LastSN
+	Gaps []uint16
+	// the marshaled packets from FirstSN to LastSN, when asked for
+	Packets [][]byte `json:",omitempty"`
+}
+
+// Dump return a snapshot of the buffer, with the packets if packets is set.
+// The packets are only copied under the lock, the pushes aren't held up
+// by the summary.
+func (b *Buffer) Dump(packets bool) BufferDump {
+	b.pktLock.Lock()
+	arrivals := make([]bufferedPkt, len(b.arrivals))
+	copy(arrivals, b.arrivals)
+	occupancy := b.occupancy
+	b.pktLock.Unlock()
+	b.nackLock.Lock()
+	last := b.lastPushSN
+	b.nackLock.Unlock()
+
+	dump := BufferDump{SSRC: b.ssrc, PayloadType: b.payloadType, Occupancy: occupancy}
+	if len(arrivals) == 0 {
+		return dump
+	}
+	dump.OldestArrival = arrivals[0].arrival
+	dump.NewestArrival = arrivals[len(arrivals)-1].arrival
+
+	// a duplicate replaced the packet arrived before with its sequence number
+	bySN := make(map[uint16]bufferedPkt, len(arrivals))
+	for _, a := range arrivals {
+		bySN[a.pkt.SequenceNumber] = a
+	}
+	sns := make([]uint16, 0, len(bySN))
+	for sn := range bySN {
+		sns = append(sns, sn)
+	}
+	// oldest first, sequence numbers may wrap
+	sort.Slice(sns, func(i, j int) bool {
+		return last-sns[i] > last-sns[j]
+	})
+	first, newest := bySN[sns[0]].pkt, bySN[sns[len(sns)-1]].pkt
+	dump.FirstSN, dump.LastSN = first.SequenceNumber, newest.SequenceNumber
+	dump.FirstTimestamp, dump.LastTimestamp = first.Timestamp, newest.Timestamp
+
+	for i := 1; i < len(sns); i++ {
+		// a stream restart, not loss
+		if sns[i]-sns[i-1] > maxNackGap {
+			continue
+		}
+		for sn := sns[i-1] + 1; sn != sns[i]; sn++ {
+			dump.Gaps = append(dump.Gaps, sn)
+		}
+	}
+	if packets {
+		for _, sn := range sns {
+			raw, err := bySN[sn].pkt.Marshal()
+			if err != nil {
+				log.Errorf("Buffer.Dump ssrc=%d sn=%d err=%v", b.ssrc, sn, err)
+				continue
+			}
+			dump.Packets = append(dump.Packets, raw)
+		}
+	}
+	return dump
+}
+
+// Dump return a snapshot of every buffer sorted by ssrc, with the packets
+// if packets is set
+func (j *JitterBuffer) Dump(packets bool) []BufferDump {
+	buffers := j.GetBuffers()
+	dumps := make([]BufferDump, 0, len(buffers))
+	for _, b := range buffers {
+		dumps = append(dumps, b.Dump(packets))
+	}
+	sort.Slice(dumps, func(i, k int) bool {
+		return dumps[i].SSRC < dumps[k].SSRC
+	})
+	return dumps
+}
@@ -3,6 +3,9 @@ package plugins
 import (
 	"errors"
 	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/ion-sfu/pkg/log"
@@ -16,29 +19,42 @@ const (
 	minBandwidth = 200
 	maxREMBCycle = 5
 	maxPLICycle  = 5
+
+	defaultNackInterval   = 20
+	defaultNackMaxRetries = 3
 )
 
 // JitterBufferConfig .
 type JitterBufferConfig struct {
-	On            bool `mapstructure:"on"`
-	TCCOn         bool `mapstructure:"tccon"`
-	REMBCycle     int  `mapstructure:"rembcycle"`
-	PLICycle      int  `mapstructure:"plicycle"`
-	MaxBandwidth  int  `mapstructure:"maxbandwidth"`
-	MaxBufferTime int  `mapstructure:"maxbuffertime"`
+	On             bool `mapstructure:"on"`
+	TCCOn          bool `mapstructure:"tccon"`
+	TCCExtID       int  `mapstructure:"tccextid"`
+	REMBCycle      int  `mapstructure:"rembcycle"`
+	PLICycle       int  `mapstructure:"plicycle"`
+	MaxBandwidth   int  `mapstructure:"maxbandwidth"`
+	MaxBufferTime  int  `mapstructure:"maxbuffertime"`
+	NackInterval   int  `mapstructure:"nackinterval"`
+	NackMaxRetries int  `mapstructure:"nackmaxretries"`
 }
 
-// JitterBuffer core buffer module
+// JitterBuffer core buffer module, each ssrc of the pub has its own buffer
+// tracking its sequence numbers, the losts of one stream are never nacked
+// or resent from another
 type JitterBuffer struct {
-	buffers   map[uint32]*Buffer
-	stop      bool
-	bandwidth uint64
-	lostRate  float64
+	buffers    map[uint32]*Buffer
+	bufferLock sync.RWMutex
+	// set by Stop, accessed atomically
+	stop uint32
+
+	keyFrames    map[uint32]*keyFrameCache
+	keyFrameLock sync.Mutex
 
 	id         string
 	config     JitterBufferConfig
-	Pub        transport.Transport
+	pub        transport.Transport
+	pubLock    sync.RWMutex
 	outRTPChan chan *rtp.Packet
+	twcc       *twccRecorder
 }
 
 // NewJitterBuffer return new JitterBuffer
@@ -46,11 +62,17 @@ func NewJitterBuffer(ID string, config JitterBufferConfig) *JitterBuffer {
 	j := &JitterBuffer{
 		id:         ID,
 		buffers:    make(map[uint32]*Buffer),
+		keyFrames:  make(map[uint32]*keyFrameCache),
 		outRTPChan: make(chan *rtp.Packet, maxSize),
 	}
 	j.Init(config)
+	if j.config.TCCOn {
+		j.twcc = newTWCCRecorder(time.Now())
+		j.twccLoop()
+	}
 	j.rembLoop()
 	j.pliLoop()
+	j.nackLoop()
 	return j
 }
 
@@ -70,6 +92,18 @@ func (j *JitterBuffer) Init(config JitterBufferConfig) {
 		j.config.MaxBandwidth = minBandwidth
 	}
 
+	if j.config.NackInterval <= 0 {
+		j.config.NackInterval = defaultNackInterval
+	}
+
+	if j.config.NackMaxRetries <= 0 {
+		j.config.NackMaxRetries = defaultNackMaxRetries
+	}
+
+	if j.config.TCCExtID <= 0 {
+		j.config.TCCExtID = defaultTCCExtID
+	}
+
 	log.Infof("JitterBuffer.Init ok  j.config=%v", j.config)
 }
 
@@ -78,17 +112,36 @@ func (j *JitterBuffer) ID() string {
 	return j.id
 }
 
-// AttachPub Attach pub stream
+// GetPub return the pub attached, nil before AttachPub
+func (j *JitterBuffer) GetPub() transport.Transport {
+	j.pubLock.RLock()
+	defer j.pubLock.RUnlock()
+	return j.pub
+}
+
+func (j *JitterBuffer) setPub(t transport.Transport) {
+	j.pubLock.Lock()
+	defer j.pubLock.Unlock()
+	j.pub = t
+}
+
+// AttachPub Attach pub stream, it is read until it closes or another pub is
+// attached
 func (j *JitterBuffer) AttachPub(t transport.Transport) {
-	j.Pub = t
+	j.setPub(t)
 	go func() {
 		for {
-			if j.stop {
+			// stop reading once another pub is attached
+			if j.stopped() || j.GetPub() != t {
 				return
 			}
-			pkt, err := j.Pub.ReadRTP()
+			pkt, err := t.ReadRTP()
 			if err != nil {
-				log.Errorf("AttachPub j.Pub.ReadRTP pkt=%+v", pkt)
+				if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) {
+					log.Infof("AttachPub pub %s closed err=%v", t.ID(), err)
+					return
+				}
+				log.Errorf("AttachPub pub.ReadRTP err=%v", err)
 				continue
 			}
 
@@ -101,27 +154,40 @@ func (j *JitterBuffer) AttachPub(t transport.Transport) {
 	}()
 }
 
-// AddBuffer add a buffer by ssrc
+// AddBuffer add a buffer by ssrc, the buffer of ssrc if it has one
 func (j *JitterBuffer) AddBuffer(ssrc uint32) *Buffer {
+	j.bufferLock.Lock()
+	if b := j.buffers[ssrc]; b != nil {
+		j.bufferLock.Unlock()
+		return b
+	}
 	log.Infof("JitterBuffer.AddBuffer ssrc=%d", ssrc)
 	o := BufferOptions{
-		TCCOn:      j.config.TCCOn,
 		BufferTime: j.config.MaxBufferTime,
 	}
 	b := NewBuffer(o)
 	j.buffers[ssrc] = b
+	j.bufferLock.Unlock()
 	j.rtcpLoop(b)
 	return b
 }
 
 // GetBuffer get a buffer by ssrc
 func (j *JitterBuffer) GetBuffer(ssrc uint32) *Buffer {
+	j.bufferLock.RLock()
+	defer j.bufferLock.RUnlock()
 	return j.buffers[ssrc]
 }
 
 // GetBuffers get all buffers
 func (j *JitterBuffer) GetBuffers() map[uint32]*Buffer {
-	return j.buffers
+	j.bufferLock.RLock()
+	defer j.bufferLock.RUnlock()
+	buffers := make(map[uint32]*Buffer, len(j.buffers))
+	for ssrc, b := range j.buffers {
+		buffers[ssrc] = b
+	}
+	return buffers
 }
 
 // WriteRTP push rtp packet which from pub
@@ -129,6 +195,14 @@ func (j *JitterBuffer) WriteRTP(pkt *rtp.Packet) error {
 	ssrc := pkt.SSRC
 	pt := pkt.PayloadType
 
+	// the transport-wide sequence numbers count the packets of every track
+	if j.twcc != nil {
+		var ext rtp.TransportCCExtension
+		if err := ext.Unmarshal(pkt.GetExtension(uint8(j.config.TCCExtID))); err == nil {
+			j.twcc.record(ssrc, ext.TransportSequence, time.Now())
+		}
+	}
+
 	// only video, because opus doesn't need nack, use fec: `a=fmtp:111 minptime=10;useinbandfec=1`
 	if transport.IsVideo(pt) {
 		buffer := j.GetBuffer(ssrc)
@@ -143,11 +217,44 @@ func (j *JitterBuffer) WriteRTP(pkt *rtp.Packet) error {
 		}
 
 		buffer.Push(pkt)
+		j.cacheKeyFrame(pkt)
 	}
 	j.outRTPChan <- pkt
 	return nil
 }
 
+// cacheKeyFrame collect pkt into the key frame cache of its ssrc
+func (j *JitterBuffer) cacheKeyFrame(pkt *rtp.Packet) {
+	j.keyFrameLock.Lock()
+	defer j.keyFrameLock.Unlock()
+	c := j.keyFrames[pkt.SSRC]
+	if c == nil {
+		c = &keyFrameCache{}
+		j.keyFrames[pkt.SSRC] = c
+	}
+	if c.push(pkt) {
+		log.Debugf("JitterBuffer.cacheKeyFrame ssrc=%d ts=%d packets=%d", pkt.SSRC, pkt.Timestamp, len(c.last))
+	}
+}
+
+// GetLastKeyframe return copies of the packets of the last complete key
+// frame of ssrc in sequence number order, nil if none was received
+func (j *JitterBuffer) GetLastKeyframe(ssrc uint32) []*rtp.Packet {
+	j.keyFrameLock.Lock()
+	defer j.keyFrameLock.Unlock()
+	c := j.keyFrames[ssrc]
+	if c == nil || len(c.last) == 0 {
+		return nil
+	}
+	frame := make([]*rtp.Packet, len(c.last))
+	for i, p := range c.last {
+		pkt := *p
+		pkt.Payload = append([]byte(nil), p.Payload...)
+		frame[i] = &pkt
+	}
+	return frame
+}
+
 // ReadRTP return the last packet
 func (j *JitterBuffer) ReadRTP() <-chan *rtp.Packet {
 	return j.outRTPChan
@@ -156,15 +263,16 @@ func (j *JitterBuffer) ReadRTP() <-chan *rtp.Packet {
 func (j *JitterBuffer) rtcpLoop(b *Buffer) {
 	go func() {
 		for pkt := range b.GetRTCPChan() {
-			if j.stop {
+			if j.stopped() {
 				return
 			}
-			if j.Pub == nil {
+			pub := j.GetPub()
+			if pub == nil {
 				continue
 			}
-			err := j.Pub.WriteRTCP(pkt)
+			err := pub.WriteRTCP(pkt)
 			if err != nil {
-				log.Errorf("JitterBuffer.rtcpLoop j.Pub.WriteRTCP err=%v", err)
+				log.Errorf("JitterBuffer.rtcpLoop pub.WriteRTCP err=%v", err)
 			}
 		}
 	}()
@@ -173,7 +281,7 @@ func (j *JitterBuffer) rtcpLoop(b *Buffer) {
 func (j *JitterBuffer) rembLoop() {
 	go func() {
 		for {
-			if j.stop {
+			if j.stopped() {
 				return
 			}
 
@@ -183,51 +291,78 @@ func (j *JitterBuffer) rembLoop() {
 			}
 
 			time.Sleep(time.Duration(j.config.REMBCycle) * time.Second)
-			for _, buffer := range j.GetBuffers() {
-				// only calc video recently
-				if !transport.IsVideo(buffer.GetPayloadType()) {
-					continue
-				}
-				j.lostRate, j.bandwidth = buffer.GetLostRateBandwidth(uint64(j.config.REMBCycle))
-				var bw uint64
-				if j.lostRate == 0 && j.bandwidth == 0 {
-					bw = uint64(j.config.MaxBandwidth)
-				} else if j.lostRate >= 0 && j.lostRate < 0.1 {
-					bw = uint64(j.bandwidth * 2)
-				} else {
-					bw = uint64(float64(j.bandwidth) * (1 - j.lostRate))
-				}
+			j.sendREMB()
+		}
+	}()
+}
 
-				if bw < minBandwidth {
-					bw = minBandwidth
-				}
+// feedback return the congestion control feedback of the pub, the one it
+// negotiated or transport-cc when tccon is set for the others
+func (j *JitterBuffer) feedback() string {
+	if t, ok := j.GetPub().(transport.FeedbackTransport); ok {
+		feedback := t.Feedback()
+		if feedback == transport.FeedbackTransportCC && j.twcc == nil {
+			return transport.FeedbackREMB
+		}
+		return feedback
+	}
+	if j.twcc != nil {
+		return transport.FeedbackTransportCC
+	}
+	return transport.FeedbackREMB
+}
 
-				if bw > uint64(j.config.MaxBandwidth) {
-					bw = uint64(j.config.MaxBandwidth)
-				}
+// sendREMB send the estimate of each video buffer to the pub
+func (j *JitterBuffer) sendREMB() {
+	pub := j.GetPub()
+	feedback := j.feedback()
+	if pub == nil || feedback == "" {
+		return
+	}
+	for _, buffer := range j.GetBuffers() {
+		// only calc video recently
+		if !transport.IsVideo(buffer.GetPayloadType()) {
+			continue
+		}
+		lostRate, bandwidth := buffer.GetLostRateBandwidth(uint64(j.config.REMBCycle))
+		var bw uint64
+		if feedback == transport.FeedbackTransportCC {
+			// the pub estimates the bandwidth from the transport-cc
+			// feedback, remb only caps it
+			bw = uint64(j.config.MaxBandwidth)
+		} else if lostRate == 0 && bandwidth == 0 {
+			bw = uint64(j.config.MaxBandwidth)
+		} else if lostRate >= 0 && lostRate < 0.1 {
+			bw = bandwidth * 2
+		} else {
+			bw = uint64(float64(bandwidth) * (1 - lostRate))
+		}
 
-				remb := &rtcp.ReceiverEstimatedMaximumBitrate{
-					SenderSSRC: buffer.GetSSRC(),
-					Bitrate:    bw * 1000,
-					SSRCs:      []uint32{buffer.GetSSRC()},
-				}
+		if bw < minBandwidth {
+			bw = minBandwidth
+		}
 
-				if j.Pub == nil {
-					continue
-				}
-				err := j.Pub.WriteRTCP(remb)
-				if err != nil {
-					log.Errorf("JitterBuffer.rembLoop j.Pub.WriteRTCP err=%v", err)
-				}
-			}
+		if bw > uint64(j.config.MaxBandwidth) {
+			bw = uint64(j.config.MaxBandwidth)
 		}
-	}()
+
+		remb := &rtcp.ReceiverEstimatedMaximumBitrate{
+			SenderSSRC: buffer.GetSSRC(),
+			Bitrate:    bw * 1000,
+			SSRCs:      []uint32{buffer.GetSSRC()},
+		}
+
+		err := pub.WriteRTCP(remb)
+		if err != nil {
+			log.Errorf("JitterBuffer.rembLoop pub.WriteRTCP err=%v", err)
+		}
+	}
 }
 
 func (j *JitterBuffer) pliLoop() {
 	go func() {
 		for {
-			if j.stop {
+			if j.stopped() {
 				return
 			}
 
@@ -239,13 +374,14 @@ func (j *JitterBuffer) pliLoop() {
 			for _, buffer := range j.GetBuffers() {
 				if transport.IsVideo(buffer.GetPayloadType()) {
 					pli := &rtcp.PictureLossIndication{SenderSSRC: buffer.GetSSRC(), MediaSSRC: buffer.GetSSRC()}
-					if j.Pub == nil {
+					pub := j.GetPub()
+					if pub == nil {
 						continue
 					}
 					// log.Infof("pliLoop send pli=%d pt=%v", buffer.GetSSRC(), buffer.GetPayloadType())
-					err := j.Pub.WriteRTCP(pli)
+					err := pub.WriteRTCP(pli)
 					if err != nil {
-						log.Errorf("JitterBuffer.pliLoop j.Pub.WriteRTCP err=%v", err)
+						log.Errorf("JitterBuffer.pliLoop pub.WriteRTCP err=%v", err)
 					}
 				}
 			}
@@ -253,32 +389,108 @@ func (j *JitterBuffer) pliLoop() {
 	}()
 }
 
+// nackLoop ask the pub to resend the packets missing from the buffers
+func (j *JitterBuffer) nackLoop() {
+	go func() {
+		interval := time.Duration(j.config.NackInterval) * time.Millisecond
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for now := range t.C {
+			if j.stopped() {
+				return
+			}
+			for _, buffer := range j.GetBuffers() {
+				pairs := buffer.GetNackPairs(now, interval, j.config.NackMaxRetries)
+				pub := j.GetPub()
+				if len(pairs) == 0 || pub == nil {
+					continue
+				}
+				nack := &rtcp.TransportLayerNack{
+					SenderSSRC: buffer.GetSSRC(),
+					MediaSSRC:  buffer.GetSSRC(),
+					Nacks:      pairs,
+				}
+				err := pub.WriteRTCP(nack)
+				if err != nil {
+					log.Errorf("JitterBuffer.nackLoop pub.WriteRTCP err=%v", err)
+				}
+			}
+		}
+	}()
+}
+
+// twccLoop send the transport-cc feedback of the packets received to the pub
+func (j *JitterBuffer) twccLoop() {
+	go func() {
+		t := time.NewTicker(tccCycle)
+		defer t.Stop()
+		for range t.C {
+			if j.stopped() {
+				return
+			}
+			j.sendTWCC()
+		}
+	}()
+}
+
+// sendTWCC send the transport-cc feedback to a pub which negotiated it
+func (j *JitterBuffer) sendTWCC() {
+	pub := j.GetPub()
+	if pub == nil || j.feedback() != transport.FeedbackTransportCC {
+		return
+	}
+	fb := j.twcc.feedback()
+	if fb == nil {
+		return
+	}
+	err := pub.WriteRTCP(fb)
+	if err != nil {
+		log.Errorf("JitterBuffer.twccLoop pub.WriteRTCP err=%v", err)
+	}
+}
+
 // GetPacket get packet from buffer
 func (j *JitterBuffer) GetPacket(ssrc uint32, sn uint16) *rtp.Packet {
-	buffer := j.buffers[ssrc]
+	buffer := j.GetBuffer(ssrc)
 	if buffer == nil {
 		return nil
 	}
 	return buffer.GetPacket(sn)
 }
 
+// stopped report if Stop was called, the loops return once it is
+func (j *JitterBuffer) stopped() bool {
+	return atomic.LoadUint32(&j.stop) == 1
+}
+
 // Stop stop all buffer
 func (j *JitterBuffer) Stop() {
-	if j.stop {
+	if !atomic.CompareAndSwapUint32(&j.stop, 0, 1) {
 		return
 	}
-	j.stop = true
+	j.bufferLock.Lock()
+	defer j.bufferLock.Unlock()
 	for _, buffer := range j.buffers {
 		buffer.Stop()
 	}
 	j.buffers = nil
 }
 
+// Stats return the packet counters of every buffer by ssrc
+func (j *JitterBuffer) Stats() map[uint32]BufferStats {
+	stats := make(map[uint32]BufferStats)
+	for ssrc, buffer := range j.GetBuffers() {
+		stats[ssrc] = buffer.Stats()
+	}
+	return stats
+}
+
 // Stat get stat from buffers
 func (j *JitterBuffer) Stat() string {
 	out := ""
-	for ssrc, buffer := range j.buffers {
-		out += fmt.Sprintf("ssrc:%d payload:%d | lostRate:%.2f | bandwidth:%dkbps | %s", ssrc, buffer.GetPayloadType(), j.lostRate, j.bandwidth, buffer.GetStat())
+	for ssrc, buffer := range j.GetBuffers() {
+		lostRate, bandwidth := buffer.LastLostRateBandwidth()
+		out += fmt.Sprintf("ssrc:%d payload:%d | lostRate:%.2f | bandwidth:%dkbps | %s", ssrc, buffer.GetPayloadType(), lostRate, bandwidth, buffer.GetStat())
 	}
 	return out
 }
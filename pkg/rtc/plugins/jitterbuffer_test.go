@@ -0,0 +1,432 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+)
+
+// fakeTransport records what a plugin writes to a transport
+type fakeTransport struct {
+	lock      sync.Mutex
+	rtp       []*rtp.Packet
+	rtcp      []rtcp.Packet
+	writeCh   chan struct{}
+	failWrite bool
+	closed    bool
+}
+
+func (f *fakeTransport) ID() string                        { return "fake" }
+func (f *fakeTransport) Type() int                         { return -1 }
+func (f *fakeTransport) ReadRTP() (*rtp.Packet, error)     { select {} }
+func (f *fakeTransport) GetRTCPChan() chan rtcp.Packet     { return nil }
+func (f *fakeTransport) OnClose(func())                    {}
+func (f *fakeTransport) OnConnectionStateChange(func(int)) {}
+func (f *fakeTransport) WriteErrTotal() int                { return 0 }
+func (f *fakeTransport) WriteErrReset()                    {}
+func (f *fakeTransport) GetBandwidth() uint32              { return 0 }
+
+func (f *fakeTransport) WriteRTP(pkt *rtp.Packet) error {
+	if f.writeCh != nil {
+		<-f.writeCh
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.failWrite {
+		return errors.New("fake write error")
+	}
+	f.rtp = append(f.rtp, pkt)
+	return nil
+}
+
+func (f *fakeTransport) Close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+}
+
+func (f *fakeTransport) WriteRTCP(pkt rtcp.Packet) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.rtcp = append(f.rtcp, pkt)
+	return nil
+}
+
+func (f *fakeTransport) written() []*rtp.Packet {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]*rtp.Packet(nil), f.rtp...)
+}
+
+func (f *fakeTransport) nacks() []*rtcp.TransportLayerNack {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var nacks []*rtcp.TransportLayerNack
+	for _, pkt := range f.rtcp {
+		if nack, ok := pkt.(*rtcp.TransportLayerNack); ok {
+			nacks = append(nacks, nack)
+		}
+	}
+	return nacks
+}
+
+func videoPkt(sn uint16) *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: sn, Timestamp: uint32(sn) * 3000}}
+}
+
+func TestJitterBufferNack(t *testing.T) {
+	j := NewJitterBuffer("jb", JitterBufferConfig{On: true, NackInterval: 10, NackMaxRetries: 2})
+	defer j.Stop()
+	pub := &fakeTransport{}
+	j.setPub(pub)
+
+	// 3, 4 and 6 are lost
+	for _, sn := range []uint16{1, 2, 5, 7} {
+		if err := j.WriteRTP(videoPkt(sn)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testhelper.WaitFor(t, time.Second, func() bool { return len(pub.nacks()) != 0 })
+	nack := pub.nacks()[0]
+	if nack.MediaSSRC != 1234 {
+		t.Fatalf("MediaSSRC=%d, want 1234", nack.MediaSSRC)
+	}
+	if len(nack.Nacks) != 1 {
+		t.Fatalf("nacks=%+v, want one pair", nack.Nacks)
+	}
+	// 3 plus bits for 4 and 6
+	if pair := nack.Nacks[0]; pair.PacketID != 3 || pair.LostPackets != 0x5 {
+		t.Fatalf("pair=%+v, want PacketID=3 LostPackets=0x5", pair)
+	}
+
+	// each packet is nacked at most NackMaxRetries times
+	time.Sleep(100 * time.Millisecond)
+	if n := len(pub.nacks()); n != 2 {
+		t.Fatalf("nacks sent=%d, want 2", n)
+	}
+}
+
+func TestJitterBufferNackRecovered(t *testing.T) {
+	b := NewBuffer(BufferOptions{})
+	defer b.Stop()
+	for _, sn := range []uint16{65534, 1, 0} {
+		b.Push(videoPkt(sn))
+	}
+	// 65535 is missing across the wraparound, 0 arrived late
+	pairs := b.GetNackPairs(time.Now(), time.Second, 3)
+	if len(pairs) != 1 || pairs[0].PacketID != 65535 || pairs[0].LostPackets != 0 {
+		t.Fatalf("pairs=%+v, want only 65535", pairs)
+	}
+	// already nacked within the interval
+	if pairs := b.GetNackPairs(time.Now(), time.Second, 3); len(pairs) != 0 {
+		t.Fatalf("pairs=%+v, want none", pairs)
+	}
+	b.Push(videoPkt(65535))
+	if pairs := b.GetNackPairs(time.Now().Add(2*time.Second), time.Second, 3); len(pairs) != 0 {
+		t.Fatalf("pairs=%+v, want none once recovered", pairs)
+	}
+}
+
+// closedTransport is a pub whose reads fail as once it closed
+type closedTransport struct {
+	*fakeTransport
+	reads int32
+}
+
+func (c *closedTransport) ReadRTP() (*rtp.Packet, error) {
+	atomic.AddInt32(&c.reads, 1)
+	return nil, io.EOF
+}
+
+func TestJitterBufferClosedPub(t *testing.T) {
+	j := NewJitterBuffer("jb", JitterBufferConfig{On: true})
+	defer j.Stop()
+	pub := &closedTransport{fakeTransport: &fakeTransport{}}
+	j.AttachPub(pub)
+	if j.GetPub() != pub {
+		t.Fatal("pub not attached")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if reads := atomic.LoadInt32(&pub.reads); reads != 1 {
+		t.Fatalf("reads=%d, want the reader to stop at the first eof", reads)
+	}
+}
+
+func TestBufferMaxBufferTime(t *testing.T) {
+	b := NewBuffer(BufferOptions{BufferTime: 1000})
+	defer b.Stop()
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	for sn := uint16(0); sn < 10; sn++ {
+		b.Push(videoPkt(sn))
+	}
+	if n := b.GetOccupancy(); n != 10 {
+		t.Fatalf("occupancy=%d, want 10", n)
+	}
+
+	now = now.Add(600 * time.Millisecond)
+	for sn := uint16(10); sn < 15; sn++ {
+		b.Push(videoPkt(sn))
+	}
+	// the first packets are past MaxBufferTime now
+	now = now.Add(500 * time.Millisecond)
+	for sn := uint16(0); sn < 10; sn++ {
+		if pkt := b.GetPacket(sn); pkt != nil {
+			t.Fatalf("sn=%d still buffered", sn)
+		}
+	}
+	for sn := uint16(10); sn < 15; sn++ {
+		if pkt := b.GetPacket(sn); pkt == nil {
+			t.Fatalf("sn=%d evicted too early", sn)
+		}
+	}
+	if n := b.GetOccupancy(); n != 5 {
+		t.Fatalf("occupancy=%d, want 5", n)
+	}
+}
+
+func TestBufferStats(t *testing.T) {
+	b := NewBuffer(BufferOptions{})
+	defer b.Stop()
+
+	// 65535 and 2 are lost, 65535 is resent, 1 arrives twice
+	for _, sn := range []uint16{65533, 65534, 0, 1, 1, 3, 65535} {
+		b.Push(videoPkt(sn))
+	}
+	want := BufferStats{Received: 6, Lost: 2, Recovered: 1, Duplicate: 1}
+	if stats := b.Stats(); stats != want {
+		t.Fatalf("stats=%+v, want %+v", stats, want)
+	}
+
+	// a stream restart is not loss
+	b.Push(videoPkt(30000))
+	b.Push(videoPkt(30001))
+	want.Received += 2
+	if stats := b.Stats(); stats != want {
+		t.Fatalf("stats=%+v after restart, want %+v", stats, want)
+	}
+}
+
+func TestBufferTrackSNLate(t *testing.T) {
+	b := NewBuffer(BufferOptions{})
+	defer b.Stop()
+
+	// 2 is lost
+	for _, sn := range []uint16{1000, 1001, 1003} {
+		b.trackSN(sn, false)
+	}
+	// the newest packet again once evicted, then one far behind
+	b.trackSN(1003, false)
+	b.trackSN(1003-maxNackGap-100, false)
+
+	stats := b.Stats()
+	if stats.Lost != 1 || b.lastPushSN != 1003 {
+		t.Fatalf("stats=%+v last=%d, want 1 lost and 1003 the newest", stats, b.lastPushSN)
+	}
+	if _, found := b.nackPending[1002]; !found || len(b.nackPending) != 1 {
+		t.Fatalf("pending nacks %v, want 1002", b.nackPending)
+	}
+}
+
+func TestJitterBufferStats(t *testing.T) {
+	j := NewJitterBuffer("jb", JitterBufferConfig{On: true})
+	defer j.Stop()
+	for _, sn := range []uint16{1, 2, 4} {
+		if err := j.WriteRTP(videoPkt(sn)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := j.Stats()[1234]
+	if stats.Received != 3 || stats.Lost != 1 {
+		t.Fatalf("stats=%+v, want 3 received 1 lost", stats)
+	}
+}
+
+func TestJitterBufferSSRCIsolation(t *testing.T) {
+	j := NewJitterBuffer("jb", JitterBufferConfig{On: true})
+	defer j.Stop()
+	// two video streams with overlapping sequence numbers, 2 of the second
+	// is lost, and audio which isn't buffered
+	write := []*rtp.Packet{
+		{Header: rtp.Header{SSRC: 1111, PayloadType: 96, SequenceNumber: 1}, Payload: []byte{1}},
+		{Header: rtp.Header{SSRC: 2222, PayloadType: 96, SequenceNumber: 1}, Payload: []byte{2}},
+		{Header: rtp.Header{SSRC: 1111, PayloadType: 96, SequenceNumber: 2}, Payload: []byte{1}},
+		{Header: rtp.Header{SSRC: 3333, PayloadType: 111, SequenceNumber: 900}, Payload: []byte{3}},
+		{Header: rtp.Header{SSRC: 2222, PayloadType: 96, SequenceNumber: 3}, Payload: []byte{2}},
+		{Header: rtp.Header{SSRC: 1111, PayloadType: 96, SequenceNumber: 3}, Payload: []byte{1}},
+	}
+	for _, pkt := range write {
+		if err := j.WriteRTP(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, sn := range []uint16{1, 2, 3} {
+		if pkt := j.GetPacket(1111, sn); pkt == nil || pkt.SSRC != 1111 || pkt.Payload[0] != 1 {
+			t.Fatalf("GetPacket(1111, %d)=%v", sn, pkt)
+		}
+	}
+	for _, sn := range []uint16{1, 3} {
+		if pkt := j.GetPacket(2222, sn); pkt == nil || pkt.SSRC != 2222 || pkt.Payload[0] != 2 {
+			t.Fatalf("GetPacket(2222, %d)=%v", sn, pkt)
+		}
+	}
+	if pkt := j.GetPacket(2222, 2); pkt != nil {
+		t.Fatalf("GetPacket(2222, 2)=%v, want the packet of 1111 not returned", pkt)
+	}
+	if pkt := j.GetPacket(3333, 900); pkt != nil {
+		t.Fatal("audio buffered")
+	}
+
+	// the gaps are per ssrc, the audio sn jump is no loss of the video
+	stats := j.Stats()
+	if s := stats[1111]; s.Received != 3 || s.Lost != 0 {
+		t.Fatalf("stats of 1111=%+v, want 3 received none lost", s)
+	}
+	if s := stats[2222]; s.Received != 2 || s.Lost != 1 {
+		t.Fatalf("stats of 2222=%+v, want 2 received 1 lost", s)
+	}
+	if pairs := j.GetBuffer(2222).GetNackPairs(time.Now(), time.Second, 3); len(pairs) != 1 || pairs[0].PacketID != 2 {
+		t.Fatalf("nacks of 2222=%+v, want 2", pairs)
+	}
+	if pairs := j.GetBuffer(1111).GetNackPairs(time.Now(), time.Second, 3); len(pairs) != 0 {
+		t.Fatalf("nacks of 1111=%+v, want none", pairs)
+	}
+}
+
+func TestCheckPluginsCycles(t *testing.T) {
+	if err := CheckPlugins(Config{JitterBuffer: JitterBufferConfig{On: true, REMBCycle: -1}}); err != errInvalidCycle {
+		t.Fatalf("err=%v, want errInvalidCycle", err)
+	}
+	if err := CheckPlugins(Config{JitterBuffer: JitterBufferConfig{On: true, PLICycle: 1}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJitterBufferLastKeyframe(t *testing.T) {
+	j := NewJitterBuffer("jb", JitterBufferConfig{On: true})
+	defer j.Stop()
+	vp8 := func(sn uint16, ts uint32, marker bool, payload ...byte) *rtp.Packet {
+		return &rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: sn, Timestamp: ts, Marker: marker}, Payload: payload}
+	}
+	h264 := func(sn uint16, ts uint32, marker bool, payload ...byte) *rtp.Packet {
+		return &rtp.Packet{Header: rtp.Header{SSRC: 5678, PayloadType: 102, SequenceNumber: sn, Timestamp: ts, Marker: marker}, Payload: payload}
+	}
+	write := []*rtp.Packet{
+		// a vp8 key frame in 3 packets out of order, then a delta frame
+		vp8(10, 3000, false, 0x10, 0x00, 0x9d),
+		vp8(12, 3000, true, 0x00, 0x03),
+		vp8(11, 3000, false, 0x00, 0x02),
+		vp8(13, 6000, true, 0x10, 0x01),
+		// the next key frame lost its middle packet, it doesn't replace the
+		// last complete one
+		vp8(14, 9000, false, 0x10, 0x00, 0x9d),
+		vp8(16, 9000, true, 0x00, 0x04),
+		vp8(17, 12000, true, 0x10, 0x01),
+		// a h264 idr in fu-a fragments across the sequence number wrap
+		h264(65535, 3000, false, 0x7c, 0x85),
+		h264(0, 3000, false, 0x7c, 0x05),
+		h264(1, 3000, true, 0x7c, 0x45),
+		h264(2, 6000, true, 0x41, 0x9a),
+	}
+	for _, pkt := range write {
+		if err := j.WriteRTP(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(ssrc uint32, sns ...uint16) {
+		frame := j.GetLastKeyframe(ssrc)
+		if len(frame) != len(sns) {
+			t.Fatalf("key frame of %d has %d packets, want %d", ssrc, len(frame), len(sns))
+		}
+		for i, pkt := range frame {
+			if pkt.SSRC != ssrc || pkt.SequenceNumber != sns[i] || pkt.Timestamp != 3000 {
+				t.Fatalf("packet %d of %d: %+v, want sn %d", i, ssrc, pkt.Header, sns[i])
+			}
+		}
+		if !frame[len(frame)-1].Marker {
+			t.Fatalf("key frame of %d doesn't end with the marker", ssrc)
+		}
+	}
+	check(1234, 10, 11, 12)
+	check(5678, 65535, 0, 1)
+
+	// the cached packets are copies, a sub rewriting them can't corrupt
+	// the cache
+	frame := j.GetLastKeyframe(1234)
+	frame[0].SequenceNumber = 99
+	frame[0].Payload[2] = 0
+	if again := j.GetLastKeyframe(1234); again[0].SequenceNumber != 10 || again[0].Payload[2] != 0x9d {
+		t.Fatal("cache changed through a returned packet")
+	}
+	if frame := j.GetLastKeyframe(4321); frame != nil {
+		t.Fatalf("key frame of an unknown ssrc %v", frame)
+	}
+}
+
+func TestJitterBufferDump(t *testing.T) {
+	j := NewJitterBuffer("jb", JitterBufferConfig{On: true})
+	defer j.Stop()
+	start := time.Now()
+	// 12, 15 and 16 are lost and 11 is received twice, the other stream
+	// wraps around and lost 0
+	for _, sn := range []uint16{10, 11, 13, 11, 14, 17} {
+		if err := j.WriteRTP(videoPkt(sn)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, sn := range []uint16{65534, 65535, 1} {
+		if err := j.WriteRTP(&rtp.Packet{Header: rtp.Header{SSRC: 1000, PayloadType: 96, SequenceNumber: sn, Timestamp: 90000}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dumps := j.Dump(false)
+	if len(dumps) != 2 || dumps[0].SSRC != 1000 || dumps[1].SSRC != 1234 {
+		t.Fatalf("dumps %+v, want 1000 then 1234", dumps)
+	}
+	wrapped, d := dumps[0], dumps[1]
+	if wrapped.FirstSN != 65534 || wrapped.LastSN != 1 || len(wrapped.Gaps) != 1 || wrapped.Gaps[0] != 0 {
+		t.Fatalf("dump %+v, want 65534 to 1 missing 0", wrapped)
+	}
+	if d.PayloadType != 96 || d.Occupancy != 5 || d.FirstSN != 10 || d.LastSN != 17 {
+		t.Fatalf("dump %+v, want 5 packets from 10 to 17", d)
+	}
+	if d.FirstTimestamp != 10*3000 || d.LastTimestamp != 17*3000 {
+		t.Fatalf("timestamps %d %d, want the ones of 10 and 17", d.FirstTimestamp, d.LastTimestamp)
+	}
+	if d.OldestArrival.Before(start) || d.NewestArrival.Before(d.OldestArrival) || d.NewestArrival.After(time.Now()) {
+		t.Fatalf("arrivals %v %v", d.OldestArrival, d.NewestArrival)
+	}
+	if len(d.Gaps) != 3 || d.Gaps[0] != 12 || d.Gaps[1] != 15 || d.Gaps[2] != 16 {
+		t.Fatalf("gaps %v, want 12 15 16", d.Gaps)
+	}
+	if d.Packets != nil {
+		t.Fatal("packets dumped when not asked")
+	}
+
+	d = j.Dump(true)[1]
+	var sns []uint16
+	for _, raw := range d.Packets {
+		var pkt rtp.Packet
+		if err := pkt.Unmarshal(raw); err != nil {
+			t.Fatal(err)
+		}
+		sns = append(sns, pkt.SequenceNumber)
+	}
+	if fmt.Sprint(sns) != "[10 11 13 14 17]" {
+		t.Fatalf("packets %v, want 10 11 13 14 17", sns)
+	}
+}
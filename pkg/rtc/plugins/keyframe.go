@@ -0,0 +1,76 @@
+package plugins
+
+import (
+	"sort"
+
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+	"github.com/pion/rtp"
+)
+
+// keyFrameCache keep the last complete key frame of a video ssrc. The
+// packets of the frame being received are collected by timestamp, they
+// make a key frame once the first one starts a key frame, the last one has
+// the marker bit and no sequence number is missing between them.
+type keyFrameCache struct {
+	// packets of the frame being received
+	ts      uint32
+	pending []*rtp.Packet
+	// last complete key frame in sequence number order
+	last []*rtp.Packet
+}
+
+// push pkt, report if it completed a key frame
+func (c *keyFrameCache) push(pkt *rtp.Packet) bool {
+	if len(c.pending) == 0 || pkt.Timestamp != c.ts {
+		// a new frame, the packets still missing of the last one are lost
+		c.ts = pkt.Timestamp
+		c.pending = c.pending[:0]
+	}
+	for _, p := range c.pending {
+		if p.SequenceNumber == pkt.SequenceNumber {
+			return false
+		}
+	}
+	c.pending = append(c.pending, pkt)
+
+	// the packets may arrive out of order, the frame starts at the first
+	// packet starting a key frame
+	first := -1
+	end := -1
+	for i, p := range c.pending {
+		if transport.IsKeyFrame(p.PayloadType, p.Payload) && (first < 0 || seqBefore(p.SequenceNumber, c.pending[first].SequenceNumber)) {
+			first = i
+		}
+		if p.Marker {
+			end = i
+		}
+	}
+	if first < 0 || end < 0 {
+		return false
+	}
+	span := int(c.pending[end].SequenceNumber-c.pending[first].SequenceNumber) + 1
+	if span > len(c.pending) {
+		return false
+	}
+	start := c.pending[first].SequenceNumber
+	frame := make([]*rtp.Packet, 0, span)
+	for _, p := range c.pending {
+		if offset := int(p.SequenceNumber - start); offset < span {
+			frame = append(frame, p)
+		}
+	}
+	if len(frame) != span {
+		return false
+	}
+	sort.Slice(frame, func(i, j int) bool {
+		return seqBefore(frame[i].SequenceNumber, frame[j].SequenceNumber)
+	})
+	c.last = frame
+	c.pending = c.pending[:0]
+	return true
+}
+
+// seqBefore report if sequence number a comes before b, with wrap around
+func seqBefore(a, b uint16) bool {
+	return a != b && b-a < 0x8000
+}
@@ -0,0 +1,137 @@
+package plugins
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+
+	"github.com/pion/ion-sfu/pkg/log"
+)
+
+// LossSimulatorConfig describes configuration parameters for the loss
+// simulator plugin, for testing how clients cope with a bad network.
+type LossSimulatorConfig struct {
+	On bool `mapstructure:"on"`
+	// must be set too, the plugin breaks the streams on purpose and must
+	// not run in production by accident
+	Testing bool `mapstructure:"testing"`
+	// percent of the packets dropped at random
+	Loss float64 `mapstructure:"loss"`
+	// indexes of the packets of each ssrc dropped, counting from 0,
+	// repeated every Period packets when Period > 0
+	Drops  []int `mapstructure:"drops"`
+	Period int   `mapstructure:"period"`
+	// ms every packet is delayed, plus up to Jitter ms at random
+	Delay  int `mapstructure:"delay"`
+	Jitter int `mapstructure:"jitter"`
+	// seed of the random drops and jitter, the same seed drops the same
+	// packets. 0 seeds from the clock
+	Seed int64 `mapstructure:"seed"`
+}
+
+// LossSimulator represents a LossSimulator plugin.
+// The LossSimulator plugin drops and delays the packets of the pub before
+// the subs get them, the plugins before it and the jitter buffer see them
+// all so the nacks of the subs are answered.
+type LossSimulator struct {
+	// accessed atomically
+	dropped uint64
+
+	id         string
+	config     LossSimulatorConfig
+	stop       bool
+	done       chan struct{}
+	outRTPChan chan *rtp.Packet
+	// only WriteRTP touches them
+	rand  *rand.Rand
+	drops map[int]bool
+	count map[uint32]int
+}
+
+// NewLossSimulator create new LossSimulator
+func NewLossSimulator(id string, config LossSimulatorConfig) *LossSimulator {
+	log.Warnf("New LossSimulator Plugin with id %s, packets are dropped on purpose config=%+v", id, config)
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	l := &LossSimulator{
+		id:         id,
+		config:     config,
+		done:       make(chan struct{}),
+		outRTPChan: make(chan *rtp.Packet, maxSize),
+		rand:       rand.New(rand.NewSource(seed)),
+		drops:      make(map[int]bool, len(config.Drops)),
+		count:      make(map[uint32]int),
+	}
+	for _, i := range config.Drops {
+		l.drops[i] = true
+	}
+	return l
+}
+
+// ID returns the configured LossSimulator ID.
+func (l *LossSimulator) ID() string {
+	return l.id
+}
+
+// WriteRTP drop or delay the packet as configured and pass it on
+func (l *LossSimulator) WriteRTP(pkt *rtp.Packet) error {
+	if l.stop {
+		return nil
+	}
+	if l.drop(pkt) {
+		atomic.AddUint64(&l.dropped, 1)
+		return nil
+	}
+	delay := time.Duration(l.config.Delay) * time.Millisecond
+	if l.config.Jitter > 0 {
+		delay += time.Duration(l.rand.Int63n(int64(l.config.Jitter) * int64(time.Millisecond)))
+	}
+	if delay <= 0 {
+		l.outRTPChan <- pkt
+		return nil
+	}
+	time.AfterFunc(delay, func() {
+		select {
+		case l.outRTPChan <- pkt:
+		case <-l.done:
+		}
+	})
+	return nil
+}
+
+// drop report if pkt is dropped by the pattern or the random loss
+func (l *LossSimulator) drop(pkt *rtp.Packet) bool {
+	i := l.count[pkt.SSRC]
+	l.count[pkt.SSRC]++
+	if l.config.Period > 0 {
+		i %= l.config.Period
+	}
+	if l.drops[i] {
+		return true
+	}
+	return l.config.Loss > 0 && l.rand.Float64()*100 < l.config.Loss
+}
+
+// ReadRTP can be used to read RTP packets written to the
+// LossSimulator plugin after processing.
+func (l *LossSimulator) ReadRTP() <-chan *rtp.Packet {
+	return l.outRTPChan
+}
+
+// Dropped return how many packets were dropped
+func (l *LossSimulator) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+// Stop halts the simulation, the delayed packets are dropped.
+func (l *LossSimulator) Stop() {
+	if l.stop {
+		return
+	}
+	l.stop = true
+	close(l.done)
+}
@@ -0,0 +1,93 @@
+package plugins
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// passed write n packets of ssrc to l and return the sequence numbers it
+// passed on
+func passed(t *testing.T, l *LossSimulator, ssrc uint32, n int) []uint16 {
+	var out []uint16
+	for sn := 0; sn < n; sn++ {
+		if err := l.WriteRTP(&rtp.Packet{Header: rtp.Header{SSRC: ssrc, SequenceNumber: uint16(sn)}}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case pkt := <-l.ReadRTP():
+			out = append(out, pkt.SequenceNumber)
+		default:
+		}
+	}
+	return out
+}
+
+func TestLossSimulatorLoss(t *testing.T) {
+	l := NewLossSimulator(TypeLossSim, LossSimulatorConfig{On: true, Testing: true, Loss: 20, Seed: 1})
+	defer l.Stop()
+	const n = 10000
+	out := passed(t, l, 1, n)
+	if dropped := n - len(out); dropped < n*18/100 || dropped > n*22/100 {
+		t.Fatalf("dropped %d of %d, want about 20%%", dropped, n)
+	}
+	if l.Dropped() != uint64(n-len(out)) {
+		t.Fatalf("Dropped()=%d, want %d", l.Dropped(), n-len(out))
+	}
+}
+
+func TestLossSimulatorPattern(t *testing.T) {
+	l := NewLossSimulator(TypeLossSim, LossSimulatorConfig{On: true, Testing: true, Drops: []int{1, 3}, Period: 5})
+	defer l.Stop()
+	want := []uint16{0, 2, 4, 5, 7, 9, 10, 12, 14}
+	out := passed(t, l, 1, 15)
+	if len(out) != len(want) {
+		t.Fatalf("passed %v, want %v", out, want)
+	}
+	for i := range want {
+		if out[i] != want[i] {
+			t.Fatalf("passed %v, want %v", out, want)
+		}
+	}
+	// each ssrc counts its own packets
+	if out := passed(t, l, 2, 2); len(out) != 1 || out[0] != 0 {
+		t.Fatalf("passed %v of another ssrc, want [0]", out)
+	}
+
+	// without a period the indexes drop once
+	l = NewLossSimulator(TypeLossSim, LossSimulatorConfig{On: true, Testing: true, Drops: []int{0, 2}})
+	defer l.Stop()
+	if out := passed(t, l, 1, 8); len(out) != 6 || out[0] != 1 || out[1] != 3 {
+		t.Fatalf("passed %v, want all but 0 and 2", out)
+	}
+}
+
+func TestLossSimulatorDelay(t *testing.T) {
+	l := NewLossSimulator(TypeLossSim, LossSimulatorConfig{On: true, Testing: true, Delay: 30, Jitter: 10})
+	defer l.Stop()
+	start := time.Now()
+	if err := l.WriteRTP(&rtp.Packet{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-l.ReadRTP():
+		if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+			t.Fatalf("packet passed after %v, want at least 30ms", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("delayed packet never passed")
+	}
+}
+
+func TestCheckPluginsLossSim(t *testing.T) {
+	if err := CheckPlugins(Config{LossSim: LossSimulatorConfig{On: true, Loss: 10}}); err != errLossSimTesting {
+		t.Fatalf("err=%v, want errLossSimTesting", err)
+	}
+	if err := CheckPlugins(Config{LossSim: LossSimulatorConfig{On: true, Testing: true, Loss: 110}}); err != errInvalidLossSim {
+		t.Fatalf("err=%v, want errInvalidLossSim", err)
+	}
+	if err := CheckPlugins(Config{LossSim: LossSimulatorConfig{On: true, Testing: true, Loss: 10}}); err != nil {
+		t.Fatal(err)
+	}
+}
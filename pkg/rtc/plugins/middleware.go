@@ -0,0 +1,30 @@
+package plugins
+
+import "github.com/pion/rtp"
+
+// Middleware filter or observe a packet of the pub before the router fans
+// it out. It return the packet to forward, the one passed changed or a new
+// one, and false to drop it.
+type Middleware func(*rtp.Packet) (*rtp.Packet, bool)
+
+// Use add m after the middleware already added, it runs whether the
+// plugins are on or not
+func (p *PluginChain) Use(m Middleware) {
+	p.middlewareLock.Lock()
+	defer p.middlewareLock.Unlock()
+	p.middleware = append(p.middleware, m)
+}
+
+// Filter run pkt through the middleware in the order they were added,
+// false if one dropped it
+func (p *PluginChain) Filter(pkt *rtp.Packet) (*rtp.Packet, bool) {
+	p.middlewareLock.RLock()
+	defer p.middlewareLock.RUnlock()
+	for _, m := range p.middleware {
+		var ok bool
+		if pkt, ok = m(pkt); !ok || pkt == nil {
+			return nil, false
+		}
+	}
+	return pkt, true
+}
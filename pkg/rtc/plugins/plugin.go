@@ -2,7 +2,9 @@ package plugins
 
 import (
 	"errors"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/pion/ion-sfu/pkg/log"
 	"github.com/pion/ion-sfu/pkg/rtc/transport"
@@ -10,7 +12,12 @@ import (
 )
 
 var (
-	errInvalidPlugins = errors.New("invalid plugins, make sure at least one plugin is on")
+	errInvalidPlugins  = errors.New("invalid plugins, make sure at least one plugin is on")
+	errInvalidProtocol = errors.New("invalid rtpforwarder protocol, must be udp, kcp or tcp")
+	errInvalidCodec    = errors.New("invalid recorder codec, must be vp8 or opus")
+	errInvalidCycle    = errors.New("invalid jitterbuffer rembcycle or plicycle, must be >= 0")
+	errLossSimTesting  = errors.New("losssimulator drops packets on purpose, set its testing flag to run it")
+	errInvalidLossSim  = errors.New("invalid losssimulator, loss must be 0-100 and the others >= 0")
 )
 
 // Plugin some interfaces
@@ -24,23 +31,33 @@ type Plugin interface {
 const (
 	TypeJitterBuffer = "JitterBuffer"
 	TypeRTPForwarder = "RTPForwarder"
+	TypeRecorder     = "Recorder"
+	TypeDedup        = "Dedup"
+	TypeLossSim      = "LossSimulator"
 
 	maxSize = 100
 )
 
 // Config for plugin initialization
 type Config struct {
-	On           bool               `mapstructure:"on"`
-	JitterBuffer JitterBufferConfig `mapstructure:"jitterbuffer"`
-	RTPForwarder RTPForwarderConfig `mapstructure:"rtpforwarder"`
+	On           bool                `mapstructure:"on"`
+	JitterBuffer JitterBufferConfig  `mapstructure:"jitterbuffer"`
+	Dedup        DedupConfig         `mapstructure:"dedup"`
+	RTPForwarder RTPForwarderConfig  `mapstructure:"rtpforwarder"`
+	Recorder     RecorderConfig      `mapstructure:"recorder"`
+	LossSim      LossSimulatorConfig `mapstructure:"losssimulator"`
 }
 
 type PluginChain struct {
 	mid        string
 	plugins    []Plugin
 	pluginLock sync.RWMutex
-	stop       bool
-	config     Config
+	// set by Close, accessed atomically
+	stop   uint32
+	config Config
+
+	middleware     []Middleware
+	middlewareLock sync.RWMutex
 }
 
 func NewPluginChain(mid string) *PluginChain {
@@ -50,7 +67,7 @@ func NewPluginChain(mid string) *PluginChain {
 }
 
 func (p *PluginChain) ReadRTP() *rtp.Packet {
-	if p.stop {
+	if atomic.LoadUint32(&p.stop) == 1 {
 		return nil
 	}
 
@@ -74,15 +91,59 @@ func CheckPlugins(config Config) error {
 		oneOn = true
 	}
 
+	if config.Dedup.On {
+		oneOn = true
+	}
+
 	//check second plugin
 	if config.RTPForwarder.On {
 		oneOn = true
 	}
 
+	if config.Recorder.On {
+		oneOn = true
+	}
+
+	if config.LossSim.On {
+		oneOn = true
+	}
+
 	if !oneOn {
 		return errInvalidPlugins
 	}
 
+	if config.JitterBuffer.REMBCycle < 0 || config.JitterBuffer.PLICycle < 0 {
+		return errInvalidCycle
+	}
+
+	switch config.RTPForwarder.Protocol {
+	case "", ProtocolUDP, ProtocolKCP, ProtocolTCP:
+	default:
+		return errInvalidProtocol
+	}
+
+	for _, c := range config.Recorder.Codecs {
+		switch strings.ToLower(c) {
+		case RecorderCodecVP8, RecorderCodecOpus:
+		default:
+			return errInvalidCodec
+		}
+	}
+
+	if sim := config.LossSim; sim.On {
+		if !sim.Testing {
+			return errLossSimTesting
+		}
+		if sim.Loss < 0 || sim.Loss > 100 || sim.Period < 0 || sim.Delay < 0 || sim.Jitter < 0 {
+			return errInvalidLossSim
+		}
+		for _, i := range sim.Drops {
+			if i < 0 {
+				return errInvalidLossSim
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -96,30 +157,47 @@ func (p *PluginChain) Init(config Config) error {
 		p.AddPlugin(TypeJitterBuffer, NewJitterBuffer(TypeJitterBuffer, config.JitterBuffer))
 	}
 
+	// drop the duplicates before the others see them
+	if config.Dedup.On {
+		log.Infof("PluginChain.Init config.Dedup.On=true")
+		p.AddPlugin(TypeDedup, NewDedup(TypeDedup, config.Dedup))
+	}
+
 	// second, add others
 	if config.RTPForwarder.On {
 		log.Infof("PluginChain.Init config.RTPForwarder.On=true config=%v", config.RTPForwarder)
 		p.AddPlugin(TypeRTPForwarder, NewRTPForwarder(TypeRTPForwarder, p.mid, config.RTPForwarder))
 	}
 
+	if config.Recorder.On {
+		log.Infof("PluginChain.Init config.Recorder.On=true config=%v", config.Recorder)
+		p.AddPlugin(TypeRecorder, NewRecorder(TypeRecorder, p.mid, config.Recorder))
+	}
+
+	// last, the others see every packet. Checked here too, the routers may
+	// be initialized with a config CheckPlugins never saw.
+	if config.LossSim.On && config.LossSim.Testing {
+		p.AddPlugin(TypeLossSim, NewLossSimulator(TypeLossSim, config.LossSim))
+	}
+
 	// forward packets along plugin chain
 	for i, plugin := range p.plugins {
 		if i == 0 {
 			continue
 		}
-		go func(i int, plugin Plugin) {
-			if p.stop {
+		go func(prev, plugin Plugin) {
+			if atomic.LoadUint32(&p.stop) == 1 {
 				return
 			}
 
-			for pkt := range p.plugins[i-1].ReadRTP() {
+			for pkt := range prev.ReadRTP() {
 				err := plugin.WriteRTP(pkt)
 
 				if err != nil {
 					log.Errorf("Plugin Forward Packet error => %+v", err)
 				}
 			}
-		}(i, plugin)
+		}(p.plugins[i-1], plugin)
 	}
 
 	if p.GetPluginsTotal() <= 0 {
@@ -135,11 +213,39 @@ func (p *PluginChain) On() bool {
 func (p *PluginChain) AttachPub(pub transport.Transport) {
 	jitterBuffer := p.GetPlugin(TypeJitterBuffer)
 	if jitterBuffer != nil {
-		log.Infof("PluginChain.AttachPub pub=%+v", pub)
+		log.Infof("PluginChain.AttachPub pub=%s", pub.ID())
 		jitterBuffer.(*JitterBuffer).AttachPub(pub)
 	}
 }
 
+// JitterBufferStats return the jitter buffer stats by ssrc, nil without a jitter buffer
+func (p *PluginChain) JitterBufferStats() map[uint32]BufferStats {
+	jitterBuffer := p.GetPlugin(TypeJitterBuffer)
+	if jitterBuffer == nil {
+		return nil
+	}
+	return jitterBuffer.(*JitterBuffer).Stats()
+}
+
+// JitterBufferDump return a snapshot of the jitter buffers, false without a
+// jitter buffer
+func (p *PluginChain) JitterBufferDump(packets bool) ([]BufferDump, bool) {
+	jitterBuffer := p.GetPlugin(TypeJitterBuffer)
+	if jitterBuffer == nil {
+		return nil, false
+	}
+	return jitterBuffer.(*JitterBuffer).Dump(packets), true
+}
+
+// DuplicatesDropped return the duplicates dropped by the dedup plugin
+func (p *PluginChain) DuplicatesDropped() uint64 {
+	dedup := p.GetPlugin(TypeDedup)
+	if dedup == nil {
+		return 0
+	}
+	return dedup.(*Dedup).Dropped()
+}
+
 // AddPlugin add a plugin
 func (p *PluginChain) AddPlugin(id string, i Plugin) {
 	p.pluginLock.Lock()
@@ -189,9 +295,8 @@ func (p *PluginChain) DelPluginChain() {
 }
 
 func (p *PluginChain) Close() {
-	if p.stop {
+	if !atomic.CompareAndSwapUint32(&p.stop, 0, 1) {
 		return
 	}
-	p.stop = true
 	p.DelPluginChain()
 }
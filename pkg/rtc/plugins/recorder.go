@@ -0,0 +1,289 @@
+package plugins
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media/samplebuilder"
+
+	"github.com/pion/ion-sfu/pkg/log"
+)
+
+// codecs the recorder can write
+const (
+	RecorderCodecVP8  = "vp8"
+	RecorderCodecOpus = "opus"
+)
+
+const (
+	recorderVideoMaxLate = 256
+	recorderAudioMaxLate = 16
+	videoClockRate       = 90000
+
+	// audio waits this long for a video track before an audio only file is started
+	recorderAudioOnlyDelay = 2 * time.Second
+)
+
+// RecorderConfig describes configuration parameters for the recorder.
+type RecorderConfig struct {
+	On             bool     `mapstructure:"on"`
+	OutputDir      string   `mapstructure:"outputdir"`
+	Codecs         []string `mapstructure:"codecs"`
+	RotateInterval int      `mapstructure:"rotateinterval"`
+}
+
+// Recorder represents a Recorder plugin.
+// The Recorder plugin writes the pub vp8 and opus streams to webm files in
+// OutputDir, a new file is started on the first key frame after
+// RotateInterval seconds. Packets pass through it unchanged.
+type Recorder struct {
+	// accessed atomically
+	dropped uint64
+
+	id         string
+	mid        string
+	stop       bool
+	config     RecorderConfig
+	video      bool
+	audio      bool
+	outRTPChan chan *rtp.Packet
+	recordChan chan *rtp.Packet
+	done       chan struct{}
+	closed     chan struct{}
+
+	// only recordLoop touches these
+	videoSSRC    uint32
+	audioSSRC    uint32
+	videoBuilder *samplebuilder.SampleBuilder
+	audioBuilder *samplebuilder.SampleBuilder
+	file         *webmWriter
+	fileVideo    bool
+	firstAudio   time.Time
+	fileStart    time.Time
+	videoTime    trackTime
+	audioTime    trackTime
+}
+
+// trackTime map the rtp timestamps of a track to ms in the current file
+type trackTime struct {
+	set    bool
+	base   uint32
+	offset int64
+}
+
+func (t *trackTime) ms(ts uint32, clockRate int64, fileStart time.Time) int64 {
+	if !t.set {
+		t.set = true
+		t.base = ts
+		t.offset = int64(time.Since(fileStart) / time.Millisecond)
+	}
+	return t.offset + int64(ts-t.base)*1000/clockRate
+}
+
+// NewRecorder create new Recorder, it records both vp8 and opus when no codecs are set
+func NewRecorder(id, mid string, config RecorderConfig) *Recorder {
+	log.Infof("New Recorder Plugin with id %s dir %s codecs %v for mid %s", id, config.OutputDir, config.Codecs, mid)
+	r := &Recorder{
+		id:           id,
+		mid:          mid,
+		config:       config,
+		video:        len(config.Codecs) == 0,
+		audio:        len(config.Codecs) == 0,
+		outRTPChan:   make(chan *rtp.Packet, maxSize),
+		recordChan:   make(chan *rtp.Packet, maxSize),
+		done:         make(chan struct{}),
+		closed:       make(chan struct{}),
+		videoBuilder: samplebuilder.New(recorderVideoMaxLate, &codecs.VP8Packet{}, samplebuilder.WithPartitionHeadChecker(&codecs.VP8PartitionHeadChecker{})),
+		audioBuilder: samplebuilder.New(recorderAudioMaxLate, &codecs.OpusPacket{}),
+	}
+	for _, c := range config.Codecs {
+		switch strings.ToLower(c) {
+		case RecorderCodecVP8:
+			r.video = true
+		case RecorderCodecOpus:
+			r.audio = true
+		}
+	}
+	if config.OutputDir != "" {
+		if err := os.MkdirAll(config.OutputDir, 0755); err != nil {
+			log.Errorf("Recorder mkdir %s => %s", config.OutputDir, err)
+		}
+	}
+	go r.recordLoop()
+	return r
+}
+
+// ID returns the configured Recorder ID.
+func (r *Recorder) ID() string {
+	return r.id
+}
+
+// WriteRTP pass the packet on and queue it for recording,
+// it is dropped from the recording when the disk can't keep up
+func (r *Recorder) WriteRTP(pkt *rtp.Packet) error {
+	if r.stop {
+		return nil
+	}
+
+	r.outRTPChan <- pkt
+	select {
+	case r.recordChan <- pkt:
+	default:
+		atomic.AddUint64(&r.dropped, 1)
+	}
+	return nil
+}
+
+// ReadRTP can be used to read RTP packets written to the
+// Recorder plugin after processing.
+func (r *Recorder) ReadRTP() <-chan *rtp.Packet {
+	return r.outRTPChan
+}
+
+// Dropped return how many packets were left out of the recording
+func (r *Recorder) Dropped() uint64 {
+	return atomic.LoadUint64(&r.dropped)
+}
+
+// Stop finish the current file and halts recording.
+func (r *Recorder) Stop() {
+	if r.stop {
+		return
+	}
+	r.stop = true
+	close(r.done)
+	<-r.closed
+}
+
+func (r *Recorder) recordLoop() {
+	defer close(r.closed)
+	for {
+		select {
+		case <-r.done:
+			r.closeFile()
+			return
+		case pkt := <-r.recordChan:
+			r.record(pkt)
+		}
+	}
+}
+
+// record push pkt to the sample builder of its track and write the frames built
+func (r *Recorder) record(pkt *rtp.Packet) {
+	switch pkt.PayloadType {
+	case webrtc.DefaultPayloadTypeVP8, 120:
+		if !r.video {
+			return
+		}
+		if r.videoSSRC == 0 {
+			r.videoSSRC = pkt.SSRC
+		}
+		// only the first video ssrc is recorded, e.g. the first simulcast layer
+		if pkt.SSRC != r.videoSSRC {
+			return
+		}
+		r.videoBuilder.Push(pkt)
+		for sample, ts := r.videoBuilder.PopWithTimestamp(); sample != nil; sample, ts = r.videoBuilder.PopWithTimestamp() {
+			r.writeVideo(sample.Data, ts)
+		}
+	case webrtc.DefaultPayloadTypeOpus:
+		if !r.audio {
+			return
+		}
+		if r.audioSSRC == 0 {
+			r.audioSSRC = pkt.SSRC
+		}
+		if pkt.SSRC != r.audioSSRC {
+			return
+		}
+		r.audioBuilder.Push(pkt)
+		for sample, ts := r.audioBuilder.PopWithTimestamp(); sample != nil; sample, ts = r.audioBuilder.PopWithTimestamp() {
+			r.writeAudio(sample.Data, ts)
+		}
+	}
+}
+
+func (r *Recorder) writeVideo(frame []byte, ts uint32) {
+	keyFrame := len(frame) >= 10 && frame[0]&0x01 == 0
+	if keyFrame && (r.file == nil || !r.fileVideo || r.rotate(r.videoTime.ms(ts, videoClockRate, r.fileStart))) {
+		// the frame header of a key frame carries the size, rfc6386 section 9.1
+		width := int(frame[6]) | int(frame[7]&0x3f)<<8
+		height := int(frame[8]) | int(frame[9]&0x3f)<<8
+		r.openFile(width, height)
+	}
+	if r.file == nil || !r.fileVideo {
+		return
+	}
+	r.writeBlock(webmTrackVideo, keyFrame, r.videoTime.ms(ts, videoClockRate, r.fileStart), frame)
+}
+
+func (r *Recorder) writeAudio(frame []byte, ts uint32) {
+	if r.firstAudio.IsZero() {
+		r.firstAudio = time.Now()
+	}
+	if r.file == nil {
+		// give the video track a chance to show up before starting without it
+		if r.video && (r.videoSSRC != 0 || time.Since(r.firstAudio) < recorderAudioOnlyDelay) {
+			return
+		}
+		r.openFile(0, 0)
+	} else if !r.fileVideo && r.rotate(r.audioTime.ms(ts, opusRate, r.fileStart)) {
+		r.openFile(0, 0)
+	}
+	if r.file == nil {
+		return
+	}
+	r.writeBlock(webmTrackAudio, true, r.audioTime.ms(ts, opusRate, r.fileStart), frame)
+}
+
+// rotate check if the current file is over RotateInterval at ms
+func (r *Recorder) rotate(ms int64) bool {
+	return r.config.RotateInterval > 0 && ms >= int64(r.config.RotateInterval)*1000
+}
+
+// openFile close the current file and start a new one, without video when width is 0
+func (r *Recorder) openFile(width, height int) {
+	r.closeFile()
+	name := filepath.Join(r.config.OutputDir, fmt.Sprintf("%s_%d.webm", r.mid, time.Now().UnixNano()))
+	f, err := os.Create(name)
+	if err != nil {
+		log.Errorf("Recorder create %s => %s", name, err)
+		return
+	}
+	w, err := newWebMWriter(f, width, height, r.audio)
+	if err != nil {
+		log.Errorf("Recorder write %s => %s", name, err)
+		f.Close()
+		return
+	}
+	log.Infof("Recorder mid=%s writing %s", r.mid, name)
+	r.file = w
+	r.fileVideo = width > 0 && height > 0
+	r.fileStart = time.Now()
+	r.videoTime = trackTime{}
+	r.audioTime = trackTime{}
+}
+
+func (r *Recorder) writeBlock(track int, keyFrame bool, ms int64, frame []byte) {
+	if err := r.file.writeBlock(track, keyFrame, ms, frame); err != nil {
+		log.Errorf("Recorder write => %s", err)
+		r.closeFile()
+	}
+}
+
+func (r *Recorder) closeFile() {
+	if r.file == nil {
+		return
+	}
+	if err := r.file.Close(); err != nil {
+		log.Errorf("Recorder close => %s", err)
+	}
+	r.file = nil
+}
@@ -0,0 +1,249 @@
+package plugins
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+)
+
+// webmFile is what parseWebM found in a file
+type webmFile struct {
+	docType   string
+	codecs    []string
+	width     uint64
+	height    uint64
+	clusters  int
+	blocks    map[byte]int
+	keyFrames int
+	firstKey  bool
+}
+
+// parseWebM walk the elements of a webm file, descending into the master ones
+func parseWebM(t *testing.T, data []byte) webmFile {
+	masters := map[uint32]bool{
+		ebmlIDHeader:     true,
+		webmIDSegment:    true,
+		webmIDTracks:     true,
+		webmIDTrackEntry: true,
+		webmIDVideo:      true,
+		webmIDAudio:      true,
+		webmIDCluster:    true,
+	}
+	f := webmFile{blocks: make(map[byte]int)}
+	for i := 0; i < len(data); {
+		// the id keeps its length marker
+		l := 1
+		for l <= 4 && data[i]&(0x80>>uint(l-1)) == 0 {
+			l++
+		}
+		var id uint32
+		for _, b := range data[i : i+l] {
+			id = id<<8 | uint32(b)
+		}
+		i += l
+
+		l = 1
+		for l <= 8 && data[i]&(0x80>>uint(l-1)) == 0 {
+			l++
+		}
+		if l > 8 {
+			t.Fatalf("bad size at %d", i)
+		}
+		size := uint64(data[i] & (0xff >> uint(l)))
+		unknown := size == uint64(0xff>>uint(l))
+		for _, b := range data[i+1 : i+l] {
+			size = size<<8 | uint64(b)
+			unknown = unknown && b == 0xff
+		}
+		i += l
+
+		if masters[id] {
+			if id == webmIDCluster {
+				f.clusters++
+			}
+			continue
+		}
+		if unknown || i+int(size) > len(data) {
+			t.Fatalf("element %x of size %d truncated", id, size)
+		}
+		value := data[i : i+int(size)]
+		i += int(size)
+
+		switch id {
+		case ebmlIDDocType:
+			f.docType = string(value)
+		case webmIDCodecID:
+			f.codecs = append(f.codecs, string(value))
+		case webmIDPixelWidth:
+			f.width = readUint(value)
+		case webmIDPixelHeight:
+			f.height = readUint(value)
+		case webmIDSimpleBlock:
+			track := value[0] & 0x7f
+			if track == webmTrackVideo && len(f.blocks) == 0 {
+				f.firstKey = value[3]&0x80 != 0
+			}
+			f.blocks[track]++
+			if track == webmTrackVideo && value[3]&0x80 != 0 {
+				f.keyFrames++
+			}
+		}
+	}
+	return f
+}
+
+func readUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// vp8Frame return a one packet vp8 frame of 640x480
+func vp8Frame(sn uint16, ts uint32, key bool) *rtp.Packet {
+	// descriptor with S set, then a frame tag of a shown frame
+	payload := []byte{0x10, 0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01, 0x00, 0x00}
+	if !key {
+		payload[1] |= 0x01
+	}
+	return &rtp.Packet{
+		Header:  rtp.Header{SSRC: 1, PayloadType: webrtc.DefaultPayloadTypeVP8, SequenceNumber: sn, Timestamp: ts, Marker: true},
+		Payload: payload,
+	}
+}
+
+func opusFrame(sn uint16, ts uint32) *rtp.Packet {
+	return &rtp.Packet{
+		Header:  rtp.Header{SSRC: 2, PayloadType: webrtc.DefaultPayloadTypeOpus, SequenceNumber: sn, Timestamp: ts},
+		Payload: []byte{0xfc, 0xff, 0xfe},
+	}
+}
+
+// writeRecorder write pkt and wait for the recorder to take it, so nothing is dropped
+func writeRecorder(t *testing.T, r *Recorder, pkt *rtp.Packet) {
+	if err := r.WriteRTP(pkt); err != nil {
+		t.Fatal(err)
+	}
+	testhelper.WaitFor(t, time.Second, func() bool { return len(r.recordChan) == 0 })
+}
+
+func recordings(t *testing.T, dir string) []webmFile {
+	names, err := filepath.Glob(filepath.Join(dir, "mid_*.webm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []webmFile
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, parseWebM(t, data))
+	}
+	return files
+}
+
+func TestRecorderWritesWebM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := NewRecorder("rec", "mid", RecorderConfig{On: true, OutputDir: dir})
+	go func() {
+		for range r.ReadRTP() {
+		}
+	}()
+
+	// 1s of 30fps video, a key frame then delta frames, with 20ms opus frames
+	var audioSN uint16
+	for i := 0; i < 30; i++ {
+		writeRecorder(t, r, vp8Frame(uint16(i), uint32(i*3000), i == 0))
+		for ; int(audioSN)*20 < (i+1)*33; audioSN++ {
+			writeRecorder(t, r, opusFrame(audioSN, uint32(audioSN)*960))
+		}
+	}
+	r.Stop()
+
+	files := recordings(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("files=%d, want 1", len(files))
+	}
+	f := files[0]
+	if f.docType != "webm" {
+		t.Fatalf("doctype=%q, want webm", f.docType)
+	}
+	if len(f.codecs) != 2 || f.codecs[0] != "V_VP8" || f.codecs[1] != "A_OPUS" {
+		t.Fatalf("codecs=%v, want V_VP8 and A_OPUS", f.codecs)
+	}
+	if f.width != 640 || f.height != 480 {
+		t.Fatalf("size=%dx%d, want 640x480", f.width, f.height)
+	}
+	if !f.firstKey || f.keyFrames != 1 {
+		t.Fatalf("first block key=%v key frames=%d, want one key frame first", f.firstKey, f.keyFrames)
+	}
+	// the sample builder holds back the last frame of each track
+	if f.blocks[webmTrackVideo] != 29 {
+		t.Fatalf("video blocks=%d, want 29", f.blocks[webmTrackVideo])
+	}
+	if f.blocks[webmTrackAudio] == 0 {
+		t.Fatal("no audio blocks")
+	}
+	if n := r.Dropped(); n != 0 {
+		t.Fatalf("dropped=%d, want 0", n)
+	}
+}
+
+func TestRecorderRotatesOnKeyFrame(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := NewRecorder("rec", "mid", RecorderConfig{On: true, OutputDir: dir, Codecs: []string{"vp8"}, RotateInterval: 1})
+	go func() {
+		for range r.ReadRTP() {
+		}
+	}()
+
+	// a key frame every 500ms for 2s, so a file every second
+	for i := 0; i < 60; i++ {
+		writeRecorder(t, r, vp8Frame(uint16(i), uint32(i*3000), i%15 == 0))
+		// audio is not recorded
+		writeRecorder(t, r, opusFrame(uint16(i), uint32(i*960)))
+	}
+	r.Stop()
+
+	files := recordings(t, dir)
+	if len(files) != 2 {
+		t.Fatalf("files=%d, want 2", len(files))
+	}
+	for i, f := range files {
+		if len(f.codecs) != 1 || f.codecs[0] != "V_VP8" {
+			t.Fatalf("file %d codecs=%v, want V_VP8", i, f.codecs)
+		}
+		if !f.firstKey || f.keyFrames != 2 || f.clusters != 2 {
+			t.Fatalf("file %d key=%v key frames=%d clusters=%d, want 2 starting with a key frame", i, f.firstKey, f.keyFrames, f.clusters)
+		}
+		if f.blocks[webmTrackAudio] != 0 {
+			t.Fatalf("file %d has audio", i)
+		}
+	}
+}
+
+func TestCheckPluginsRecorderCodecs(t *testing.T) {
+	if err := CheckPlugins(Config{Recorder: RecorderConfig{On: true, Codecs: []string{"VP8", "opus"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckPlugins(Config{Recorder: RecorderConfig{On: true, Codecs: []string{"h264"}}}); err != errInvalidCodec {
+		t.Fatalf("err=%v, want errInvalidCodec", err)
+	}
+}
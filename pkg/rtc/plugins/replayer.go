@@ -0,0 +1,302 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2/pkg/media/rtpdump"
+
+	"github.com/pion/ion-sfu/pkg/log"
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+)
+
+var (
+	// wraps io.EOF, a router reading the replayer closes with it
+	errReplayerClosed   = fmt.Errorf("replayer closed: %w", io.EOF)
+	errReplayerReadOnly = errors.New("replayer can't write rtp")
+	errReplayEmpty      = errors.New("no rtp packets to replay")
+)
+
+// ReplayConfig describes how the packets are replayed.
+type ReplayConfig struct {
+	// start again after the last packet instead of closing
+	Loop bool
+	// 2 replays twice as fast, 1 when not set
+	Speed float64
+}
+
+// ReplayPacket is a packet to replay and its time since the first packet
+type ReplayPacket struct {
+	Offset time.Duration
+	Packet *rtp.Packet
+}
+
+// Replayer represents a Replayer plugin.
+// The Replayer is a pub transport injecting recorded rtp packets into a
+// router with their original timing, e.g. for testing or to fill a room
+// while the real pub is gone. It closes after the last packet unless it
+// loops, every loop continues the sequence numbers and timestamps.
+type Replayer struct {
+	id             string
+	pkts           []ReplayPacket
+	config         ReplayConfig
+	rtpCh          chan *rtp.Packet
+	rtcpCh         chan rtcp.Packet
+	done           chan struct{}
+	closeOnce      sync.Once
+	onCloseHandler func()
+	onCloseLock    sync.Mutex
+}
+
+// NewReplayer create a Replayer, it starts replaying pkts right away
+func NewReplayer(id string, pkts []ReplayPacket, config ReplayConfig) (*Replayer, error) {
+	if len(pkts) == 0 {
+		return nil, errReplayEmpty
+	}
+	if config.Speed <= 0 {
+		config.Speed = 1
+	}
+	log.Infof("New Replayer with id %s packets %d config %+v", id, len(pkts), config)
+	r := &Replayer{
+		id:     id,
+		pkts:   pkts,
+		config: config,
+		// unbuffered, so the router has read every packet when the replayer closes
+		rtpCh:  make(chan *rtp.Packet),
+		rtcpCh: make(chan rtcp.Packet, maxSize),
+		done:   make(chan struct{}),
+	}
+	go r.replayLoop()
+	return r, nil
+}
+
+// NewFileReplayer create a Replayer of the rtp packets in an rtpdump file
+func NewFileReplayer(id, path string, config ReplayConfig) (*Replayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	pkts, err := ReadRTPDump(f)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplayer(id, pkts, config)
+}
+
+// ReadRTPDump read the rtp packets of an rtpdump stream, rtcp packets are skipped
+func ReadRTPDump(r io.Reader) ([]ReplayPacket, error) {
+	reader, _, err := rtpdump.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var pkts []ReplayPacket
+	for {
+		p, err := reader.Next()
+		if err == io.EOF {
+			return pkts, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if p.IsRTCP {
+			continue
+		}
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(p.Payload); err != nil {
+			return nil, err
+		}
+		pkts = append(pkts, ReplayPacket{Offset: p.Offset, Packet: pkt})
+	}
+}
+
+// CaptureRTP read n rtp packets from t, e.g. an RTPTransport fed by an
+// RTPForwarder, and stamp them with their arrival time
+func CaptureRTP(t transport.Transport, n int) ([]ReplayPacket, error) {
+	var pkts []ReplayPacket
+	var start time.Time
+	for len(pkts) < n {
+		pkt, err := t.ReadRTP()
+		if err != nil {
+			return pkts, err
+		}
+		if pkt == nil {
+			continue
+		}
+		now := time.Now()
+		if start.IsZero() {
+			start = now
+		}
+		pkts = append(pkts, ReplayPacket{Offset: now.Sub(start), Packet: pkt})
+	}
+	return pkts, nil
+}
+
+// replayOffset is what a loop adds to the sequence numbers and timestamps of a ssrc
+type replayOffset struct {
+	sn uint16
+	ts uint32
+}
+
+// loopOffsets return the offsets of one loop by ssrc, the timestamps move on by
+// the average step so the first packet of a loop follows the last one
+func (r *Replayer) loopOffsets() map[uint32]replayOffset {
+	type span struct {
+		firstSN, lastSN uint16
+		firstTS, lastTS uint32
+		steps           uint32
+	}
+	spans := make(map[uint32]*span)
+	for _, p := range r.pkts {
+		s := spans[p.Packet.SSRC]
+		if s == nil {
+			spans[p.Packet.SSRC] = &span{
+				firstSN: p.Packet.SequenceNumber,
+				lastSN:  p.Packet.SequenceNumber,
+				firstTS: p.Packet.Timestamp,
+				lastTS:  p.Packet.Timestamp,
+			}
+			continue
+		}
+		s.lastSN = p.Packet.SequenceNumber
+		if p.Packet.Timestamp != s.lastTS {
+			s.steps++
+		}
+		s.lastTS = p.Packet.Timestamp
+	}
+	offsets := make(map[uint32]replayOffset, len(spans))
+	for ssrc, s := range spans {
+		o := replayOffset{sn: s.lastSN - s.firstSN + 1, ts: s.lastTS - s.firstTS}
+		if s.steps > 0 {
+			o.ts += o.ts / s.steps
+		}
+		offsets[ssrc] = o
+	}
+	return offsets
+}
+
+func (r *Replayer) replayLoop() {
+	defer r.Close()
+
+	offsets := r.loopOffsets()
+	last := r.pkts[len(r.pkts)-1].Offset
+	// a loop lasts one average packet interval more than its last packet
+	loopTime := last
+	if len(r.pkts) > 1 {
+		loopTime += last / time.Duration(len(r.pkts)-1)
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for loop := 0; ; loop++ {
+		for _, p := range r.pkts {
+			due := time.Duration(float64(time.Duration(loop)*loopTime+p.Offset) / r.config.Speed)
+			if wait := due - time.Since(start); wait > 0 {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(wait)
+				select {
+				case <-timer.C:
+				case <-r.done:
+					return
+				}
+			}
+
+			pkt := *p.Packet
+			o := offsets[pkt.SSRC]
+			pkt.SequenceNumber += uint16(loop) * o.sn
+			pkt.Timestamp += uint32(loop) * o.ts
+			select {
+			case r.rtpCh <- &pkt:
+			case <-r.done:
+				return
+			}
+		}
+		if !r.config.Loop {
+			log.Infof("Replayer %s done", r.id)
+			return
+		}
+	}
+}
+
+// ID return id
+func (r *Replayer) ID() string {
+	return r.id
+}
+
+// Type return type of transport
+func (r *Replayer) Type() int {
+	return transport.TypeReplayer
+}
+
+// ReadRTP read the next replayed packet
+func (r *Replayer) ReadRTP() (*rtp.Packet, error) {
+	select {
+	case pkt := <-r.rtpCh:
+		return pkt, nil
+	case <-r.done:
+		return nil, errReplayerClosed
+	}
+}
+
+// WriteRTP fails, a replayer is only a pub
+func (r *Replayer) WriteRTP(*rtp.Packet) error {
+	return errReplayerReadOnly
+}
+
+// WriteRTCP drop the rtcp meant for the pub, there is nobody to ask for a key frame
+func (r *Replayer) WriteRTCP(rtcp.Packet) error {
+	return nil
+}
+
+// GetRTCPChan return a chan no rtcp is ever sent on
+func (r *Replayer) GetRTCPChan() chan rtcp.Packet {
+	return r.rtcpCh
+}
+
+// Close stop replaying
+func (r *Replayer) Close() {
+	r.closeOnce.Do(func() {
+		log.Infof("Replayer.Close() %s", r.id)
+		close(r.done)
+		r.onCloseLock.Lock()
+		f := r.onCloseHandler
+		r.onCloseLock.Unlock()
+		if f != nil {
+			f()
+		}
+	})
+}
+
+// OnClose calls passed handler when the replay ends or is closed
+func (r *Replayer) OnClose(f func()) {
+	r.onCloseLock.Lock()
+	defer r.onCloseLock.Unlock()
+	r.onCloseHandler = f
+}
+
+// OnConnectionStateChange do nothing, the replayer stays connected until it is closed
+func (r *Replayer) OnConnectionStateChange(func(state int)) {}
+
+// WriteErrTotal return 0, nothing is written
+func (r *Replayer) WriteErrTotal() int {
+	return 0
+}
+
+// WriteErrReset do nothing
+func (r *Replayer) WriteErrReset() {}
+
+// GetBandwidth return 0, there is no remote to estimate
+func (r *Replayer) GetBandwidth() uint32 {
+	return 0
+}
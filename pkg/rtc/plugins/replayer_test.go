@@ -0,0 +1,114 @@
+package plugins
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2/pkg/media/rtpdump"
+)
+
+// replayPkts return n packets of ssrc 1, every 3000 ts and 20ms apart
+func replayPkts(n int) []ReplayPacket {
+	var pkts []ReplayPacket
+	for i := 0; i < n; i++ {
+		pkts = append(pkts, ReplayPacket{
+			Offset: time.Duration(i) * 20 * time.Millisecond,
+			Packet: &rtp.Packet{Header: rtp.Header{SSRC: 1, SequenceNumber: uint16(100 + i), Timestamp: uint32(i * 3000)}},
+		})
+	}
+	return pkts
+}
+
+func TestReplayerTimingAndClose(t *testing.T) {
+	r, err := NewReplayer("replay", replayPkts(10), ReplayConfig{Speed: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	r.OnClose(func() { close(closed) })
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		pkt, err := r.ReadRTP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt.SequenceNumber != uint16(100+i) {
+			t.Fatalf("sn=%d, want %d", pkt.SequenceNumber, 100+i)
+		}
+	}
+	// 180ms of packets at twice the speed
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond || elapsed > 300*time.Millisecond {
+		t.Fatalf("replayed in %v, want about 90ms", elapsed)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("not closed after the last packet")
+	}
+	if _, err := r.ReadRTP(); err != errReplayerClosed {
+		t.Fatalf("err=%v, want errReplayerClosed", err)
+	}
+}
+
+func TestReplayerLoop(t *testing.T) {
+	r, err := NewReplayer("replay", replayPkts(3), ReplayConfig{Loop: true, Speed: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for i := 0; i < 9; i++ {
+		pkt, err := r.ReadRTP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt.SequenceNumber != uint16(100+i) || pkt.Timestamp != uint32(i*3000) {
+			t.Fatalf("packet %d sn=%d ts=%d, want sn=%d ts=%d", i, pkt.SequenceNumber, pkt.Timestamp, 100+i, i*3000)
+		}
+	}
+}
+
+func TestNewReplayerEmpty(t *testing.T) {
+	if _, err := NewReplayer("replay", nil, ReplayConfig{}); err != errReplayEmpty {
+		t.Fatalf("err=%v, want errReplayEmpty", err)
+	}
+}
+
+func TestReadRTPDump(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := rtpdump.NewWriter(buf, rtpdump.Header{Start: time.Now(), Source: net.IPv4(127, 0, 0, 1), Port: 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range replayPkts(3) {
+		raw, err := p.Packet.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WritePacket(rtpdump.Packet{Offset: p.Offset, Payload: raw}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// rtcp is skipped
+	if err := w.WritePacket(rtpdump.Packet{Offset: time.Second, IsRTCP: true, Payload: []byte{0x80, 0xc9, 0x00, 0x01, 0, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	pkts, err := ReadRTPDump(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 3 {
+		t.Fatalf("packets=%d, want 3", len(pkts))
+	}
+	for i, p := range pkts {
+		if p.Offset != time.Duration(i)*20*time.Millisecond || p.Packet.SequenceNumber != uint16(100+i) {
+			t.Fatalf("packet %d offset=%v sn=%d", i, p.Offset, p.Packet.SequenceNumber)
+		}
+	}
+}
@@ -1,48 +1,155 @@
 package plugins
 
 import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/pion/rtp"
 
 	"github.com/pion/ion-sfu/pkg/log"
 	"github.com/pion/ion-sfu/pkg/rtc/transport"
 )
 
+// state of the rtp forwarder connection
+const (
+	RTPForwarderConnected = iota
+	RTPForwarderReconnecting
+	RTPForwarderClosed
+)
+
+const (
+	// forwardBlockTime is how long WriteRTP waits for a slow endpoint before dropping
+	forwardBlockTime = 10 * time.Millisecond
+
+	defaultForwarderMaxWriteErr = 10
+	reconnectMinBackoff         = 100 * time.Millisecond
+	defaultReconnectMaxBackoff  = 5000
+)
+
+// protocols of the rtp forwarder
+const (
+	ProtocolUDP = "udp"
+	ProtocolKCP = "kcp"
+	ProtocolTCP = "tcp"
+)
+
+var errForwarderNotConnected = errors.New("rtp forwarder not connected")
+
 // RTPForwarderConfig describes configuration parameters for the rtp forwarder.
 type RTPForwarderConfig struct {
-	On      bool   `mapstructure:"on"`
-	Addr    string `mapstructure:"addr"`
-	KcpKey  string `mapstructure:"kcpkey"`
-	KcpSalt string `mapstructure:"kcpsalt"`
+	On                  bool     `mapstructure:"on"`
+	Addr                string   `mapstructure:"addr"`
+	Addrs               []string `mapstructure:"addrs"`
+	Protocol            string   `mapstructure:"protocol"`
+	KcpKey              string   `mapstructure:"kcpkey"`
+	KcpSalt             string   `mapstructure:"kcpsalt"`
+	MaxWriteErr         int      `mapstructure:"maxwriteerr"`
+	ReconnectMaxBackoff int      `mapstructure:"reconnectmaxbackoff"`
 }
 
 // RTPForwarder represents an RTPForwarder plugin.
 // The RTPForwarder plugin forwards rtp packets using an RTPTransport
-// to the configured endpoint. It can be used for sending raw stream rtp
-// to another service for processing.
+// to every configured endpoint. It can be used for sending raw stream rtp
+// to other services for processing.
 type RTPForwarder struct {
-	id         string
-	stop       bool
-	Transport  *transport.RTPTransport
+	id string
+	// set by Stop, accessed atomically
+	stop       uint32
+	endpoints  []*forwardEndpoint
 	outRTPChan chan *rtp.Packet
 }
 
+// forwardEndpoint writes to one address, a slow or broken endpoint
+// does not hold back the others
+type forwardEndpoint struct {
+	// accessed atomically
+	dropped uint64
+	state   int32
+
+	addr          string
+	stop          bool
+	transport     transport.Transport
+	transportLock sync.Mutex
+	dial          func(addr string) transport.Transport
+	config        RTPForwarderConfig
+	forwardChan   chan *rtp.Packet
+	done          chan struct{}
+}
+
 // NewRTPForwarder create new RTPForwarder. The RTPForwarder connects to
-// the configured RTP endpoint.
+// the configured RTP endpoints.
 func NewRTPForwarder(id, mid string, config RTPForwarderConfig) *RTPForwarder {
-	log.Infof("New RTPForwarder Plugin with id %s address %s for mid %s", id, config.Addr, mid)
-	var rtpTransport *transport.RTPTransport
-
-	if config.KcpKey != "" && config.KcpSalt != "" {
-		rtpTransport = transport.NewOutRTPTransportWithKCP(mid, config.Addr, config.KcpKey, config.KcpSalt)
-	} else {
-		rtpTransport = transport.NewOutRTPTransport(mid, config.Addr)
+	log.Infof("New RTPForwarder Plugin with id %s address %s %v for mid %s", id, config.Addr, config.Addrs, mid)
+	protocol := config.Protocol
+	if protocol == "" {
+		protocol = ProtocolUDP
+		if config.KcpKey != "" && config.KcpSalt != "" {
+			protocol = ProtocolKCP
+		}
 	}
+	dial := func(addr string) transport.Transport {
+		var rtpTransport *transport.RTPTransport
+		switch protocol {
+		case ProtocolKCP:
+			rtpTransport = transport.NewOutRTPTransportWithKCP(mid, addr, config.KcpKey, config.KcpSalt)
+		case ProtocolTCP:
+			rtpTransport = transport.NewOutRTPTransportTCP(mid, addr)
+		default:
+			rtpTransport = transport.NewOutRTPTransport(mid, addr)
+		}
+		// keep the interface nil when dialing failed
+		if rtpTransport == nil {
+			return nil
+		}
+		return rtpTransport
+	}
+	return newRTPForwarder(id, config, dial)
+}
 
-	return &RTPForwarder{
+func newRTPForwarder(id string, config RTPForwarderConfig, dial func(addr string) transport.Transport) *RTPForwarder {
+	if config.MaxWriteErr <= 0 {
+		config.MaxWriteErr = defaultForwarderMaxWriteErr
+	}
+	if config.ReconnectMaxBackoff <= 0 {
+		config.ReconnectMaxBackoff = defaultReconnectMaxBackoff
+	}
+	r := &RTPForwarder{
 		id:         id,
-		Transport:  rtpTransport,
 		outRTPChan: make(chan *rtp.Packet, maxSize),
 	}
+	for _, addr := range forwardAddrs(config) {
+		e := &forwardEndpoint{
+			addr:        addr,
+			transport:   dial(addr),
+			dial:        dial,
+			config:      config,
+			forwardChan: make(chan *rtp.Packet, maxSize),
+			done:        make(chan struct{}),
+		}
+		// the first dial failed, the endpoint is down until reconnected
+		if e.transport == nil {
+			e.state = RTPForwarderReconnecting
+		}
+		r.endpoints = append(r.endpoints, e)
+		go e.forwardLoop()
+	}
+	return r
+}
+
+// forwardAddrs return Addr followed by Addrs without duplicates
+func forwardAddrs(config RTPForwarderConfig) []string {
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, addr := range append([]string{config.Addr}, config.Addrs...) {
+		if addr == "" || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		addrs = append(addrs, addr)
+	}
+	return addrs
 }
 
 // ID returns the configured RTPForwarder ID.
@@ -52,28 +159,185 @@ func (r *RTPForwarder) ID() string {
 
 // WriteRTP forwards rtp packet written to the RTPForwader.
 func (r *RTPForwarder) WriteRTP(pkt *rtp.Packet) error {
-	if r.stop {
+	if atomic.LoadUint32(&r.stop) == 1 {
 		return nil
 	}
 
 	r.outRTPChan <- pkt
-	go func() {
-		err := r.Transport.WriteRTP(pkt)
-		if err != nil {
-			log.Errorf("r.Transport.WriteRTP => %s", err)
-		}
-	}()
+	for _, e := range r.endpoints {
+		e.push(pkt)
+	}
 	return nil
 }
 
+// State return RTPForwarderConnected when every endpoint is connected
+func (r *RTPForwarder) State() int {
+	if atomic.LoadUint32(&r.stop) == 1 {
+		return RTPForwarderClosed
+	}
+	for _, e := range r.endpoints {
+		if state := e.State(); state != RTPForwarderConnected {
+			return state
+		}
+	}
+	return RTPForwarderConnected
+}
+
+// States return the connection state by endpoint address
+func (r *RTPForwarder) States() map[string]int {
+	states := make(map[string]int, len(r.endpoints))
+	for _, e := range r.endpoints {
+		states[e.addr] = e.State()
+	}
+	return states
+}
+
+// Dropped return how many packets were not forwarded because an endpoint was too slow
+func (r *RTPForwarder) Dropped() uint64 {
+	var dropped uint64
+	for _, e := range r.endpoints {
+		dropped += atomic.LoadUint64(&e.dropped)
+	}
+	return dropped
+}
+
 // ReadRTP can be used to read RTP packets written to the
 // RTPForwader plugin after processing.
 func (r *RTPForwarder) ReadRTP() <-chan *rtp.Packet {
 	return r.outRTPChan
 }
 
-// Stop closes the rtp transport and halts forwarding.
+// Stop closes the rtp transports and halts forwarding.
 func (r *RTPForwarder) Stop() {
-	r.stop = true
-	r.Transport.Close()
+	if !atomic.CompareAndSwapUint32(&r.stop, 0, 1) {
+		return
+	}
+	for _, e := range r.endpoints {
+		e.Stop()
+	}
+}
+
+// push queue a packet, dropping it when the endpoint is down or backed up
+func (e *forwardEndpoint) push(pkt *rtp.Packet) {
+	select {
+	case e.forwardChan <- pkt:
+		return
+	default:
+	}
+	if e.State() != RTPForwarderConnected {
+		atomic.AddUint64(&e.dropped, 1)
+		return
+	}
+	// the endpoint is slow, wait a bit before dropping the packet
+	t := time.NewTimer(forwardBlockTime)
+	defer t.Stop()
+	select {
+	case e.forwardChan <- pkt:
+	case <-t.C:
+		atomic.AddUint64(&e.dropped, 1)
+		log.Warnf("RTPForwarder.WriteRTP endpoint %s is backed up, dropping packet", e.addr)
+	case <-e.done:
+	}
+}
+
+// forwardLoop writes the packets to the endpoint in order,
+// and reconnects when writing keeps failing
+func (e *forwardEndpoint) forwardLoop() {
+	if e.State() == RTPForwarderReconnecting && !e.reconnect() {
+		return
+	}
+	var writeErrCnt int
+	for {
+		select {
+		case <-e.done:
+			return
+		case pkt := <-e.forwardChan:
+			err := e.write(pkt)
+			if err == nil {
+				writeErrCnt = 0
+				continue
+			}
+			log.Errorf("RTPForwarder write to %s => %s", e.addr, err)
+			writeErrCnt++
+			if err == errForwarderNotConnected || writeErrCnt >= e.config.MaxWriteErr {
+				if !e.reconnect() {
+					return
+				}
+				writeErrCnt = 0
+			}
+		}
+	}
+}
+
+func (e *forwardEndpoint) write(pkt *rtp.Packet) error {
+	e.transportLock.Lock()
+	t := e.transport
+	e.transportLock.Unlock()
+	if t == nil {
+		return errForwarderNotConnected
+	}
+	return t.WriteRTP(pkt)
+}
+
+// reconnect close the transport and dial again with exponential backoff,
+// return false if the endpoint was stopped meanwhile
+func (e *forwardEndpoint) reconnect() bool {
+	atomic.StoreInt32(&e.state, RTPForwarderReconnecting)
+	e.transportLock.Lock()
+	if e.transport != nil {
+		e.transport.Close()
+		e.transport = nil
+	}
+	e.transportLock.Unlock()
+
+	maxBackoff := time.Duration(e.config.ReconnectMaxBackoff) * time.Millisecond
+	backoff := reconnectMinBackoff
+	for {
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		log.Infof("RTPForwarder.reconnect addr=%s in %v", e.addr, backoff)
+		select {
+		case <-e.done:
+			return false
+		case <-time.After(backoff):
+		}
+
+		t := e.dial(e.addr)
+		if t == nil {
+			backoff *= 2
+			continue
+		}
+		e.transportLock.Lock()
+		if e.stop {
+			e.transportLock.Unlock()
+			t.Close()
+			return false
+		}
+		e.transport = t
+		e.transportLock.Unlock()
+		atomic.StoreInt32(&e.state, RTPForwarderConnected)
+		log.Infof("RTPForwarder.reconnect addr=%s ok", e.addr)
+		return true
+	}
+}
+
+// State return the connection state, RTPForwarderConnected etc.
+func (e *forwardEndpoint) State() int {
+	return int(atomic.LoadInt32(&e.state))
+}
+
+// Stop close the transport, it may race with a reconnect
+func (e *forwardEndpoint) Stop() {
+	e.transportLock.Lock()
+	defer e.transportLock.Unlock()
+	if e.stop {
+		return
+	}
+	e.stop = true
+	atomic.StoreInt32(&e.state, RTPForwarderClosed)
+	close(e.done)
+	if e.transport != nil {
+		e.transport.Close()
+	}
 }
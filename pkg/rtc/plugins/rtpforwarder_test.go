@@ -0,0 +1,237 @@
+package plugins
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+	"github.com/pion/rtp"
+)
+
+func TestRTPForwarderInOrder(t *testing.T) {
+	endpoint := &fakeTransport{}
+	r := newRTPForwarder("fwd", RTPForwarderConfig{Addr: "fake"}, func(string) transport.Transport { return endpoint })
+	defer r.Stop()
+
+	go func() {
+		for range r.ReadRTP() {
+		}
+	}()
+	for sn := uint16(0); sn < 500; sn++ {
+		if err := r.WriteRTP(&rtp.Packet{Header: rtp.Header{SequenceNumber: sn}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testhelper.WaitFor(t, time.Second, func() bool { return len(endpoint.written()) >= 500 })
+	for i, pkt := range endpoint.written() {
+		if pkt.SequenceNumber != uint16(i) {
+			t.Fatalf("forwarded[%d]=%d, want in order", i, pkt.SequenceNumber)
+		}
+	}
+	if n := r.Dropped(); n != 0 {
+		t.Fatalf("dropped=%d, want 0", n)
+	}
+}
+
+func TestRTPForwarderDropsWhenBackedUp(t *testing.T) {
+	// the endpoint never finishes a write
+	endpoint := &fakeTransport{writeCh: make(chan struct{})}
+	r := newRTPForwarder("fwd", RTPForwarderConfig{Addr: "fake"}, func(string) transport.Transport { return endpoint })
+	defer r.Stop()
+	defer close(endpoint.writeCh)
+
+	go func() {
+		for range r.ReadRTP() {
+		}
+	}()
+	// one packet stuck in the endpoint, maxSize queued, the rest dropped
+	for sn := uint16(0); sn < maxSize+10; sn++ {
+		if err := r.WriteRTP(&rtp.Packet{Header: rtp.Header{SequenceNumber: sn}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := r.Dropped(); n < 9 {
+		t.Fatalf("dropped=%d, want at least 9", n)
+	}
+}
+
+func TestRTPForwarderReconnect(t *testing.T) {
+	failing := &fakeTransport{failWrite: true}
+	recovered := &fakeTransport{}
+	var lock sync.Mutex
+	dials := 0
+	dial := func(string) transport.Transport {
+		lock.Lock()
+		defer lock.Unlock()
+		dials++
+		switch dials {
+		case 1:
+			return failing
+		case 2:
+			// the endpoint is still down
+			return nil
+		default:
+			return recovered
+		}
+	}
+	r := newRTPForwarder("fwd", RTPForwarderConfig{Addr: "fake", MaxWriteErr: 3, ReconnectMaxBackoff: 10}, dial)
+	defer r.Stop()
+	go func() {
+		for range r.ReadRTP() {
+		}
+	}()
+
+	var sn uint16
+	testhelper.WaitFor(t, time.Second, func() bool {
+		if len(recovered.written()) != 0 {
+			return true
+		}
+		if err := r.WriteRTP(&rtp.Packet{Header: rtp.Header{SequenceNumber: sn}}); err != nil {
+			t.Fatal(err)
+		}
+		sn++
+		return false
+	})
+	if state := r.State(); state != RTPForwarderConnected {
+		t.Fatalf("state=%d, want connected", state)
+	}
+	failing.lock.Lock()
+	defer failing.lock.Unlock()
+	if !failing.closed {
+		t.Fatal("failed transport not closed")
+	}
+}
+
+func TestRTPForwarderInitialDialFails(t *testing.T) {
+	connected := &fakeTransport{}
+	var dials int32
+	dial := func(string) transport.Transport {
+		if atomic.AddInt32(&dials, 1) == 1 {
+			return nil
+		}
+		return connected
+	}
+	r := newRTPForwarder("fwd", RTPForwarderConfig{Addr: "fake", ReconnectMaxBackoff: 10}, dial)
+	defer r.Stop()
+	if state := r.State(); state != RTPForwarderReconnecting {
+		t.Fatalf("state=%d, want reconnecting", state)
+	}
+	// reconnected without waiting for a packet
+	testhelper.WaitFor(t, time.Second, func() bool { return r.State() == RTPForwarderConnected })
+}
+
+func TestRTPForwarderStopWhileReconnecting(t *testing.T) {
+	dial := func(string) transport.Transport {
+		return nil
+	}
+	r := newRTPForwarder("fwd", RTPForwarderConfig{Addr: "fake", ReconnectMaxBackoff: 10}, dial)
+	go func() {
+		for range r.ReadRTP() {
+		}
+	}()
+	if err := r.WriteRTP(&rtp.Packet{}); err != nil {
+		t.Fatal(err)
+	}
+	testhelper.WaitFor(t, time.Second, func() bool { return r.State() == RTPForwarderReconnecting })
+	r.Stop()
+	if state := r.State(); state != RTPForwarderClosed {
+		t.Fatalf("state=%d, want closed", state)
+	}
+}
+
+func TestRTPForwarderStopWhileWriting(t *testing.T) {
+	endpoint := &fakeTransport{}
+	r := newRTPForwarder("fwd", RTPForwarderConfig{Addr: "fake"}, func(string) transport.Transport { return endpoint })
+	go func() {
+		for range r.ReadRTP() {
+		}
+	}()
+
+	// the router writes and reads the state while the chain stops
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for sn := uint16(0); sn < 100; sn++ {
+			if err := r.WriteRTP(&rtp.Packet{Header: rtp.Header{SequenceNumber: sn}}); err != nil {
+				t.Error(err)
+				return
+			}
+			r.State()
+		}
+	}()
+	r.Stop()
+	<-done
+	if state := r.State(); state != RTPForwarderClosed {
+		t.Fatalf("state=%d, want closed", state)
+	}
+}
+
+func TestRTPForwarderFanOut(t *testing.T) {
+	endpoints := map[string]*fakeTransport{
+		"a": {},
+		"b": {},
+		// a broken endpoint must not hold back the others
+		"c": {failWrite: true},
+	}
+	dial := func(addr string) transport.Transport {
+		return endpoints[addr]
+	}
+	config := RTPForwarderConfig{Addr: "a", Addrs: []string{"a", "b", "c"}, ReconnectMaxBackoff: 1000}
+	r := newRTPForwarder("fwd", config, dial)
+	defer r.Stop()
+	if n := len(r.States()); n != 3 {
+		t.Fatalf("endpoints=%d, want 3", n)
+	}
+	go func() {
+		for range r.ReadRTP() {
+		}
+	}()
+
+	start := time.Now()
+	for sn := uint16(0); sn < 300; sn++ {
+		if err := r.WriteRTP(&rtp.Packet{Header: rtp.Header{SequenceNumber: sn}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("WriteRTP took %v with a broken endpoint", elapsed)
+	}
+
+	for _, addr := range []string{"a", "b"} {
+		testhelper.WaitFor(t, time.Second, func() bool { return len(endpoints[addr].written()) >= 300 })
+	}
+}
+
+func benchmarkForwarder(b *testing.B, write func(pkt *rtp.Packet)) {
+	pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: 1}, Payload: make([]byte, 1000)}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		write(pkt)
+	}
+}
+
+// BenchmarkRTPForwarderGoroutinePerPacket is the previous forwarding path
+func BenchmarkRTPForwarderGoroutinePerPacket(b *testing.B) {
+	endpoint := &fakeTransport{}
+	benchmarkForwarder(b, func(pkt *rtp.Packet) {
+		go func() {
+			_ = endpoint.WriteRTP(pkt)
+		}()
+	})
+}
+
+func BenchmarkRTPForwarderWriteRTP(b *testing.B) {
+	r := newRTPForwarder("fwd", RTPForwarderConfig{Addr: "fake"}, func(string) transport.Transport { return &fakeTransport{} })
+	defer r.Stop()
+	go func() {
+		for range r.ReadRTP() {
+		}
+	}()
+	benchmarkForwarder(b, func(pkt *rtp.Packet) {
+		_ = r.WriteRTP(pkt)
+	})
+}
@@ -0,0 +1,195 @@
+package plugins
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+const (
+	// default id of the transport-wide sequence number header extension
+	defaultTCCExtID = 3
+
+	// feedback cycle
+	tccCycle = 10 * time.Millisecond
+
+	// reference time unit, 64ms
+	//https://tools.ietf.org/html/draft-holmer-rmcat-transport-wide-cc-extensions-01#section-3.1
+	tccRefTimeUnit = 64 * time.Millisecond
+	// recv delta unit, 250us
+	tccDeltaUnit = rtcp.TypeTCCDeltaScaleFactor * time.Microsecond
+
+	// a run length chunk counts 13 bits
+	maxTCCRunLength = 1<<13 - 1
+	// a two bit status vector chunk holds 7 symbols
+	tccVectorSize = 7
+
+	// a bigger gap is a stream restart, the packets before it are not reported
+	maxTCCGap = 1 << 14
+)
+
+// twccRecorder collect the arrival time of the packets of a pub by
+// transport-wide sequence number and build the transport-cc feedback,
+// the pub bandwidth estimator works on it
+type twccRecorder struct {
+	start time.Time
+	// the feedback is about the first track, as in libwebrtc
+	mediaSSRC uint32
+	// arrival time of the packets not reported yet by extended sequence number
+	arrivals map[int64]time.Duration
+	// the highest extended sequence number received
+	lastSN int64
+	// the first sequence number of the next feedback
+	nextSN  int64
+	started bool
+	fbCount uint8
+	lock    sync.Mutex
+}
+
+func newTWCCRecorder(start time.Time) *twccRecorder {
+	return &twccRecorder{
+		start:    start,
+		arrivals: make(map[int64]time.Duration),
+	}
+}
+
+// record store the arrival time of transport-wide sequence number sn of a
+// packet of ssrc, packets arrived after their feedback was sent are forgotten
+func (t *twccRecorder) record(ssrc uint32, sn uint16, arrival time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var ext int64
+	if !t.started {
+		t.started = true
+		t.mediaSSRC = ssrc
+		ext = int64(sn)
+		t.lastSN, t.nextSN = ext, ext
+	} else {
+		// sequence numbers may wrap
+		ext = t.lastSN + int64(int16(sn-uint16(t.lastSN)))
+	}
+
+	if ext-t.nextSN > maxTCCGap || t.lastSN-ext > maxTCCGap {
+		t.arrivals = make(map[int64]time.Duration)
+		t.lastSN, t.nextSN = ext, ext
+	}
+	if ext < t.nextSN {
+		return
+	}
+	if ext > t.lastSN {
+		t.lastSN = ext
+	}
+	if _, found := t.arrivals[ext]; !found {
+		t.arrivals[ext] = arrival.Sub(t.start)
+	}
+}
+
+// feedback return the transport-cc feedback of the packets received since
+// the last one, nil if none was received
+func (t *twccRecorder) feedback() *rtcp.TransportLayerCC {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.arrivals) == 0 {
+		return nil
+	}
+
+	var (
+		symbols  []uint16
+		deltas   []*rtcp.RecvDelta
+		refTime  int64
+		lastTick int64
+		base     = t.nextSN
+		sn       = base
+	)
+	for ; sn <= t.lastSN; sn++ {
+		arrival, found := t.arrivals[sn]
+		if !found {
+			symbols = append(symbols, rtcp.TypeTCCPacketNotReceived)
+			continue
+		}
+		tick := int64(arrival / tccDeltaUnit)
+		if len(deltas) == 0 {
+			refTime = int64(arrival / tccRefTimeUnit)
+			lastTick = refTime * int64(tccRefTimeUnit/tccDeltaUnit)
+		}
+		delta := tick - lastTick
+		if delta < math.MinInt16 || delta > math.MaxInt16 {
+			// too far from the last packet, it goes to the next feedback
+			break
+		}
+		symbol := uint16(rtcp.TypeTCCPacketReceivedSmallDelta)
+		if delta < 0 || delta > math.MaxUint8 {
+			symbol = rtcp.TypeTCCPacketReceivedLargeDelta
+		}
+		symbols = append(symbols, symbol)
+		deltas = append(deltas, &rtcp.RecvDelta{Type: symbol, Delta: delta * rtcp.TypeTCCDeltaScaleFactor})
+		lastTick = tick
+		delete(t.arrivals, sn)
+	}
+	t.nextSN = sn
+
+	fb := &rtcp.TransportLayerCC{
+		Header: rtcp.Header{
+			Count: rtcp.FormatTCC,
+			Type:  rtcp.TypeTransportSpecificFeedback,
+		},
+		SenderSSRC:         t.mediaSSRC,
+		MediaSSRC:          t.mediaSSRC,
+		BaseSequenceNumber: uint16(base),
+		PacketStatusCount:  uint16(len(symbols)),
+		ReferenceTime:      uint32(refTime) & 0xFFFFFF,
+		FbPktCount:         t.fbCount,
+		PacketChunks:       tccChunks(symbols),
+		RecvDeltas:         deltas,
+	}
+	// the deltas are padded to 32 bits
+	fb.Header.Padding = fb.Len() != tccLen(fb)
+	fb.Header.Length = fb.Len()/4 - 1
+	t.fbCount++
+	return fb
+}
+
+// tccLen return the size of fb without padding
+func tccLen(fb *rtcp.TransportLayerCC) uint16 {
+	// header, ssrcs, base sequence number, status count, reference time and fb count
+	n := 20 + 2*len(fb.PacketChunks)
+	for _, d := range fb.RecvDeltas {
+		n++
+		if d.Type == rtcp.TypeTCCPacketReceivedLargeDelta {
+			n++
+		}
+	}
+	return uint16(n)
+}
+
+// tccChunks encode the status symbols, long runs as run length chunks and
+// the others as two bit status vectors, like libwebrtc
+func tccChunks(symbols []uint16) []rtcp.PacketStatusChunk {
+	var chunks []rtcp.PacketStatusChunk
+	for i := 0; i < len(symbols); {
+		n := 1
+		for i+n < len(symbols) && symbols[i+n] == symbols[i] && n < maxTCCRunLength {
+			n++
+		}
+		if n >= tccVectorSize {
+			chunks = append(chunks, &rtcp.RunLengthChunk{
+				Type:               rtcp.TypeTCCRunLengthChunk,
+				PacketStatusSymbol: symbols[i],
+				RunLength:          uint16(n),
+			})
+			i += n
+			continue
+		}
+		// the vector is padded with not received symbols
+		list := make([]uint16, tccVectorSize)
+		i += copy(list, symbols[i:])
+		chunks = append(chunks, &rtcp.StatusVectorChunk{
+			Type:       rtcp.TypeTCCStatusVectorChunk,
+			SymbolSize: rtcp.TypeTCCSymbolSizeTwoBit,
+			SymbolList: list,
+		})
+	}
+	return chunks
+}
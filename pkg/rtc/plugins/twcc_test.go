@@ -0,0 +1,217 @@
+package plugins
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+func TestTWCCRecorderFeedback(t *testing.T) {
+	start := time.Now()
+	r := newTWCCRecorder(start)
+	if r.feedback() != nil {
+		t.Fatal("feedback with no packet received")
+	}
+
+	// 65535 is lost, 2 arrives 100ms after 1, the sequence numbers wrap
+	at := func(ms float64) time.Time { return start.Add(time.Duration(ms * float64(time.Millisecond))) }
+	r.record(1234, 65533, at(130))
+	r.record(1234, 65534, at(131))
+	r.record(1234, 0, at(132.5))
+	r.record(1234, 1, at(132))
+	r.record(1234, 2, at(232))
+
+	raw, err := r.feedback().Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fb rtcp.TransportLayerCC
+	if err := fb.Unmarshal(raw); err != nil {
+		t.Fatal(err)
+	}
+	if fb.MediaSSRC != 1234 || fb.BaseSequenceNumber != 65533 || fb.PacketStatusCount != 6 || fb.FbPktCount != 0 {
+		t.Fatalf("feedback=%+v, want ssrc 1234 and 6 packets from 65533", fb)
+	}
+	// 130ms is in the third 64ms period
+	if fb.ReferenceTime != 2 {
+		t.Fatalf("ReferenceTime=%d, want 2", fb.ReferenceTime)
+	}
+	if int(fb.Header.Length+1)*4 != len(raw) {
+		t.Fatalf("header length=%d for %d bytes", fb.Header.Length, len(raw))
+	}
+
+	if len(fb.PacketChunks) != 1 {
+		t.Fatalf("chunks=%d, want one status vector", len(fb.PacketChunks))
+	}
+	symbols := fb.PacketChunks[0].(*rtcp.StatusVectorChunk).SymbolList[:fb.PacketStatusCount]
+	small, large, lost := uint16(rtcp.TypeTCCPacketReceivedSmallDelta), uint16(rtcp.TypeTCCPacketReceivedLargeDelta), uint16(rtcp.TypeTCCPacketNotReceived)
+	want := []uint16{small, small, lost, small, large, large}
+	if len(symbols) != len(want) {
+		t.Fatalf("symbols=%v, want %v", symbols, want)
+	}
+	for i := range want {
+		if symbols[i] != want[i] {
+			t.Fatalf("symbols=%v, want %v", symbols, want)
+		}
+	}
+
+	// deltas in us from the reference time, then from the previous packet
+	wantDeltas := []int64{2000, 1000, 1500, -500, 100000}
+	if len(fb.RecvDeltas) != len(wantDeltas) {
+		t.Fatalf("deltas=%d, want %d", len(fb.RecvDeltas), len(wantDeltas))
+	}
+	for i, d := range fb.RecvDeltas {
+		if d.Delta != wantDeltas[i] {
+			t.Fatalf("delta %d=%d, want %d", i, d.Delta, wantDeltas[i])
+		}
+	}
+
+	// the next feedback starts after the last one, a late packet is dropped
+	r.record(1234, 1, at(300))
+	for sn := uint16(3); sn < 13; sn++ {
+		r.record(1234, sn, at(300))
+	}
+	fb2 := r.feedback()
+	if fb2.BaseSequenceNumber != 3 || fb2.PacketStatusCount != 10 || fb2.FbPktCount != 1 {
+		t.Fatalf("feedback=%+v, want packets 3 to 12", fb2)
+	}
+	// a long run is run length encoded
+	if chunk, ok := fb2.PacketChunks[0].(*rtcp.RunLengthChunk); !ok || chunk.RunLength != 10 || len(fb2.PacketChunks) != 1 {
+		t.Fatalf("chunks=%+v, want a run of 10", fb2.PacketChunks)
+	}
+}
+
+func TestJitterBufferTWCC(t *testing.T) {
+	j := NewJitterBuffer("jb", JitterBufferConfig{On: true, TCCOn: true})
+	defer j.Stop()
+	pub := &fakeTransport{}
+	j.setPub(pub)
+
+	// audio and video share the transport-wide sequence numbers
+	for i := uint16(0); i < 4; i++ {
+		pkt := videoPkt(i)
+		if i%2 == 1 {
+			pkt = &rtp.Packet{Header: rtp.Header{SSRC: 5678, PayloadType: 111, SequenceNumber: i}}
+		}
+		ext, err := (&rtp.TransportCCExtension{TransportSequence: 100 + i}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pkt.SetExtension(defaultTCCExtID, ext); err != nil {
+			t.Fatal(err)
+		}
+		if err := j.WriteRTP(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testhelper.WaitFor(t, time.Second, func() bool {
+		var received uint16
+		for _, fb := range pub.twccs() {
+			if fb.MediaSSRC != 1234 || fb.BaseSequenceNumber != 100+received {
+				t.Fatalf("feedback=%+v, want ssrc 1234 from %d", fb, 100+received)
+			}
+			received += fb.PacketStatusCount
+		}
+		return received >= 4
+	})
+}
+
+func (f *fakeTransport) twccs() []*rtcp.TransportLayerCC {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var fbs []*rtcp.TransportLayerCC
+	for _, pkt := range f.rtcp {
+		if fb, ok := pkt.(*rtcp.TransportLayerCC); ok {
+			fbs = append(fbs, fb)
+		}
+	}
+	return fbs
+}
+
+// feedbackTransport is a fakeTransport which negotiated feedback
+type feedbackTransport struct {
+	*fakeTransport
+	feedback string
+}
+
+func (f *feedbackTransport) Feedback() string { return f.feedback }
+
+func TestJitterBufferNegotiatedFeedback(t *testing.T) {
+	// each pub gets the feedback it negotiated, whatever tccon says
+	pubs := map[string]*feedbackTransport{
+		transport.FeedbackTransportCC: {fakeTransport: &fakeTransport{}, feedback: transport.FeedbackTransportCC},
+		transport.FeedbackREMB:        {fakeTransport: &fakeTransport{}, feedback: transport.FeedbackREMB},
+	}
+	jbs := make(map[string]*JitterBuffer)
+	for feedback, pub := range pubs {
+		j := NewJitterBuffer("jb", JitterBufferConfig{On: true, TCCOn: true, REMBCycle: maxREMBCycle, MaxBandwidth: 1000})
+		defer j.Stop()
+		j.setPub(pub)
+		jbs[feedback] = j
+		// 2 of 8 lost
+		for _, sn := range []uint16{0, 1, 2, 4, 5, 7} {
+			pkt := videoPkt(sn)
+			ext, err := (&rtp.TransportCCExtension{TransportSequence: sn}).Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := pkt.SetExtension(defaultTCCExtID, ext); err != nil {
+				t.Fatal(err)
+			}
+			if err := j.WriteRTP(pkt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tcc, remb := pubs[transport.FeedbackTransportCC], pubs[transport.FeedbackREMB]
+	testhelper.WaitFor(t, time.Second, func() bool { return len(tcc.twccs()) != 0 })
+	jbs[transport.FeedbackREMB].sendTWCC()
+	if fbs := remb.twccs(); len(fbs) != 0 {
+		t.Fatalf("remb pub got transport-cc feedback %v", fbs)
+	}
+
+	// remb only caps the transport-cc pub, the other gets the estimate of
+	// the losses
+	rembs := func(pub *feedbackTransport) []*rtcp.ReceiverEstimatedMaximumBitrate {
+		pub.lock.Lock()
+		defer pub.lock.Unlock()
+		var rembs []*rtcp.ReceiverEstimatedMaximumBitrate
+		for _, pkt := range pub.rtcp {
+			if r, ok := pkt.(*rtcp.ReceiverEstimatedMaximumBitrate); ok {
+				rembs = append(rembs, r)
+			}
+		}
+		return rembs
+	}
+	for _, j := range jbs {
+		j.sendREMB()
+	}
+	if r := rembs(tcc); len(r) != 1 || r[0].Bitrate != 1000*1000 {
+		t.Fatalf("transport-cc pub rembs %v, want the max bandwidth", r)
+	}
+	if r := rembs(remb); len(r) != 1 || r[0].Bitrate != minBandwidth*1000 {
+		t.Fatalf("remb pub rembs %v, want the estimate", r)
+	}
+
+	// a pub which negotiated neither gets none
+	none := &feedbackTransport{fakeTransport: &fakeTransport{}}
+	j := NewJitterBuffer("jb", JitterBufferConfig{On: true, TCCOn: true, REMBCycle: maxREMBCycle})
+	defer j.Stop()
+	j.setPub(none)
+	if err := j.WriteRTP(videoPkt(1)); err != nil {
+		t.Fatal(err)
+	}
+	j.sendREMB()
+	j.sendTWCC()
+	none.lock.Lock()
+	defer none.lock.Unlock()
+	if len(none.rtcp) != 0 {
+		t.Fatalf("pub without feedback got %v", none.rtcp)
+	}
+}
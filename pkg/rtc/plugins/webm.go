@@ -0,0 +1,223 @@
+package plugins
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// ebml ids of the webm elements written by webmWriter
+const (
+	ebmlIDHeader             = 0x1A45DFA3
+	ebmlIDVersion            = 0x4286
+	ebmlIDReadVersion        = 0x42F7
+	ebmlIDMaxIDLength        = 0x42F2
+	ebmlIDMaxSizeLength      = 0x42F3
+	ebmlIDDocType            = 0x4282
+	ebmlIDDocTypeVersion     = 0x4287
+	ebmlIDDocTypeReadVersion = 0x4285
+
+	webmIDSegment           = 0x18538067
+	webmIDInfo              = 0x1549A966
+	webmIDTimecodeScale     = 0x2AD7B1
+	webmIDMuxingApp         = 0x4D80
+	webmIDWritingApp        = 0x5741
+	webmIDTracks            = 0x1654AE6B
+	webmIDTrackEntry        = 0xAE
+	webmIDTrackNumber       = 0xD7
+	webmIDTrackUID          = 0x73C5
+	webmIDTrackType         = 0x83
+	webmIDCodecID           = 0x86
+	webmIDCodecPrivate      = 0x63A2
+	webmIDVideo             = 0xE0
+	webmIDPixelWidth        = 0xB0
+	webmIDPixelHeight       = 0xBA
+	webmIDAudio             = 0xE1
+	webmIDSamplingFrequency = 0xB5
+	webmIDChannels          = 0x9F
+	webmIDCluster           = 0x1F43B675
+	webmIDTimecode          = 0xE7
+	webmIDSimpleBlock       = 0xA3
+)
+
+const (
+	webmTrackVideo = 1
+	webmTrackAudio = 2
+
+	webmTrackTypeVideo = 1
+	webmTrackTypeAudio = 2
+
+	webmMuxingApp = "ion-sfu"
+	opusRate      = 48000
+	opusChannels  = 2
+)
+
+// ebmlUnknownSize let the segment and clusters be written without seeking back
+var ebmlUnknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// webmWriter mux vp8 and opus frames into a live webm stream, with ms timecodes
+type webmWriter struct {
+	w           io.WriteCloser
+	hasCluster  bool
+	clusterTime int64
+}
+
+// newWebMWriter write the webm header, with a video track when width and
+// height are set and an audio track when audio is true
+func newWebMWriter(w io.WriteCloser, width, height int, audio bool) (*webmWriter, error) {
+	header := ebmlElement(ebmlIDHeader,
+		ebmlUint(ebmlIDVersion, 1),
+		ebmlUint(ebmlIDReadVersion, 1),
+		ebmlUint(ebmlIDMaxIDLength, 4),
+		ebmlUint(ebmlIDMaxSizeLength, 8),
+		ebmlString(ebmlIDDocType, "webm"),
+		ebmlUint(ebmlIDDocTypeVersion, 2),
+		ebmlUint(ebmlIDDocTypeReadVersion, 2),
+	)
+
+	var tracks [][]byte
+	if width > 0 && height > 0 {
+		tracks = append(tracks, ebmlElement(webmIDTrackEntry,
+			ebmlUint(webmIDTrackNumber, webmTrackVideo),
+			ebmlUint(webmIDTrackUID, webmTrackVideo),
+			ebmlUint(webmIDTrackType, webmTrackTypeVideo),
+			ebmlString(webmIDCodecID, "V_VP8"),
+			ebmlElement(webmIDVideo,
+				ebmlUint(webmIDPixelWidth, uint64(width)),
+				ebmlUint(webmIDPixelHeight, uint64(height)),
+			),
+		))
+	}
+	if audio {
+		tracks = append(tracks, ebmlElement(webmIDTrackEntry,
+			ebmlUint(webmIDTrackNumber, webmTrackAudio),
+			ebmlUint(webmIDTrackUID, webmTrackAudio),
+			ebmlUint(webmIDTrackType, webmTrackTypeAudio),
+			ebmlString(webmIDCodecID, "A_OPUS"),
+			ebmlElement(webmIDCodecPrivate, opusHead()),
+			ebmlElement(webmIDAudio,
+				ebmlFloat(webmIDSamplingFrequency, opusRate),
+				ebmlUint(webmIDChannels, opusChannels),
+			),
+		))
+	}
+
+	buf := header
+	buf = append(buf, ebmlID(webmIDSegment)...)
+	buf = append(buf, ebmlUnknownSize...)
+	buf = append(buf, ebmlElement(webmIDInfo,
+		ebmlUint(webmIDTimecodeScale, 1000000),
+		ebmlString(webmIDMuxingApp, webmMuxingApp),
+		ebmlString(webmIDWritingApp, webmMuxingApp),
+	)...)
+	buf = append(buf, ebmlElement(webmIDTracks, tracks...)...)
+	if _, err := w.Write(buf); err != nil {
+		return nil, err
+	}
+	return &webmWriter{w: w}, nil
+}
+
+// writeBlock write a frame of track at ts ms, a video key frame starts a new cluster
+func (w *webmWriter) writeBlock(track int, keyFrame bool, ts int64, data []byte) error {
+	var buf []byte
+	rel := ts - w.clusterTime
+	if !w.hasCluster || (track == webmTrackVideo && keyFrame) || rel > math.MaxInt16 || rel < math.MinInt16 {
+		w.hasCluster = true
+		w.clusterTime = ts
+		rel = 0
+		buf = append(buf, ebmlID(webmIDCluster)...)
+		buf = append(buf, ebmlUnknownSize...)
+		buf = append(buf, ebmlUint(webmIDTimecode, uint64(ts))...)
+	}
+
+	var flags byte
+	if keyFrame {
+		flags = 0x80
+	}
+	block := make([]byte, 4, 4+len(data))
+	block[0] = 0x80 | byte(track)
+	binary.BigEndian.PutUint16(block[1:], uint16(int16(rel)))
+	block[3] = flags
+	block = append(block, data...)
+	buf = append(buf, ebmlElement(webmIDSimpleBlock, block)...)
+	_, err := w.w.Write(buf)
+	return err
+}
+
+// Close close the underlying writer, the unknown sizes need no finalizing
+func (w *webmWriter) Close() error {
+	return w.w.Close()
+}
+
+// opusHead is the opus codec private data, rfc7845 section 5.1
+func opusHead() []byte {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1
+	head[9] = opusChannels
+	binary.LittleEndian.PutUint32(head[12:], opusRate)
+	return head
+}
+
+// ebmlID return the id bytes, the length marker is part of the id
+func ebmlID(id uint32) []byte {
+	switch {
+	case id <= 0xFF:
+		return []byte{byte(id)}
+	case id <= 0xFFFF:
+		return []byte{byte(id >> 8), byte(id)}
+	case id <= 0xFFFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	}
+	return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+}
+
+// ebmlSize encode n as the shortest vint, all ones is reserved for unknown sizes
+func ebmlSize(n uint64) []byte {
+	l := 1
+	for l < 8 && n >= 1<<(7*uint(l))-1 {
+		l++
+	}
+	b := make([]byte, l)
+	for i := l - 1; i >= 0; i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+	b[0] |= 0x80 >> uint(l-1)
+	return b
+}
+
+func ebmlElement(id uint32, children ...[]byte) []byte {
+	var size int
+	for _, c := range children {
+		size += len(c)
+	}
+	buf := append(ebmlID(id), ebmlSize(uint64(size))...)
+	for _, c := range children {
+		buf = append(buf, c...)
+	}
+	return buf
+}
+
+func ebmlUint(id uint32, v uint64) []byte {
+	l := 1
+	for l < 8 && v >= 1<<(8*uint(l)) {
+		l++
+	}
+	b := make([]byte, l)
+	for i := l - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+	return ebmlElement(id, b)
+}
+
+func ebmlFloat(id uint32, f float64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(f))
+	return ebmlElement(id, b)
+}
+
+func ebmlString(id uint32, s string) []byte {
+	return ebmlElement(id, []byte(s))
+}
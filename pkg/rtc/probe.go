@@ -0,0 +1,187 @@
+package rtc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/log"
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+	"github.com/pion/ion-sfu/pkg/util"
+	"github.com/pion/rtp"
+)
+
+const (
+	// the padding of an rtp packet is at most 255 bytes, its last byte
+	// holds the count
+	maxProbeSize        = 255
+	defaultProbePackets = 5
+
+	// probe bursts remembered to map the nacks of a sub to the pub
+	maxProbeShifts = 64
+)
+
+// isProbe report if pkt is a probe, i.e. its payload is only padding
+func isProbe(pkt *rtp.Packet) bool {
+	n := len(pkt.Payload)
+	return pkt.Padding && n > 0 && int(pkt.Payload[n-1]) == n
+}
+
+// probeShift is a burst of probes, the media written after it is shifted
+// by offset
+type probeShift struct {
+	start  uint16
+	count  uint16
+	offset uint16
+}
+
+// prober builds the padding bursts probing the bandwidth of a sub. The
+// probes continue the sequence numbers of the first video ssrc written to
+// the sub, so the media after a burst is shifted to stay in sequence.
+type prober struct {
+	lock    sync.Mutex
+	started bool
+	ssrc    uint32
+	pt      uint8
+	ts      uint32
+	lastSN  uint16
+	offset  uint16
+	shifts  []probeShift
+	// a burst was sent since the last call to probed
+	pending bool
+}
+
+func newProber() *prober {
+	return &prober{}
+}
+
+// media return pkt shifted past the probes sent before it
+func (p *prober) media(pkt *rtp.Packet) *rtp.Packet {
+	if p == nil || !transport.IsVideo(pkt.PayloadType) {
+		return pkt
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.started {
+		p.started = true
+		p.ssrc = pkt.SSRC
+		p.lastSN = pkt.SequenceNumber
+	}
+	if pkt.SSRC != p.ssrc {
+		return pkt
+	}
+	p.pt = pkt.PayloadType
+	p.ts = pkt.Timestamp
+	if p.offset != 0 {
+		shifted := *pkt
+		shifted.SequenceNumber += p.offset
+		pkt = &shifted
+	}
+	if int16(pkt.SequenceNumber-p.lastSN) > 0 {
+		p.lastSN = pkt.SequenceNumber
+	}
+	return pkt
+}
+
+// burst return count probes of size bytes following the last video packet,
+// nil before one was written
+func (p *prober) burst(count, size int) []*rtp.Packet {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.started || count <= 0 {
+		return nil
+	}
+	p.shifts = append(p.shifts, probeShift{start: p.lastSN + 1, count: uint16(count), offset: p.offset})
+	if len(p.shifts) > maxProbeShifts {
+		p.shifts = p.shifts[1:]
+	}
+	pkts := make([]*rtp.Packet, count)
+	for i := range pkts {
+		p.lastSN++
+		p.offset++
+		payload := make([]byte, size)
+		payload[size-1] = byte(size)
+		pkts[i] = &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Padding:        true,
+				PayloadType:    p.pt,
+				SequenceNumber: p.lastSN,
+				Timestamp:      p.ts,
+				SSRC:           p.ssrc,
+			},
+			Payload: payload,
+		}
+	}
+	p.pending = true
+	return pkts
+}
+
+// pubSeq return the sequence number the pub sent for sn of the sub, false
+// if sn is a probe
+func (p *prober) pubSeq(ssrc uint32, sn uint16) (uint16, bool) {
+	if p == nil {
+		return sn, true
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if ssrc != p.ssrc || len(p.shifts) == 0 {
+		return sn, true
+	}
+	for i := len(p.shifts) - 1; i >= 0; i-- {
+		s := p.shifts[i]
+		if int16(sn-s.start) < 0 {
+			continue
+		}
+		if sn-s.start < s.count {
+			return 0, false
+		}
+		return sn - s.offset - s.count, true
+	}
+	return sn - p.shifts[0].offset, true
+}
+
+// probed report if a burst was sent since the last call
+func (p *prober) probed() bool {
+	if p == nil {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	probed := p.pending
+	p.pending = false
+	return probed
+}
+
+// subProber return the prober of a sub, nil when probing is off
+func (r *Router) subProber(id string) *prober {
+	r.subLock.RLock()
+	defer r.subLock.RUnlock()
+	return r.subProbers[id]
+}
+
+// subProbeLoop send a burst of probes to a sub every interval until it is
+// removed, the remb answering it can step the sub up a layer at once
+func (r *Router) subProbeLoop(subID string, trans transport.Transport, probes *prober, done chan struct{}, interval time.Duration, count, size int) {
+	defer util.Recover("[Router.subProbeLoop]")
+	logger := r.logger.With(log.Fields{"sub_id": subID})
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, pkt := range probes.burst(count, size) {
+				if err := trans.WriteRTP(pkt); err != nil {
+					logger.Debugf("Router.subProbeLoop err=%v", err)
+					continue
+				}
+				atomic.AddUint64(&r.probePackets, 1)
+				atomic.AddUint64(&r.probeBytes, uint64(pkt.MarshalSize()))
+			}
+		case <-done:
+			return
+		case <-r.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package rtc
+
+import (
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+)
+
+func TestProber(t *testing.T) {
+	p := newProber()
+	if p.burst(3, 100) != nil {
+		t.Fatal("probes before a video packet")
+	}
+
+	// audio is left alone
+	audio := &rtp.Packet{Header: rtp.Header{SSRC: 1, PayloadType: 111, SequenceNumber: 7}}
+	if p.media(audio) != audio {
+		t.Fatal("audio packet changed")
+	}
+
+	p.media(&rtp.Packet{Header: rtp.Header{SSRC: 2, PayloadType: 96, SequenceNumber: 10, Timestamp: 900}})
+	probes := p.burst(3, 100)
+	if len(probes) != 3 || !p.probed() || p.probed() {
+		t.Fatalf("probes=%d, want 3 reported once", len(probes))
+	}
+	for i, pkt := range probes {
+		if !isProbe(pkt) || pkt.SSRC != 2 || pkt.PayloadType != 96 || pkt.Timestamp != 900 ||
+			pkt.SequenceNumber != uint16(11+i) || pkt.MarshalSize() != 112 {
+			t.Fatalf("probe %d=%+v", i, pkt.Header)
+		}
+	}
+
+	// the media after the burst continues after the probes
+	pkt := &rtp.Packet{Header: rtp.Header{SSRC: 2, PayloadType: 96, SequenceNumber: 11}}
+	if out := p.media(pkt); out.SequenceNumber != 14 || pkt.SequenceNumber != 11 || isProbe(out) {
+		t.Fatalf("media sn=%d, want 14 without changing the routed packet", out.SequenceNumber)
+	}
+
+	for _, c := range []struct {
+		sn, pubSN uint16
+		ok        bool
+	}{
+		{10, 10, true},
+		{12, 0, false},
+		{14, 11, true},
+	} {
+		if pubSN, ok := p.pubSeq(2, c.sn); pubSN != c.pubSN || ok != c.ok {
+			t.Fatalf("pubSeq(%d)=%d,%v, want %d,%v", c.sn, pubSN, ok, c.pubSN, c.ok)
+		}
+	}
+	if pubSN, ok := p.pubSeq(1, 12); pubSN != 12 || !ok {
+		t.Fatal("sn of another ssrc mapped")
+	}
+}
+
+func TestRouterProbesSubs(t *testing.T) {
+	InitRouter(RouterConfig{ProbeInterval: 50, ProbePackets: 3, ProbeSize: 100})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	defer router.Close()
+
+	stop := make(chan struct{})
+	sent := make(chan int)
+	go func() {
+		sn := uint16(0)
+		for {
+			select {
+			case <-stop:
+				sent <- int(sn)
+				return
+			case <-time.After(5 * time.Millisecond):
+				pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: sn}, Payload: make([]byte, 10)}
+				sn++
+			}
+		}
+	}()
+	start := time.Now()
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+	media := <-sent
+
+	testhelper.WaitFor(t, time.Second, func() bool { return atomic.LoadUint64(&router.packetsRouted) == uint64(media) })
+	// let the sub writer catch up
+	time.Sleep(50 * time.Millisecond)
+
+	router.Close()
+	elapsed := time.Since(start)
+	sub.lock.Lock()
+	written := append([]*rtp.Packet(nil), sub.written...)
+	sub.lock.Unlock()
+	probes := 0
+	var sns []int
+	for _, pkt := range written {
+		if isProbe(pkt) {
+			probes++
+		}
+		sns = append(sns, int(pkt.SequenceNumber))
+	}
+
+	// a burst of 3 every 50ms, the first one once video was written
+	bursts := int(elapsed / (50 * time.Millisecond))
+	if probes%3 != 0 || probes/3 < bursts/2 || probes/3 > bursts {
+		t.Fatalf("probes=%d in %v, want bursts of 3 every 50ms", probes, elapsed)
+	}
+	stats := router.Stats()
+	if stats.ProbePackets != uint64(probes) || stats.ProbeBytes != uint64(probes*112) {
+		t.Fatalf("stats=%+v, want %d probes of 112 bytes", stats, probes)
+	}
+	if stats.PacketsRouted != uint64(media) {
+		t.Fatalf("routed=%d, want %d without the probes", stats.PacketsRouted, media)
+	}
+
+	// probes and media share one gapless sequence
+	sort.Ints(sns)
+	for i, sn := range sns {
+		if sn != i {
+			t.Fatalf("sequence numbers %v, want 0 to %d", sns, len(sns)-1)
+		}
+	}
+}
+
+func TestRouterProbeStepsUpLayer(t *testing.T) {
+	router := NewRouter("router")
+	defer router.Close()
+	router.SetPubLayers([]uint32{1, 2})
+	router.AddSub("sub", newFakeTransport("sub"))
+	router.SetSubLayer("sub", 0)
+	router.subLock.Lock()
+	for i, rate := range []uint64{100000, 500000} {
+		atomic.StoreUint64(&router.layerMeters[i].rate, rate)
+	}
+	router.subLock.Unlock()
+
+	// without a probe the headroom has to last the hold time
+	router.adaptSubLayer("sub", 1000000, false)
+	if layer := router.GetSubLayer("sub"); layer != 0 {
+		t.Fatalf("layer=%d, want 0 before the hold time", layer)
+	}
+	router.adaptSubLayer("sub", 1000000, true)
+	if layer := router.GetSubLayer("sub"); layer != 1 {
+		t.Fatalf("layer=%d, want 1 after a probe", layer)
+	}
+}
@@ -0,0 +1,314 @@
+package rtc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/log"
+	"github.com/pion/ion-sfu/pkg/metrics"
+	"github.com/pion/ion-sfu/pkg/rtc/plugins"
+	"github.com/pion/ion-sfu/pkg/rtc/rtpengine"
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+)
+
+const (
+	statCycle = 3 * time.Second
+
+	// how long Shutdown lets the routers flush when ctx has no deadline
+	defaultShutdownTimeout = 10 * time.Second
+)
+
+var errRegistryClosed = errors.New("registry is closed")
+
+// ErrRouterExists is returned by AddRouter when a router has the id already
+var ErrRouterExists = errors.New("router already exists")
+
+// Registry holds the routers by id, the package functions use a default
+// one and every embedded sfu has its own
+type Registry struct {
+	routers map[string]*Router
+	plugins plugins.Config
+	started time.Time
+	closed  bool
+	done    chan struct{}
+	lock    sync.RWMutex
+}
+
+// NewRegistry return an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		routers: make(map[string]*Router),
+		started: time.Now(),
+		done:    make(chan struct{}),
+	}
+}
+
+// SetPlugins set the plugins config of the routers added from now on
+func (g *Registry) SetPlugins(config plugins.Config) {
+	g.lock.Lock()
+	g.plugins = config
+	g.lock.Unlock()
+	log.Infof("Registry.SetPlugins config=%+v", config)
+}
+
+// Plugins return the plugins config of the routers added from now on
+func (g *Registry) Plugins() plugins.Config {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.plugins
+}
+
+// ServeRTP accept the rtp pubs on config.Port, every pub gets a router
+// named by the id it sends
+func (g *Registry) ServeRTP(config RTPConfig) error {
+	// show stat about all routers
+	go g.check()
+
+	var connCh chan *transport.RTPTransport
+	var err error
+	// accept relay rtptransport
+	if config.KcpKey != "" && config.KcpSalt != "" {
+		connCh, err = rtpengine.ServeWithKCP(config.Port, config.KcpKey, config.KcpSalt)
+	} else {
+		connCh, err = rtpengine.Serve(config.Port)
+	}
+	if err != nil {
+		log.Errorf("rtc.ServeRTP err=%v", err)
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case rtpTransport := <-connCh:
+				go g.acceptRTP(rtpTransport)
+			case <-g.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// acceptRTP add the router of an rtp pub once it sent its id
+func (g *Registry) acceptRTP(rtpTransport *transport.RTPTransport) {
+	id := <-rtpTransport.IDChan
+	if id == "" {
+		log.Errorf("invalid id from incoming rtp transport")
+		return
+	}
+
+	log.Infof("accept new rtp id=%s conn=%s", id, rtpTransport.RemoteAddr().String())
+	router, err := g.AddRouter(id)
+	if err != nil {
+		log.Errorf("rtc.acceptRTP id=%s err=%v", id, err)
+		rtpTransport.Close()
+		return
+	}
+	if err := router.AddPub(rtpTransport); err != nil {
+		log.Errorf("rtc.acceptRTP id=%s err=%v", id, err)
+		rtpTransport.Close()
+	}
+}
+
+// GetOrNewRouter get a router, or add it when there is none with id
+func (g *Registry) GetOrNewRouter(id string) *Router {
+	log.Infof("rtc.GetOrNewRouter id=%s", id)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if router := g.routers[id]; router != nil {
+		return router
+	}
+	router, err := g.addRouter(id)
+	if err != nil {
+		log.Errorf("rtc.GetOrNewRouter err=%v", err)
+		return nil
+	}
+	return router
+}
+
+// GetRouter get router by id, nil if there is none
+func (g *Registry) GetRouter(id string) *Router {
+	log.Infof("rtc.GetRouter id=%s", id)
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.routers[id]
+}
+
+// AddRouter add a new router, ErrRouterExists if there is one with id
+func (g *Registry) AddRouter(id string) (*Router, error) {
+	log.Infof("rtc.AddRouter id=%s", id)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.routers[id] != nil {
+		return nil, ErrRouterExists
+	}
+	return g.addRouter(id)
+}
+
+// addRouter add a new router, g.lock is held and no router has id
+func (g *Registry) addRouter(id string) (*Router, error) {
+	if g.closed {
+		return nil, errRegistryClosed
+	}
+	router := NewRouter(id)
+	if err := router.InitPlugins(g.plugins); err != nil {
+		// not handled yet, closing it doesn't take g.lock
+		router.Close()
+		return nil, err
+	}
+	router.OnClose(func() {
+		g.delRouter(id, router)
+	})
+	metrics.Routers.Inc()
+	g.routers[id] = router
+	return router, nil
+}
+
+// delRouter forget a closed router, if it is still the one with id
+func (g *Registry) delRouter(id string, router *Router) {
+	log.Infof("delRouter id=%s", id)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.routers[id] != router {
+		return
+	}
+	metrics.Routers.Dec()
+	delete(g.routers, id)
+}
+
+// Routers return the routers sorted by id
+func (g *Registry) Routers() []*Router {
+	g.lock.RLock()
+	list := make([]*Router, 0, len(g.routers))
+	for _, router := range g.routers {
+		list = append(list, router)
+	}
+	g.lock.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	return list
+}
+
+// Stats return the stats of all routers
+func (g *Registry) Stats() Stats {
+	routers := g.Routers()
+	stats := Stats{
+		Routers: len(routers),
+		Uptime:  time.Since(g.started),
+	}
+	for _, router := range routers {
+		if router.GetPub() != nil {
+			stats.Pubs++
+		}
+		routerStats := router.Stats()
+		stats.Subs += routerStats.Subs
+		stats.Bitrate += routerStats.Bitrate
+	}
+	return stats
+}
+
+// List return the running routers sorted by id
+func (g *Registry) List() []RouterInfo {
+	routers := g.Routers()
+	infos := make([]RouterInfo, 0, len(routers))
+	for _, router := range routers {
+		info := RouterInfo{ID: router.id, Stats: router.Stats()}
+		if pub := router.GetPub(); pub != nil {
+			info.Pub = pub.ID()
+		}
+		router.subLock.RLock()
+		for id := range router.subs {
+			info.Subs = append(info.Subs, id)
+		}
+		router.subLock.RUnlock()
+		sort.Strings(info.Subs)
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Close close all routers, no router can be added afterwards
+func (g *Registry) Close() {
+	if !g.markClosed() {
+		return
+	}
+	for _, router := range g.Routers() {
+		router.Close()
+	}
+}
+
+// Shutdown close all routers once their subs were sent the packets queued
+// for them, no router can be added afterwards. The routers still flushing
+// when ctx is done are closed at its deadline and ctx.Err() is returned.
+func (g *Registry) Shutdown(ctx context.Context) error {
+	g.markClosed()
+	timeout := defaultShutdownTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	var wg sync.WaitGroup
+	for _, router := range g.Routers() {
+		wg.Add(1)
+		go func(router *Router) {
+			defer wg.Done()
+			router.CloseGraceful(timeout)
+		}(router)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// markClosed stop adding routers, false if it was stopped already
+func (g *Registry) markClosed() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.closed {
+		return false
+	}
+	g.closed = true
+	close(g.done)
+	return true
+}
+
+// check show all Routers' stat
+func (g *Registry) check() {
+	t := time.NewTicker(statCycle)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-g.done:
+			return
+		}
+		routers := g.Routers()
+		if len(routers) == 0 {
+			continue
+		}
+		info := "\n----------------rtc-----------------\n"
+		for _, router := range routers {
+			info += "pub: " + router.id + "\n"
+			subs := router.GetSubs()
+			if len(subs) < 6 {
+				for id := range subs {
+					info += fmt.Sprintf("sub: %s\n", id)
+				}
+				info += "\n"
+			} else {
+				info += fmt.Sprintf("subs: %d\n\n", len(subs))
+			}
+		}
+		log.Infof(info)
+	}
+}
@@ -0,0 +1,41 @@
+package rtc
+
+import (
+	"testing"
+
+	"github.com/pion/ion-sfu/pkg/rtc/plugins"
+)
+
+func TestRegistryAddRouterExists(t *testing.T) {
+	g := NewRegistry()
+	g.SetPlugins(plugins.Config{On: true, JitterBuffer: plugins.JitterBufferConfig{On: true}})
+	defer g.Close()
+
+	router, err := g.AddRouter("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.AddRouter("room"); err != ErrRouterExists {
+		t.Fatalf("AddRouter=%v, want ErrRouterExists", err)
+	}
+	if g.GetRouter("room") != router || router.closed() {
+		t.Fatal("existing router replaced")
+	}
+	if g.GetOrNewRouter("room") != router {
+		t.Fatal("GetOrNewRouter doesn't return the existing router")
+	}
+}
+
+func TestRegistryAddRouterInitFails(t *testing.T) {
+	g := NewRegistry()
+	// on without any plugin, Init refuses it
+	g.SetPlugins(plugins.Config{On: true})
+	defer g.Close()
+
+	if _, err := g.AddRouter("room"); err == nil {
+		t.Fatal("AddRouter succeeded without plugins")
+	}
+	if g.GetRouter("room") != nil || len(g.Routers()) != 0 {
+		t.Fatal("router of a failed AddRouter left in the registry")
+	}
+}
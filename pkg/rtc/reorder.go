@@ -0,0 +1,123 @@
+package rtc
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// subReorderTimeout is how long a packet may wait for a missing one
+const subReorderTimeout = 50 * time.Millisecond
+
+// reorderBuffer holds a few packets per ssrc so a sub receives them in
+// sequence order, only used by one subWriteLoop
+type reorderBuffer struct {
+	depth   int
+	timeout time.Duration
+	streams map[uint32]*reorderStream
+}
+
+type reorderStream struct {
+	started bool
+	// next sequence number to emit
+	next uint16
+	pkts map[uint16]*rtp.Packet
+	// arrival of the oldest held packet
+	since time.Time
+}
+
+func newReorderBuffer(depth int, timeout time.Duration) *reorderBuffer {
+	return &reorderBuffer{
+		depth:   depth,
+		timeout: timeout,
+		streams: make(map[uint32]*reorderStream),
+	}
+}
+
+// Push add a packet and return the packets ready to be written, in order
+func (b *reorderBuffer) Push(pkt *rtp.Packet, now time.Time) []*rtp.Packet {
+	s := b.streams[pkt.SSRC]
+	if s == nil {
+		s = &reorderStream{pkts: make(map[uint16]*rtp.Packet)}
+		b.streams[pkt.SSRC] = s
+	}
+	if !s.started {
+		s.started = true
+		s.next = pkt.SequenceNumber
+	}
+
+	diff := int16(pkt.SequenceNumber - s.next)
+	if diff < 0 {
+		// too late to be in order, a retransmission is still worth sending
+		return []*rtp.Packet{pkt}
+	}
+	if _, found := s.pkts[pkt.SequenceNumber]; found {
+		return nil
+	}
+	if len(s.pkts) == 0 {
+		s.since = now
+	}
+	s.pkts[pkt.SequenceNumber] = pkt
+
+	out := s.drain(nil)
+	// give up on the gap when the window is full
+	for len(s.pkts) > b.depth {
+		out = s.skip(out)
+	}
+	return out
+}
+
+// Expire release packets which waited longer than the timeout
+func (b *reorderBuffer) Expire(now time.Time) []*rtp.Packet {
+	var out []*rtp.Packet
+	for _, s := range b.streams {
+		if len(s.pkts) > 0 && now.Sub(s.since) >= b.timeout {
+			out = s.flush(out)
+		}
+	}
+	return out
+}
+
+// Flush release every held packet
+func (b *reorderBuffer) Flush() []*rtp.Packet {
+	var out []*rtp.Packet
+	for _, s := range b.streams {
+		out = s.flush(out)
+	}
+	return out
+}
+
+// drain emit the consecutive packets starting at next
+func (s *reorderStream) drain(out []*rtp.Packet) []*rtp.Packet {
+	for {
+		pkt, found := s.pkts[s.next]
+		if !found {
+			return out
+		}
+		delete(s.pkts, s.next)
+		out = append(out, pkt)
+		s.next++
+	}
+}
+
+// skip move next to the lowest held packet and drain from there
+func (s *reorderStream) skip(out []*rtp.Packet) []*rtp.Packet {
+	if len(s.pkts) == 0 {
+		return out
+	}
+	lowest := uint16(0xffff)
+	for sn := range s.pkts {
+		if d := sn - s.next; d < lowest {
+			lowest = d
+		}
+	}
+	s.next += lowest
+	return s.drain(out)
+}
+
+func (s *reorderStream) flush(out []*rtp.Packet) []*rtp.Packet {
+	for len(s.pkts) > 0 {
+		out = s.skip(out)
+	}
+	return out
+}
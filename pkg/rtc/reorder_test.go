@@ -0,0 +1,113 @@
+package rtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+)
+
+func reorderPkt(sn uint16) *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{SSRC: 1, SequenceNumber: sn}}
+}
+
+func TestReorderBufferWraparound(t *testing.T) {
+	b := newReorderBuffer(4, time.Second)
+	now := time.Now()
+	var out []*rtp.Packet
+	for _, sn := range []uint16{65534, 0, 65535, 2, 1, 3} {
+		out = append(out, b.Push(reorderPkt(sn), now)...)
+	}
+	want := []uint16{65534, 65535, 0, 1, 2, 3}
+	if len(out) != len(want) {
+		t.Fatalf("out=%d, want %d", len(out), len(want))
+	}
+	for i, pkt := range out {
+		if pkt.SequenceNumber != want[i] {
+			t.Fatalf("out[%d]=%d, want %d", i, pkt.SequenceNumber, want[i])
+		}
+	}
+}
+
+func TestReorderBufferMissingPacket(t *testing.T) {
+	b := newReorderBuffer(8, 50*time.Millisecond)
+	now := time.Now()
+	if out := b.Push(reorderPkt(10), now); len(out) != 1 {
+		t.Fatalf("out=%d, want 1", len(out))
+	}
+	// 11 never arrives
+	if out := b.Push(reorderPkt(12), now); len(out) != 0 {
+		t.Fatalf("out=%d, want 0 while waiting for 11", len(out))
+	}
+	if out := b.Push(reorderPkt(13), now); len(out) != 0 {
+		t.Fatalf("out=%d, want 0 while waiting for 11", len(out))
+	}
+	if out := b.Expire(now.Add(10 * time.Millisecond)); len(out) != 0 {
+		t.Fatalf("out=%d, want 0 before the timeout", len(out))
+	}
+	out := b.Expire(now.Add(50 * time.Millisecond))
+	if len(out) != 2 || out[0].SequenceNumber != 12 || out[1].SequenceNumber != 13 {
+		t.Fatalf("out=%v, want 12 and 13 after the timeout", out)
+	}
+	// a late 11 is still written
+	if out := b.Push(reorderPkt(11), now); len(out) != 1 {
+		t.Fatalf("out=%d, want 1", len(out))
+	}
+}
+
+func TestReorderBufferFull(t *testing.T) {
+	b := newReorderBuffer(2, time.Second)
+	now := time.Now()
+	b.Push(reorderPkt(1), now)
+	b.Push(reorderPkt(3), now)
+	b.Push(reorderPkt(4), now)
+	// the window is full, give up on 2
+	out := b.Push(reorderPkt(5), now)
+	if len(out) != 3 || out[0].SequenceNumber != 3 || out[2].SequenceNumber != 5 {
+		t.Fatalf("out=%v, want 3 4 5", out)
+	}
+}
+
+func TestRouterSubReorder(t *testing.T) {
+	InitRouter(RouterConfig{SubReorderDepth: 8})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	defer router.Close()
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+
+	for _, sn := range []uint16{100, 102, 101, 105, 103, 104, 107, 106} {
+		pub.rtpCh <- reorderPkt(sn)
+	}
+	testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= 8 })
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	for i, pkt := range sub.written {
+		if pkt.SequenceNumber != 100+uint16(i) {
+			t.Fatalf("written[%d]=%d, want %d", i, pkt.SequenceNumber, 100+i)
+		}
+	}
+}
+
+func TestRouterSubReorderMissingPacket(t *testing.T) {
+	InitRouter(RouterConfig{SubReorderDepth: 8})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	defer router.Close()
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+
+	for _, sn := range []uint16{1, 3, 4} {
+		pub.rtpCh <- reorderPkt(sn)
+	}
+	// 2 is lost, 3 and 4 are released after the timeout
+	testhelper.WaitFor(t, 4*subReorderTimeout, func() bool { return sub.writtenTotal() >= 3 })
+}
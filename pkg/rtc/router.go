@@ -1,11 +1,15 @@
 package rtc
 
 import (
+	"errors"
+	"io"
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/ion-sfu/pkg/log"
+	"github.com/pion/ion-sfu/pkg/metrics"
 	"github.com/pion/ion-sfu/pkg/rtc/plugins"
 	"github.com/pion/ion-sfu/pkg/rtc/transport"
 	"github.com/pion/ion-sfu/pkg/util"
@@ -14,13 +18,78 @@ import (
 )
 
 const (
-	maxWriteErr = 100
+	// REMBStrategyLowest sends the lowest sub estimate to the pub
+	REMBStrategyLowest = "lowest"
+	// REMBStrategyAverage sends the average sub estimate to the pub
+	REMBStrategyAverage = "average"
+
+	defaultMaxWriteErr   = 100
+	defaultSubBufferSize = 1000
+	defaultPLIInterval   = 500 * time.Millisecond
+	defaultREMBInterval  = 200 * time.Millisecond
+	// how long a disconnected pub or sub may take to reconnect
+	defaultDisconnectGrace = 5000 * time.Millisecond
+	// wait between reads of a pub failing with a transient error, doubled
+	// on every failure up to readRetryMax
+	readRetryMin = 10 * time.Millisecond
+	readRetryMax = time.Second
+	// a pub failing every read for pubErrorWindow, at least
+	// pubErrorThreshold times, is closed
+	defaultPubErrorThreshold = 10
+	defaultPubErrorWindow    = 10000 * time.Millisecond
+	// how long the goroutines of a closed router may take to return when
+	// RouterConfig.DebugGoroutines is on
+	goroutineLeakTimeout = 5 * time.Second
+)
+
+// ErrRouterHasPub is returned by AddPub when the router has a pub
+var ErrRouterHasPub = errors.New("router already has a pub")
+
+// router states, Router.state moves forward only
+const (
+	routerRunning uint32 = iota
+	// CloseGraceful flushes the subs, no pub, sub or packet is taken
+	routerDraining
+	routerClosed
 )
 
 type RouterConfig struct {
-	MinBandwidth uint64 `mapstructure:"minbandwidth"`
-	MaxBandwidth uint64 `mapstructure:"maxbandwidth"`
-	REMBFeedback bool   `mapstructure:"rembfeedback"`
+	MinBandwidth       uint64  `mapstructure:"minbandwidth"`
+	MaxBandwidth       uint64  `mapstructure:"maxbandwidth"`
+	REMBFeedback       bool    `mapstructure:"rembfeedback"`
+	SubBufferSize      int     `mapstructure:"subbuffersize"`
+	PLIInterval        int     `mapstructure:"pliinterval"`
+	REMBStrategy       string  `mapstructure:"rembstrategy"`
+	MaxWriteErr        int     `mapstructure:"maxwriteerr"`
+	SubNackBufferSize  int     `mapstructure:"subnackbuffersize"`
+	LayerDownThreshold float64 `mapstructure:"layerdownthreshold"`
+	LayerUpThreshold   float64 `mapstructure:"layerupthreshold"`
+	LayerHoldTime      int     `mapstructure:"layerholdtime"`
+	AudioLevelExtID    int     `mapstructure:"audiolevelextid"`
+	SubReorderDepth    int     `mapstructure:"subreorderdepth"`
+	DisconnectGrace    int     `mapstructure:"disconnectgrace"`
+	RemapSSRC          bool    `mapstructure:"remapssrc"`
+	OpusAware          bool    `mapstructure:"opusaware"`
+	SubSRInterval      int     `mapstructure:"subsrinterval"`
+	ProbeInterval      int     `mapstructure:"probeinterval"`
+	ProbePackets       int     `mapstructure:"probepackets"`
+	ProbeSize          int     `mapstructure:"probesize"`
+	MaxSubs            int     `mapstructure:"maxsubs"`
+	REMBInterval       int     `mapstructure:"rembinterval"`
+	InitialBandwidth   uint64  `mapstructure:"initialbandwidth"`
+	PubErrorThreshold  int     `mapstructure:"puberrorthreshold"`
+	PubErrorWindow     int     `mapstructure:"puberrorwindow"`
+	REMBDelta          float64 `mapstructure:"rembdelta"`
+	DebugGoroutines    bool    `mapstructure:"debuggoroutines"`
+	Pacing             bool    `mapstructure:"pacing"`
+	PacingRate         uint64  `mapstructure:"pacingrate"`
+	UpstreamNackWindow int     `mapstructure:"upstreamnackwindow"`
+	UpstreamNackRate   int     `mapstructure:"upstreamnackrate"`
+	IdleTimeout        int     `mapstructure:"idletimeout"`
+	SubBatchSize       int     `mapstructure:"subbatchsize"`
+	SubBatchDelay      int     `mapstructure:"subbatchdelay"`
+	PubRejoinGrace     int     `mapstructure:"pubrejoingrace"`
+	RewriteTimestamps  bool    `mapstructure:"rewritetimestamps"`
 }
 
 //                                      +--->sub
@@ -30,32 +99,147 @@ type RouterConfig struct {
 //                                      +--->sub
 // Router is rtp router
 type Router struct {
-	id             string
-	pub            transport.Transport
-	subs           map[string]transport.Transport
-	subLock        sync.RWMutex
-	stop           bool
-	pluginChain    *plugins.PluginChain
-	subChans       map[string]chan *rtp.Packet
-	rembChan       chan *rtcp.ReceiverEstimatedMaximumBitrate
-	onCloseHandler func()
-}
-
-// NewRouter return a new Router
+	// accessed atomically, keep 64-bit aligned
+	packetsRouted  uint64
+	packetsDropped uint64
+	packetsCapped  uint64
+	rembTarget     uint64
+	probePackets   uint64
+	probeBytes     uint64
+	goroutines     int64
+	lastActive     int64
+	opusAware      uint32
+	state          uint32
+
+	id              string
+	pub             transport.Transport
+	pubLock         sync.RWMutex
+	pubStarted      bool
+	rejoinTimer     *time.Timer
+	subs            map[string]transport.Transport
+	subLock         sync.RWMutex
+	pluginChain     *plugins.PluginChain
+	subChans        map[string]chan *routedPacket
+	subBatches      map[string]chan []*routedPacket
+	batcher         *batcher
+	subDone         map[string]chan struct{}
+	subRetains      map[string]bool
+	routes          atomic.Value
+	subWriters      sync.WaitGroup
+	droppedPackets  map[string]*uint64
+	pausedSubs      map[string]bool
+	subHistory      map[string]*sendHistory
+	layers          []uint32
+	layerMeters     []*bitrateMeter
+	pubMeter        *slidingMeter
+	capStates       map[uint32]*capState
+	lastCapREMB     time.Time
+	subLayers       map[string]*layerState
+	subBitrates     map[string]uint64
+	subSenders      map[string]*senderStats
+	subPTs          map[string]*payloadTypes
+	subExts         map[string]*extensionIDs
+	subProbers      map[string]*prober
+	subRTX          map[string]*rtxSender
+	subSeqs         map[string]*subSeqs
+	subMaxBitrates  map[string]uint64
+	upstreamNacks   *nackLimiter
+	inboundLoss     *lossTracker
+	onSubREMB       func(string, uint64)
+	ssrcs           map[uint32]uint8
+	ssrcLock        sync.RWMutex
+	ssrcMap         *ssrcMap
+	ssrcChanges     *ssrcChanges
+	opus            *opusTracker
+	lastPLI         time.Time
+	pliLock         sync.Mutex
+	rembChan        chan *rtcp.ReceiverEstimatedMaximumBitrate
+	rembLock        sync.RWMutex
+	rembClosed      bool
+	rembFeedback    bool
+	rembStarted     bool
+	rembRunning     bool
+	rembStop        chan struct{}
+	done            chan struct{}
+	created         time.Time
+	now             func() time.Time // clock of rembLoop, replaced in tests
+	onCloseHandlers []*closeHandler
+	onCloseLock     sync.Mutex
+	audioLevel      uint32
+	onAudioLevel    func(uint8)
+	audioLock       sync.RWMutex
+	dataChannels    map[string]transport.DataChannelOptions
+	dataLock        sync.RWMutex
+	logger          *log.Logger
+}
+
+// NewRouter return a new Router, closed once idle for
+// RouterConfig.IdleTimeout
 func NewRouter(id string) *Router {
+	return newRouter(id, time.Now)
+}
+
+// newRouter return a new Router reading the time from now
+func newRouter(id string, now func() time.Time) *Router {
 	log.Infof("NewRouter id=%s", id)
-	return &Router{
-		id:          id,
-		subs:        make(map[string]transport.Transport),
-		pluginChain: plugins.NewPluginChain(id),
-		subChans:    make(map[string]chan *rtp.Packet),
-		rembChan:    make(chan *rtcp.ReceiverEstimatedMaximumBitrate),
+	r := &Router{
+		id:             id,
+		subs:           make(map[string]transport.Transport),
+		pluginChain:    plugins.NewPluginChain(id),
+		subChans:       make(map[string]chan *routedPacket),
+		subBatches:     make(map[string]chan []*routedPacket),
+		subDone:        make(map[string]chan struct{}),
+		subRetains:     make(map[string]bool),
+		droppedPackets: make(map[string]*uint64),
+		pausedSubs:     make(map[string]bool),
+		subHistory:     make(map[string]*sendHistory),
+		subLayers:      make(map[string]*layerState),
+		subBitrates:    make(map[string]uint64),
+		subSenders:     make(map[string]*senderStats),
+		subPTs:         make(map[string]*payloadTypes),
+		subExts:        make(map[string]*extensionIDs),
+		subProbers:     make(map[string]*prober),
+		subRTX:         make(map[string]*rtxSender),
+		subSeqs:        make(map[string]*subSeqs),
+		subMaxBitrates: make(map[string]uint64),
+		upstreamNacks:  newNackLimiter(),
+		inboundLoss:    newLossTracker(),
+		pubMeter:       &slidingMeter{},
+		capStates:      make(map[uint32]*capState),
+		ssrcs:          make(map[uint32]uint8),
+		opus:           newOpusTracker(),
+		ssrcChanges:    newSSRCChanges(),
+		created:        time.Now(),
+		now:            now,
+		audioLevel:     audioLevelSilence,
+		rembChan:       make(chan *rtcp.ReceiverEstimatedMaximumBitrate),
+		done:           make(chan struct{}),
+		dataChannels:   make(map[string]transport.DataChannelOptions),
+		logger:         log.With(log.Fields{"router_id": id}),
+	}
+	config := getRouterConfig()
+	if config.RemapSSRC {
+		r.ssrcMap = newSSRCMap()
+	}
+	if size, _ := subBatchLimits(config); size > 0 {
+		r.batcher = newBatcher(size)
 	}
+	r.SetOpusAware(config.OpusAware)
+	r.rembFeedback = config.REMBFeedback
+	r.touch(now())
+	timeout := idleTimeout()
+	r.spawn(func() { r.idleLoop(timeout) })
+	return r
+}
+
+// ID return id
+func (r *Router) ID() string {
+	return r.id
 }
 
 // InitPlugins initializes plugins for the router
 func (r *Router) InitPlugins(config plugins.Config) error {
-	log.Infof("Router.InitPlugins config=%+v", config)
+	r.logger.Infof("Router.InitPlugins config=%+v", config)
 	if r.pluginChain != nil {
 		return r.pluginChain.Init(config)
 	}
@@ -63,108 +247,1016 @@ func (r *Router) InitPlugins(config plugins.Config) error {
 }
 
 func (r *Router) start() {
-	if routerConfig.REMBFeedback {
-		go r.rembLoop()
+	config := getRouterConfig()
+	// the pub starts at the initial target until the subs sent feedback,
+	// it applies to the whole pub as no ssrc is known yet
+	if config.InitialBandwidth > 0 {
+		r.sendREMB(clampREMB(config.InitialBandwidth, config), nil)
+	}
+	r.rembLock.Lock()
+	r.rembStarted = true
+	r.startREMBLoop()
+	r.rembLock.Unlock()
+	pub := r.GetPub()
+	r.spawn(func() { r.routeLoop(pub) })
+	r.spawn(func() { r.pubFeedbackLoop(pub) })
+	if r.batcher != nil {
+		_, delay := subBatchLimits(config)
+		r.spawn(func() { r.batchLoop(delay) })
 	}
+	r.touch(r.now())
+}
+
+// spawn run f on a goroutine of the router, counted in Stats().Goroutines
+// until it returns
+func (r *Router) spawn(f func()) {
+	atomic.AddInt64(&r.goroutines, 1)
 	go func() {
-		defer util.Recover("[Router.start]")
-		for {
-			if r.stop {
+		defer atomic.AddInt64(&r.goroutines, -1)
+		f()
+	}()
+}
+
+// routeLoop push rtp from pub, or from pluginChain when it is on, to all subs
+func (r *Router) routeLoop(pub transport.Transport) {
+	defer util.Recover("[Router.routeLoop]")
+	retry := readRetryMin
+	threshold, window := pubErrorLimits(getRouterConfig())
+	// read errors since the last packet of the pub, and when the first was
+	failures := 0
+	var failing time.Time
+	for {
+		if !r.running() {
+			return
+		}
+
+		var pkt *rtp.Packet
+		var err error
+		// packets of the pub go back to its pool once every sub wrote them,
+		// the plugins keep theirs
+		var owner transport.PooledTransport
+		// get rtp from pluginChain or pub
+		if r.pluginChain != nil && r.pluginChain.On() {
+			pkt = r.pluginChain.ReadRTP()
+		} else {
+			// pub was switched, the new pub has its own loop
+			if r.GetPub() != pub {
 				return
 			}
-
-			var pkt *rtp.Packet
-			var err error
-			// get rtp from pluginChain or pub
-			if r.pluginChain != nil && r.pluginChain.On() {
-				pkt = r.pluginChain.ReadRTP()
-			} else {
-				pkt, err = r.pub.ReadRTP()
-				if err != nil {
-					log.Errorf("r.pub.ReadRTP err=%v", err)
-					continue
+			pkt, err = pub.ReadRTP()
+			if err != nil {
+				if isClosedErr(err) {
+					r.logger.Infof("Router pub %s closed err=%v", pub.ID(), err)
+					r.pubClosed(pub)
+					return
+				}
+				now := r.now()
+				if failures == 0 {
+					failing = now
+				}
+				failures++
+				if failures >= threshold && now.Sub(failing) >= window {
+					r.logger.Errorf("Router pub %s failed %d reads in %v, closing err=%v", pub.ID(), failures, now.Sub(failing), err)
+					if r.GetPub() == pub {
+						r.Close()
+					}
+					return
+				}
+				r.logger.Errorf("r.pub.ReadRTP err=%v, retry in %v", err, retry)
+				select {
+				case <-time.After(retry):
+				case <-r.done:
+					return
 				}
+				if retry *= 2; retry > readRetryMax {
+					retry = readRetryMax
+				}
+				continue
 			}
-			// log.Debugf("pkt := <-r.subCh %v", pkt)
-			if pkt == nil {
+			retry = readRetryMin
+			failures = 0
+			owner, _ = pub.(transport.PooledTransport)
+		}
+		// log.Debugf("pkt := <-r.subCh %v", pkt)
+		if pkt == nil {
+			continue
+		}
+		if r.pluginChain != nil {
+			filtered, ok := r.pluginChain.Filter(pkt)
+			if !ok {
+				if owner != nil {
+					owner.ReleaseRTP(pkt)
+				}
 				continue
 			}
-			r.subLock.RLock()
-			// Push to client send queues
-			for i := range r.GetSubs() {
-				// Nonblock sending
-				select {
-				case r.subChans[i] <- pkt:
-				default:
-					log.Errorf("Sub consumer is backed up. Dropping packet")
+			// a new packet may share the buffers of the pooled one, leave
+			// both to the gc
+			if filtered != pkt {
+				pkt, owner = filtered, nil
+			}
+		}
+		if log.TracingSSRC(pkt.SSRC) {
+			r.logger.SSRCf(pkt.SSRC, "Router pub rtp pt=%d sn=%d ts=%d marker=%v size=%d", pkt.PayloadType, pkt.SequenceNumber, pkt.Timestamp, pkt.Marker, pkt.MarshalSize())
+		}
+		r.addSSRC(pkt.SSRC, pkt.PayloadType)
+		r.inboundLoss.push(pkt.SSRC, pkt.SequenceNumber)
+		r.updateAudioLevel(pkt)
+		r.trackOpus(pkt)
+		now := time.Now()
+		r.pubMeter.add(pkt.MarshalSize(), now)
+		if !r.capPacket(pkt, now) {
+			if owner != nil {
+				owner.ReleaseRTP(pkt)
+			}
+			continue
+		}
+		for _, p := range r.checkSSRC(pkt, now, owner) {
+			r.routePacket(p, owner)
+		}
+	}
+}
+
+// upstreamNackLimits return how long a packet nacked to the pub isn't
+// nacked again and how many nacks per second reach the pub
+func upstreamNackLimits(config RouterConfig) (time.Duration, int) {
+	window := defaultUpstreamNackWindow
+	if config.UpstreamNackWindow > 0 {
+		window = time.Duration(config.UpstreamNackWindow) * time.Millisecond
+	}
+	rate := defaultUpstreamNackRate
+	if config.UpstreamNackRate > 0 {
+		rate = config.UpstreamNackRate
+	}
+	return window, rate
+}
+
+// pubErrorLimits return how many read errors for how long without a packet
+// close the pub
+func pubErrorLimits(config RouterConfig) (int, time.Duration) {
+	threshold := config.PubErrorThreshold
+	if threshold <= 0 {
+		threshold = defaultPubErrorThreshold
+	}
+	window := defaultPubErrorWindow
+	if config.PubErrorWindow > 0 {
+		window = time.Duration(config.PubErrorWindow) * time.Millisecond
+	}
+	return threshold, window
+}
+
+// isClosedErr report if a pub read failed because it won't read anymore
+func isClosedErr(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe)
+}
+
+// pubFeedbackLoop forward the sender reports of pub to the subs, they need
+// them to map the rtp timestamps to ntp time and sync audio and video
+func (r *Router) pubFeedbackLoop(pub transport.Transport) {
+	defer util.Recover("[Router.pubFeedbackLoop]")
+	rtcpCh := pub.GetRTCPChan()
+	if rtcpCh == nil {
+		return
+	}
+	for {
+		select {
+		case pkt, ok := <-rtcpCh:
+			if !ok || r.GetPub() != pub {
+				return
+			}
+			if sr, ok := pkt.(*rtcp.SenderReport); ok {
+				if log.TracingSSRC(sr.SSRC) {
+					r.logger.SSRCf(sr.SSRC, "Router pub sr rtp_ts=%d ntp=%d packets=%d octets=%d", sr.RTPTime, sr.NTPTime, sr.PacketCount, sr.OctetCount)
+				}
+				if sr = r.ssrcChanges.senderReport(sr); sr != nil {
+					r.forwardSenderReport(sr)
 				}
 			}
-			r.subLock.RUnlock()
+		case <-r.done:
+			return
 		}
-	}()
+	}
+}
+
+// forwardSenderReport write sr to every running sub, rewritten like the
+// packets the sub receives. The subs the router sends its own reports keep
+// it to map the timestamps instead.
+func (r *Router) forwardSenderReport(sr *rtcp.SenderReport) {
+	now := time.Now()
+	type subReport struct {
+		t  transport.Transport
+		sr *rtcp.SenderReport
+	}
+	r.subLock.RLock()
+	reports := make([]subReport, 0, len(r.subs))
+	for id, sub := range r.subs {
+		if r.pausedSubs[id] {
+			continue
+		}
+		out := r.simulcastSenderReport(id, sr)
+		if out == nil {
+			continue
+		}
+		src := out.SSRC
+		if r.ssrcMap != nil {
+			// nothing was sent on the stable ssrc yet
+			stable, found := r.ssrcMap.lookup(out.SSRC)
+			if !found {
+				continue
+			}
+			out.SSRC = stable
+		}
+		// the timestamps of the sub continue across pubs
+		if out = r.subSeqs[id].senderReport(src, out); out == nil {
+			continue
+		}
+		if stats := r.subSenders[id]; stats != nil {
+			stats.setReference(out, now)
+			continue
+		}
+		reports = append(reports, subReport{t: sub, sr: out})
+	}
+	r.subLock.RUnlock()
+
+	for _, rep := range reports {
+		if err := rep.t.WriteRTCP(rep.sr); err != nil {
+			r.logger.Debugf("Router.forwardSenderReport sub=%s err=%v", rep.t.ID(), err)
+		}
+	}
+}
+
+// subRoute is a sub queue as seen by routePacket
+type subRoute struct {
+	id      string
+	ch      chan *routedPacket
+	done    chan struct{}
+	dropped *uint64
+	// the batches of the sub, nil when it isn't batched
+	batch chan []*routedPacket
+}
+
+// routeSnapshot is the copy of the subs routePacket reads without subLock,
+// it is replaced whenever a sub is added, removed, paused or resumed
+type routeSnapshot struct {
+	subs      []subRoute
+	simulcast bool
+	// some sub keeps packets after writing them, for nacks or reordering
+	retained bool
+}
+
+// updateRoutes publish a new routeSnapshot, subLock must be held
+func (r *Router) updateRoutes() {
+	snap := &routeSnapshot{simulcast: len(r.layers) > 0}
+	for id, ch := range r.subChans {
+		if r.pausedSubs[id] {
+			continue
+		}
+		if r.subRetains[id] {
+			snap.retained = true
+		}
+		snap.subs = append(snap.subs, subRoute{id: id, ch: ch, batch: r.subBatches[id], done: r.subDone[id], dropped: r.droppedPackets[id]})
+	}
+	r.routes.Store(snap)
+}
+
+// routePacket push pkt to the send queue of every sub, pkt is given back
+// to owner when no sub keeps it
+func (r *Router) routePacket(pkt *rtp.Packet, owner transport.PooledTransport) {
+	snap, _ := r.routes.Load().(*routeSnapshot)
+	if snap == nil || len(snap.subs) == 0 {
+		if owner != nil {
+			owner.ReleaseRTP(pkt)
+		}
+		return
+	}
+	// simulcast copies share the payload of pkt
+	if snap.simulcast || snap.retained {
+		owner = nil
+	}
+	routed := newRoutedPacket(pkt, owner)
+	routed.hold()
+	defer routed.release()
+
+	// the simulcast state of the subs is still guarded by subLock, nothing
+	// below may take it again: a waiting AddSub would deadlock a nested RLock
+	if snap.simulcast {
+		r.subLock.RLock()
+		defer r.subLock.RUnlock()
+		r.measureLayer(pkt)
+	}
+	for _, sub := range snap.subs {
+		out := routed
+		if snap.simulcast {
+			layered := r.simulcastPacket(sub.id, pkt)
+			if layered == nil {
+				continue
+			}
+			if layered != pkt {
+				out = newRoutedPacket(layered, nil)
+			}
+		}
+		out.hold()
+		if sub.batch != nil {
+			r.batcher.add(r, sub, out)
+			continue
+		}
+		// Nonblock sending, the queue of a removed sub is never closed so a
+		// stale snapshot is safe
+		select {
+		case <-sub.done:
+			out.release()
+		case sub.ch <- out:
+			atomic.AddUint64(&r.packetsRouted, 1)
+			metrics.PacketsRouted.Inc()
+		default:
+			out.release()
+			atomic.AddUint64(sub.dropped, 1)
+			atomic.AddUint64(&r.packetsDropped, 1)
+			metrics.PacketsDropped.Inc()
+			r.logger.Errorf("Sub consumer is backed up. Dropping packet")
+		}
+	}
+}
+
+// addSSRC remember a ssrc and its payload type seen from the pub
+func (r *Router) addSSRC(ssrc uint32, pt uint8) {
+	r.ssrcLock.RLock()
+	oldPT, found := r.ssrcs[ssrc]
+	r.ssrcLock.RUnlock()
+	if found && oldPT == pt {
+		return
+	}
+	r.ssrcLock.Lock()
+	r.ssrcs[ssrc] = pt
+	r.ssrcLock.Unlock()
+}
+
+// replayKeyFrames queue the last key frames the jitter buffer cached to sub
+// id, it can decode before the pub answers the pli. subLock must be held.
+func (r *Router) replayKeyFrames(id string) {
+	if r.pluginChain == nil {
+		return
+	}
+	hd := r.pluginChain.GetPlugin(plugins.TypeJitterBuffer)
+	if hd == nil {
+		return
+	}
+	jb := hd.(*plugins.JitterBuffer)
+	r.ssrcLock.RLock()
+	ssrcs := make([]uint32, 0, len(r.ssrcs))
+	for ssrc, pt := range r.ssrcs {
+		if transport.IsVideo(pt) {
+			ssrcs = append(ssrcs, ssrc)
+		}
+	}
+	r.ssrcLock.RUnlock()
+
+	subCh, batchCh := r.subChans[id], r.subBatches[id]
+	var batch []*routedPacket
+	for _, ssrc := range ssrcs {
+		for _, pkt := range jb.GetLastKeyframe(ssrc) {
+			// the layers the sub doesn't receive are skipped
+			if pkt = r.simulcastPacket(id, pkt); pkt == nil {
+				break
+			}
+			routed := newRoutedPacket(pkt, nil)
+			routed.hold()
+			// a batched sub reads a single queue, the frames are one batch
+			if batchCh != nil {
+				batch = append(batch, routed)
+				continue
+			}
+			select {
+			case subCh <- routed:
+			default:
+				routed.release()
+				r.logger.Warnf("Router.replayKeyFrames sub=%s queue full", id)
+				return
+			}
+		}
+	}
+	if len(batch) > 0 {
+		// the queue of a new sub is empty
+		batchCh <- batch
+	}
+}
+
+// requestKeyFrame send a pli to the pub for every video ssrc routed so far
+func (r *Router) requestKeyFrame() {
+	pub := r.GetPub()
+	if pub == nil {
+		return
+	}
+	r.ssrcLock.RLock()
+	ssrcs := make([]uint32, 0, len(r.ssrcs))
+	for ssrc, pt := range r.ssrcs {
+		if transport.IsVideo(pt) {
+			ssrcs = append(ssrcs, ssrc)
+		}
+	}
+	r.ssrcLock.RUnlock()
+	if len(ssrcs) == 0 || !r.allowPLI() {
+		return
+	}
+	for _, ssrc := range ssrcs {
+		pli := &rtcp.PictureLossIndication{SenderSSRC: ssrc, MediaSSRC: ssrc}
+		if err := pub.WriteRTCP(pli); err != nil {
+			r.logger.Errorf("Router.requestKeyFrame err => %+v", err)
+		}
+		metrics.PLIs.Inc()
+	}
+}
+
+// RouterStats is a snapshot of the router metrics
+type RouterStats struct {
+	// Subs number of subs
+	Subs int
+	// PubSSRCs ssrcs routed from the pub
+	PubSSRCs []uint32
+	// PacketsRouted packets queued to subs, counted once per sub
+	PacketsRouted uint64
+	// PacketsDropped packets dropped because a sub queue was full
+	PacketsDropped uint64
+	// PacketsCapped video packets dropped to keep the pub under MaxBandwidth
+	PacketsCapped uint64
+	// ProbePackets padding packets sent to subs to probe their bandwidth,
+	// they are not counted as routed
+	ProbePackets uint64
+	// ProbeBytes bytes of the probe packets
+	ProbeBytes uint64
+	// PacketsDuplicate duplicates of pub packets dropped by the dedup plugin
+	PacketsDuplicate uint64
+	// InboundLossCount packets of the pub missing from its sequence numbers,
+	// the ones arriving late aren't counted
+	InboundLossCount uint64
+	// InboundLossRate fraction of the packets of the pub lost
+	InboundLossRate float64
+	// REMBTarget last bitrate sent to the pub by rembLoop
+	REMBTarget uint64
+	// Goroutines loops of the router running, back to 0 once it closed
+	Goroutines int64
+	// Bitrate bits per second routed from the pub
+	Bitrate uint64
+	// Uptime time since the router was created
+	Uptime time.Duration
+}
+
+// Stats return the router metrics
+func (r *Router) Stats() RouterStats {
+	r.ssrcLock.RLock()
+	ssrcs := make([]uint32, 0, len(r.ssrcs))
+	for ssrc := range r.ssrcs {
+		ssrcs = append(ssrcs, ssrc)
+	}
+	r.ssrcLock.RUnlock()
+
+	r.subLock.RLock()
+	subs := len(r.subs)
+	r.subLock.RUnlock()
+	lost, lossRate := r.inboundLoss.stats()
+
+	return RouterStats{
+		Subs:             subs,
+		PubSSRCs:         ssrcs,
+		PacketsRouted:    atomic.LoadUint64(&r.packetsRouted),
+		PacketsDropped:   atomic.LoadUint64(&r.packetsDropped),
+		PacketsCapped:    atomic.LoadUint64(&r.packetsCapped),
+		ProbePackets:     atomic.LoadUint64(&r.probePackets),
+		ProbeBytes:       atomic.LoadUint64(&r.probeBytes),
+		PacketsDuplicate: r.pluginChain.DuplicatesDropped(),
+		InboundLossCount: lost,
+		InboundLossRate:  lossRate,
+		REMBTarget:       atomic.LoadUint64(&r.rembTarget),
+		Goroutines:       atomic.LoadInt64(&r.goroutines),
+		Bitrate:          r.pubMeter.bitrate(),
+		Uptime:           time.Since(r.created),
+	}
+}
+
+// DumpJitterBuffer return a snapshot of the jitter buffer of the pub for
+// debugging, with the packets if packets is set. false when the router runs
+// no jitter buffer.
+func (r *Router) DumpJitterBuffer(packets bool) ([]plugins.BufferDump, bool) {
+	if r.pluginChain == nil {
+		return nil, false
+	}
+	return r.pluginChain.JitterBufferDump(packets)
 }
 
-// AddPub add a pub transport to the router
-func (r *Router) AddPub(t transport.Transport) transport.Transport {
-	log.Infof("AddPub")
+// AddPub add a pub transport to the router, a pub rejoining within
+// PubRejoinGrace of the last one closing takes over its subs. It returns
+// ErrRouterHasPub when the router has a pub, t is left to the caller.
+func (r *Router) AddPub(t transport.Transport) error {
+	r.logger.Infof("AddPub")
+	r.pubLock.Lock()
+	if r.pub != nil {
+		r.pubLock.Unlock()
+		return ErrRouterHasPub
+	}
 	r.pub = t
-	r.pluginChain.AttachPub(t)
-	r.start()
+	rejoined := r.pubStarted
+	r.pubStarted = true
+	if r.rejoinTimer != nil {
+		r.rejoinTimer.Stop()
+		r.rejoinTimer = nil
+	}
+	r.pubLock.Unlock()
+	if rejoined {
+		r.logger.Infof("Router pub %s rejoined", t.ID())
+		r.routePub(t)
+	} else {
+		r.pluginChain.AttachPub(t)
+		r.start()
+	}
 	t.OnClose(func() {
-		r.Close()
+		r.pubClosed(t)
 	})
-	return t
+	r.watchState("pub", t)
+	r.attachData(t)
+	return nil
 }
 
-// delPub
-func (r *Router) delPub() {
-	log.Infof("Router.delPub %s", r.pub.ID())
-	if r.pub != nil {
-		r.pub.Close()
+// SwitchPub replace the pub transport, e.g. when the publisher reconnects,
+// without tearing down the subs
+func (r *Router) SwitchPub(t transport.Transport) {
+	if !r.running() {
+		return
 	}
-	if r.pluginChain != nil {
-		r.pluginChain.Close()
+	old := r.GetPub()
+	if old == nil {
+		if err := r.AddPub(t); err != nil {
+			r.logger.Errorf("Router.SwitchPub %s err=%v", t.ID(), err)
+			t.Close()
+		}
+		return
+	}
+	r.logger.Infof("Router.SwitchPub %s => %s", old.ID(), t.ID())
+
+	// the old pub may still be partially alive, closing it must not close the router
+	old.OnClose(func() {})
+	old.OnConnectionStateChange(func(int) {})
+	if data, ok := old.(transport.DataTransport); ok {
+		data.OnDataChannel(func(string, transport.DataChannelOptions) {})
+		data.OnDataMessage(func(string, []byte) {})
+	}
+	old.Close()
+
+	r.pubLock.Lock()
+	r.pub = t
+	r.pubLock.Unlock()
+	r.routePub(t)
+	t.OnClose(func() {
+		r.pubClosed(t)
+	})
+	r.watchState("pub", t)
+	r.attachData(t)
+}
+
+// routePub route the packets of t, which replaced an earlier pub, to the
+// subs the router already runs
+func (r *Router) routePub(t transport.Transport) {
+	if r.ssrcMap != nil {
+		r.ssrcMap.switchPub()
+	}
+	r.ssrcChanges.reset()
+	r.pluginChain.AttachPub(t)
+	if !r.pluginChain.On() {
+		r.spawn(func() { r.routeLoop(t) })
+	}
+	r.spawn(func() { r.pubFeedbackLoop(t) })
+}
+
+// pubClosed close the router once its pub t closed. With PubRejoinGrace
+// t is removed and the router and its subs wait that long for AddPub to
+// add a new pub.
+func (r *Router) pubClosed(t transport.Transport) {
+	if r.GetPub() != t {
+		return
+	}
+	grace := time.Duration(getRouterConfig().PubRejoinGrace) * time.Millisecond
+	if grace <= 0 {
+		r.Close()
+		return
+	}
+	if !r.delPub(t) {
+		return
+	}
+	r.pubLock.Lock()
+	defer r.pubLock.Unlock()
+	// a pub added meanwhile already rejoined
+	if r.pub != nil || r.rejoinTimer != nil || !r.running() {
+		return
+	}
+	r.logger.Infof("Router pub %s closed, closing in %v unless a pub rejoins", t.ID(), grace)
+	r.rejoinTimer = time.AfterFunc(grace, func() {
+		if r.GetPub() == nil {
+			r.logger.Infof("Router no pub rejoined")
+			r.Close()
+		}
+	})
+}
+
+// delPub remove the pub t and close it, any pub when t is nil. false when
+// t is not the pub.
+func (r *Router) delPub(t transport.Transport) bool {
+	r.pubLock.Lock()
+	pub := r.pub
+	if t != nil && pub != t {
+		r.pubLock.Unlock()
+		return false
 	}
 	r.pub = nil
+	r.pubLock.Unlock()
+	if pub != nil {
+		r.logger.Infof("Router.delPub %s", pub.ID())
+		pub.Close()
+	}
+	return true
+}
+
+// watchState close t when it stays disconnected for DisconnectGrace, its
+// OnClose handler then closes the router or removes the sub. A transport
+// reconnecting within the grace period is kept, a failed one closes itself.
+func (r *Router) watchState(name string, t transport.Transport) {
+	var timer *time.Timer
+	var lock sync.Mutex
+	t.OnConnectionStateChange(func(state int) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch state {
+		case transport.StateDisconnected:
+			if timer != nil {
+				return
+			}
+			grace := defaultDisconnectGrace
+			if ms := getRouterConfig().DisconnectGrace; ms > 0 {
+				grace = time.Duration(ms) * time.Millisecond
+			}
+			r.logger.Infof("Router %s disconnected, closing in %v", name, grace)
+			timer = time.AfterFunc(grace, func() {
+				r.logger.Infof("Router %s did not reconnect", name)
+				t.Close()
+			})
+		case transport.StateConnected:
+			if timer != nil && timer.Stop() {
+				r.logger.Infof("Router %s reconnected", name)
+			}
+			timer = nil
+		}
+	})
+}
+
+// attachData forward the data channel messages of the pub to the subs,
+// when it carries data channels
+func (r *Router) attachData(t transport.Transport) {
+	pub, ok := t.(transport.DataTransport)
+	if !ok {
+		return
+	}
+	pub.OnDataChannel(r.addDataChannel)
+	pub.OnDataMessage(r.BroadcastData)
+}
+
+// addDataChannel open a data channel of the pub on every sub, ordered and
+// reliable like the one of the pub
+func (r *Router) addDataChannel(label string, options transport.DataChannelOptions) {
+	r.logger.Infof("Router.addDataChannel label=%s options=%+v", label, options)
+	r.dataLock.Lock()
+	r.dataChannels[label] = options
+	r.dataLock.Unlock()
+
+	r.subLock.RLock()
+	defer r.subLock.RUnlock()
+	for id, sub := range r.subs {
+		if data, ok := sub.(transport.DataTransport); ok {
+			if err := data.CreateDataChannel(label, options); err != nil {
+				r.logger.Errorf("Router.addDataChannel sub=%s label=%s err=%v", id, label, err)
+			}
+		}
+	}
+}
+
+// openDataChannels open the data channels of the pub on a new sub
+func (r *Router) openDataChannels(id string, sub transport.DataTransport) {
+	r.dataLock.RLock()
+	defer r.dataLock.RUnlock()
+	for label, options := range r.dataChannels {
+		if err := sub.CreateDataChannel(label, options); err != nil {
+			r.logger.Errorf("Router.openDataChannels sub=%s label=%s err=%v", id, label, err)
+		}
+	}
+}
+
+// BroadcastData send msg on the data channel labeled label of every sub
+func (r *Router) BroadcastData(label string, msg []byte) {
+	if r.closed() {
+		return
+	}
+	r.subLock.RLock()
+	subs := make(map[string]transport.DataTransport, len(r.subs))
+	for id, sub := range r.subs {
+		if data, ok := sub.(transport.DataTransport); ok {
+			subs[id] = data
+		}
+	}
+	r.subLock.RUnlock()
+
+	for id, sub := range subs {
+		if err := sub.WriteData(label, msg); err != nil {
+			r.logger.Debugf("Router.BroadcastData sub=%s label=%s err=%v", id, label, err)
+		}
+	}
 }
 
 // GetPub get pub
 func (r *Router) GetPub() transport.Transport {
 	// log.Infof("Router.GetPub %v", r.pub)
+	r.pubLock.RLock()
+	defer r.pubLock.RUnlock()
 	return r.pub
 }
 
-func (r *Router) subWriteLoop(subID string, trans transport.Transport) {
-	for pkt := range r.subChans[subID] {
-		// log.Infof(" WriteRTP %v:%v to %v PT: %v", pkt.SSRC, pkt.SequenceNumber, trans.ID(), pkt.Header.PayloadType)
+// subState is what the writer of a sub works with, AddSub creates it for
+// every sub added. history, senders and probes are nil when off.
+type subState struct {
+	id      string
+	trans   transport.Transport
+	ch      chan *routedPacket
+	batches chan []*routedPacket
+	done    chan struct{}
+	history *sendHistory
+	senders *senderStats
+	pts     *payloadTypes
+	exts    *extensionIDs
+	seqs    *subSeqs
+	probes  *prober
+	// packets held to put them back in order, 0 writes them as they come
+	reorderDepth int
+}
+
+// subWriteLoop write the queued packets to sub until sub.done is closed,
+// then the packets still queued
+func (r *Router) subWriteLoop(sub *subState) {
+	defer r.subWriters.Done()
+	logger := r.logger.With(log.Fields{"sub_id": sub.id})
+	config := getRouterConfig()
+	maxWriteErr := config.MaxWriteErr
+	if maxWriteErr <= 0 {
+		maxWriteErr = defaultMaxWriteErr
+	}
+	pace := r.subPacer(sub.id, config)
+	// write return false when the sub was removed
+	write := func(pkt *rtp.Packet) bool {
+		src, srcSN := pkt.SSRC, pkt.SequenceNumber
+		// the stable ssrcs are assigned by the payload type of the pub, the
+		// sequence numbers continue when another pub takes one over
+		pkt = sub.probes.media(sub.exts.rewrite(sub.pts.rewrite(sub.seqs.rewrite(pkt.SSRC, r.remapPacket(pkt)))))
+		// log.Infof(" WriteRTP %v:%v to %v PT: %v", pkt.SSRC, pkt.SequenceNumber, sub.trans.ID(), pkt.Header.PayloadType)
+		// the resent packets don't come through here and skip the pacer
+		if wait := pace.delay(pkt); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-r.done:
+			}
+		}
 
-		if err := trans.WriteRTP(pkt); err != nil {
+		// the pub or the sub ssrc may be traced
+		traced := src
+		if !log.TracingSSRC(src) {
+			traced = pkt.SSRC
+		}
+		if err := sub.trans.WriteRTP(pkt); err != nil {
+			if log.TracingSSRC(traced) {
+				logger.SSRCf(traced, "Router sub rtp sn=%d write err=%v", srcSN, err)
+			}
 			// log.Errorf("wt.WriteRTP err=%v", err)
 			// del sub when err is increasing
-			if trans.WriteErrTotal() > maxWriteErr {
-				r.delSub(trans.ID())
+			if sub.trans.WriteErrTotal() >= maxWriteErr {
+				logger.Errorf("Router.subWriteLoop too many write errors, del sub")
+				r.delSub(sub.id)
+				return false
+			}
+			return true
+		}
+		sub.trans.WriteErrReset()
+		if log.TracingSSRC(traced) {
+			logger.SSRCf(traced, "Router sub rtp sn=%d as ssrc=%d pt=%d sn=%d ts=%d", srcSN, pkt.SSRC, pkt.PayloadType, pkt.SequenceNumber, pkt.Timestamp)
+		}
+		metrics.BytesForwarded.Add(float64(pkt.MarshalSize()))
+		if sub.history != nil {
+			sub.history.Push(pkt)
+		}
+		if sub.senders != nil {
+			sub.senders.add(pkt, time.Now())
+		}
+		return true
+	}
+
+	// send write a queued packet and release it
+	send := func(routed *routedPacket) bool {
+		ok := write(routed.pkt)
+		routed.release()
+		return ok
+	}
+
+	// queued return the packets left in sub.ch and sub.batches once
+	// sub.done is closed, a sub is fed by only one of them
+	queued := func() []*routedPacket {
+		var pkts []*routedPacket
+		for {
+			select {
+			case routed := <-sub.ch:
+				pkts = append(pkts, routed)
+			case batch := <-sub.batches:
+				pkts = append(pkts, batch...)
+			default:
+				return pkts
+			}
+		}
+	}
+
+	if sub.reorderDepth <= 0 {
+		for {
+			select {
+			case routed := <-sub.ch:
+				if !send(routed) {
+					return
+				}
+			case batch := <-sub.batches:
+				for _, routed := range batch {
+					if !send(routed) {
+						return
+					}
+				}
+			case <-sub.done:
+				for _, routed := range queued() {
+					if !send(routed) {
+						return
+					}
+				}
+				logger.Infof("Closing sub writer")
+				return
+			}
+		}
+	}
+
+	// the reorder buffer keeps the packets, they are never pooled
+	reorder := newReorderBuffer(sub.reorderDepth, subReorderTimeout)
+	ticker := time.NewTicker(subReorderTimeout / 2)
+	defer ticker.Stop()
+	for {
+		var pkts []*rtp.Packet
+		select {
+		case routed := <-sub.ch:
+			pkts = reorder.Push(routed.pkt, time.Now())
+			routed.release()
+		case batch := <-sub.batches:
+			now := time.Now()
+			for _, routed := range batch {
+				pkts = append(pkts, reorder.Push(routed.pkt, now)...)
+				routed.release()
+			}
+		case <-sub.done:
+			now := time.Now()
+			for _, routed := range queued() {
+				ready := reorder.Push(routed.pkt, now)
+				routed.release()
+				for _, pkt := range ready {
+					if !write(pkt) {
+						return
+					}
+				}
+			}
+			for _, pkt := range reorder.Flush() {
+				if !write(pkt) {
+					return
+				}
+			}
+			logger.Infof("Closing sub writer")
+			return
+		case now := <-ticker.C:
+			pkts = reorder.Expire(now)
+		}
+		for _, pkt := range pkts {
+			if !write(pkt) {
+				return
 			}
 		}
-		trans.WriteErrReset()
 	}
-	log.Infof("Closing sub writer")
 }
 
-func (r *Router) rembLoop() {
-	lastRembTime := time.Now()
-	maxRembTime := 200 * time.Millisecond
-	rembMin := routerConfig.MinBandwidth
-	rembMax := routerConfig.MaxBandwidth
+// clampREMB return target within the min and max bandwidth of config
+func clampREMB(target uint64, config RouterConfig) uint64 {
+	rembMin := config.MinBandwidth
+	rembMax := config.MaxBandwidth
 	if rembMin == 0 {
 		rembMin = 10000 //10 KBit
 	}
 	if rembMax == 0 {
 		rembMax = 100000000 //100 MBit
 	}
+	if target < rembMin {
+		return rembMin
+	} else if target > rembMax {
+		return rembMax
+	}
+	return target
+}
+
+// sendREMB send the remb target for ssrcs to the pub
+func (r *Router) sendREMB(target uint64, ssrcs []uint32) {
+	newPkt := &rtcp.ReceiverEstimatedMaximumBitrate{
+		Bitrate:    target,
+		SenderSSRC: 1,
+		SSRCs:      ssrcs,
+	}
+
+	r.logger.Infof("Router.rembLoop send REMB: %+v", newPkt)
+	atomic.StoreUint64(&r.rembTarget, target)
+	metrics.REMBTarget.Set(float64(target))
+
+	if pub := r.GetPub(); pub != nil && takesREMB(pub) {
+		if err := pub.WriteRTCP(newPkt); err != nil {
+			r.logger.Errorf("Router.rembLoop err => %+v", err)
+		}
+	}
+}
+
+// takesREMB report if t negotiated a congestion control feedback remb
+// applies to, the transports not negotiating any are assumed to
+func takesREMB(t transport.Transport) bool {
+	if f, ok := t.(transport.FeedbackTransport); ok {
+		return f.Feedback() != ""
+	}
+	return true
+}
+
+// rembInterval return the time between the remb sent to the pub
+func rembInterval(config RouterConfig) time.Duration {
+	if config.REMBInterval > 0 {
+		return time.Duration(config.REMBInterval) * time.Millisecond
+	}
+	return defaultREMBInterval
+}
+
+// SetREMBFeedback turn the remb feedback of the subs to the pub on or off,
+// e.g. off for fixed rate broadcasts. It defaults to RouterConfig.REMBFeedback.
+func (r *Router) SetREMBFeedback(on bool) {
+	r.rembLock.Lock()
+	defer r.rembLock.Unlock()
+	r.rembFeedback = on
+	if on {
+		r.startREMBLoop()
+		return
+	}
+	if r.rembRunning {
+		close(r.rembStop)
+		r.rembRunning = false
+	}
+}
+
+// REMBFeedback report if the remb feedback of the subs is sent to the pub
+func (r *Router) REMBFeedback() bool {
+	r.rembLock.RLock()
+	defer r.rembLock.RUnlock()
+	return r.rembFeedback
+}
+
+// startREMBLoop start rembLoop if the feedback is on and the router was
+// started, rembLock must be held
+func (r *Router) startREMBLoop() {
+	if !r.rembFeedback || !r.rembStarted || r.rembRunning || r.rembClosed {
+		return
+	}
+	stop := make(chan struct{})
+	r.rembStop = stop
+	r.rembRunning = true
+	r.spawn(func() { r.rembLoop(stop) })
+}
+
+// rembLoop combine the sub estimates sent to the pub until stop or
+// rembChan is closed
+func (r *Router) rembLoop(stop <-chan struct{}) {
+	lastRembTime := r.now()
 	var lowest uint64 = math.MaxUint64
 	var rembCount, rembTotalRate uint64
+	// the target sent last, a drop of more than REMBDelta of it is sent
+	// before the interval is up. A rise waits for the interval, the stats
+	// since the last send may miss the subs behind.
+	var lastTarget uint64
 
-	for pkt := range r.rembChan {
+	for {
+		var pkt *rtcp.ReceiverEstimatedMaximumBitrate
+		select {
+		case p, ok := <-r.rembChan:
+			if !ok {
+				r.logger.Infof("Closing remb loop")
+				return
+			}
+			pkt = p
+		case <-stop:
+			r.logger.Infof("Stopping remb loop")
+			return
+		}
 		// Update stats
 		rembCount++
 		rembTotalRate += pkt.Bitrate
@@ -172,34 +1264,19 @@ func (r *Router) rembLoop() {
 			lowest = pkt.Bitrate
 		}
 
-		// Send upstream if time
-		if time.Since(lastRembTime) > maxRembTime {
-			lastRembTime = time.Now()
-			avg := uint64(rembTotalRate / rembCount)
-
-			_ = avg
-			target := lowest
-
-			if target < rembMin {
-				target = rembMin
-			} else if target > rembMax {
-				target = rembMax
-			}
-
-			newPkt := &rtcp.ReceiverEstimatedMaximumBitrate{
-				Bitrate:    target,
-				SenderSSRC: 1,
-				SSRCs:      pkt.SSRCs,
-			}
-
-			log.Infof("Router.rembLoop send REMB: %+v", newPkt)
-
-			if r.GetPub() != nil {
-				err := r.GetPub().WriteRTCP(newPkt)
-				if err != nil {
-					log.Errorf("Router.rembLoop err => %+v", err)
-				}
-			}
+		// Send upstream if time, read the config on every packet so a reload
+		// applies to running routers
+		config := getRouterConfig()
+		now := r.now()
+		target := lowest
+		if config.REMBStrategy == REMBStrategyAverage {
+			target = rembTotalRate / rembCount
+		}
+		target = clampREMB(target, config)
+		if now.Sub(lastRembTime) > rembInterval(config) || rembDropped(lastTarget, target, config.REMBDelta) {
+			lastRembTime = now
+			lastTarget = target
+			r.sendREMB(target, pkt.SSRCs)
 
 			// Reset stats
 			rembCount = 0
@@ -209,73 +1286,363 @@ func (r *Router) rembLoop() {
 	}
 }
 
-func (r *Router) subFeedbackLoop(subID string, trans transport.Transport) {
-	for pkt := range trans.GetRTCPChan() {
-		if r.stop {
-			break
+// rembDropped report if target is below last by more than the fraction
+// delta of it, delta 0 never is
+func rembDropped(last, target uint64, delta float64) bool {
+	if delta <= 0 || target >= last {
+		return false
+	}
+	return float64(last-target) > delta*float64(last)
+}
+
+// pushREMB hands a sub estimate to rembLoop, dropping it once the router is
+// closed or the loop stopped
+func (r *Router) pushREMB(pkt *rtcp.ReceiverEstimatedMaximumBitrate) {
+	r.rembLock.RLock()
+	defer r.rembLock.RUnlock()
+	if r.rembClosed {
+		return
+	}
+	// nil until the loop first started, a stopped loop left it closed
+	select {
+	case r.rembChan <- pkt:
+	case <-r.done:
+	case <-r.rembStop:
+	}
+}
+
+// subFeedbackLoop handle the rtcp of sub subID until its transport, the
+// sub or the router closes. The transports don't close their rtcp channel.
+func (r *Router) subFeedbackLoop(subID string, trans transport.Transport, done chan struct{}) {
+	logger := r.logger.With(log.Fields{"sub_id": subID})
+	defer logger.Infof("Closing sub feedback")
+	rtcpCh := trans.GetRTCPChan()
+	for {
+		select {
+		case pkt, ok := <-rtcpCh:
+			if !ok || r.closed() {
+				return
+			}
+			r.subFeedback(logger, subID, pkt)
+		case <-done:
+			return
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// subFeedback handle an rtcp packet of sub subID
+func (r *Router) subFeedback(logger *log.Logger, subID string, pkt rtcp.Packet) {
+	if _, ok := log.TracedSSRC(); ok {
+		for _, ssrc := range pkt.DestinationSSRC() {
+			logger.SSRCf(ssrc, "Router sub rtcp %T %+v", pkt, pkt)
 		}
-		switch pkt := pkt.(type) {
-		case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
-			if r.GetPub() != nil {
-				// Request a Key Frame
-				log.Infof("Router got pli: %d", pkt.DestinationSSRC())
-				err := r.GetPub().WriteRTCP(pkt)
-				if err != nil {
-					log.Errorf("Router pli err => %+v", err)
-				}
+	}
+	switch pkt := pkt.(type) {
+	case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+		if !r.allowPLI() {
+			logger.Debugf("Router drop pli: %d", pkt.DestinationSSRC())
+			return
+		}
+		if r.GetPub() != nil {
+			// Request a Key Frame
+			logger.Infof("Router got pli: %d", pkt.DestinationSSRC())
+			err := r.GetPub().WriteRTCP(r.pubFeedback(pkt))
+			if err != nil {
+				logger.Errorf("Router pli err => %+v", err)
 			}
-		case *rtcp.ReceiverEstimatedMaximumBitrate:
-			if routerConfig.REMBFeedback {
-				r.rembChan <- pkt
-			}
-		case *rtcp.TransportLayerNack:
-			// log.Infof("Router got nack: %+v", pkt)
-			nack := pkt
-			for _, nackPair := range nack.Nacks {
-				if !r.resendRTP(subID, nack.MediaSSRC, nackPair.PacketID) {
-					n := &rtcp.TransportLayerNack{
-						//origin ssrc
-						SenderSSRC: nack.SenderSSRC,
-						MediaSSRC:  nack.MediaSSRC,
-						Nacks:      []rtcp.NackPair{{PacketID: nackPair.PacketID}},
-					}
-					if r.pub != nil {
-						err := r.GetPub().WriteRTCP(n)
-						if err != nil {
-							log.Errorf("Router nack WriteRTCP err => %+v", err)
-						}
-					}
-				}
+			metrics.PLIs.Inc()
+		}
+	case *rtcp.ReceiverEstimatedMaximumBitrate:
+		logger.Debugf("Router got remb: %d", pkt.Bitrate)
+		r.setSubBitrate(subID, pkt.Bitrate)
+		r.adaptSubLayer(subID, r.cappedSubBitrate(subID, pkt.Bitrate), r.subProber(subID).probed())
+		if r.REMBFeedback() {
+			r.pushREMB(r.pubFeedback(pkt).(*rtcp.ReceiverEstimatedMaximumBitrate))
+		}
+	case *rtcp.TransportLayerNack:
+		// log.Infof("Router got nack: %+v", pkt)
+		metrics.NACKs.Inc()
+		nack := pkt
+		probes := r.subProber(subID)
+		config := getRouterConfig()
+		window, rate := upstreamNackLimits(config)
+		now := r.now()
+		// the packets the sub lost which the router can't resend, by pub ssrc
+		var upstream map[uint32][]uint16
+		for _, nackPair := range nack.Nacks {
+			pubSN, ok := probes.pubSeq(nack.MediaSSRC, nackPair.PacketID)
+			if !ok {
+				logger.Debugf("Router drop probe nack: %d %d", nack.MediaSSRC, nackPair.PacketID)
+				continue
 			}
+			pubSSRC, pubSN := r.subSource(subID, nack.MediaSSRC, pubSN)
+			if !r.needsResend(pubSSRC, pubSN) {
+				logger.Debugf("Router drop opus nack: %d %d", nack.MediaSSRC, nackPair.PacketID)
+				continue
+			}
+			if r.resendRTP(subID, nack.MediaSSRC, nackPair.PacketID) {
+				continue
+			}
+			if !r.upstreamNacks.allow(pubSSRC, pubSN, now, window, rate) {
+				logger.Debugf("Router drop upstream nack: %d %d", pubSSRC, pubSN)
+				metrics.NACKsLimited.Inc()
+				continue
+			}
+			if upstream == nil {
+				upstream = make(map[uint32][]uint16)
+			}
+			upstream[pubSSRC] = append(upstream[pubSSRC], pubSN)
+		}
+		pub := r.GetPub()
+		if pub == nil {
+			return
+		}
+		for pubSSRC, sns := range upstream {
+			n := &rtcp.TransportLayerNack{
+				//origin ssrc
+				SenderSSRC: nack.SenderSSRC,
+				MediaSSRC:  pubSSRC,
+				Nacks:      nackPairs(sns),
+			}
+			if log.TracingSSRC(pubSSRC) {
+				logger.SSRCf(pubSSRC, "Router nack pub sns=%v", sns)
+			}
+			if err := pub.WriteRTCP(n); err != nil {
+				logger.Errorf("Router nack WriteRTCP err => %+v", err)
+			}
+		}
 
-		default:
+	default:
+	}
+}
+
+// setSubBitrate store the last estimate of a sub and report it to the
+// OnSubREMB handler
+func (r *Router) setSubBitrate(subID string, bitrate uint64) {
+	r.subLock.Lock()
+	if r.subs[subID] == nil {
+		r.subLock.Unlock()
+		return
+	}
+	r.subBitrates[subID] = bitrate
+	f := r.onSubREMB
+	r.subLock.Unlock()
+	if f != nil {
+		f(subID, bitrate)
+	}
+}
+
+// SubBitrate return the last bitrate estimated by sub id, 0 if it sent none
+func (r *Router) SubBitrate(id string) uint64 {
+	r.subLock.RLock()
+	defer r.subLock.RUnlock()
+	return r.subBitrates[id]
+}
+
+// SetSubMaxBitrate cap sub id at bps whatever it estimates, e.g. for a
+// mobile viewer. It gets the highest simulcast layer under the cap and is
+// paced at most at the cap. 0 removes the cap.
+func (r *Router) SetSubMaxBitrate(id string, bps uint64) {
+	r.logger.Infof("Router.SetSubMaxBitrate id=%s bps=%d", id, bps)
+	r.subLock.Lock()
+	if r.subs[id] == nil {
+		r.subLock.Unlock()
+		return
+	}
+	if bps == 0 {
+		delete(r.subMaxBitrates, id)
+	} else {
+		r.subMaxBitrates[id] = bps
+	}
+	changed := false
+	if st := r.subLayers[id]; st != nil && len(r.layers) >= 2 {
+		cur := r.selectedLayer(st)
+		if next := r.fitSubLayer(id, cur); next != cur {
+			st.layer = next
+			st.downSince = time.Time{}
+			st.upSince = time.Time{}
+			changed = true
 		}
 	}
-	log.Infof("Closing sub feedback")
+	r.subLock.Unlock()
+
+	if changed {
+		r.requestKeyFrame()
+	}
+}
+
+// SubMaxBitrate return the cap of sub id, 0 if it has none
+func (r *Router) SubMaxBitrate(id string) uint64 {
+	r.subLock.RLock()
+	defer r.subLock.RUnlock()
+	return r.subMaxBitrates[id]
+}
+
+// cappedSubBitrate return bitrate, or the cap of sub id if it is lower
+func (r *Router) cappedSubBitrate(id string, bitrate uint64) uint64 {
+	if max := r.SubMaxBitrate(id); max > 0 && bitrate > max {
+		return max
+	}
+	return bitrate
+}
+
+// OnSubREMB set a handler called with the estimate of every remb of a sub,
+// e.g. to pick its quality or warn about its connection
+func (r *Router) OnSubREMB(f func(id string, bitrate uint64)) {
+	r.subLock.Lock()
+	defer r.subLock.Unlock()
+	r.onSubREMB = f
 }
 
-// AddSub add a sub to router
+// allowPLI coalesces keyframe requests from all subs so at most one
+// reaches the pub per PLIInterval
+func (r *Router) allowPLI() bool {
+	interval := time.Duration(getRouterConfig().PLIInterval) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultPLIInterval
+	}
+	r.pliLock.Lock()
+	defer r.pliLock.Unlock()
+	if time.Since(r.lastPLI) < interval {
+		return false
+	}
+	r.lastPLI = time.Now()
+	return true
+}
+
+// AddSub add a sub to router, a key frame is requested so the sub does
+// not wait for the next one to render video
 func (r *Router) AddSub(id string, t transport.Transport) transport.Transport {
 	//fix panic: assignment to entry in nil map
-	if r.stop {
+	if !r.running() {
 		return nil
 	}
 	r.subLock.Lock()
 	defer r.subLock.Unlock()
+	config := getRouterConfig()
+	// checked under subLock, concurrent adds can't pass the limit together
+	if r.subs[id] == nil && r.full(config) {
+		r.logger.Warnf("Router.AddSub id=%s refused, router has %d subs", id, len(r.subs))
+		metrics.SubsRefused.Inc()
+		return nil
+	}
+	subBufferSize := config.SubBufferSize
+	if subBufferSize <= 0 {
+		subBufferSize = defaultSubBufferSize
+	}
+	if r.subs[id] == nil {
+		metrics.Subs.Inc()
+	}
 	r.subs[id] = t
-	r.subChans[id] = make(chan *rtp.Packet, 1000)
-	log.Infof("Router.AddSub id=%s t=%p", id, t)
+	r.touch(r.now())
+	if done := r.subDone[id]; done != nil {
+		close(done)
+	}
+	r.subChans[id] = make(chan *routedPacket, subBufferSize)
+	if r.batcher != nil {
+		r.subBatches[id] = make(chan []*routedPacket, subBufferSize/r.batcher.size+1)
+	} else {
+		delete(r.subBatches, id)
+	}
+	r.subDone[id] = make(chan struct{})
+	r.droppedPackets[id] = new(uint64)
+	layers := &layerState{layer: -1}
+	if config.RewriteTimestamps {
+		layers.ts = &tsRewriter{}
+	}
+	r.subLayers[id] = layers
+	seqs := newSubSeqs(r.now, config.RewriteTimestamps)
+	r.subSeqs[id] = seqs
+	var history *sendHistory
+	if size := config.SubNackBufferSize; size > 0 {
+		history = newSendHistory(size)
+		r.subHistory[id] = history
+	}
+	r.subRetains[id] = history != nil || config.SubReorderDepth > 0
+	var senders *senderStats
+	if config.SubSRInterval > 0 {
+		senders = newSenderStats()
+		r.subSenders[id] = senders
+	} else {
+		delete(r.subSenders, id)
+	}
+	var probes *prober
+	if config.ProbeInterval > 0 {
+		probes = newProber()
+		r.subProbers[id] = probes
+	} else {
+		delete(r.subProbers, id)
+	}
+	// queued before the sub is routed, the cached key frames come first
+	r.replayKeyFrames(id)
+	r.updateRoutes()
+	r.logger.Infof("Router.AddSub id=%s t=%p", id, t)
 
 	t.OnClose(func() {
 		r.delSub(id)
 	})
+	r.watchState("sub "+id, t)
+	if data, ok := t.(transport.DataTransport); ok {
+		r.openDataChannels(id, data)
+	}
 
 	// Sub loops
-	go r.subWriteLoop(id, t)
-	go r.subFeedbackLoop(id, t)
+	sub := &subState{
+		id:           id,
+		trans:        t,
+		ch:           r.subChans[id],
+		batches:      r.subBatches[id],
+		done:         r.subDone[id],
+		history:      history,
+		senders:      senders,
+		pts:          r.subPayloadTypes(id),
+		exts:         r.subExtensionIDs(id),
+		seqs:         seqs,
+		probes:       probes,
+		reorderDepth: config.SubReorderDepth,
+	}
+	done := sub.done
+	r.subWriters.Add(1)
+	r.spawn(func() { r.subWriteLoop(sub) })
+	r.spawn(func() { r.subFeedbackLoop(id, t, done) })
+	if senders != nil {
+		r.spawn(func() {
+			r.subReportLoop(id, t, senders, done, time.Duration(config.SubSRInterval)*time.Millisecond)
+		})
+	}
+	if probes != nil {
+		count := config.ProbePackets
+		if count <= 0 {
+			count = defaultProbePackets
+		}
+		size := config.ProbeSize
+		if size <= 0 || size > maxProbeSize {
+			size = maxProbeSize
+		}
+		r.spawn(func() {
+			r.subProbeLoop(id, t, probes, done, time.Duration(config.ProbeInterval)*time.Millisecond, count, size)
+		})
+	}
+	// joins within PLIInterval share one pli
+	r.requestKeyFrame()
 	return t
 }
 
+// Full report if the router has MaxSubs subs, AddSub refuses new ones
+// until a sub leaves
+func (r *Router) Full() bool {
+	r.subLock.RLock()
+	defer r.subLock.RUnlock()
+	return r.full(getRouterConfig())
+}
+
+// full report if the subs reached config.MaxSubs, subLock must be held
+func (r *Router) full(config RouterConfig) bool {
+	return config.MaxSubs > 0 && len(r.subs) >= config.MaxSubs
+}
+
 // GetSub get a sub by id
 func (r *Router) GetSub(id string) transport.Transport {
 	r.subLock.RLock()
@@ -284,32 +1651,102 @@ func (r *Router) GetSub(id string) transport.Transport {
 	return r.subs[id]
 }
 
-// GetSubs get all subs
+// GetSubs get a copy of all subs, safe to range over while subs come and go
 func (r *Router) GetSubs() map[string]transport.Transport {
 	r.subLock.RLock()
 	defer r.subLock.RUnlock()
 	// log.Infof("Router.GetSubs len=%v", len(r.subs))
-	return r.subs
+	subs := make(map[string]transport.Transport, len(r.subs))
+	for id, sub := range r.subs {
+		subs[id] = sub
+	}
+	return subs
+}
+
+// RemoveSub remove a sub and close it, false if there was no such sub. Of
+// concurrent calls for one sub only one returns true.
+func (r *Router) RemoveSub(id string) bool {
+	return r.delSub(id)
 }
 
-// delSub del sub by id
-func (r *Router) delSub(id string) {
-	log.Infof("Router.delSub id=%s", id)
+// delSub del sub by id, report if it was there
+func (r *Router) delSub(id string) bool {
+	r.logger.Infof("Router.delSub id=%s", id)
 	r.subLock.Lock()
-	defer r.subLock.Unlock()
-	if r.subs[id] != nil {
-		r.subs[id].Close()
+	sub := r.subs[id]
+	if sub != nil {
+		metrics.Subs.Dec()
 	}
-	if r.subChans[id] != nil {
-		close(r.subChans[id])
+	if done := r.subDone[id]; done != nil {
+		close(done)
 	}
 	delete(r.subs, id)
 	delete(r.subChans, id)
+	delete(r.subBatches, id)
+	delete(r.subDone, id)
+	delete(r.subRetains, id)
+	delete(r.droppedPackets, id)
+	delete(r.pausedSubs, id)
+	delete(r.subHistory, id)
+	delete(r.subLayers, id)
+	delete(r.subBitrates, id)
+	delete(r.subSenders, id)
+	delete(r.subPTs, id)
+	delete(r.subExts, id)
+	delete(r.subProbers, id)
+	delete(r.subRTX, id)
+	delete(r.subSeqs, id)
+	delete(r.subMaxBitrates, id)
+	r.updateRoutes()
+	r.subLock.Unlock()
+
+	// close outside the lock, the sub OnClose handler calls back into delSub
+	if sub != nil {
+		sub.Close()
+	}
+	return sub != nil
+}
+
+// SubDropStats return the number of packets dropped for each sub
+// because its send queue was full
+func (r *Router) SubDropStats() map[string]uint64 {
+	r.subLock.RLock()
+	defer r.subLock.RUnlock()
+	stats := make(map[string]uint64, len(r.droppedPackets))
+	for id, dropped := range r.droppedPackets {
+		stats[id] = atomic.LoadUint64(dropped)
+	}
+	return stats
+}
+
+// PauseSub stop sending packets to a sub without removing it
+func (r *Router) PauseSub(id string) {
+	r.logger.Infof("Router.PauseSub id=%s", id)
+	r.subLock.Lock()
+	defer r.subLock.Unlock()
+	if r.subs[id] != nil {
+		r.pausedSubs[id] = true
+		r.updateRoutes()
+	}
+}
+
+// ResumeSub resume sending packets to a paused sub, a key frame is
+// requested so its video recovers quickly
+func (r *Router) ResumeSub(id string) {
+	r.logger.Infof("Router.ResumeSub id=%s", id)
+	r.subLock.Lock()
+	paused := r.pausedSubs[id]
+	delete(r.pausedSubs, id)
+	r.updateRoutes()
+	r.subLock.Unlock()
+	if paused {
+		r.requestKeyFrame()
+	}
 }
 
 // delSubs del all sub
 func (r *Router) delSubs() {
-	log.Infof("Router.delSubs")
+	r.logger.Infof("Router.delSubs")
 	r.subLock.RLock()
 	keys := make([]string, 0, len(r.subs))
 	for k := range r.subs {
@@ -322,40 +1759,188 @@ func (r *Router) delSubs() {
 	}
 }
 
-// Close release all
+// running report if the router takes pubs, subs and packets, neither
+// draining nor closed
+func (r *Router) running() bool {
+	return atomic.LoadUint32(&r.state) == routerRunning
+}
+
+// closed report if Close was called, the loops return once it is
+func (r *Router) closed() bool {
+	return atomic.LoadUint32(&r.state) == routerClosed
+}
+
+// Close release all, it is safe to call concurrently and again
 func (r *Router) Close() {
-	if r.stop {
+	// the first caller closes, the pub, the sub, idle and rejoin timers and
+	// a failing routeLoop may race to it
+	if atomic.SwapUint32(&r.state, routerClosed) == routerClosed {
 		return
 	}
-	log.Infof("Router.Close")
-	r.onCloseHandler()
-	r.delPub()
-	r.stop = true
+	r.logger.Infof("Router.Close")
+	close(r.done)
+	// a handler may add or remove handlers
+	r.onCloseLock.Lock()
+	handlers := append([]*closeHandler(nil), r.onCloseHandlers...)
+	r.onCloseLock.Unlock()
+	for _, h := range handlers {
+		if h.f != nil {
+			h.f()
+		}
+	}
+	r.pubLock.Lock()
+	if r.rejoinTimer != nil {
+		r.rejoinTimer.Stop()
+		r.rejoinTimer = nil
+	}
+	r.pubLock.Unlock()
+	r.delPub(nil)
+	if r.pluginChain != nil {
+		r.pluginChain.Close()
+	}
 	r.delSubs()
+
+	// wait for in-flight feedback to give up before closing rembChan
+	r.rembLock.Lock()
+	r.rembClosed = true
+	close(r.rembChan)
+	r.rembLock.Unlock()
+
+	if getRouterConfig().DebugGoroutines {
+		go r.checkGoroutines(goroutineLeakTimeout)
+	}
 }
 
-// OnClose handler called when router is closed.
-func (r *Router) OnClose(f func()) {
-	r.onCloseHandler = f
+// checkGoroutines log an error if the goroutines of the closed router are
+// still running after timeout, each of them must return once it closed
+func (r *Router) checkGoroutines(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		n := atomic.LoadInt64(&r.goroutines)
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			r.logger.Errorf("Router.Close %d goroutines still running after %v", n, timeout)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 }
 
+// CloseGraceful stops routing packets from the pub, waits for every sub
+// to flush its queued packets or until timeout, then closes the router
+func (r *Router) CloseGraceful(timeout time.Duration) {
+	// a concurrent Close or CloseGraceful wins
+	if !atomic.CompareAndSwapUint32(&r.state, routerRunning, routerDraining) {
+		return
+	}
+	r.logger.Infof("Router.CloseGraceful timeout=%v", timeout)
+	// the packets waiting for their batch are queued first
+	if r.batcher != nil {
+		r.batcher.flush(r)
+	}
+
+	// closing done lets each subWriteLoop exit once its queue is empty
+	r.subLock.Lock()
+	for id, done := range r.subDone {
+		close(done)
+		delete(r.subChans, id)
+		delete(r.subBatches, id)
+		delete(r.subDone, id)
+	}
+	r.updateRoutes()
+	r.subLock.Unlock()
+
+	done := make(chan struct{})
+	r.spawn(func() {
+		r.subWriters.Wait()
+		close(done)
+	})
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		r.logger.Warnf("Router.CloseGraceful timeout, dropping unsent packets")
+	}
+	r.Close()
+}
+
+// Use add middleware filtering the packets of the pub before they are
+// routed to the subs, see plugins.Middleware
+func (r *Router) Use(m plugins.Middleware) {
+	r.pluginChain.Use(m)
+}
+
+// closeHandler is a handler added by OnClose, compared by pointer to remove it
+type closeHandler struct {
+	f func()
+}
+
+// OnClose add a handler called when router is closed,
+// handlers are called in registration order. The returned func removes
+// the handler, e.g. once its owner is gone before the router.
+func (r *Router) OnClose(f func()) func() {
+	h := &closeHandler{f: f}
+	r.onCloseLock.Lock()
+	defer r.onCloseLock.Unlock()
+	r.onCloseHandlers = append(r.onCloseHandlers, h)
+	return func() {
+		r.onCloseLock.Lock()
+		defer r.onCloseLock.Unlock()
+		for i, other := range r.onCloseHandlers {
+			if other == h {
+				r.onCloseHandlers = append(r.onCloseHandlers[:i], r.onCloseHandlers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// resendRTP resend packet sn of ssrc, as the sub sees it, to sub sid, on
+// the rtx stream of ssrc if the sub negotiated one
 func (r *Router) resendRTP(sid string, ssrc uint32, sn uint16) bool {
-	if r.pub == nil {
+	// try the packets already sent to this sub first
+	r.subLock.RLock()
+	sub, history, probes, rtx := r.subs[sid], r.subHistory[sid], r.subProbers[sid], r.subRTX[sid]
+	r.subLock.RUnlock()
+	if sub != nil && history != nil {
+		if pkt := history.Get(ssrc, sn); pkt != nil {
+			if err := sub.WriteRTP(rtx.wrap(pkt)); err != nil {
+				r.logger.Errorf("router.resendRTP err=%v", err)
+			}
+			return true
+		}
+	}
+
+	if r.GetPub() == nil {
 		return false
 	}
 	hd := r.pluginChain.GetPlugin(plugins.TypeJitterBuffer)
 	if hd != nil {
 		jb := hd.(*plugins.JitterBuffer)
-		pkt := jb.GetPacket(ssrc, sn)
+		pubSN, ok := probes.pubSeq(ssrc, sn)
+		if !ok {
+			return true
+		}
+		pkt := jb.GetPacket(r.subSource(sid, ssrc, pubSN))
 		if pkt == nil {
 			// log.Infof("Router.resendRTP pkt not found sid=%s ssrc=%d sn=%d pkt=%v", sid, ssrc, sn, pkt)
 			return false
 		}
 		sub := r.GetSub(sid)
 		if sub != nil {
-			err := sub.WriteRTP(pkt)
+			r.subLock.RLock()
+			pts := r.subPTs[sid]
+			exts := r.subExts[sid]
+			r.subLock.RUnlock()
+			// resent as the sub was sent it
+			resent := *pkt
+			resent.SSRC = ssrc
+			resent.SequenceNumber = sn
+			out := exts.rewrite(pts.rewrite(&resent))
+			err := sub.WriteRTP(rtx.wrap(out))
 			if err != nil {
-				log.Errorf("router.resendRTP err=%v", err)
+				r.logger.Errorf("router.resendRTP err=%v", err)
 			}
 			// log.Infof("Router.resendRTP sid=%s ssrc=%d sn=%d", sid, ssrc, sn)
 			return true
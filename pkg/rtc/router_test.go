@@ -0,0 +1,1783 @@
+package rtc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+	"github.com/pion/ion-sfu/pkg/metrics"
+	"github.com/pion/ion-sfu/pkg/rtc/plugins"
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var errFakeWrite = errors.New("fake write error")
+
+// fakeTransport is an in-memory transport.Transport used by router tests
+type fakeTransport struct {
+	id             string
+	rtpCh          chan *rtp.Packet
+	rtcpCh         chan rtcp.Packet
+	lock           sync.Mutex
+	written        []*rtp.Packet
+	writtenRTCP    []rtcp.Packet
+	failWrite      bool
+	discard        bool
+	readErr        error
+	reads          int32
+	writeStarted   chan struct{}
+	writeBlock     chan struct{}
+	writeErrCnt    int
+	stop           bool
+	onCloseHandler func()
+	onStateHandler func(int)
+}
+
+func newFakeTransport(id string) *fakeTransport {
+	return &fakeTransport{
+		id:     id,
+		rtpCh:  make(chan *rtp.Packet, 100),
+		rtcpCh: make(chan rtcp.Packet, 100),
+	}
+}
+
+func (f *fakeTransport) ID() string {
+	return f.id
+}
+
+func (f *fakeTransport) Type() int {
+	return -1
+}
+
+func (f *fakeTransport) ReadRTP() (*rtp.Packet, error) {
+	if f.readErr != nil {
+		atomic.AddInt32(&f.reads, 1)
+		return nil, f.readErr
+	}
+	pkt, ok := <-f.rtpCh
+	if !ok {
+		return nil, errors.New("channel closed")
+	}
+	return pkt, nil
+}
+
+func (f *fakeTransport) WriteRTP(pkt *rtp.Packet) error {
+	if f.writeBlock != nil {
+		select {
+		case f.writeStarted <- struct{}{}:
+		default:
+		}
+		<-f.writeBlock
+	}
+	if f.discard {
+		return nil
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.failWrite {
+		f.writeErrCnt++
+		return errFakeWrite
+	}
+	f.written = append(f.written, pkt)
+	return nil
+}
+
+func (f *fakeTransport) WriteRTCP(pkt rtcp.Packet) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.writtenRTCP = append(f.writtenRTCP, pkt)
+	return nil
+}
+
+func (f *fakeTransport) GetRTCPChan() chan rtcp.Packet {
+	return f.rtcpCh
+}
+
+func (f *fakeTransport) Close() {
+	f.lock.Lock()
+	if f.stop {
+		f.lock.Unlock()
+		return
+	}
+	f.stop = true
+	f.lock.Unlock()
+	if f.onCloseHandler != nil {
+		f.onCloseHandler()
+	}
+}
+
+func (f *fakeTransport) OnClose(fn func()) {
+	f.onCloseHandler = fn
+}
+
+func (f *fakeTransport) OnConnectionStateChange(fn func(int)) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.onStateHandler = fn
+}
+
+// setState report a connection state change like the ice agent would
+func (f *fakeTransport) setState(state int) {
+	f.lock.Lock()
+	fn := f.onStateHandler
+	f.lock.Unlock()
+	if fn != nil {
+		fn(state)
+	}
+}
+
+func (f *fakeTransport) isClosed() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.stop
+}
+
+func (f *fakeTransport) WriteErrTotal() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.writeErrCnt
+}
+
+func (f *fakeTransport) WriteErrReset() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.writeErrCnt = 0
+}
+
+func (f *fakeTransport) GetBandwidth() uint32 {
+	return 0
+}
+
+func (f *fakeTransport) writtenTotal() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.written)
+}
+
+func (f *fakeTransport) writtenRTCPTotal() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.writtenRTCP)
+}
+
+// fakeDataTransport is a fakeTransport with in-memory data channels, the
+// remote end opens and sends with open and send
+type fakeDataTransport struct {
+	*fakeTransport
+	dataLock  sync.Mutex
+	channels  map[string]transport.DataChannelOptions
+	received  map[string][]string
+	onChannel func(string, transport.DataChannelOptions)
+	onMessage func(string, []byte)
+}
+
+func newFakeDataTransport(id string) *fakeDataTransport {
+	return &fakeDataTransport{
+		fakeTransport: newFakeTransport(id),
+		channels:      make(map[string]transport.DataChannelOptions),
+		received:      make(map[string][]string),
+	}
+}
+
+func (f *fakeDataTransport) OnDataChannel(fn func(string, transport.DataChannelOptions)) {
+	f.dataLock.Lock()
+	defer f.dataLock.Unlock()
+	f.onChannel = fn
+}
+
+func (f *fakeDataTransport) OnDataMessage(fn func(string, []byte)) {
+	f.dataLock.Lock()
+	defer f.dataLock.Unlock()
+	f.onMessage = fn
+}
+
+func (f *fakeDataTransport) CreateDataChannel(label string, options transport.DataChannelOptions) error {
+	f.dataLock.Lock()
+	defer f.dataLock.Unlock()
+	f.channels[label] = options
+	return nil
+}
+
+func (f *fakeDataTransport) WriteData(label string, msg []byte) error {
+	f.dataLock.Lock()
+	defer f.dataLock.Unlock()
+	if _, found := f.channels[label]; !found {
+		return errors.New("no data channel")
+	}
+	f.received[label] = append(f.received[label], string(msg))
+	return nil
+}
+
+func (f *fakeDataTransport) open(label string, options transport.DataChannelOptions) {
+	f.dataLock.Lock()
+	f.channels[label] = options
+	fn := f.onChannel
+	f.dataLock.Unlock()
+	fn(label, options)
+}
+
+func (f *fakeDataTransport) send(label, msg string) {
+	f.dataLock.Lock()
+	fn := f.onMessage
+	f.dataLock.Unlock()
+	fn(label, []byte(msg))
+}
+
+func (f *fakeDataTransport) channel(label string) (transport.DataChannelOptions, []string, bool) {
+	f.dataLock.Lock()
+	defer f.dataLock.Unlock()
+	options, found := f.channels[label]
+	return options, f.received[label], found
+}
+
+func TestRouterAddSubUsesConfiguredBufferSize(t *testing.T) {
+	InitRouter(RouterConfig{SubBufferSize: 10})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	router.AddSub("sub", newFakeTransport("sub"))
+	defer router.delSub("sub")
+
+	router.subLock.RLock()
+	size := cap(router.subChans["sub"])
+	router.subLock.RUnlock()
+	if size != 10 {
+		t.Fatalf("sub chan cap=%d, want 10", size)
+	}
+}
+
+func TestRouterAddSubUsesDefaultBufferSize(t *testing.T) {
+	router := NewRouter("router")
+	router.AddSub("sub", newFakeTransport("sub"))
+	defer router.delSub("sub")
+
+	router.subLock.RLock()
+	size := cap(router.subChans["sub"])
+	router.subLock.RUnlock()
+	if size != defaultSubBufferSize {
+		t.Fatalf("sub chan cap=%d, want %d", size, defaultSubBufferSize)
+	}
+}
+
+func TestRouterMaxSubs(t *testing.T) {
+	InitRouter(RouterConfig{MaxSubs: 3})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	defer router.Close()
+	refused := testutil.ToFloat64(metrics.SubsRefused)
+
+	// concurrent adds never pass the limit
+	var wg sync.WaitGroup
+	var added int32
+	subs := make([]*fakeTransport, 10)
+	for i := range subs {
+		subs[i] = newFakeTransport(fmt.Sprintf("sub%d", i))
+		wg.Add(1)
+		go func(sub *fakeTransport) {
+			defer wg.Done()
+			if router.AddSub(sub.id, sub) != nil {
+				atomic.AddInt32(&added, 1)
+			}
+		}(subs[i])
+	}
+	wg.Wait()
+	if added != 3 || len(router.GetSubs()) != 3 || !router.Full() {
+		t.Fatalf("added=%d subs=%d, want 3", added, len(router.GetSubs()))
+	}
+	if n := testutil.ToFloat64(metrics.SubsRefused) - refused; n != 7 {
+		t.Fatalf("refused metric=%v, want 7", n)
+	}
+
+	// a sub added again keeps its slot
+	var kept *fakeTransport
+	for _, sub := range subs {
+		if router.GetSub(sub.id) != nil {
+			kept = sub
+		}
+	}
+	if router.AddSub(kept.id, kept) == nil {
+		t.Fatal("existing sub refused")
+	}
+	if router.AddSub("late", newFakeTransport("late")) != nil {
+		t.Fatal("sub added past MaxSubs")
+	}
+
+	// a sub leaving frees a slot
+	router.delSub(kept.id)
+	if router.Full() {
+		t.Fatal("router still full after delSub")
+	}
+	if router.AddSub("late", newFakeTransport("late")) == nil {
+		t.Fatal("sub refused after a slot freed up")
+	}
+}
+
+func TestRouterRemoveSubRefused(t *testing.T) {
+	InitRouter(RouterConfig{MaxSubs: 1})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	defer router.Close()
+	router.AddSub("sub", newFakeTransport("sub"))
+
+	// what a subscribe sets before adding its sub goes with the refused sub
+	router.SetSubPayloadTypes("late", map[uint8]uint8{96: 120})
+	router.SetSubExtensions("late", map[uint8]uint8{1: 2})
+	router.SetSubRTX("late", map[uint32]RTXStream{1: {SSRC: 2, PayloadType: 97}})
+	if router.AddSub("late", newFakeTransport("late")) != nil {
+		t.Fatal("sub added past MaxSubs")
+	}
+	if router.RemoveSub("late") {
+		t.Fatal("RemoveSub reported the refused sub")
+	}
+	router.subLock.RLock()
+	defer router.subLock.RUnlock()
+	if router.subPTs["late"] != nil || router.subExts["late"] != nil || router.subRTX["late"] != nil {
+		t.Fatal("settings of the refused sub kept")
+	}
+}
+
+func TestRouterCountsDroppedPacketsPerSub(t *testing.T) {
+	InitRouter(RouterConfig{SubBufferSize: 1})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	router.OnClose(func() {})
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+
+	sub := newFakeTransport("sub")
+	sub.writeStarted = make(chan struct{}, 1)
+	sub.writeBlock = make(chan struct{})
+	router.AddSub("sub", sub)
+	defer router.Close()
+	defer close(sub.writeBlock)
+
+	// first packet blocks the sub writer, second one fills the queue
+	pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SequenceNumber: 1}}
+	<-sub.writeStarted
+	for i := 2; i <= 6; i++ {
+		pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(i)}}
+	}
+
+	testhelper.WaitFor(t, time.Second, func() bool { return router.SubDropStats()["sub"] == 4 })
+
+	router.delSub("sub")
+	if _, ok := router.SubDropStats()["sub"]; ok {
+		t.Fatal("drop counter not removed with sub")
+	}
+}
+
+func TestRouterCloseWithoutOnCloseHandler(t *testing.T) {
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+
+	// pub goes away before anyone registered a router close handler
+	pub.Close()
+
+	if router.GetPub() != nil {
+		t.Fatal("pub not removed on close")
+	}
+}
+
+func TestRouterCloseGracefulFlushesSubs(t *testing.T) {
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+
+	sub := newFakeTransport("sub")
+	sub.writeBlock = make(chan struct{})
+	router.AddSub("sub", sub)
+
+	for i := 0; i < 10; i++ {
+		pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(i)}}
+	}
+
+	// wait until the sub writer holds one packet and the rest are queued
+	testhelper.WaitFor(t, time.Second, func() bool {
+		router.subLock.RLock()
+		defer router.subLock.RUnlock()
+		return len(router.subChans["sub"]) == 9
+	})
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(sub.writeBlock)
+	}()
+	router.CloseGraceful(time.Second)
+
+	if total := sub.writtenTotal(); total != 10 {
+		t.Fatalf("written=%d, want 10", total)
+	}
+}
+
+func TestRouterConcurrentClose(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		router := NewRouter("router")
+		router.AddPub(newFakeTransport("pub"))
+		router.AddSub("sub", newFakeTransport("sub"))
+		closes := 0
+		router.OnClose(func() { closes++ })
+
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				router.Close()
+			}()
+			go func() {
+				defer wg.Done()
+				router.CloseGraceful(time.Second)
+			}()
+		}
+		wg.Wait()
+		if !router.closed() || closes != 1 {
+			t.Fatalf("closed=%v closes=%d, want closed once", router.closed(), closes)
+		}
+		if router.AddSub("late", newFakeTransport("late")) != nil {
+			t.Fatal("closed router added a sub")
+		}
+	}
+}
+
+func TestRouterOnCloseWhileClosing(t *testing.T) {
+	router := NewRouter("router")
+	var closes int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				router.OnClose(func() { atomic.AddInt32(&closes, 1) })
+			}
+		}()
+	}
+	router.Close()
+	wg.Wait()
+	if n := atomic.LoadInt32(&closes); n > 200 {
+		t.Fatalf("closes=%d, want at most 200", n)
+	}
+}
+
+func TestRouterCoalescesPLI(t *testing.T) {
+	InitRouter(RouterConfig{PLIInterval: 1000})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	defer router.Close()
+
+	for i := 0; i < 10; i++ {
+		sub.rtcpCh <- &rtcp.PictureLossIndication{MediaSSRC: 1234}
+	}
+
+	testhelper.WaitFor(t, time.Second, func() bool { return len(sub.rtcpCh) == 0 })
+	time.Sleep(50 * time.Millisecond)
+
+	if total := pub.writtenRTCPTotal(); total != 1 {
+		t.Fatalf("pli forwarded=%d, want 1", total)
+	}
+}
+
+func TestRouterREMBStrategy(t *testing.T) {
+	tests := []struct {
+		strategy string
+		want     uint64
+	}{
+		{"", 100000},
+		{REMBStrategyLowest, 100000},
+		{REMBStrategyAverage, 300000},
+	}
+
+	for _, tt := range tests {
+		InitRouter(RouterConfig{
+			REMBFeedback: true,
+			REMBStrategy: tt.strategy,
+			MinBandwidth: 1,
+			MaxBandwidth: 1000000,
+		})
+
+		router := NewRouter("router")
+		pub := newFakeTransport("pub")
+		router.AddPub(pub)
+
+		for _, bitrate := range []uint64{100000, 200000, 600000} {
+			router.rembChan <- &rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: bitrate}
+		}
+		// the next estimate after the send interval flushes the stats upstream
+		time.Sleep(250 * time.Millisecond)
+		router.rembChan <- &rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: 300000}
+
+		testhelper.WaitFor(t, time.Second, func() bool { return pub.writtenRTCPTotal() != 0 })
+
+		pub.lock.Lock()
+		remb := pub.writtenRTCP[0].(*rtcp.ReceiverEstimatedMaximumBitrate)
+		pub.lock.Unlock()
+		if remb.Bitrate != tt.want {
+			t.Fatalf("strategy=%q bitrate=%d, want %d", tt.strategy, remb.Bitrate, tt.want)
+		}
+		router.Close()
+	}
+	InitRouter(RouterConfig{})
+}
+
+func TestRouterSubBitrate(t *testing.T) {
+	router := NewRouter("router")
+	router.AddPub(newFakeTransport("pub"))
+	defer router.Close()
+	sub1, sub2 := newFakeTransport("sub1"), newFakeTransport("sub2")
+	router.AddSub("sub1", sub1)
+	router.AddSub("sub2", sub2)
+
+	var lock sync.Mutex
+	reported := make(map[string]uint64)
+	router.OnSubREMB(func(id string, bitrate uint64) {
+		lock.Lock()
+		defer lock.Unlock()
+		reported[id] = bitrate
+	})
+
+	sub1.rtcpCh <- &rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: 100000}
+	sub2.rtcpCh <- &rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: 500000}
+	sub1.rtcpCh <- &rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: 300000}
+	testhelper.WaitFor(t, time.Second, func() bool { return router.SubBitrate("sub1") == 300000 && router.SubBitrate("sub2") == 500000 })
+	lock.Lock()
+	if reported["sub1"] != 300000 || reported["sub2"] != 500000 {
+		t.Errorf("reported %v, want sub1 300000 and sub2 500000", reported)
+	}
+	lock.Unlock()
+
+	sub1.Close()
+	if bitrate := router.SubBitrate("sub1"); bitrate != 0 {
+		t.Fatalf("removed sub bitrate=%d, want 0", bitrate)
+	}
+	if bitrate := router.SubBitrate("unknown"); bitrate != 0 {
+		t.Fatalf("unknown sub bitrate=%d, want 0", bitrate)
+	}
+}
+
+func TestRouterCloseStopsREMBLoop(t *testing.T) {
+	router := NewRouter("router")
+	before := runtime.NumGoroutine()
+
+	exited := make(chan struct{})
+	go func() {
+		router.rembLoop(nil)
+		close(exited)
+	}()
+	router.pushREMB(&rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: 100000})
+	router.Close()
+
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("rembLoop still running after close")
+	}
+
+	// late feedback must neither block nor panic
+	router.pushREMB(&rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: 100000})
+
+	time.Sleep(10 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("goroutines before=%d after=%d", before, after)
+	}
+}
+
+func TestRouterREMBInterval(t *testing.T) {
+	InitRouter(RouterConfig{REMBInterval: 500})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	// the clock moves 100ms every time rembLoop reads it, once per packet
+	clock := time.Now()
+	router.now = func() time.Time {
+		clock = clock.Add(100 * time.Millisecond)
+		return clock
+	}
+	exited := make(chan struct{})
+	go func() {
+		router.rembLoop(nil)
+		close(exited)
+	}()
+
+	for i := 0; i < 20; i++ {
+		router.pushREMB(&rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: 100000})
+	}
+	router.Close()
+	<-exited
+
+	// more than 500ms after the last one is every 6th packet
+	pub.lock.Lock()
+	defer pub.lock.Unlock()
+	rembs := 0
+	for _, pkt := range pub.writtenRTCP {
+		if _, ok := pkt.(*rtcp.ReceiverEstimatedMaximumBitrate); ok {
+			rembs++
+		}
+	}
+	if rembs != 3 {
+		t.Fatalf("rembs=%d, want 3 in 2s at a 500ms interval", rembs)
+	}
+}
+
+func TestRouterREMBDelta(t *testing.T) {
+	InitRouter(RouterConfig{REMBInterval: 1000, REMBDelta: 0.2})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	clock := time.Now()
+	router.now = func() time.Time {
+		clock = clock.Add(100 * time.Millisecond)
+		return clock
+	}
+	exited := make(chan struct{})
+	go func() {
+		router.rembLoop(nil)
+		close(exited)
+	}()
+
+	// the first goes out after the interval, small changes wait for the
+	// next one, the sharp drop is sent at once
+	for _, bitrate := range []uint64{1000000, 1000000, 1000000, 1000000, 1000000, 1000000, 1000000, 1000000, 1000000, 1000000, 1000000, 900000, 950000, 300000, 300000} {
+		router.pushREMB(&rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: bitrate})
+	}
+	router.Close()
+	<-exited
+
+	pub.lock.Lock()
+	defer pub.lock.Unlock()
+	var rembs []uint64
+	for _, pkt := range pub.writtenRTCP {
+		if remb, ok := pkt.(*rtcp.ReceiverEstimatedMaximumBitrate); ok {
+			rembs = append(rembs, remb.Bitrate)
+		}
+	}
+	if len(rembs) != 2 || rembs[0] != 1000000 || rembs[1] != 300000 {
+		t.Fatalf("rembs=%v, want 1000000 at the interval and the drop to 300000 at once", rembs)
+	}
+}
+
+func TestRouterSetREMBFeedback(t *testing.T) {
+	router := NewRouter("router")
+	defer router.Close()
+	// every estimate is past the send interval
+	var clock int64
+	start := time.Now()
+	router.now = func() time.Time {
+		return start.Add(time.Duration(atomic.AddInt64(&clock, 1)) * time.Second)
+	}
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	sub := newFakeTransport("sub")
+	router.AddSub(sub.ID(), sub)
+	goroutines := router.Stats().Goroutines
+
+	rembs := func() int {
+		pub.lock.Lock()
+		defer pub.lock.Unlock()
+		n := 0
+		for _, pkt := range pub.writtenRTCP {
+			if _, ok := pkt.(*rtcp.ReceiverEstimatedMaximumBitrate); ok {
+				n++
+			}
+		}
+		return n
+	}
+	// feedback send an estimate of the sub and return the rembs the pub
+	// got after it
+	feedback := func() int {
+		sub.rtcpCh <- &rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: 500000}
+		time.Sleep(50 * time.Millisecond)
+		return rembs()
+	}
+	waitGoroutines := func(want int64) {
+		testhelper.WaitFor(t, time.Second, func() bool { return router.Stats().Goroutines == want })
+	}
+
+	if router.REMBFeedback() {
+		t.Fatal("feedback on without the config")
+	}
+	if n := feedback(); n != 0 {
+		t.Fatalf("rembs=%d with the feedback off", n)
+	}
+
+	// the loop starts after the router did
+	router.SetREMBFeedback(true)
+	waitGoroutines(goroutines + 1)
+	if n := feedback(); n != 1 {
+		t.Fatalf("rembs=%d with the feedback on, want 1", n)
+	}
+
+	router.SetREMBFeedback(false)
+	waitGoroutines(goroutines)
+	if n := feedback(); n != 1 {
+		t.Fatalf("rembs=%d after the feedback was turned off, want 1", n)
+	}
+
+	router.SetREMBFeedback(true)
+	router.SetREMBFeedback(true)
+	waitGoroutines(goroutines + 1)
+	if n := feedback(); n != 2 {
+		t.Fatalf("rembs=%d after the feedback was turned on again, want 2", n)
+	}
+}
+
+func TestRouterInitialBandwidth(t *testing.T) {
+	InitRouter(RouterConfig{InitialBandwidth: 800000, MinBandwidth: 100000, MaxBandwidth: 500000})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	defer router.Close()
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+
+	// sent at once, clamped to maxbandwidth
+	pub.lock.Lock()
+	defer pub.lock.Unlock()
+	if len(pub.writtenRTCP) != 1 {
+		t.Fatalf("pub got %d rtcp, want the initial remb", len(pub.writtenRTCP))
+	}
+	remb, ok := pub.writtenRTCP[0].(*rtcp.ReceiverEstimatedMaximumBitrate)
+	if !ok || remb.Bitrate != 500000 {
+		t.Fatalf("rtcp=%+v, want a remb of 500000", pub.writtenRTCP[0])
+	}
+	if target := router.Stats().REMBTarget; target != 500000 {
+		t.Fatalf("target=%d, want 500000", target)
+	}
+}
+
+func TestCheckRouter(t *testing.T) {
+	if err := CheckRouter(RouterConfig{REMBInterval: 100, PLIInterval: 0}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []RouterConfig{{REMBInterval: -1}, {PLIInterval: -1}, {ProbeInterval: -1}, {PubErrorThreshold: -1}, {PubErrorWindow: -1}, {REMBDelta: -0.1}} {
+		if err := CheckRouter(c); err == nil {
+			t.Fatalf("config %+v accepted", c)
+		}
+	}
+}
+
+func TestRouterMemoryTransport(t *testing.T) {
+	router := NewRouter("router")
+	pub := transport.NewMemoryTransport("pub")
+	router.AddPub(pub)
+	sub := transport.NewMemoryTransport("sub")
+	router.AddSub(sub.ID(), sub)
+
+	for sn := uint16(0); sn < 10; sn++ {
+		if err := pub.PushRTP(&rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: sn}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testhelper.WaitFor(t, time.Second, func() bool { return len(sub.Written()) >= 10 })
+	for i, pkt := range sub.Written() {
+		if pkt.SequenceNumber != uint16(i) {
+			t.Fatalf("packet %d sn=%d", i, pkt.SequenceNumber)
+		}
+	}
+
+	// the key frame request of the sub reaches the pub
+	if err := sub.PushRTCP(&rtcp.PictureLossIndication{MediaSSRC: 1234}); err != nil {
+		t.Fatal(err)
+	}
+	testhelper.WaitFor(t, time.Second, func() bool { return hasPLI(pub.WrittenRTCP()) })
+
+	// the router closes with its pub
+	pub.Close()
+	testhelper.WaitFor(t, time.Second, func() bool { return sub.IsClosed() })
+}
+
+func hasPLI(pkts []rtcp.Packet) bool {
+	for _, pkt := range pkts {
+		if _, ok := pkt.(*rtcp.PictureLossIndication); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRouterRemoveSub(t *testing.T) {
+	router := NewRouter("router")
+	defer router.Close()
+	pub := transport.NewMemoryTransport("pub")
+	router.AddPub(pub)
+	sub := transport.NewMemoryTransport("sub")
+	router.AddSub(sub.ID(), sub)
+	router.PauseSub(sub.ID())
+	router.subLock.Lock()
+	router.subBitrates[sub.ID()] = 100000
+	router.subLock.Unlock()
+
+	// removals race the packets routed to the sub, only one finds it
+	go func() {
+		for sn := uint16(0); sn < 100; sn++ {
+			_ = pub.PushRTP(&rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: sn}})
+		}
+	}()
+	var removed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if router.RemoveSub(sub.ID()) {
+				atomic.AddInt32(&removed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if removed != 1 {
+		t.Fatalf("removed=%d, want 1", removed)
+	}
+	if !sub.IsClosed() {
+		t.Fatal("removed sub not closed")
+	}
+
+	router.subLock.RLock()
+	_, dropped := router.droppedPackets[sub.ID()]
+	_, bitrate := router.subBitrates[sub.ID()]
+	left := router.subs[sub.ID()] != nil || router.subChans[sub.ID()] != nil || router.subDone[sub.ID()] != nil ||
+		router.pausedSubs[sub.ID()] || dropped || bitrate
+	router.subLock.RUnlock()
+	if left {
+		t.Fatal("state of the removed sub left")
+	}
+
+	if router.RemoveSub("unknown") {
+		t.Fatal("unknown sub removed")
+	}
+}
+
+func TestRouterSwitchPubKeepsSubs(t *testing.T) {
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	defer router.Close()
+
+	waitWritten := func(n int) {
+		testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= n })
+	}
+
+	for i := 0; i < 5; i++ {
+		pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(i)}}
+	}
+	waitWritten(5)
+
+	newPub := newFakeTransport("newpub")
+	router.SwitchPub(newPub)
+	if router.GetPub() != newPub {
+		t.Fatal("pub not switched")
+	}
+	if router.closed() {
+		t.Fatal("router closed by the old pub")
+	}
+
+	for i := 5; i < 10; i++ {
+		newPub.rtpCh <- &rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(i)}}
+	}
+	waitWritten(10)
+	if router.GetSub("sub") == nil {
+		t.Fatal("sub removed on pub switch")
+	}
+}
+
+func TestRouterPubRejoin(t *testing.T) {
+	InitRouter(RouterConfig{PubRejoinGrace: 200})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	defer router.Close()
+	closed := make(chan struct{})
+	router.OnClose(func() { close(closed) })
+
+	waitWritten := func(n int) {
+		testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= n })
+	}
+	for i := 0; i < 5; i++ {
+		pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(i)}}
+	}
+	waitWritten(5)
+
+	// the router waits for a new pub
+	pub.Close()
+	time.Sleep(50 * time.Millisecond)
+	if router.closed() || router.GetSub("sub") == nil {
+		t.Fatal("router closed with its pub")
+	}
+	if router.GetPub() != nil {
+		t.Fatal("closed pub kept")
+	}
+	newPub := newFakeTransport("newpub")
+	router.AddPub(newPub)
+	for i := 5; i < 10; i++ {
+		newPub.rtpCh <- &rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(i)}}
+	}
+	waitWritten(10)
+
+	// the rejoined pub keeps the router past the grace
+	select {
+	case <-closed:
+		t.Fatal("router closed after the pub rejoined")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// no pub rejoins
+	newPub.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("router not closed after the grace")
+	}
+}
+
+func TestRouterAddPubHasPub(t *testing.T) {
+	router := NewRouter("router")
+	defer router.Close()
+
+	// concurrent pubs, one is added and the others are left to the callers
+	pubs := make([]*fakeTransport, 4)
+	errs := make([]error, len(pubs))
+	var wg sync.WaitGroup
+	for i := range pubs {
+		pubs[i] = newFakeTransport(fmt.Sprintf("pub%d", i))
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = router.AddPub(pubs[i])
+		}(i)
+	}
+	wg.Wait()
+	added := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			added++
+			if router.GetPub() != pubs[i] {
+				t.Fatalf("pub%d added but not the pub", i)
+			}
+		case err != ErrRouterHasPub:
+			t.Fatalf("AddPub=%v, want nil or ErrRouterHasPub", err)
+		case pubs[i].isClosed():
+			t.Fatalf("refused pub%d closed", i)
+		}
+	}
+	if added != 1 {
+		t.Fatalf("%d pubs added, want 1", added)
+	}
+}
+
+func TestRouterRemovesSubAfterMaxWriteErr(t *testing.T) {
+	InitRouter(RouterConfig{MaxWriteErr: 3})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	sub := newFakeTransport("sub")
+	sub.failWrite = true
+	router.AddSub("sub", sub)
+	defer router.Close()
+
+	for i := 0; i < 2; i++ {
+		pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(i)}}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if router.GetSub("sub") == nil {
+		t.Fatal("sub removed before reaching max write errors")
+	}
+
+	pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SequenceNumber: 2}}
+	testhelper.WaitFor(t, time.Second, func() bool { return router.GetSub("sub") == nil })
+}
+
+func TestRouterPauseResumeSub(t *testing.T) {
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	defer router.Close()
+
+	send := func(from, to int) {
+		for i := from; i < to; i++ {
+			pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: uint16(i)}}
+		}
+	}
+	waitWritten := func(n int) {
+		testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= n })
+	}
+
+	send(0, 3)
+	waitWritten(3)
+
+	router.PauseSub("sub")
+	send(3, 6)
+	time.Sleep(50 * time.Millisecond)
+	if total := sub.writtenTotal(); total != 3 {
+		t.Fatalf("paused sub written=%d, want 3", total)
+	}
+
+	router.ResumeSub("sub")
+	if total := pub.writtenRTCPTotal(); total != 1 {
+		t.Fatalf("pli on resume=%d, want 1", total)
+	}
+	pub.lock.Lock()
+	pli, ok := pub.writtenRTCP[0].(*rtcp.PictureLossIndication)
+	pub.lock.Unlock()
+	if !ok || pli.MediaSSRC != 1234 {
+		t.Fatalf("unexpected rtcp on resume %v", pli)
+	}
+
+	send(6, 9)
+	waitWritten(6)
+}
+
+func TestRouterRequestsKeyFrameOnAddSub(t *testing.T) {
+	InitRouter(RouterConfig{PLIInterval: 1000})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	first := newFakeTransport("first")
+	router.AddSub("first", first)
+	defer router.Close()
+
+	pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96}}
+	testhelper.WaitFor(t, time.Second, func() bool { return first.writtenTotal() >= 1 })
+	if total := pub.writtenRTCPTotal(); total != 0 {
+		t.Fatalf("pli before the pub sent video=%d, want 0", total)
+	}
+
+	// a pli is written before AddSub returns
+	router.AddSub("sub", newFakeTransport("sub"))
+	if total := pub.writtenRTCPTotal(); total != 1 {
+		t.Fatalf("pli on add sub=%d, want 1", total)
+	}
+	pub.lock.Lock()
+	pli, ok := pub.writtenRTCP[0].(*rtcp.PictureLossIndication)
+	pub.lock.Unlock()
+	if !ok || pli.MediaSSRC != 1234 {
+		t.Fatalf("unexpected rtcp on add sub %v", pli)
+	}
+
+	// a burst of joins shares the pli
+	for i := 0; i < 5; i++ {
+		router.AddSub(fmt.Sprintf("burst%d", i), newFakeTransport("burst"))
+	}
+	if total := pub.writtenRTCPTotal(); total != 1 {
+		t.Fatalf("pli after a burst of joins=%d, want 1", total)
+	}
+}
+
+func TestRouterReplaysKeyFrameOnAddSub(t *testing.T) {
+	InitRouter(RouterConfig{PLIInterval: 1000})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	if err := router.InitPlugins(plugins.Config{On: true, JitterBuffer: plugins.JitterBufferConfig{On: true}}); err != nil {
+		t.Fatal(err)
+	}
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	first := newFakeTransport("first")
+	router.AddSub("first", first)
+	defer router.Close()
+
+	// a vp8 key frame in 3 packets then a delta frame
+	for _, pkt := range []*rtp.Packet{
+		{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: 1, Timestamp: 3000}, Payload: []byte{0x10, 0x00, 0x9d}},
+		{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: 2, Timestamp: 3000}, Payload: []byte{0x00, 0x01}},
+		{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: 3, Timestamp: 3000, Marker: true}, Payload: []byte{0x00, 0x02}},
+		{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: 4, Timestamp: 6000, Marker: true}, Payload: []byte{0x10, 0x01}},
+	} {
+		pub.rtpCh <- pkt
+	}
+	testhelper.WaitFor(t, time.Second, func() bool { return first.writtenTotal() >= 4 })
+
+	// the new sub gets the key frame without waiting for the pub, which is
+	// still asked for a fresh one
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= 3 })
+	sub.lock.Lock()
+	written := append([]*rtp.Packet(nil), sub.written...)
+	sub.lock.Unlock()
+	if len(written) != 3 {
+		t.Fatalf("sub got %d packets, want the 3 of the key frame", len(written))
+	}
+	for i, pkt := range written {
+		if pkt.SSRC != 1234 || pkt.Timestamp != 3000 || pkt.Marker != (i == 2) {
+			t.Fatalf("packet %d %+v, not the key frame in order", i, pkt.Header)
+		}
+	}
+	if !transport.IsKeyFrame(written[0].PayloadType, written[0].Payload) {
+		t.Fatal("replay doesn't start with the key frame")
+	}
+	if total := pub.writtenRTCPTotal(); total != 1 {
+		t.Fatalf("pli on add sub=%d, want 1", total)
+	}
+}
+
+func TestRouterCallsAllOnCloseHandlersOnce(t *testing.T) {
+	router := NewRouter("router")
+
+	var called []int
+	for i := 1; i <= 3; i++ {
+		i := i
+		router.OnClose(func() {
+			called = append(called, i)
+		})
+	}
+
+	router.Close()
+	router.Close()
+
+	if len(called) != 3 || called[0] != 1 || called[1] != 2 || called[2] != 3 {
+		t.Fatalf("called=%v, want [1 2 3]", called)
+	}
+}
+
+func TestRouterStats(t *testing.T) {
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	sub1 := newFakeTransport("sub1")
+	router.AddSub("sub1", sub1)
+	sub2 := newFakeTransport("sub2")
+	router.AddSub("sub2", sub2)
+	defer router.Close()
+
+	for i := 0; i < 5; i++ {
+		pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: uint16(i)}}
+	}
+	testhelper.WaitFor(t, time.Second, func() bool { return sub1.writtenTotal() >= 5 && sub2.writtenTotal() >= 5 })
+
+	stats := router.Stats()
+	if stats.Subs != 2 {
+		t.Fatalf("subs=%d, want 2", stats.Subs)
+	}
+	if stats.PacketsRouted != 10 {
+		t.Fatalf("routed=%d, want 10", stats.PacketsRouted)
+	}
+	if stats.PacketsDropped != 0 {
+		t.Fatalf("dropped=%d, want 0", stats.PacketsDropped)
+	}
+	if len(stats.PubSSRCs) != 1 || stats.PubSSRCs[0] != 1234 {
+		t.Fatalf("pub ssrcs=%v, want [1234]", stats.PubSSRCs)
+	}
+	if stats.Uptime <= 0 {
+		t.Fatalf("uptime=%v", stats.Uptime)
+	}
+}
+
+func TestRouterStatsInboundLoss(t *testing.T) {
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	defer router.Close()
+
+	// 3, 6 and 7 never arrive, 1 arrives after 2
+	sns := []uint16{0, 2, 1, 4, 5, 8, 9}
+	for _, sn := range sns {
+		pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: sn}}
+	}
+	testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= len(sns) })
+
+	stats := router.Stats()
+	if stats.InboundLossCount != 3 {
+		t.Fatalf("inbound loss=%d, want 3", stats.InboundLossCount)
+	}
+	if stats.InboundLossRate != 0.3 {
+		t.Fatalf("inbound loss rate=%v, want 0.3", stats.InboundLossRate)
+	}
+}
+
+func TestRouterResendsNackFromSubHistory(t *testing.T) {
+	InitRouter(RouterConfig{SubNackBufferSize: 16})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	defer router.Close()
+
+	for i := 0; i < 5; i++ {
+		pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: uint16(i)}}
+	}
+	testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= 5 })
+
+	sub.rtcpCh <- &rtcp.TransportLayerNack{MediaSSRC: 1234, Nacks: []rtcp.NackPair{{PacketID: 3}}}
+	testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= 6 })
+
+	sub.lock.Lock()
+	resent := sub.written[5]
+	sub.lock.Unlock()
+	if resent.SequenceNumber != 3 {
+		t.Fatalf("resent sn=%d, want 3", resent.SequenceNumber)
+	}
+	if total := pub.writtenRTCPTotal(); total != 0 {
+		t.Fatalf("nack forwarded to pub %d times", total)
+	}
+}
+
+func TestRouterLimitsUpstreamNacks(t *testing.T) {
+	InitRouter(RouterConfig{UpstreamNackRate: 5})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	now := time.Unix(1000, 0)
+	router.now = func() time.Time { return now }
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	router.AddSub("a", newFakeTransport("a"))
+	router.AddSub("b", newFakeTransport("b"))
+	defer router.Close()
+	upstream := func() []*rtcp.TransportLayerNack {
+		pub.lock.Lock()
+		defer pub.lock.Unlock()
+		var nacks []*rtcp.TransportLayerNack
+		for _, pkt := range pub.writtenRTCP {
+			if nack, ok := pkt.(*rtcp.TransportLayerNack); ok {
+				nacks = append(nacks, nack)
+			}
+		}
+		return nacks
+	}
+	nack := func(sub string, sns ...uint16) {
+		n := &rtcp.TransportLayerNack{MediaSSRC: 1234}
+		for _, sn := range sns {
+			n.Nacks = append(n.Nacks, rtcp.NackPair{PacketID: sn})
+		}
+		router.subFeedback(router.logger, sub, n)
+	}
+
+	// nothing to resend from, both subs keep nacking the same packet
+	for i := 0; i < 10; i++ {
+		nack("a", 3)
+		nack("b", 3)
+	}
+	nacks := upstream()
+	if len(nacks) != 1 || nacks[0].MediaSSRC != 1234 || len(nacks[0].Nacks) != 1 || nacks[0].Nacks[0].PacketID != 3 {
+		t.Fatalf("upstream nacks %v, want one for 3", nacks)
+	}
+
+	// the 4 nacks left of the rate are packed in one pair
+	nack("a", 10, 11, 12, 13, 14, 15, 16, 17)
+	nacks = upstream()
+	if len(nacks) != 2 {
+		t.Fatalf("%d upstream nacks, want 2", len(nacks))
+	}
+	if pairs := nacks[1].Nacks; len(pairs) != 1 || pairs[0].PacketID != 10 || pairs[0].LostPackets != 0x7 {
+		t.Fatalf("pairs %+v, want 10 to 13", pairs)
+	}
+	nack("b", 20)
+	if n := len(upstream()); n != 2 {
+		t.Fatalf("%d upstream nacks over the rate, want 2", n)
+	}
+
+	// the packet is nacked again after the window, as the rate allows
+	now = now.Add(defaultUpstreamNackWindow + 100*time.Millisecond)
+	nack("a", 3, 21)
+	nacks = upstream()
+	if len(nacks) != 3 || len(nacks[2].Nacks) != 1 || nacks[2].Nacks[0].PacketID != 3 {
+		t.Fatalf("upstream nacks %v, want 3 again after the window", nacks)
+	}
+}
+
+func TestRouterReplayedPub(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan *transport.RTPTransport, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- transport.NewRTPTransportTCP(conn)
+	}()
+
+	// record what the forwarder sends
+	fwd := plugins.NewRTPForwarder(plugins.TypeRTPForwarder, "router", plugins.RTPForwarderConfig{Addr: listener.Addr().String(), Protocol: plugins.ProtocolTCP})
+	defer fwd.Stop()
+	go func() {
+		for range fwd.ReadRTP() {
+		}
+	}()
+	in := <-accepted
+	defer in.Close()
+	// the forwarder tags the packets with the router id
+	go func() { <-in.IDChan }()
+	const total = 20
+	go func() {
+		for sn := uint16(1); sn <= total; sn++ {
+			fwd.WriteRTP(&rtp.Packet{
+				Header:  rtp.Header{Version: 2, SSRC: 1234, PayloadType: 96, SequenceNumber: sn, Timestamp: uint32(sn) * 3000},
+				Payload: []byte{byte(sn)},
+			})
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	pkts, err := plugins.CaptureRTP(in, total)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayer, err := plugins.NewReplayer("replay", pkts, plugins.ReplayConfig{Loop: true, Speed: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter("router")
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	router.AddPub(replayer)
+	defer router.Close()
+
+	testhelper.WaitFor(t, 2*time.Second, func() bool { return sub.writtenTotal() >= total+1 })
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	for i, pkt := range sub.written[:total] {
+		if pkt.SequenceNumber != uint16(i+1) || pkt.Payload[0] != byte(i+1) {
+			t.Fatalf("written[%d] sn=%d payload=%v, want the forwarded sequence", i, pkt.SequenceNumber, pkt.Payload)
+		}
+	}
+	// the loop continues the sequence
+	if sn := sub.written[total].SequenceNumber; sn != total+1 {
+		t.Fatalf("looped sn=%d, want %d", sn, total+1)
+	}
+}
+
+func TestRouterPubReconnectsWithinGrace(t *testing.T) {
+	InitRouter(RouterConfig{DisconnectGrace: 100})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	closed := make(chan struct{})
+	router.OnClose(func() { close(closed) })
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	defer router.Close()
+
+	// a blip shorter than the grace period
+	pub.setState(transport.StateDisconnected)
+	time.Sleep(50 * time.Millisecond)
+	pub.setState(transport.StateConnected)
+	sub.setState(transport.StateDisconnected)
+	sub.setState(transport.StateConnected)
+	select {
+	case <-closed:
+		t.Fatal("router closed on a transient disconnect")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if pub.isClosed() || router.GetSub("sub") == nil {
+		t.Fatal("pub or sub closed on a transient disconnect")
+	}
+
+	pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SequenceNumber: 1}}
+	testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= 1 })
+}
+
+func TestRouterClosesAfterGrace(t *testing.T) {
+	InitRouter(RouterConfig{DisconnectGrace: 50})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	closed := make(chan struct{})
+	router.OnClose(func() { close(closed) })
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	other := newFakeTransport("other")
+	router.AddSub("other", other)
+
+	// a sub gone for good is removed, the router keeps going
+	sub.setState(transport.StateDisconnected)
+	testhelper.WaitFor(t, time.Second, func() bool { return router.GetSub("sub") == nil })
+	if !sub.isClosed() || router.GetSub("other") == nil {
+		t.Fatal("want only the disconnected sub closed")
+	}
+
+	pub.setState(transport.StateDisconnected)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("router not closed after the grace period")
+	}
+}
+
+func TestRouterBroadcastsData(t *testing.T) {
+	router := NewRouter("router")
+	pub := newFakeDataTransport("pub")
+	router.AddPub(pub)
+	defer router.Close()
+	before := newFakeDataTransport("before")
+	router.AddSub("before", before)
+	// a sub without data channels only gets rtp
+	router.AddSub("rtp", newFakeTransport("rtp"))
+
+	lifeTime := uint16(500)
+	options := transport.DataChannelOptions{Ordered: false, MaxPacketLifeTime: &lifeTime}
+	pub.open("cursor", options)
+	after := newFakeDataTransport("after")
+	router.AddSub("after", after)
+
+	pub.send("cursor", "1,2")
+	router.BroadcastData("cursor", []byte("3,4"))
+	// nobody opened it
+	router.BroadcastData("chat", []byte("hi"))
+
+	for _, sub := range []*fakeDataTransport{before, after} {
+		got, msgs, found := sub.channel("cursor")
+		if !found || got.Ordered || got.MaxPacketLifeTime == nil || *got.MaxPacketLifeTime != lifeTime || got.MaxRetransmits != nil {
+			t.Fatalf("sub %s channel found=%v options=%+v, want the pub options", sub.ID(), found, got)
+		}
+		if len(msgs) != 2 || msgs[0] != "1,2" || msgs[1] != "3,4" {
+			t.Fatalf("sub %s got %v, want [1,2 3,4]", sub.ID(), msgs)
+		}
+		if _, _, found := sub.channel("chat"); found {
+			t.Fatalf("sub %s has a channel the pub never opened", sub.ID())
+		}
+	}
+}
+
+func TestRouterAddDelSubsWhileRouting(t *testing.T) {
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	defer router.Close()
+
+	stop := make(chan struct{})
+	churned := make(chan struct{})
+	go func() {
+		defer close(churned)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			id := fmt.Sprintf("churn%d", i%4)
+			router.AddSub(id, newFakeTransport(id))
+			router.PauseSub(id)
+			router.ResumeSub(id)
+			router.delSub(id)
+		}
+	}()
+
+	for i := 0; i < 500; i++ {
+		pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 1234, SequenceNumber: uint16(i)}}
+	}
+	testhelper.WaitFor(t, 2*time.Second, func() bool { return sub.writtenTotal() >= 500 })
+	close(stop)
+	<-churned
+
+	if drops := router.SubDropStats()["sub"]; drops != 0 {
+		t.Fatalf("dropped=%d, want 0", drops)
+	}
+}
+
+func BenchmarkRouterRoute(b *testing.B) {
+	router := NewRouter("router")
+	router.OnClose(func() {})
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("sub%d", i)
+		sub := newFakeTransport(id)
+		sub.discard = true
+		router.AddSub(id, sub)
+	}
+	defer router.Close()
+
+	// subs come and go while packets flow
+	stop := make(chan struct{})
+	churned := make(chan struct{})
+	go func() {
+		defer close(churned)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			sub := newFakeTransport("churn")
+			sub.discard = true
+			router.AddSub("churn", sub)
+			router.GetSub("churn")
+			router.delSub("churn")
+		}
+	}()
+
+	pkt := &rtp.Packet{Header: rtp.Header{SSRC: 1234}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pub.rtpCh <- pkt
+	}
+	for len(pub.rtpCh) > 0 {
+		runtime.Gosched()
+	}
+	b.StopTimer()
+	close(stop)
+	<-churned
+}
+
+func TestRouterClosesOnPubEOF(t *testing.T) {
+	router := NewRouter("router")
+	closed := make(chan struct{})
+	router.OnClose(func() { close(closed) })
+	pub := newFakeTransport("pub")
+	pub.readErr = io.EOF
+	router.AddPub(pub)
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("router not closed after pub EOF")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if reads := atomic.LoadInt32(&pub.reads); reads != 1 {
+		t.Fatalf("reads=%d after EOF, want 1", reads)
+	}
+}
+
+func TestRouterBacksOffOnPubReadErr(t *testing.T) {
+	router := NewRouter("router")
+	router.OnClose(func() {})
+	pub := newFakeTransport("pub")
+	pub.readErr = errors.New("temporary read error")
+	router.AddPub(pub)
+
+	// 10, 20, 40, 80 and 160ms between reads
+	time.Sleep(200 * time.Millisecond)
+	reads := atomic.LoadInt32(&pub.reads)
+	if reads < 2 || reads > 6 {
+		t.Fatalf("reads=%d in 200ms, want a few retries", reads)
+	}
+	if router.closed() {
+		t.Fatal("router closed on a transient error")
+	}
+
+	router.Close()
+	time.Sleep(50 * time.Millisecond)
+	if after := atomic.LoadInt32(&pub.reads); after > reads+1 {
+		t.Fatalf("reads=%d after close, want at most %d", after, reads+1)
+	}
+}
+
+func TestRouterClosesOnSustainedPubReadErr(t *testing.T) {
+	InitRouter(RouterConfig{PubErrorThreshold: 5, PubErrorWindow: 100})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	closed := make(chan struct{})
+	router.OnClose(func() { close(closed) })
+	pub := newFakeTransport("pub")
+	pub.readErr = errors.New("degraded read error")
+	start := time.Now()
+	router.AddPub(pub)
+
+	// the 5th read fails after 10+20+40+80ms of retries
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("router not closed after sustained pub errors")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("closed after %v, before the window", elapsed)
+	}
+	if reads := atomic.LoadInt32(&pub.reads); reads < 5 {
+		t.Fatalf("closed after %d reads, want 5", reads)
+	}
+}
+
+// senderReports return the sender reports written to f
+func (f *fakeTransport) senderReports() []*rtcp.SenderReport {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var srs []*rtcp.SenderReport
+	for _, pkt := range f.writtenRTCP {
+		if sr, ok := pkt.(*rtcp.SenderReport); ok {
+			srs = append(srs, sr)
+		}
+	}
+	return srs
+}
+
+func TestRouterForwardsSenderReports(t *testing.T) {
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	defer router.Close()
+	subs := []*fakeTransport{newFakeTransport("sub1"), newFakeTransport("sub2")}
+	for _, sub := range subs {
+		router.AddSub(sub.ID(), sub)
+	}
+
+	pub.rtcpCh <- &rtcp.SenderReport{
+		SSRC:        1234,
+		NTPTime:     0xe2c5a0e400000000,
+		RTPTime:     90000,
+		PacketCount: 10,
+		OctetCount:  1000,
+		Reports:     []rtcp.ReceptionReport{{SSRC: 42}},
+	}
+	for _, sub := range subs {
+		testhelper.WaitFor(t, time.Second, func() bool { return len(sub.senderReports()) != 0 })
+		sr := sub.senderReports()[0]
+		if sr.SSRC != 1234 || sr.NTPTime != 0xe2c5a0e400000000 || sr.RTPTime != 90000 {
+			t.Fatalf("%s got %+v, want the timestamps of the pub report", sub.ID(), sr)
+		}
+		// reception reports are about what the pub receives
+		if len(sr.Reports) != 0 {
+			t.Fatalf("%s got reception reports %+v", sub.ID(), sr.Reports)
+		}
+	}
+}
+
+func TestRouterGoroutinesReturnOnClose(t *testing.T) {
+	InitRouter(RouterConfig{REMBFeedback: true, SubSRInterval: 1000, ProbeInterval: 1000})
+	defer InitRouter(RouterConfig{})
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		router := NewRouter(fmt.Sprintf("router%d", i))
+		pub := transport.NewMemoryTransport("pub")
+		router.AddPub(pub)
+		// the rtcp channel of the subs is never closed, like the one of
+		// the webrtc transports
+		for j := 0; j < 2; j++ {
+			sub := newFakeTransport(fmt.Sprintf("sub%d", j))
+			router.AddSub(sub.ID(), sub)
+		}
+		// idle check, rembLoop, route and feedback of the pub, write,
+		// feedback, report and probe of each sub
+		if n := router.Stats().Goroutines; n != 12 {
+			t.Fatalf("router goroutines=%d, want 12", n)
+		}
+		router.Close()
+
+		testhelper.WaitFor(t, time.Second, func() bool { return router.Stats().Goroutines == 0 })
+	}
+
+	testhelper.WaitFor(t, time.Second, func() bool { return runtime.NumGoroutine() <= before })
+}
+
+func TestRouterMiddlewareDrops(t *testing.T) {
+	router := NewRouter("router")
+	defer router.Close()
+	// drop every third packet to fake loss
+	var n int
+	router.Use(func(pkt *rtp.Packet) (*rtp.Packet, bool) {
+		n++
+		return pkt, n%3 != 0
+	})
+	pub := transport.NewMemoryTransport("pub")
+	router.AddPub(pub)
+	sub := transport.NewMemoryTransport("sub")
+	router.AddSub(sub.ID(), sub)
+
+	for sn := uint16(0); sn < 9; sn++ {
+		if err := pub.PushRTP(&rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: sn}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testhelper.WaitFor(t, time.Second, func() bool { return len(sub.Written()) >= 6 })
+	time.Sleep(20 * time.Millisecond)
+	written := sub.Written()
+	if len(written) != 6 {
+		t.Fatalf("sub written=%d, want 6", len(written))
+	}
+	// the order of the kept packets is preserved
+	for i, sn := range []uint16{0, 1, 3, 4, 6, 7} {
+		if written[i].SequenceNumber != sn {
+			t.Fatalf("packet %d sn=%d, want %d", i, written[i].SequenceNumber, sn)
+		}
+	}
+}
+
+func TestRouterMiddlewareMutates(t *testing.T) {
+	router := NewRouter("router")
+	defer router.Close()
+	// strip the extensions in place, then redact into a new packet
+	router.Use(func(pkt *rtp.Packet) (*rtp.Packet, bool) {
+		pkt.Extension = false
+		return pkt, true
+	})
+	router.Use(func(pkt *rtp.Packet) (*rtp.Packet, bool) {
+		redacted := *pkt
+		redacted.Payload = make([]byte, len(pkt.Payload))
+		return &redacted, true
+	})
+	pub := transport.NewMemoryTransport("pub")
+	router.AddPub(pub)
+	sub := transport.NewMemoryTransport("sub")
+	router.AddSub(sub.ID(), sub)
+
+	pkt := &rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96}, Payload: []byte{1, 2, 3}}
+	if err := pkt.Header.SetExtension(1, []byte{0xff}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.PushRTP(pkt); err != nil {
+		t.Fatal(err)
+	}
+	testhelper.WaitFor(t, time.Second, func() bool { return len(sub.Written()) >= 1 })
+	got := sub.Written()[0]
+	if got.Extension || got.GetExtension(1) != nil {
+		t.Fatal("extension not stripped")
+	}
+	if len(got.Payload) != 3 || got.Payload[0] != 0 || got.Payload[1] != 0 || got.Payload[2] != 0 {
+		t.Fatalf("payload %v, want it redacted", got.Payload)
+	}
+}
+
+func TestRouterOnCloseRemoved(t *testing.T) {
+	router := NewRouter("router")
+	var calls []string
+	router.OnClose(func() { calls = append(calls, "first") })
+	remove := router.OnClose(func() { calls = append(calls, "removed") })
+	router.OnClose(func() { calls = append(calls, "last") })
+	remove()
+	remove()
+	router.Close()
+	if len(calls) != 2 || calls[0] != "first" || calls[1] != "last" {
+		t.Fatalf("calls=%v, want first and last", calls)
+	}
+}
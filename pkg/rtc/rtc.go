@@ -2,26 +2,18 @@ package rtc
 
 import (
 	"fmt"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/ion-sfu/pkg/log"
 	"github.com/pion/ion-sfu/pkg/rtc/plugins"
-	"github.com/pion/ion-sfu/pkg/rtc/rtpengine"
-	"github.com/pion/ion-sfu/pkg/rtc/transport"
-)
-
-const (
-	statCycle = 3 * time.Second
 )
 
 var (
-	routers    = make(map[string]*Router)
-	routerLock sync.RWMutex
+	defaultRegistry = NewRegistry()
 
-	pluginsConfig plugins.Config
-	routerConfig  RouterConfig
-	stop          bool
+	// RouterConfig, replaced as a whole by InitRouter
+	routerConfig atomic.Value
 )
 
 // RTPConfig defines parameters for the rtp engine
@@ -37,14 +29,52 @@ type RTPConfig struct {
 // 	return transport.InitWebRTC(iceServers, icePortStart, icePortEnd)
 // }
 
+// InitRouter set the router config, it can be called again to change
+// the config of running routers
 func InitRouter(config RouterConfig) {
-	routerConfig = config
+	routerConfig.Store(config)
 }
 
-// InitPlugins plugins config
+// CheckRouter router config, the intervals in ms and the counts can't be
+// negative, 0 is the default or off
+func CheckRouter(config RouterConfig) error {
+	for _, c := range []struct {
+		name string
+		ms   int
+	}{
+		{"pliinterval", config.PLIInterval},
+		{"rembinterval", config.REMBInterval},
+		{"subsrinterval", config.SubSRInterval},
+		{"probeinterval", config.ProbeInterval},
+		{"layerholdtime", config.LayerHoldTime},
+		{"disconnectgrace", config.DisconnectGrace},
+		{"puberrorthreshold", config.PubErrorThreshold},
+		{"puberrorwindow", config.PubErrorWindow},
+		{"upstreamnackwindow", config.UpstreamNackWindow},
+		{"upstreamnackrate", config.UpstreamNackRate},
+		{"idletimeout", config.IdleTimeout},
+		{"subbatchsize", config.SubBatchSize},
+		{"subbatchdelay", config.SubBatchDelay},
+		{"pubrejoingrace", config.PubRejoinGrace},
+	} {
+		if c.ms < 0 {
+			return fmt.Errorf("invalid router %s %d, must be >= 0", c.name, c.ms)
+		}
+	}
+	if config.REMBDelta < 0 {
+		return fmt.Errorf("invalid router rembdelta %v, must be >= 0", config.REMBDelta)
+	}
+	return nil
+}
+
+func getRouterConfig() RouterConfig {
+	config, _ := routerConfig.Load().(RouterConfig)
+	return config
+}
+
+// InitPlugins plugins config, used by routers created after the call
 func InitPlugins(config plugins.Config) {
-	pluginsConfig = config
-	log.Infof("InitPlugins pluginsConfig=%+v", pluginsConfig)
+	defaultRegistry.SetPlugins(config)
 }
 
 // CheckPlugins plugins config
@@ -52,116 +82,61 @@ func CheckPlugins(config plugins.Config) error {
 	return plugins.CheckPlugins(config)
 }
 
-// InitRTP rtp port
+// InitRTP rtp port, the routers of the rtp pubs go to the default registry
 func InitRTP(config RTPConfig) error {
-	// show stat about all routers
-	go check()
-
-	var connCh chan *transport.RTPTransport
-	var err error
-	// accept relay rtptransport
-	if config.KcpKey != "" && config.KcpSalt != "" {
-		connCh, err = rtpengine.ServeWithKCP(config.Port, config.KcpKey, config.KcpSalt)
-	} else {
-		connCh, err = rtpengine.Serve(config.Port)
-	}
-	if err != nil {
-		log.Errorf("rtc.InitRPC err=%v", err)
-		return err
-	}
-	go func() {
-		for {
-			if stop {
-				return
-			}
-			for rtpTransport := range connCh {
-				go func(rtpTransport *transport.RTPTransport) {
-					id := <-rtpTransport.IDChan
-
-					if id == "" {
-						log.Errorf("invalid id from incoming rtp transport")
-						return
-					}
-
-					log.Infof("accept new rtp id=%s conn=%s", id, rtpTransport.RemoteAddr().String())
-					if router := AddRouter(id); router != nil {
-						router.AddPub(rtpTransport)
-					}
-				}(rtpTransport)
-			}
-		}
-	}()
-	return nil
+	return defaultRegistry.ServeRTP(config)
 }
 
+// GetOrNewRouter get a router from the default registry, or add it
 func GetOrNewRouter(id string) *Router {
-	log.Infof("rtc.GetOrNewRouter id=%s", id)
-	router := GetRouter(id)
-	if router == nil {
-		return AddRouter(id)
-	}
-	return router
+	return defaultRegistry.GetOrNewRouter(id)
 }
 
-// GetRouter get router from map
+// GetRouter get router from the default registry
 func GetRouter(id string) *Router {
-	log.Infof("rtc.GetRouter id=%s", id)
-	routerLock.RLock()
-	defer routerLock.RUnlock()
-	return routers[id]
+	return defaultRegistry.GetRouter(id)
 }
 
-// AddRouter add a new router
+// AddRouter add a new router to the default registry
 func AddRouter(id string) *Router {
-	log.Infof("rtc.AddRouter id=%s", id)
-	routerLock.Lock()
-	defer routerLock.Unlock()
-	router := NewRouter(id)
-	router.OnClose(func() {
-		delRouter(id)
-	})
-	if err := router.InitPlugins(pluginsConfig); err != nil {
-		log.Errorf("rtc.AddRouter InitPlugins err=%v", err)
+	router, err := defaultRegistry.AddRouter(id)
+	if err != nil {
+		log.Errorf("rtc.AddRouter err=%v", err)
 		return nil
 	}
-	routers[id] = router
-	return routers[id]
+	return router
 }
 
-// delRouter delete pub
-func delRouter(id string) {
-	log.Infof("delRouter id=%s", id)
-	routerLock.Lock()
-	defer routerLock.Unlock()
-	delete(routers, id)
+// Stats is a snapshot of all routers
+type Stats struct {
+	// Routers number of routers
+	Routers int
+	// Pubs number of routers with a pub
+	Pubs int
+	// Subs number of subs of all routers
+	Subs int
+	// Bitrate bits per second routed from all pubs
+	Bitrate uint64
+	// Uptime time since the sfu started
+	Uptime time.Duration
 }
 
-// check show all Routers' stat
-func check() {
-	t := time.NewTicker(statCycle)
-	for range t.C {
-		info := "\n----------------rtc-----------------\n"
-		print := false
-		routerLock.Lock()
-		if len(routers) > 0 {
-			print = true
-		}
+// GetStats return the stats of the routers of the default registry
+func GetStats() Stats {
+	return defaultRegistry.Stats()
+}
 
-		for id, router := range routers {
-			info += "pub: " + string(id) + "\n"
-			subs := router.GetSubs()
-			if len(subs) < 6 {
-				for id := range subs {
-					info += fmt.Sprintf("sub: %s\n", id)
-				}
-				info += "\n"
-			} else {
-				info += fmt.Sprintf("subs: %d\n\n", len(subs))
-			}
-		}
-		routerLock.Unlock()
-		if print {
-			log.Infof(info)
-		}
-	}
+// RouterInfo describes a running router
+type RouterInfo struct {
+	ID string
+	// Pub id of the pub transport, empty without a pub
+	Pub string
+	// Subs ids of the subs
+	Subs  []string
+	Stats RouterStats
+}
+
+// ListRouters return the routers of the default registry sorted by id
+func ListRouters() []RouterInfo {
+	return defaultRegistry.List()
 }
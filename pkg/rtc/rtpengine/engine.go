@@ -3,6 +3,7 @@ package rtpengine
 import (
 	"crypto/sha1"
 	"net"
+	"sync"
 
 	"fmt"
 
@@ -18,18 +19,34 @@ const (
 )
 
 var (
+	// guards the listeners and stop, the accept loops check them
+	lock        sync.Mutex
 	listener    net.Listener
 	kcpListener *kcp.Listener
 	stop        bool
 )
 
+// accepting report if l is still the listener served, neither replaced by
+// a new Serve nor closed
+func accepting(l net.Listener) bool {
+	lock.Lock()
+	defer lock.Unlock()
+	if stop {
+		return false
+	}
+	return l == listener || (kcpListener != nil && l == net.Listener(kcpListener))
+}
+
 // Serve listen on a port and accept udp conn
 // func Serve(port int) chan *udp.Conn {
 func Serve(port int) (chan *transport.RTPTransport, error) {
 	log.Infof("rtpengine.Serve port=%d ", port)
+	lock.Lock()
+	defer lock.Unlock()
 	if listener != nil {
 		listener.Close()
 	}
+	stop = false
 	ch := make(chan *transport.RTPTransport, maxRtpConnSize)
 	var err error
 	listener, err = udp.Listen("udp", &net.UDPAddr{IP: net.IPv4zero, Port: port})
@@ -38,13 +55,18 @@ func Serve(port int) (chan *transport.RTPTransport, error) {
 		return nil, err
 	}
 
+	l := listener
 	go func() {
 		for {
-			if stop {
+			if !accepting(l) {
 				return
 			}
-			conn, err := listener.Accept()
+			conn, err := l.Accept()
 			if err != nil {
+				// closed by Close or a new Serve
+				if !accepting(l) {
+					return
+				}
 				log.Errorf("failed to accept conn %v", err)
 				continue
 			}
@@ -59,9 +81,12 @@ func Serve(port int) (chan *transport.RTPTransport, error) {
 // ServeWithKCP accept kcp conn
 func ServeWithKCP(port int, kcpPwd, kcpSalt string) (chan *transport.RTPTransport, error) {
 	log.Infof("kcp Serve port=%d", port)
+	lock.Lock()
+	defer lock.Unlock()
 	if kcpListener != nil {
 		kcpListener.Close()
 	}
+	stop = false
 	ch := make(chan *transport.RTPTransport, maxRtpConnSize)
 	var err error
 	key := pbkdf2.Key([]byte(kcpPwd), []byte(kcpSalt), 1024, 32, sha1.New)
@@ -72,13 +97,18 @@ func ServeWithKCP(port int, kcpPwd, kcpSalt string) (chan *transport.RTPTranspor
 		return nil, err
 	}
 
+	l := kcpListener
 	go func() {
 		for {
-			if stop {
+			if !accepting(l) {
 				return
 			}
-			conn, err := kcpListener.AcceptKCP()
+			conn, err := l.AcceptKCP()
 			if err != nil {
+				// closed by Close or a new ServeWithKCP
+				if !accepting(l) {
+					return
+				}
 				log.Errorf("failed to accept conn %v", err)
 				continue
 			}
@@ -92,10 +122,18 @@ func ServeWithKCP(port int, kcpPwd, kcpSalt string) (chan *transport.RTPTranspor
 
 // Close closes the rtp listener and stops accepting new connections.
 func Close() {
-	if !stop {
+	lock.Lock()
+	defer lock.Unlock()
+	if stop {
 		return
 	}
 	stop = true
-	listener.Close()
-	kcpListener.Close()
+	if listener != nil {
+		listener.Close()
+		listener = nil
+	}
+	if kcpListener != nil {
+		kcpListener.Close()
+		kcpListener = nil
+	}
 }
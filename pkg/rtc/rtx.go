@@ -0,0 +1,71 @@
+package rtc
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+// RTXStream is the rfc 4588 retransmission stream a sub negotiated for one
+// of the ssrcs it receives
+type RTXStream struct {
+	SSRC        uint32
+	PayloadType uint8
+}
+
+// rtxSender wrap the packets resent to a sub into its rtx streams
+type rtxSender struct {
+	streams map[uint32]RTXStream
+	// next sequence number of each rtx ssrc
+	sns  map[uint32]uint16
+	lock sync.Mutex
+}
+
+func newRTXSender(streams map[uint32]RTXStream) *rtxSender {
+	s := &rtxSender{
+		streams: make(map[uint32]RTXStream, len(streams)),
+		sns:     make(map[uint32]uint16, len(streams)),
+	}
+	for ssrc, stream := range streams {
+		s.streams[ssrc] = stream
+		s.sns[stream.SSRC] = uint16(rand.Uint32())
+	}
+	return s
+}
+
+// wrap return pkt as a packet of the rtx stream of its ssrc, the original
+// sequence number leads the payload. pkt is returned as it is without one.
+func (s *rtxSender) wrap(pkt *rtp.Packet) *rtp.Packet {
+	if s == nil {
+		return pkt
+	}
+	stream, ok := s.streams[pkt.SSRC]
+	if !ok {
+		return pkt
+	}
+	s.lock.Lock()
+	sn := s.sns[stream.SSRC]
+	s.sns[stream.SSRC] = sn + 1
+	s.lock.Unlock()
+
+	payload := make([]byte, 2+len(pkt.Payload))
+	binary.BigEndian.PutUint16(payload, pkt.SequenceNumber)
+	copy(payload[2:], pkt.Payload)
+	out := &rtp.Packet{Header: pkt.Header, Payload: payload}
+	out.SSRC = stream.SSRC
+	out.PayloadType = stream.PayloadType
+	out.SequenceNumber = sn
+	return out
+}
+
+// SetSubRTX set the rtx streams sub id negotiated, by the ssrc it receives.
+// The packets resent for these ssrcs go to the rtx streams, the others are
+// resent as they were sent. It may be called before AddSub.
+func (r *Router) SetSubRTX(id string, streams map[uint32]RTXStream) {
+	r.logger.Infof("Router.SetSubRTX id=%s streams=%v", id, streams)
+	r.subLock.Lock()
+	defer r.subLock.Unlock()
+	r.subRTX[id] = newRTXSender(streams)
+}
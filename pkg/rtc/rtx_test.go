@@ -0,0 +1,64 @@
+package rtc
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+)
+
+func TestRouterResendsOnRTX(t *testing.T) {
+	InitRouter(RouterConfig{SubNackBufferSize: 16})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	rtxSub := newFakeTransport("rtx")
+	router.SetSubRTX("rtx", map[uint32]RTXStream{1234: {SSRC: 5678, PayloadType: 97}})
+	router.AddSub("rtx", rtxSub)
+	plainSub := newFakeTransport("plain")
+	router.AddSub("plain", plainSub)
+	defer router.Close()
+
+	for i := 0; i < 5; i++ {
+		pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: uint16(i), Timestamp: 3000}, Payload: []byte{byte(i), 0xaa}}
+	}
+	subs := []*fakeTransport{rtxSub, plainSub}
+	for _, sub := range subs {
+		testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= 5 })
+	}
+
+	resent := func(sub *fakeTransport, sns ...uint16) []*rtp.Packet {
+		for _, sn := range sns {
+			sub.rtcpCh <- &rtcp.TransportLayerNack{MediaSSRC: 1234, Nacks: []rtcp.NackPair{{PacketID: sn}}}
+		}
+		testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= 5+len(sns) })
+		sub.lock.Lock()
+		defer sub.lock.Unlock()
+		return append([]*rtp.Packet(nil), sub.written[5:]...)
+	}
+
+	pkts := resent(rtxSub, 3, 1)
+	for i, osn := range []uint16{3, 1} {
+		pkt := pkts[i]
+		if pkt.SSRC != 5678 || pkt.PayloadType != 97 || pkt.Timestamp != 3000 {
+			t.Fatalf("rtx packet %+v, want ssrc 5678 and pt 97", pkt.Header)
+		}
+		if len(pkt.Payload) != 4 || binary.BigEndian.Uint16(pkt.Payload) != osn || pkt.Payload[2] != byte(osn) || pkt.Payload[3] != 0xaa {
+			t.Fatalf("rtx payload %v, want sn %d and the original payload", pkt.Payload, osn)
+		}
+	}
+	if pkts[1].SequenceNumber != pkts[0].SequenceNumber+1 {
+		t.Fatalf("rtx sns %d, %d, want the rtx stream in sequence", pkts[0].SequenceNumber, pkts[1].SequenceNumber)
+	}
+
+	pkts = resent(plainSub, 3)
+	if pkt := pkts[0]; pkt.SSRC != 1234 || pkt.PayloadType != 96 || pkt.SequenceNumber != 3 || len(pkt.Payload) != 2 {
+		t.Fatalf("resent %+v, want the original packet", pkt.Header)
+	}
+}
@@ -0,0 +1,135 @@
+package rtc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/log"
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+	"github.com/pion/ion-sfu/pkg/util"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+const (
+	videoClockRate = 90000
+	audioClockRate = 48000
+
+	// seconds from the ntp epoch, 1900, to the unix epoch
+	ntpEpochOffset = 2208988800
+)
+
+// toNTP return t as a 64 bit ntp timestamp
+func toNTP(t time.Time) uint64 {
+	return uint64(t.Unix()+ntpEpochOffset)<<32 | uint64(t.Nanosecond())<<32/uint64(time.Second)
+}
+
+// ntpAdd return the ntp timestamp d after ntp
+func ntpAdd(ntp uint64, d time.Duration) uint64 {
+	return ntp + uint64(d/time.Second)<<32 + uint64(d%time.Second)<<32/uint64(time.Second)
+}
+
+// rtpElapsed return d in rtp timestamp units of clockRate
+func rtpElapsed(d time.Duration, clockRate uint32) uint32 {
+	return uint32(int64(d) * int64(clockRate) / int64(time.Second))
+}
+
+// streamStats is what a sub was sent of one ssrc
+type streamStats struct {
+	packets   uint32
+	octets    uint32
+	clockRate uint32
+	lastTS    uint32
+	lastSent  time.Time
+	// report of the pub mapping the rtp timestamps to its ntp clock, the
+	// subs keep the pub clock for a/v sync
+	ref     *rtcp.SenderReport
+	refTime time.Time
+}
+
+// senderStats count the packets written to a sub for the sender reports
+// the router sends it
+type senderStats struct {
+	streams map[uint32]*streamStats
+	lock    sync.Mutex
+}
+
+func newSenderStats() *senderStats {
+	return &senderStats{streams: make(map[uint32]*streamStats)}
+}
+
+// add count pkt written to the sub at now
+func (s *senderStats) add(pkt *rtp.Packet, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	st := s.streams[pkt.SSRC]
+	if st == nil {
+		st = &streamStats{clockRate: audioClockRate}
+		if transport.IsVideo(pkt.PayloadType) {
+			st.clockRate = videoClockRate
+		}
+		s.streams[pkt.SSRC] = st
+	}
+	st.packets++
+	st.octets += uint32(len(pkt.Payload))
+	st.lastTS = pkt.Timestamp
+	st.lastSent = now
+}
+
+// setReference keep the pub report sr, rewritten like the packets of the
+// sub, received at now
+func (s *senderStats) setReference(sr *rtcp.SenderReport, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if st := s.streams[sr.SSRC]; st != nil {
+		st.ref = sr
+		st.refTime = now
+	}
+}
+
+// reports return a sender report at now for every ssrc the sub was sent
+func (s *senderStats) reports(now time.Time) []*rtcp.SenderReport {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	srs := make([]*rtcp.SenderReport, 0, len(s.streams))
+	for ssrc, st := range s.streams {
+		sr := &rtcp.SenderReport{
+			SSRC:        ssrc,
+			PacketCount: st.packets,
+			OctetCount:  st.octets,
+		}
+		if st.ref != nil {
+			elapsed := now.Sub(st.refTime)
+			sr.NTPTime = ntpAdd(st.ref.NTPTime, elapsed)
+			sr.RTPTime = st.ref.RTPTime + rtpElapsed(elapsed, st.clockRate)
+		} else {
+			sr.NTPTime = toNTP(now)
+			sr.RTPTime = st.lastTS + rtpElapsed(now.Sub(st.lastSent), st.clockRate)
+		}
+		srs = append(srs, sr)
+	}
+	return srs
+}
+
+// subReportLoop send the sender reports of a sub every interval until it
+// is removed
+func (r *Router) subReportLoop(subID string, trans transport.Transport, stats *senderStats, done chan struct{}, interval time.Duration) {
+	defer util.Recover("[Router.subReportLoop]")
+	logger := r.logger.With(log.Fields{"sub_id": subID})
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, sr := range stats.reports(now) {
+				if err := trans.WriteRTCP(sr); err != nil {
+					logger.Debugf("Router.subReportLoop err=%v", err)
+				}
+			}
+		case <-done:
+			return
+		case <-r.done:
+			return
+		}
+	}
+}
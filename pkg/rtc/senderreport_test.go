@@ -0,0 +1,94 @@
+package rtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+)
+
+func TestSenderStatsReports(t *testing.T) {
+	s := newSenderStats()
+	start := time.Unix(1600000000, 0)
+	for i := 0; i < 3; i++ {
+		s.add(&rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96, Timestamp: 9000 * uint32(i)}, Payload: make([]byte, 100)}, start.Add(time.Duration(i)*100*time.Millisecond))
+	}
+
+	// without a pub report the local clock is used
+	now := start.Add(300 * time.Millisecond)
+	srs := s.reports(now)
+	if len(srs) != 1 {
+		t.Fatalf("reports=%d, want 1", len(srs))
+	}
+	sr := srs[0]
+	if sr.SSRC != 1234 || sr.PacketCount != 3 || sr.OctetCount != 300 {
+		t.Fatalf("report %+v, want 3 packets and 300 octets of 1234", sr)
+	}
+	if sr.NTPTime != toNTP(now) || sr.NTPTime>>32 != 1600000000+ntpEpochOffset {
+		t.Fatalf("ntp time %x, want %x", sr.NTPTime, toNTP(now))
+	}
+	if sr.RTPTime != 27000 {
+		t.Fatalf("rtp time %d, want 27000", sr.RTPTime)
+	}
+
+	// the pub report keeps the mapping of the pub clock
+	s.setReference(&rtcp.SenderReport{SSRC: 1234, NTPTime: 0xe2c5a0e400000000, RTPTime: 1000}, now)
+	sr = s.reports(now.Add(1500 * time.Millisecond))[0]
+	if sr.NTPTime != 0xe2c5a0e580000000 || sr.RTPTime != 1000+135000 {
+		t.Fatalf("report %+v, want the pub report 1.5s later", sr)
+	}
+}
+
+func TestRouterSendsSubSenderReports(t *testing.T) {
+	InitRouter(RouterConfig{SubSRInterval: 20})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	defer router.Close()
+
+	stop := make(chan struct{})
+	sent := make(chan int)
+	go func() {
+		sn := uint16(0)
+		for {
+			select {
+			case <-stop:
+				sent <- int(sn)
+				return
+			case <-time.After(5 * time.Millisecond):
+				pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: sn, Timestamp: 450 * uint32(sn)}, Payload: make([]byte, 10)}
+				sn++
+			}
+		}
+	}()
+	// the pub reports aren't forwarded anymore
+	pub.rtcpCh <- &rtcp.SenderReport{SSRC: 9999, PacketCount: 1}
+
+	testhelper.WaitFor(t, 2*time.Second, func() bool { return len(sub.senderReports()) >= 5 })
+	close(stop)
+	total := <-sent
+
+	var last *rtcp.SenderReport
+	for _, sr := range sub.senderReports() {
+		if sr.SSRC != 1234 || sr.OctetCount != 10*sr.PacketCount || len(sr.Reports) != 0 {
+			t.Fatalf("report %+v, want 10 octets per packet of 1234", sr)
+		}
+		if sr.PacketCount == 0 {
+			t.Fatal("report of an empty stream")
+		}
+		if last != nil && (sr.PacketCount < last.PacketCount || sr.NTPTime <= last.NTPTime) {
+			t.Fatalf("report %+v after %+v, want increasing counts and time", sr, last)
+		}
+		last = sr
+	}
+	if int(last.PacketCount) > total {
+		t.Fatalf("reported %d packets, %d sent", last.PacketCount, total)
+	}
+}
@@ -0,0 +1,176 @@
+package rtc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// source switches remembered per stream to map the nacks of a sub back
+const maxSeqSegments = 64
+
+// seqSegment is a run of the sequence numbers of a sub stream from one
+// source, sn of the sub is sn+offset of the source
+type seqSegment struct {
+	start  uint16
+	src    uint32
+	offset uint16
+}
+
+// seqRewriter keep the sequence numbers of a stream a sub receives
+// continuous when its source changes, e.g. a simulcast layer switch or a
+// new pub taking over the stable ssrc, and map the sub sequence numbers
+// back to the source
+type seqRewriter struct {
+	started  bool
+	src      uint32
+	offset   uint16
+	lastSN   uint16
+	segments []seqSegment
+}
+
+// rewrite return the sub sequence number of sn of src
+func (w *seqRewriter) rewrite(src uint32, sn uint16) uint16 {
+	switch {
+	case !w.started:
+		w.started = true
+		w.src = src
+		w.lastSN = sn
+		w.segments = append(w.segments, seqSegment{start: sn, src: src})
+	case src != w.src:
+		// the new source continues after the last number sent
+		w.src = src
+		w.offset = sn - w.lastSN - 1
+		w.segments = append(w.segments, seqSegment{start: w.lastSN + 1, src: src, offset: w.offset})
+		if len(w.segments) > maxSeqSegments {
+			w.segments = w.segments[1:]
+		}
+	}
+	out := sn - w.offset
+	if int16(out-w.lastSN) > 0 {
+		w.lastSN = out
+	}
+	return out
+}
+
+// source return the source and its sequence number of sn of the sub,
+// false if sn is older than the segments remembered
+func (w *seqRewriter) source(sn uint16) (uint32, uint16, bool) {
+	for i := len(w.segments) - 1; i >= 0; i-- {
+		s := w.segments[i]
+		if int16(sn-s.start) >= 0 {
+			return s.src, sn + s.offset, true
+		}
+	}
+	return 0, 0, false
+}
+
+// subSeqs is the seqRewriter of every stream of a sub by the ssrc the sub
+// sees, the sources are the pub ssrcs. The timestamps are rewritten too
+// when timestamps isn't nil.
+type subSeqs struct {
+	lock       sync.Mutex
+	streams    map[uint32]*seqRewriter
+	timestamps map[uint32]*tsRewriter
+	now        func() time.Time
+}
+
+func newSubSeqs(now func() time.Time, timestamps bool) *subSeqs {
+	s := &subSeqs{streams: make(map[uint32]*seqRewriter), now: now}
+	if timestamps {
+		s.timestamps = make(map[uint32]*tsRewriter)
+	}
+	return s
+}
+
+// rewrite return pkt, sent to the sub for a packet of the pub ssrc src,
+// with the sequence number of the sub
+func (s *subSeqs) rewrite(src uint32, pkt *rtp.Packet) *rtp.Packet {
+	if s == nil {
+		return pkt
+	}
+	s.lock.Lock()
+	w := s.streams[pkt.SSRC]
+	if w == nil {
+		w = &seqRewriter{}
+		s.streams[pkt.SSRC] = w
+	}
+	sn := w.rewrite(src, pkt.SequenceNumber)
+	ts := pkt.Timestamp
+	if s.timestamps != nil {
+		tw := s.timestamps[pkt.SSRC]
+		if tw == nil {
+			tw = &tsRewriter{}
+			s.timestamps[pkt.SSRC] = tw
+		}
+		ts = tw.rewrite(src, ts, s.now(), rtpClockRate(pkt.PayloadType))
+	}
+	s.lock.Unlock()
+	if sn == pkt.SequenceNumber && ts == pkt.Timestamp {
+		return pkt
+	}
+	out := *pkt
+	out.SequenceNumber = sn
+	out.Timestamp = ts
+	return &out
+}
+
+// senderReport return sr of the pub ssrc src with the timestamps of the sub,
+// nil if src isn't the source of the stream anymore
+func (s *subSeqs) senderReport(src uint32, sr *rtcp.SenderReport) *rtcp.SenderReport {
+	if s == nil || s.timestamps == nil {
+		return sr
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tw := s.timestamps[sr.SSRC]
+	if tw == nil {
+		return sr
+	}
+	ts, ok := tw.reference(src, sr.RTPTime)
+	if !ok {
+		return nil
+	}
+	sr.RTPTime = ts
+	return sr
+}
+
+// source return the pub ssrc and sequence number of sn of ssrc of the sub
+func (s *subSeqs) source(ssrc uint32, sn uint16) (uint32, uint16, bool) {
+	if s == nil {
+		return 0, 0, false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	w := s.streams[ssrc]
+	if w == nil {
+		return 0, 0, false
+	}
+	return w.source(sn)
+}
+
+// subSource return the pub ssrc and sequence number of a packet the sub
+// was sent as sn of ssrc, the probes taken out
+func (r *Router) subSource(subID string, ssrc uint32, sn uint16) (uint32, uint16) {
+	r.subLock.RLock()
+	defer r.subLock.RUnlock()
+	src, srcSN, found := r.subSeqs[subID].source(ssrc, sn)
+	if !found {
+		src, srcSN = ssrc, sn
+		if r.ssrcMap != nil {
+			src = r.ssrcMap.toPub(ssrc)
+		}
+	}
+	// every layer is sent as the first one
+	if st := r.subLayers[subID]; st != nil && len(r.layers) > 0 && src == r.layers[0] {
+		st.lock.Lock()
+		layer, layerSN, found := st.seq.source(srcSN)
+		st.lock.Unlock()
+		if found {
+			src, srcSN = layer, layerSN
+		}
+	}
+	return r.ssrcChanges.toPub(src, srcSN)
+}
@@ -0,0 +1,116 @@
+package rtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+)
+
+func TestSeqRewriter(t *testing.T) {
+	w := &seqRewriter{}
+	var out []uint16
+	for sn := uint16(65530); sn != 2; sn++ {
+		out = append(out, w.rewrite(1, sn))
+	}
+	// the second source starts anywhere
+	for sn := uint16(300); sn < 305; sn++ {
+		out = append(out, w.rewrite(2, sn))
+	}
+	for i, sn := range out {
+		if sn != uint16(65530+i) {
+			t.Fatalf("sn %d=%d, want %d", i, sn, uint16(65530+i))
+		}
+	}
+	for _, c := range []struct {
+		sn    uint16
+		src   uint32
+		srcSN uint16
+	}{
+		{65531, 1, 65531},
+		{1, 1, 1},
+		{2, 2, 300},
+		{6, 2, 304},
+	} {
+		if src, srcSN, found := w.source(c.sn); !found || src != c.src || srcSN != c.srcSN {
+			t.Fatalf("source(%d)=%d,%d,%v, want %d,%d", c.sn, src, srcSN, found, c.src, c.srcSN)
+		}
+	}
+	if _, _, found := w.source(65000); found {
+		t.Fatal("sn before the first packet mapped")
+	}
+
+	// switching back starts a new segment
+	if sn := w.rewrite(1, 10); sn != 7 {
+		t.Fatalf("sn=%d, want 7", sn)
+	}
+	if src, srcSN, _ := w.source(7); src != 1 || srcSN != 10 {
+		t.Fatalf("source(7)=%d,%d, want 1,10", src, srcSN)
+	}
+}
+
+func TestRouterSimulcastNackMapsToLayer(t *testing.T) {
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	router.SetPubLayers([]uint32{1, 2})
+	defer router.Close()
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	router.SetSubLayer("sub", 0)
+
+	send := func(from, to int) {
+		for i := from; i < to; i++ {
+			for _, ssrc := range []uint32{1, 2} {
+				pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: ssrc, PayloadType: 96, SequenceNumber: uint16(ssrc*1000) + uint16(i)}}
+			}
+		}
+	}
+	waitWritten := func(n int) {
+		testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= n })
+	}
+	send(0, 5)
+	waitWritten(5)
+	router.SetSubLayer("sub", 1)
+	send(5, 10)
+	waitWritten(10)
+
+	// the sub sees 1000 to 1009, the second half came from layer 2
+	sub.lock.Lock()
+	for i, pkt := range sub.written {
+		if pkt.SSRC != 1 || pkt.SequenceNumber != 1000+uint16(i) {
+			sub.lock.Unlock()
+			t.Fatalf("packet %d ssrc=%d sn=%d, want 1 and %d", i, pkt.SSRC, pkt.SequenceNumber, 1000+i)
+		}
+	}
+	sub.lock.Unlock()
+
+	for _, c := range []struct {
+		sn    uint16
+		ssrc  uint32
+		pubSN uint16
+	}{
+		{1003, 1, 1003},
+		{1007, 2, 2007},
+	} {
+		before := pub.writtenRTCPTotal()
+		sub.rtcpCh <- &rtcp.TransportLayerNack{MediaSSRC: 1, Nacks: []rtcp.NackPair{{PacketID: c.sn}}}
+		var nack *rtcp.TransportLayerNack
+		testhelper.WaitFor(t, time.Second, func() bool {
+			pub.lock.Lock()
+			defer pub.lock.Unlock()
+			for _, pkt := range pub.writtenRTCP[before:] {
+				if n, ok := pkt.(*rtcp.TransportLayerNack); ok {
+					nack = n
+				}
+			}
+			return nack != nil
+		})
+		if nack.MediaSSRC != c.ssrc || nack.Nacks[0].PacketID != c.pubSN {
+			t.Fatalf("nack of %d went to ssrc=%d sn=%d, want %d and %d", c.sn, nack.MediaSSRC, nack.Nacks[0].PacketID, c.ssrc, c.pubSN)
+		}
+	}
+}
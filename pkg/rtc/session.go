@@ -0,0 +1,374 @@
+package rtc
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/pion/ion-sfu/pkg/log"
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+)
+
+var (
+	errSessionSubNotFound = errors.New("session sub not found")
+	errSessionClosed      = errors.New("router of the session is closed")
+	errSessionRouterFull  = errors.New("router of the session has too many subs")
+)
+
+// Session bundles the pubs of several routers, e.g. the participants of a
+// call, so a sub receives all of them through one transport. Every router
+// writes to the sub through its own sessionSub. When a pub joins, its tracks
+// are added to every sub and the remote has to answer a new offer.
+// Tracks of a pub which left stay on the sub until it is closed.
+type Session struct {
+	id       string
+	routers  map[string]*Router
+	tracks   map[string][]transport.TrackInfo
+	subs     map[string]*sessionBundle
+	onNewPub func(subID string, offer webrtc.SessionDescription)
+	lock     sync.RWMutex
+}
+
+// sessionBundle is a sub of the session and its view for every router
+type sessionBundle struct {
+	id      string
+	t       transport.BundleTransport
+	routers map[string]*sessionSub
+}
+
+// NewSession return a new Session
+func NewSession(id string) *Session {
+	log.Infof("NewSession id=%s", id)
+	return &Session{
+		id:      id,
+		routers: make(map[string]*Router),
+		tracks:  make(map[string][]transport.TrackInfo),
+		subs:    make(map[string]*sessionBundle),
+	}
+}
+
+// ID return id
+func (s *Session) ID() string {
+	return s.id
+}
+
+// OnNewPub set the handler called with the offer a sub has to answer, with
+// Answer, to receive a pub which joined the session
+func (s *Session) OnNewPub(f func(subID string, offer webrtc.SessionDescription)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.onNewPub = f
+}
+
+// AddPub add the pub of router to the session, tracks are the tracks the
+// subs receive from it
+func (s *Session) AddPub(router *Router, tracks []transport.TrackInfo) {
+	log.Infof("Session.AddPub id=%s router=%s tracks=%d", s.id, router.id, len(tracks))
+	// the subs see the ssrcs the router writes
+	subTracks := make([]transport.TrackInfo, len(tracks))
+	for i, info := range tracks {
+		info.SSRC = router.SubSSRC(info.SSRC, info.PT)
+		subTracks[i] = info
+	}
+	tracks = subTracks
+	s.lock.Lock()
+	s.routers[router.id] = router
+	s.tracks[router.id] = tracks
+	bundles := make([]*sessionBundle, 0, len(s.subs))
+	for _, b := range s.subs {
+		bundles = append(bundles, b)
+	}
+	onNewPub := s.onNewPub
+	s.lock.Unlock()
+
+	for _, b := range bundles {
+		offer, err := b.t.AddTracks(tracks)
+		if err != nil {
+			log.Errorf("Session.AddPub sub=%s AddTracks err=%v", b.id, err)
+			continue
+		}
+		if err := s.attach(b, router); err != nil {
+			log.Errorf("Session.AddPub sub=%s err=%v", b.id, err)
+			continue
+		}
+		if onNewPub != nil {
+			onNewPub(b.id, offer)
+		}
+	}
+}
+
+// AddSub add a sub receiving every pub of the session, the returned offer
+// has to be answered with Answer
+func (s *Session) AddSub(id string, t transport.BundleTransport) (webrtc.SessionDescription, error) {
+	log.Infof("Session.AddSub id=%s sub=%s", s.id, id)
+	b := &sessionBundle{id: id, t: t, routers: make(map[string]*sessionSub)}
+	s.lock.Lock()
+	s.subs[id] = b
+	routers := make([]*Router, 0, len(s.routers))
+	var tracks []transport.TrackInfo
+	for rid, router := range s.routers {
+		routers = append(routers, router)
+		tracks = append(tracks, s.tracks[rid]...)
+	}
+	s.lock.Unlock()
+
+	t.OnClose(func() {
+		s.delSub(id)
+	})
+	t.OnConnectionStateChange(func(state int) {
+		s.lock.RLock()
+		subs := make([]*sessionSub, 0, len(b.routers))
+		for _, sub := range b.routers {
+			subs = append(subs, sub)
+		}
+		s.lock.RUnlock()
+		for _, sub := range subs {
+			sub.setState(state)
+		}
+	})
+
+	offer, err := t.AddTracks(tracks)
+	if err != nil {
+		s.delSub(id)
+		return webrtc.SessionDescription{}, err
+	}
+	for _, router := range routers {
+		if err := s.attach(b, router); err != nil {
+			log.Errorf("Session.AddSub sub=%s err=%v", id, err)
+		}
+	}
+	go s.feedbackLoop(b)
+	return offer, nil
+}
+
+// Answer set the answer of a sub to the last offer
+func (s *Session) Answer(subID string, answer webrtc.SessionDescription) error {
+	s.lock.RLock()
+	b := s.subs[subID]
+	s.lock.RUnlock()
+	if b == nil {
+		return errSessionSubNotFound
+	}
+	return b.t.SetRemoteSDP(answer)
+}
+
+// attach add the sub to router through a new sessionSub
+func (s *Session) attach(b *sessionBundle, router *Router) error {
+	sub := &sessionSub{
+		bundle: b,
+		t:      b.t,
+		rtcpCh: make(chan rtcp.Packet, maxSessionRTCP),
+	}
+	s.lock.Lock()
+	if old := b.routers[router.id]; old != nil {
+		old.closeRTCP()
+	}
+	b.routers[router.id] = sub
+	s.lock.Unlock()
+
+	if router.AddSub(b.id, sub) == nil {
+		s.detach(b, router.id, sub)
+		if router.Full() {
+			return errSessionRouterFull
+		}
+		return errSessionClosed
+	}
+	sub.OnClose(func() {
+		s.detach(b, router.id, sub)
+		router.delSub(b.id)
+	})
+	return nil
+}
+
+// detach forget the sessionSub of a router, e.g. when the router closed
+func (s *Session) detach(b *sessionBundle, routerID string, sub *sessionSub) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if b.routers[routerID] != sub {
+		return
+	}
+	delete(b.routers, routerID)
+	sub.closeRTCP()
+	if router := s.routers[routerID]; router != nil && router.closed() {
+		delete(s.routers, routerID)
+		delete(s.tracks, routerID)
+	}
+}
+
+// delSub remove a sub from the session and its routers, the transport is
+// closed already
+func (s *Session) delSub(id string) {
+	s.lock.Lock()
+	b := s.subs[id]
+	delete(s.subs, id)
+	var subs []*sessionSub
+	if b != nil {
+		for _, sub := range b.routers {
+			subs = append(subs, sub)
+		}
+	}
+	s.lock.Unlock()
+	if b == nil {
+		return
+	}
+	log.Infof("Session.delSub id=%s sub=%s", s.id, id)
+	for _, sub := range subs {
+		sub.closed()
+	}
+}
+
+// feedbackLoop hand the rtcp of a sub to the routers of the ssrcs it is
+// about, rtcp about no known ssrc, e.g. a remb, goes to every router
+func (s *Session) feedbackLoop(b *sessionBundle) {
+	for pkt := range b.t.GetRTCPChan() {
+		s.lock.RLock()
+		if s.subs[b.id] != b {
+			s.lock.RUnlock()
+			return
+		}
+		var matched []*sessionSub
+		for rid, sub := range b.routers {
+			if s.routerHasSSRC(rid, pkt.DestinationSSRC()) {
+				matched = append(matched, sub)
+			}
+		}
+		if len(matched) == 0 {
+			for _, sub := range b.routers {
+				matched = append(matched, sub)
+			}
+		}
+		for _, sub := range matched {
+			select {
+			case sub.rtcpCh <- pkt:
+			default:
+				log.Debugf("Session.feedbackLoop sub=%s rtcp dropped", b.id)
+			}
+		}
+		s.lock.RUnlock()
+	}
+}
+
+// routerHasSSRC report if one of ssrcs is a track of the router, lock must be held
+func (s *Session) routerHasSSRC(routerID string, ssrcs []uint32) bool {
+	for _, info := range s.tracks[routerID] {
+		for _, ssrc := range ssrcs {
+			if info.SSRC == ssrc {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+const maxSessionRTCP = 100
+
+// sessionSub is the sub of a session as one router sees it. Writes go to the
+// shared transport, closing it only takes the sub out of the router.
+type sessionSub struct {
+	bundle         *sessionBundle
+	t              transport.BundleTransport
+	rtcpCh         chan rtcp.Packet
+	rtcpClosed     bool
+	onCloseHandler func()
+	onStateHandler func(int)
+	isClosed       bool
+	lock           sync.Mutex
+}
+
+// ID return the id of the sub
+func (s *sessionSub) ID() string {
+	return s.bundle.id
+}
+
+// Type return the type of the shared transport
+func (s *sessionSub) Type() int {
+	return s.t.Type()
+}
+
+// ReadRTP read from the shared transport, a sub sends nothing
+func (s *sessionSub) ReadRTP() (*rtp.Packet, error) {
+	return s.t.ReadRTP()
+}
+
+// WriteRTP write to the shared transport
+func (s *sessionSub) WriteRTP(pkt *rtp.Packet) error {
+	return s.t.WriteRTP(pkt)
+}
+
+// WriteRTCP write to the shared transport
+func (s *sessionSub) WriteRTCP(pkt rtcp.Packet) error {
+	return s.t.WriteRTCP(pkt)
+}
+
+// GetRTCPChan return the rtcp about the tracks of this router
+func (s *sessionSub) GetRTCPChan() chan rtcp.Packet {
+	return s.rtcpCh
+}
+
+// Close take the sub out of the router, the shared transport stays open
+func (s *sessionSub) Close() {
+	s.closed()
+}
+
+// closed call the close handler once, it calls back into Close through the router
+func (s *sessionSub) closed() {
+	s.lock.Lock()
+	if s.isClosed {
+		s.lock.Unlock()
+		return
+	}
+	s.isClosed = true
+	f := s.onCloseHandler
+	s.lock.Unlock()
+	if f != nil {
+		f()
+	}
+}
+
+// closeRTCP end the feedback loop of the router, session lock must be held
+func (s *sessionSub) closeRTCP() {
+	if !s.rtcpClosed {
+		s.rtcpClosed = true
+		close(s.rtcpCh)
+	}
+}
+
+// OnClose set the handler called when the sub leaves the router
+func (s *sessionSub) OnClose(f func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.onCloseHandler = f
+}
+
+// OnConnectionStateChange set the handler of the shared transport state
+func (s *sessionSub) OnConnectionStateChange(f func(state int)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.onStateHandler = f
+}
+
+func (s *sessionSub) setState(state int) {
+	s.lock.Lock()
+	f := s.onStateHandler
+	s.lock.Unlock()
+	if f != nil {
+		f(state)
+	}
+}
+
+// WriteErrTotal return the write errors of the shared transport
+func (s *sessionSub) WriteErrTotal() int {
+	return s.t.WriteErrTotal()
+}
+
+// WriteErrReset reset the write errors of the shared transport
+func (s *sessionSub) WriteErrReset() {
+	s.t.WriteErrReset()
+}
+
+// GetBandwidth return the bandwidth of the shared transport
+func (s *sessionSub) GetBandwidth() uint32 {
+	return s.t.GetBandwidth()
+}
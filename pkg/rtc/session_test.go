@@ -0,0 +1,127 @@
+package rtc
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+)
+
+// fakeBundleTransport is a fakeTransport sub whose tracks can be added
+type fakeBundleTransport struct {
+	*fakeTransport
+	tracksLock sync.Mutex
+	tracks     []transport.TrackInfo
+	offers     int
+	answers    []webrtc.SessionDescription
+}
+
+func newFakeBundleTransport(id string) *fakeBundleTransport {
+	return &fakeBundleTransport{fakeTransport: newFakeTransport(id)}
+}
+
+func (f *fakeBundleTransport) AddTracks(tracks []transport.TrackInfo) (webrtc.SessionDescription, error) {
+	f.tracksLock.Lock()
+	defer f.tracksLock.Unlock()
+	f.tracks = append(f.tracks, tracks...)
+	f.offers++
+	return webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: fmt.Sprintf("offer %d", f.offers)}, nil
+}
+
+func (f *fakeBundleTransport) SetRemoteSDP(sdp webrtc.SessionDescription) error {
+	f.tracksLock.Lock()
+	defer f.tracksLock.Unlock()
+	f.answers = append(f.answers, sdp)
+	return nil
+}
+
+func (f *fakeBundleTransport) trackTotal() int {
+	f.tracksLock.Lock()
+	defer f.tracksLock.Unlock()
+	return len(f.tracks)
+}
+
+// writtenSSRCs return how many packets of every ssrc were written
+func (f *fakeTransport) writtenSSRCs() map[uint32]int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ssrcs := make(map[uint32]int)
+	for _, pkt := range f.written {
+		ssrcs[pkt.SSRC]++
+	}
+	return ssrcs
+}
+
+func TestSessionBundlesPubsIntoOneSub(t *testing.T) {
+	session := NewSession("call")
+	var offers []string
+	session.OnNewPub(func(subID string, offer webrtc.SessionDescription) {
+		offers = append(offers, subID+" "+offer.SDP)
+	})
+
+	router1 := NewRouter("pub1")
+	pub1 := newFakeTransport("pub1")
+	router1.AddPub(pub1)
+	defer router1.Close()
+	session.AddPub(router1, []transport.TrackInfo{{SSRC: 1, PT: 96, StreamID: "pub1", TrackID: "video"}})
+
+	sub := newFakeBundleTransport("sub")
+	offer, err := session.AddSub("sub", sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offer.SDP != "offer 1" || sub.trackTotal() != 1 {
+		t.Fatalf("offer=%q tracks=%d, want the track of pub1", offer.SDP, sub.trackTotal())
+	}
+	if err := session.Answer("sub", webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "answer"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second pub joins, the sub has to renegotiate
+	router2 := NewRouter("pub2")
+	pub2 := newFakeTransport("pub2")
+	router2.AddPub(pub2)
+	session.AddPub(router2, []transport.TrackInfo{{SSRC: 2, PT: 111, StreamID: "pub2", TrackID: "audio"}})
+	if len(offers) != 1 || offers[0] != "sub offer 2" || sub.trackTotal() != 2 {
+		t.Fatalf("offers=%v tracks=%d, want a new offer with the track of pub2", offers, sub.trackTotal())
+	}
+
+	for i := 0; i < 3; i++ {
+		pub1.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 1, PayloadType: 96, SequenceNumber: uint16(i)}}
+		pub2.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 2, PayloadType: 111, SequenceNumber: uint16(i)}}
+	}
+	testhelper.WaitFor(t, time.Second, func() bool {
+		ssrcs := sub.writtenSSRCs()
+		return ssrcs[1] == 3 && ssrcs[2] == 3
+	})
+
+	// a pli about the track of pub2 only reaches pub2
+	sub.rtcpCh <- &rtcp.PictureLossIndication{MediaSSRC: 2}
+	testhelper.WaitFor(t, time.Second, func() bool { return pub2.writtenRTCPTotal() == 1 })
+	if total := pub1.writtenRTCPTotal(); total != 0 {
+		t.Fatalf("pub1 got %d rtcp for the track of pub2", total)
+	}
+
+	// pub2 leaving doesn't close the shared sub
+	router2.Close()
+	if sub.isClosed() || router1.GetSub("sub") == nil {
+		t.Fatal("sub closed when one pub left")
+	}
+	pub1.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 1, PayloadType: 96, SequenceNumber: 3}}
+	testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenSSRCs()[1] == 4 })
+
+	// closing the sub takes it out of the remaining routers
+	sub.Close()
+	if router1.GetSub("sub") != nil {
+		t.Fatal("sub not removed from router1")
+	}
+	if err := session.Answer("sub", webrtc.SessionDescription{}); err != errSessionSubNotFound {
+		t.Fatalf("err=%v, want errSessionSubNotFound", err)
+	}
+}
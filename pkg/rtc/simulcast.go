@@ -0,0 +1,275 @@
+package rtc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+const (
+	layerRateWindow = time.Second
+
+	defaultLayerDownThreshold = 1.0
+	defaultLayerUpThreshold   = 1.5
+	defaultLayerHoldTime      = 2000 * time.Millisecond
+)
+
+// bitrateMeter measures the bitrate of a layer
+type bitrateMeter struct {
+	// bits per second, accessed atomically
+	rate uint64
+
+	lock  sync.Mutex
+	bytes uint64
+	start time.Time
+}
+
+func (m *bitrateMeter) add(n int, now time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.start.IsZero() {
+		m.start = now
+	}
+	m.bytes += uint64(n)
+	if elapsed := now.Sub(m.start); elapsed >= layerRateWindow {
+		atomic.StoreUint64(&m.rate, m.bytes*8*uint64(time.Second)/uint64(elapsed))
+		m.bytes = 0
+		m.start = now
+	}
+}
+
+func (m *bitrateMeter) bitrate() uint64 {
+	return atomic.LoadUint64(&m.rate)
+}
+
+// layerState tracks the simulcast layer a sub receives and rewrites it
+// into one continuous stream. The selection is changed under the write lock
+// of subLock, the packets routed under its read lock rewrite the stream
+// under lock.
+type layerState struct {
+	// selected layer, -1 means the highest available
+	layer int
+	// when the sub estimate started to stay below/above the layer bitrate
+	downSince time.Time
+	upSince   time.Time
+
+	lock sync.Mutex
+	// layer forwarded last, the sequence numbers continue across switches
+	started bool
+	ssrc    uint32
+	seq     seqRewriter
+	// and the timestamps, nil unless rewritten
+	ts *tsRewriter
+}
+
+// SetPubLayers set the simulcast ssrcs of the pub, ordered from the lowest
+// to the highest quality. Subs see every layer as the first ssrc.
+func (r *Router) SetPubLayers(ssrcs []uint32) {
+	r.logger.Infof("Router.SetPubLayers ssrcs=%v", ssrcs)
+	r.subLock.Lock()
+	defer r.subLock.Unlock()
+	r.layers = append([]uint32(nil), ssrcs...)
+	r.layerMeters = make([]*bitrateMeter, len(ssrcs))
+	for i := range r.layerMeters {
+		r.layerMeters[i] = &bitrateMeter{}
+	}
+	r.updateRoutes()
+}
+
+// GetPubLayers return the simulcast ssrcs of the pub
+func (r *Router) GetPubLayers() []uint32 {
+	r.subLock.RLock()
+	defer r.subLock.RUnlock()
+	return append([]uint32(nil), r.layers...)
+}
+
+// SetSubLayer pin a sub to a simulcast layer, 0 is the lowest
+func (r *Router) SetSubLayer(subID string, layer int) {
+	r.logger.Infof("Router.SetSubLayer id=%s layer=%d", subID, layer)
+	r.subLock.Lock()
+	st := r.subLayers[subID]
+	if st == nil {
+		r.subLock.Unlock()
+		return
+	}
+	changed := st.layer != layer
+	st.layer = layer
+	r.subLock.Unlock()
+
+	// the new layer has to start with a key frame
+	if changed {
+		r.requestKeyFrame()
+	}
+}
+
+// GetSubLayer return the simulcast layer a sub receives
+func (r *Router) GetSubLayer(subID string) int {
+	r.subLock.RLock()
+	defer r.subLock.RUnlock()
+	st := r.subLayers[subID]
+	if st == nil {
+		return -1
+	}
+	return r.selectedLayer(st)
+}
+
+// selectedLayer return the layer index used for a sub, subLock must be held
+func (r *Router) selectedLayer(st *layerState) int {
+	if st.layer < 0 || st.layer >= len(r.layers) {
+		return len(r.layers) - 1
+	}
+	return st.layer
+}
+
+// measureLayer update the bitrate of the layer pkt belongs to, subLock must
+// be held
+func (r *Router) measureLayer(pkt *rtp.Packet) {
+	for i, ssrc := range r.layers {
+		if ssrc == pkt.SSRC {
+			r.layerMeters[i].add(pkt.MarshalSize(), time.Now())
+			return
+		}
+	}
+}
+
+// adaptSubLayer step a sub down a layer when its estimated bandwidth stays
+// below the bitrate of its layer, and back up when there is headroom again.
+// An estimate answering a probe burst steps up without the hold time.
+func (r *Router) adaptSubLayer(subID string, bitrate uint64, probed bool) {
+	config := getRouterConfig()
+	down := config.LayerDownThreshold
+	if down <= 0 {
+		down = defaultLayerDownThreshold
+	}
+	up := config.LayerUpThreshold
+	if up <= 0 {
+		up = defaultLayerUpThreshold
+	}
+	hold := time.Duration(config.LayerHoldTime) * time.Millisecond
+	if hold <= 0 {
+		hold = defaultLayerHoldTime
+	}
+
+	r.subLock.Lock()
+	st := r.subLayers[subID]
+	if st == nil || len(r.layers) < 2 {
+		r.subLock.Unlock()
+		return
+	}
+	now := time.Now()
+	cur := r.selectedLayer(st)
+	next := cur
+	curRate := r.layerMeters[cur].bitrate()
+	switch {
+	case cur > 0 && curRate > 0 && float64(bitrate) < float64(curRate)*down:
+		st.upSince = time.Time{}
+		if st.downSince.IsZero() {
+			st.downSince = now
+		}
+		if now.Sub(st.downSince) >= hold {
+			next = cur - 1
+		}
+	case cur < len(r.layers)-1 && r.layerMeters[cur+1].bitrate() > 0 &&
+		float64(bitrate) > float64(r.layerMeters[cur+1].bitrate())*up:
+		st.downSince = time.Time{}
+		if st.upSince.IsZero() {
+			st.upSince = now
+		}
+		if probed || now.Sub(st.upSince) >= hold {
+			next = cur + 1
+		}
+	default:
+		st.downSince = time.Time{}
+		st.upSince = time.Time{}
+	}
+	next = r.fitSubLayer(subID, next)
+	if next != cur {
+		st.layer = next
+		st.downSince = time.Time{}
+		st.upSince = time.Time{}
+	}
+	r.subLock.Unlock()
+
+	if next != cur {
+		r.logger.Infof("Router.adaptSubLayer id=%s bitrate=%d layer %d => %d", subID, bitrate, cur, next)
+		r.requestKeyFrame()
+	}
+}
+
+// fitSubLayer return layer, or the highest one below it whose bitrate is
+// under the cap of the sub. subLock must be held.
+func (r *Router) fitSubLayer(subID string, layer int) int {
+	max := r.subMaxBitrates[subID]
+	if max == 0 {
+		return layer
+	}
+	for layer > 0 && r.layerMeters[layer].bitrate() > max {
+		layer--
+	}
+	return layer
+}
+
+// simulcastPacket return the packet rewritten for the sub,
+// or nil if it belongs to another layer. subLock must be held.
+func (r *Router) simulcastPacket(subID string, pkt *rtp.Packet) *rtp.Packet {
+	isLayer := false
+	for _, ssrc := range r.layers {
+		if ssrc == pkt.SSRC {
+			isLayer = true
+			break
+		}
+	}
+	st := r.subLayers[subID]
+	if !isLayer || st == nil {
+		return pkt
+	}
+
+	if pkt.SSRC != r.layers[r.selectedLayer(st)] {
+		return nil
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.started = true
+	st.ssrc = pkt.SSRC
+
+	newPkt := *pkt
+	newPkt.SSRC = r.layers[0]
+	newPkt.SequenceNumber = st.seq.rewrite(pkt.SSRC, pkt.SequenceNumber)
+	if st.ts != nil {
+		newPkt.Timestamp = st.ts.rewrite(pkt.SSRC, pkt.Timestamp, r.now(), rtpClockRate(pkt.PayloadType))
+	}
+	return &newPkt
+}
+
+// simulcastSenderReport return the sender report for the sub, or nil if it
+// is about a layer the sub doesn't receive. The reception reports of the pub
+// are dropped, they are about what the pub receives. subLock must be held.
+func (r *Router) simulcastSenderReport(subID string, sr *rtcp.SenderReport) *rtcp.SenderReport {
+	out := *sr
+	out.Reports = nil
+	st := r.subLayers[subID]
+	if st == nil {
+		return &out
+	}
+	for _, ssrc := range r.layers {
+		if ssrc == sr.SSRC {
+			// the layers share the rtp clock, the report of the layer
+			// forwarded maps the timestamps of the sub stream
+			st.lock.Lock()
+			defer st.lock.Unlock()
+			if !st.started || sr.SSRC != st.ssrc {
+				return nil
+			}
+			out.SSRC = r.layers[0]
+			if st.ts != nil {
+				out.RTPTime, _ = st.ts.reference(sr.SSRC, sr.RTPTime)
+			}
+			return &out
+		}
+	}
+	return &out
+}
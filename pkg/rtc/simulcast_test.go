@@ -0,0 +1,334 @@
+package rtc
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+)
+
+func TestRouterSimulcastLayerSelection(t *testing.T) {
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	router.SetPubLayers([]uint32{1, 2, 3})
+	defer router.Close()
+
+	subs := map[string]*fakeTransport{}
+	for _, id := range []string{"low", "mid", "high"} {
+		subs[id] = newFakeTransport(id)
+		router.AddSub(id, subs[id])
+	}
+	router.SetSubLayer("low", 0)
+	router.SetSubLayer("mid", 1)
+
+	send := func(from, to int) {
+		for i := from; i < to; i++ {
+			for _, ssrc := range []uint32{1, 2, 3} {
+				pub.rtpCh <- &rtp.Packet{Header: rtp.Header{
+					SSRC:           ssrc,
+					PayloadType:    96,
+					SequenceNumber: uint16(ssrc*1000) + uint16(i),
+				}}
+			}
+		}
+	}
+	waitWritten := func(sub *fakeTransport, n int) {
+		testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= n })
+	}
+
+	send(0, 5)
+	for id, wantSN := range map[string]uint16{"low": 1000, "mid": 2000, "high": 3000} {
+		sub := subs[id]
+		waitWritten(sub, 5)
+		sub.lock.Lock()
+		for i, pkt := range sub.written {
+			if pkt.SSRC != 1 || pkt.SequenceNumber != wantSN+uint16(i) {
+				t.Fatalf("%s got ssrc=%d sn=%d, want ssrc=1 sn=%d", id, pkt.SSRC, pkt.SequenceNumber, wantSN+uint16(i))
+			}
+		}
+		sub.lock.Unlock()
+	}
+
+	// switching layers keeps the sequence numbers contiguous
+	router.SetSubLayer("high", 0)
+	if layer := router.GetSubLayer("high"); layer != 0 {
+		t.Fatalf("layer=%d, want 0", layer)
+	}
+	send(5, 10)
+	high := subs["high"]
+	waitWritten(high, 10)
+	high.lock.Lock()
+	defer high.lock.Unlock()
+	if len(high.written) != 10 {
+		t.Fatalf("written=%d, want 10", len(high.written))
+	}
+	for i, pkt := range high.written {
+		if pkt.SequenceNumber != 3000+uint16(i) {
+			t.Fatalf("sn=%d, want %d", pkt.SequenceNumber, 3000+uint16(i))
+		}
+	}
+}
+
+func TestRouterSimulcastAutoLayerSwitch(t *testing.T) {
+	InitRouter(RouterConfig{
+		PLIInterval:        1,
+		LayerDownThreshold: 1.0,
+		LayerUpThreshold:   1.5,
+		LayerHoldTime:      20,
+	})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	router.SetPubLayers([]uint32{1, 2, 3})
+	defer router.Close()
+
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+
+	// make the ssrcs known as video so switches can request key frames
+	pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 3, PayloadType: 96}}
+	testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() != 0 })
+
+	router.subLock.Lock()
+	for i, rate := range []uint64{100000, 500000, 1500000} {
+		atomic.StoreUint64(&router.layerMeters[i].rate, rate)
+	}
+	router.subLock.Unlock()
+
+	var lastREMB uint64
+	remb := func(bitrate uint64) {
+		sub.rtcpCh <- &rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: bitrate}
+	}
+	waitLayer := func(want int) {
+		// the estimate is sent again until the layer switched
+		testhelper.WaitFor(t, time.Second, func() bool {
+			if router.GetSubLayer("sub") == want {
+				return true
+			}
+			remb(lastREMB)
+			return false
+		})
+	}
+
+	if layer := router.GetSubLayer("sub"); layer != 2 {
+		t.Fatalf("layer=%d, want 2", layer)
+	}
+
+	// a single low estimate is not enough to switch
+	lastREMB = 400000
+	remb(lastREMB)
+	time.Sleep(5 * time.Millisecond)
+	if layer := router.GetSubLayer("sub"); layer != 2 {
+		t.Fatalf("layer=%d, want 2 before the hold time", layer)
+	}
+
+	waitLayer(1)
+	waitLayer(0)
+	if pub.writtenRTCPTotal() < 2 {
+		t.Fatalf("pli=%d, want one per switch", pub.writtenRTCPTotal())
+	}
+
+	// enough headroom above the next layer steps back up
+	lastREMB = 1000000
+	waitLayer(1)
+	if layer := router.GetSubLayer("sub"); layer != 1 {
+		t.Fatalf("layer=%d, want 1", layer)
+	}
+}
+
+func TestRouterSimulcastAddSubsWhileRouting(t *testing.T) {
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	router.SetPubLayers([]uint32{1, 2})
+	defer router.Close()
+
+	// the simulcast path routes under subLock, writers must not starve it
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					id := fmt.Sprintf("sub%d-%d", w, i)
+					router.AddSub(id, newFakeTransport(id))
+					router.GetSubs()
+				}
+			}(w)
+		}
+		for i := 0; i < 500; i++ {
+			pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: uint32(1 + i%2), SequenceNumber: uint16(i)}}
+		}
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("router deadlocked while adding subs")
+	}
+	if subs := len(router.GetSubs()); subs != 200 {
+		t.Fatalf("subs=%d, want 200", subs)
+	}
+}
+
+func TestRouterSimulcastNacksWhileSwitching(t *testing.T) {
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	router.SetPubLayers([]uint32{1, 2})
+	defer router.Close()
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+
+	// the nacks of the sub are mapped to the layers while they are rewritten
+	nacked := make(chan struct{})
+	go func() {
+		defer close(nacked)
+		for i := 0; i < 500; i++ {
+			sub.rtcpCh <- &rtcp.TransportLayerNack{MediaSSRC: 1, Nacks: []rtcp.NackPair{{PacketID: uint16(i % 100)}}}
+		}
+	}()
+	for i := 0; i < 500; i++ {
+		if i%50 == 0 {
+			router.SetSubLayer("sub", i/50%2)
+		}
+		for _, ssrc := range []uint32{1, 2} {
+			pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: ssrc, PayloadType: 96, SequenceNumber: uint16(i)}}
+		}
+	}
+	<-nacked
+	testhelper.WaitFor(t, time.Second, func() bool { return len(pub.rtpCh) == 0 && len(sub.rtcpCh) == 0 })
+	testhelper.WaitFor(t, time.Second, func() bool {
+		pub.lock.Lock()
+		defer pub.lock.Unlock()
+		for _, pkt := range pub.writtenRTCP {
+			if _, ok := pkt.(*rtcp.TransportLayerNack); ok {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestRouterSimulcastSenderReportsWhileRouting(t *testing.T) {
+	InitRouter(RouterConfig{RewriteTimestamps: true})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	router.SetPubLayers([]uint32{1, 2})
+	defer router.Close()
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	router.SetSubLayer("sub", 1)
+
+	// the reports are mapped to the layer forwarded while it is rewritten
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		for i := 0; i < 500; i++ {
+			pub.rtcpCh <- &rtcp.SenderReport{SSRC: uint32(1 + i%2), RTPTime: uint32(i * 90)}
+		}
+	}()
+	for i := 0; i < 500; i++ {
+		for _, ssrc := range []uint32{1, 2} {
+			pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: ssrc, PayloadType: 96, SequenceNumber: uint16(i), Timestamp: uint32(i * 90)}}
+		}
+	}
+	<-reported
+	testhelper.WaitFor(t, time.Second, func() bool { return len(sub.senderReports()) != 0 })
+}
+
+func TestRouterSimulcastSenderReports(t *testing.T) {
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	router.SetPubLayers([]uint32{1, 2, 3})
+	defer router.Close()
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	router.SetSubLayer("sub", 1)
+
+	pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 2, PayloadType: 96, SequenceNumber: 1}}
+	testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() != 0 })
+
+	// only the report of the layer forwarded reaches the sub, as layer 0
+	for _, ssrc := range []uint32{1, 2, 3} {
+		pub.rtcpCh <- &rtcp.SenderReport{SSRC: ssrc, RTPTime: ssrc * 1000}
+	}
+	testhelper.WaitFor(t, time.Second, func() bool { return len(sub.senderReports()) != 0 })
+	time.Sleep(50 * time.Millisecond)
+	srs := sub.senderReports()
+	if len(srs) != 1 || srs[0].SSRC != 1 || srs[0].RTPTime != 2000 {
+		t.Fatalf("reports=%+v, want the report of ssrc 2 as ssrc 1", srs)
+	}
+}
+
+func TestRouterSubMaxBitrate(t *testing.T) {
+	InitRouter(RouterConfig{LayerHoldTime: 20})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	router.SetPubLayers([]uint32{1, 2, 3})
+	defer router.Close()
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+
+	router.subLock.Lock()
+	for i, rate := range []uint64{100000, 500000, 1500000} {
+		atomic.StoreUint64(&router.layerMeters[i].rate, rate)
+	}
+	router.subLock.Unlock()
+	remb := func(bitrate uint64) {
+		sub.rtcpCh <- &rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: bitrate}
+	}
+
+	// the cap applies at once, the highest layer under it is picked
+	router.SetSubMaxBitrate("sub", 600000)
+	if layer := router.GetSubLayer("sub"); layer != 1 {
+		t.Fatalf("layer=%d, want 1 under the cap", layer)
+	}
+	// estimates above the cap don't step the sub up
+	for i := 0; i < 10; i++ {
+		remb(5000000)
+		time.Sleep(5 * time.Millisecond)
+	}
+	if layer := router.GetSubLayer("sub"); layer != 1 {
+		t.Fatalf("layer=%d with a high estimate, want 1 under the cap", layer)
+	}
+	if bitrate := router.SubBitrate("sub"); bitrate != 5000000 {
+		t.Fatalf("SubBitrate=%d, want the estimate of the sub", bitrate)
+	}
+
+	// the lowest layer is kept under any cap
+	router.SetSubMaxBitrate("sub", 50000)
+	if layer := router.GetSubLayer("sub"); layer != 0 {
+		t.Fatalf("layer=%d, want 0", layer)
+	}
+
+	// without a cap the estimate steps it back up
+	router.SetSubMaxBitrate("sub", 0)
+	testhelper.WaitFor(t, time.Second, func() bool {
+		if router.GetSubLayer("sub") == 2 {
+			return true
+		}
+		remb(5000000)
+		return false
+	})
+}
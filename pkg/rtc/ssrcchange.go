@@ -0,0 +1,232 @@
+package rtc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// packets in sequence a new ssrc must send while the stream of its payload
+// type is silent before it is taken as the replacement of that stream, a
+// corrupted ssrc doesn't come with a run of sequence numbers
+const ssrcChangePackets = 3
+
+// pubStream is a stream of the pub as the subs see it
+type pubStream struct {
+	pt uint8
+	// ssrc the subs see
+	out uint32
+	// last sequence number and timestamp sent to the subs
+	sn      uint16
+	ts      uint32
+	arrival time.Time
+}
+
+// ssrcRewrite continue an old stream with the packets of a new ssrc
+type ssrcRewrite struct {
+	ssrc uint32
+	sn   uint16
+	ts   uint32
+}
+
+// ssrcCandidate is a new ssrc held until it shows it replaces a stream
+type ssrcCandidate struct {
+	ssrc    uint32
+	pending []*rtp.Packet
+}
+
+// ssrcChanges detect a pub changing the ssrc of a stream on the same
+// transport, e.g. after a track replace. The new ssrc continues the ssrc,
+// sequence numbers and timestamps of the old stream so the subs keep
+// playing it. A new ssrc sending while the stream of its payload type is
+// still alive is a new track and routed as it is.
+type ssrcChanges struct {
+	lock sync.Mutex
+	// by pub ssrc
+	streams  map[uint32]*pubStream
+	rewrites map[uint32]*ssrcRewrite
+	// old ssrcs, their late packets are dropped
+	replaced map[uint32]bool
+	// pub ssrc by ssrc the subs see, only for rewritten streams
+	in map[uint32]uint32
+	// by payload type
+	candidates map[uint8]*ssrcCandidate
+}
+
+func newSSRCChanges() *ssrcChanges {
+	c := &ssrcChanges{}
+	c.reset()
+	return c
+}
+
+// reset forget the streams, e.g. for a new pub
+func (c *ssrcChanges) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.streams = make(map[uint32]*pubStream)
+	c.rewrites = make(map[uint32]*ssrcRewrite)
+	c.replaced = make(map[uint32]bool)
+	c.in = make(map[uint32]uint32)
+	c.candidates = make(map[uint8]*ssrcCandidate)
+}
+
+// check return the packets to route for pkt of the pub, none while a new
+// ssrc is held. dropped are the packets not routed, replaced the pub ssrc
+// of a stream taken over by a new ssrc, 0 if none was.
+func (c *ssrcChanges) check(pkt *rtp.Packet, now time.Time, simulcast bool) (route, dropped []*rtp.Packet, replaced uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.replaced[pkt.SSRC] {
+		return nil, []*rtp.Packet{pkt}, 0
+	}
+	if s, found := c.streams[pkt.SSRC]; found {
+		// the stream of the payload type is alive, the held ssrc is a new track
+		if cand := c.candidates[s.pt]; cand != nil {
+			delete(c.candidates, s.pt)
+			for _, p := range cand.pending {
+				route = append(route, c.add(p, now))
+			}
+		}
+		return append(route, c.rewrite(s, pkt, now)), nil, 0
+	}
+
+	// simulcast layers share the payload type
+	old, oldSSRC := c.latest(pkt.PayloadType)
+	if simulcast || old == nil {
+		return []*rtp.Packet{c.add(pkt, now)}, nil, 0
+	}
+
+	cand := c.candidates[pkt.PayloadType]
+	if cand != nil && cand.ssrc == pkt.SSRC && pkt.SequenceNumber == cand.pending[len(cand.pending)-1].SequenceNumber+1 {
+		cand.pending = append(cand.pending, pkt)
+	} else {
+		// out of sequence, the held packets were corrupted
+		if cand != nil {
+			dropped = cand.pending
+		}
+		cand = &ssrcCandidate{ssrc: pkt.SSRC, pending: []*rtp.Packet{pkt}}
+		c.candidates[pkt.PayloadType] = cand
+	}
+	if len(cand.pending) < ssrcChangePackets {
+		return nil, dropped, 0
+	}
+
+	// the new ssrc continues the old stream
+	delete(c.candidates, pkt.PayloadType)
+	first := cand.pending[0]
+	clockRate := uint32(audioClockRate)
+	if transport.IsVideo(pkt.PayloadType) {
+		clockRate = videoClockRate
+	}
+	c.rewrites[pkt.SSRC] = &ssrcRewrite{
+		ssrc: old.out,
+		sn:   old.sn + 1 - first.SequenceNumber,
+		ts:   old.ts + rtpElapsed(now.Sub(old.arrival), clockRate) - first.Timestamp,
+	}
+	delete(c.streams, oldSSRC)
+	delete(c.rewrites, oldSSRC)
+	c.replaced[oldSSRC] = true
+	c.in[old.out] = pkt.SSRC
+	s := &pubStream{pt: pkt.PayloadType, out: old.out}
+	c.streams[pkt.SSRC] = s
+	for _, p := range cand.pending {
+		route = append(route, c.rewrite(s, p, now))
+	}
+	return route, dropped, oldSSRC
+}
+
+// add start a stream sent to the subs as it is
+func (c *ssrcChanges) add(pkt *rtp.Packet, now time.Time) *rtp.Packet {
+	s := &pubStream{pt: pkt.PayloadType, out: pkt.SSRC}
+	c.streams[pkt.SSRC] = s
+	return c.rewrite(s, pkt, now)
+}
+
+// latest return the stream of payload type pt which sent last
+func (c *ssrcChanges) latest(pt uint8) (*pubStream, uint32) {
+	var latest *pubStream
+	var ssrc uint32
+	for id, s := range c.streams {
+		if s.pt == pt && (latest == nil || s.arrival.After(latest.arrival)) {
+			latest, ssrc = s, id
+		}
+	}
+	return latest, ssrc
+}
+
+// rewrite return pkt as the subs see it and remember it as the last of s
+func (c *ssrcChanges) rewrite(s *pubStream, pkt *rtp.Packet, now time.Time) *rtp.Packet {
+	if rw := c.rewrites[pkt.SSRC]; rw != nil {
+		out := *pkt
+		out.SSRC = rw.ssrc
+		out.SequenceNumber += rw.sn
+		out.Timestamp += rw.ts
+		pkt = &out
+	}
+	if s.arrival.IsZero() || int16(pkt.SequenceNumber-s.sn) > 0 {
+		s.sn = pkt.SequenceNumber
+		s.ts = pkt.Timestamp
+	}
+	s.arrival = now
+	return pkt
+}
+
+// toPub return the pub ssrc and sequence number of a packet the subs were
+// sent
+func (c *ssrcChanges) toPub(ssrc uint32, sn uint16) (uint32, uint16) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pub, found := c.in[ssrc]
+	if !found {
+		return ssrc, sn
+	}
+	return pub, sn - c.rewrites[pub].sn
+}
+
+// changed report if a stream of the pub was taken over by a new ssrc
+func (c *ssrcChanges) changed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.in) > 0
+}
+
+// senderReport return sr of the pub for the stream the subs see, nil for
+// a replaced ssrc
+func (c *ssrcChanges) senderReport(sr *rtcp.SenderReport) *rtcp.SenderReport {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.replaced[sr.SSRC] {
+		return nil
+	}
+	rw := c.rewrites[sr.SSRC]
+	if rw == nil {
+		return sr
+	}
+	out := *sr
+	out.SSRC = rw.ssrc
+	out.RTPTime += rw.ts
+	return &out
+}
+
+// checkSSRC route pkt of the pub through the ssrc change detection, a
+// replaced stream gets a key frame of the new ssrc at once
+func (r *Router) checkSSRC(pkt *rtp.Packet, now time.Time, owner transport.PooledTransport) []*rtp.Packet {
+	snap, _ := r.routes.Load().(*routeSnapshot)
+	route, dropped, replaced := r.ssrcChanges.check(pkt, now, snap != nil && snap.simulcast)
+	if owner != nil {
+		for _, p := range dropped {
+			owner.ReleaseRTP(p)
+		}
+	}
+	if replaced != 0 {
+		r.logger.Infof("Router pub ssrc %d replaced by %d", replaced, pkt.SSRC)
+		r.ssrcLock.Lock()
+		delete(r.ssrcs, replaced)
+		r.ssrcLock.Unlock()
+		r.requestKeyFrame()
+	}
+	return route
+}
@@ -0,0 +1,124 @@
+package rtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+)
+
+func TestSSRCChanges(t *testing.T) {
+	c := newSSRCChanges()
+	now := time.Now()
+	check := func(ssrc uint32, sn uint16, ts uint32) ([]*rtp.Packet, []*rtp.Packet, uint32) {
+		now = now.Add(20 * time.Millisecond)
+		return c.check(&rtp.Packet{Header: rtp.Header{SSRC: ssrc, PayloadType: 96, SequenceNumber: sn, Timestamp: ts}}, now, false)
+	}
+	for sn := uint16(100); sn < 110; sn++ {
+		if route, _, _ := check(1, sn, uint32(sn)*1800); len(route) != 1 || route[0].SSRC != 1 || route[0].SequenceNumber != sn {
+			t.Fatalf("first stream rewritten: %v", route)
+		}
+	}
+
+	// a corrupted ssrc is held and dropped with the next one out of sequence
+	if route, _, _ := check(99, 7, 0); len(route) != 0 {
+		t.Fatal("corrupted ssrc routed")
+	}
+	if _, dropped, replaced := check(98, 3, 0); len(dropped) != 1 || replaced != 0 {
+		t.Fatalf("dropped=%d replaced=%d, want the corrupted packet dropped", len(dropped), replaced)
+	}
+
+	// a run of a new ssrc while the old one is silent replaces it
+	check(2, 5000, 40000)
+	check(2, 5001, 41800)
+	route, dropped, replaced := check(2, 5002, 43600)
+	if replaced != 1 || len(dropped) != 0 || len(route) != 3 {
+		t.Fatalf("replaced=%d dropped=%d route=%d, want 1 replaced by 3 packets", replaced, len(dropped), len(route))
+	}
+	for i, pkt := range route {
+		if pkt.SSRC != 1 || pkt.SequenceNumber != uint16(110+i) {
+			t.Fatalf("packet %d ssrc=%d sn=%d, want 1 and %d", i, pkt.SSRC, pkt.SequenceNumber, 110+i)
+		}
+	}
+	if route[0].Timestamp <= 109*1800 || route[1].Timestamp-route[0].Timestamp != 1800 {
+		t.Fatalf("timestamps %d %d don't continue the old stream", route[0].Timestamp, route[1].Timestamp)
+	}
+	if route, _, _ := check(2, 5003, 45400); route[0].SSRC != 1 || route[0].SequenceNumber != 113 {
+		t.Fatalf("next packet ssrc=%d sn=%d, want 1 and 113", route[0].SSRC, route[0].SequenceNumber)
+	}
+
+	// late packets of the old ssrc are dropped, feedback goes to the new one
+	if route, dropped, _ := check(1, 110, 0); len(route) != 0 || len(dropped) != 1 {
+		t.Fatal("late packet of the replaced ssrc routed")
+	}
+	if ssrc, sn := c.toPub(1, 112); ssrc != 2 || sn != 5002 {
+		t.Fatalf("toPub=%d,%d, want 2,5002", ssrc, sn)
+	}
+	if sr := c.senderReport(&rtcp.SenderReport{SSRC: 2, RTPTime: 45400}); sr.SSRC != 1 || sr.RTPTime != route[0].Timestamp+3*1800 {
+		t.Fatalf("sender report %+v, want the old ssrc", sr)
+	}
+	if c.senderReport(&rtcp.SenderReport{SSRC: 1}) != nil {
+		t.Fatal("report of the replaced ssrc forwarded")
+	}
+
+	// a new ssrc sending along the stream is a new track
+	check(3, 10, 0)
+	route, _, replaced = check(2, 5004, 47200)
+	if replaced != 0 || len(route) != 2 || route[0].SSRC != 3 || route[1].SSRC != 1 {
+		t.Fatalf("new track not routed as it is: replaced=%d route=%v", replaced, route)
+	}
+	if route, _, _ := check(3, 11, 1800); route[0].SSRC != 3 || route[0].SequenceNumber != 11 {
+		t.Fatal("new track rewritten")
+	}
+}
+
+func TestRouterSSRCChange(t *testing.T) {
+	InitRouter(RouterConfig{PLIInterval: 1})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	defer router.Close()
+
+	send := func(ssrc uint32, sn uint16) {
+		pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: ssrc, PayloadType: 96, SequenceNumber: sn}}
+	}
+	for sn := uint16(0); sn < 10; sn++ {
+		send(1234, sn)
+	}
+	// the pub replaced its track, the new ssrc starts a new sequence
+	for sn := uint16(30000); sn < 30010; sn++ {
+		send(5678, sn)
+	}
+
+	testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= 20 })
+	sub.lock.Lock()
+	for i, pkt := range sub.written {
+		if pkt.SSRC != 1234 || pkt.SequenceNumber != uint16(i) {
+			sub.lock.Unlock()
+			t.Fatalf("packet %d ssrc=%d sn=%d, want 1234 and %d", i, pkt.SSRC, pkt.SequenceNumber, i)
+		}
+	}
+	sub.lock.Unlock()
+
+	// the new ssrc is asked for a key frame, the feedback of the sub goes there
+	testhelper.WaitFor(t, time.Second, func() bool {
+		pub.lock.Lock()
+		defer pub.lock.Unlock()
+		for _, pkt := range pub.writtenRTCP {
+			if p, ok := pkt.(*rtcp.PictureLossIndication); ok && p.MediaSSRC == 5678 {
+				return true
+			}
+		}
+		return false
+	})
+	if ssrc := router.pubSSRC(1234); ssrc != 5678 {
+		t.Fatalf("feedback ssrc=%d, want 5678", ssrc)
+	}
+}
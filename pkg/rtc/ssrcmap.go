@@ -0,0 +1,155 @@
+package rtc
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// ssrcMap give every stream of the pub a stable ssrc the subs see, so their
+// stats and a/v sync survive a pub reconnecting with new ssrcs. A stream
+// of the new pub takes over the stable ssrc of a stream of the old pub
+// with the same payload type.
+type ssrcMap struct {
+	// stable ssrc by ssrc of the current pub
+	out map[uint32]uint32
+	// pub ssrc by stable ssrc, the feedback of the subs goes there
+	in map[uint32]uint32
+	// payload type of the stable ssrcs
+	pts map[uint32]uint8
+	// stable ssrcs of an old pub, free to be taken over
+	free map[uint32]bool
+	lock sync.RWMutex
+}
+
+func newSSRCMap() *ssrcMap {
+	return &ssrcMap{
+		out:  make(map[uint32]uint32),
+		in:   make(map[uint32]uint32),
+		pts:  make(map[uint32]uint8),
+		free: make(map[uint32]bool),
+	}
+}
+
+// toSub return the stable ssrc of a pub ssrc, it is assigned on first use
+func (m *ssrcMap) toSub(ssrc uint32, pt uint8) uint32 {
+	m.lock.RLock()
+	stable, found := m.out[ssrc]
+	m.lock.RUnlock()
+	if found {
+		return stable
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if stable, found := m.out[ssrc]; found {
+		return stable
+	}
+	stable = 0
+	for s := range m.free {
+		if m.pts[s] == pt && (stable == 0 || s < stable) {
+			stable = s
+		}
+	}
+	if stable != 0 {
+		delete(m.free, stable)
+	} else {
+		for stable == 0 || m.pts[stable] != 0 || m.in[stable] != 0 {
+			stable = rand.Uint32()
+		}
+	}
+	m.out[ssrc] = stable
+	m.in[stable] = ssrc
+	m.pts[stable] = pt
+	return stable
+}
+
+// lookup return the stable ssrc of a pub ssrc, false if it has none yet
+func (m *ssrcMap) lookup(ssrc uint32) (uint32, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	stable, found := m.out[ssrc]
+	return stable, found
+}
+
+// toPub return the pub ssrc of a stable ssrc, ssrc itself if it is unknown
+func (m *ssrcMap) toPub(stable uint32) uint32 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if ssrc, found := m.in[stable]; found {
+		return ssrc
+	}
+	return stable
+}
+
+// switchPub free the stable ssrcs for the streams of a new pub, the
+// feedback still goes to the old ssrcs until they are taken over
+func (m *ssrcMap) switchPub() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for stable := range m.in {
+		m.free[stable] = true
+	}
+	m.out = make(map[uint32]uint32)
+}
+
+// SubSSRC return the ssrc the subs see for a pub ssrc of payload type pt,
+// the tracks of the subs are created with it
+func (r *Router) SubSSRC(ssrc uint32, pt uint8) uint32 {
+	if r.ssrcMap == nil {
+		return ssrc
+	}
+	return r.ssrcMap.toSub(ssrc, pt)
+}
+
+// remapPacket return pkt with the stable ssrc, the payload is shared
+func (r *Router) remapPacket(pkt *rtp.Packet) *rtp.Packet {
+	if r.ssrcMap == nil {
+		return pkt
+	}
+	newPkt := *pkt
+	newPkt.SSRC = r.ssrcMap.toSub(pkt.SSRC, pkt.PayloadType)
+	return &newPkt
+}
+
+// pubSSRC return the pub ssrc of an ssrc a sub sees
+func (r *Router) pubSSRC(ssrc uint32) uint32 {
+	if r.ssrcMap != nil {
+		ssrc = r.ssrcMap.toPub(ssrc)
+	}
+	ssrc, _ = r.ssrcChanges.toPub(ssrc, 0)
+	return ssrc
+}
+
+// pubFeedback return the key frame request or remb of a sub about the
+// ssrcs of the pub
+func (r *Router) pubFeedback(pkt rtcp.Packet) rtcp.Packet {
+	if r.ssrcMap == nil && !r.ssrcChanges.changed() {
+		return pkt
+	}
+	switch pkt := pkt.(type) {
+	case *rtcp.PictureLossIndication:
+		out := *pkt
+		out.MediaSSRC = r.pubSSRC(pkt.MediaSSRC)
+		return &out
+	case *rtcp.FullIntraRequest:
+		out := *pkt
+		out.MediaSSRC = r.pubSSRC(pkt.MediaSSRC)
+		out.FIR = make([]rtcp.FIREntry, len(pkt.FIR))
+		for i, entry := range pkt.FIR {
+			entry.SSRC = r.pubSSRC(entry.SSRC)
+			out.FIR[i] = entry
+		}
+		return &out
+	case *rtcp.ReceiverEstimatedMaximumBitrate:
+		out := *pkt
+		out.SSRCs = make([]uint32, len(pkt.SSRCs))
+		for i, ssrc := range pkt.SSRCs {
+			out.SSRCs[i] = r.pubSSRC(ssrc)
+		}
+		return &out
+	}
+	return pkt
+}
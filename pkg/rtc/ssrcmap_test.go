@@ -0,0 +1,120 @@
+package rtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+)
+
+func TestSSRCMap(t *testing.T) {
+	m := newSSRCMap()
+	audio, video := m.toSub(1, 111), m.toSub(2, 96)
+	if audio == 0 || video == 0 || audio == video {
+		t.Fatalf("stable ssrcs %d %d, want distinct non zero", audio, video)
+	}
+	if m.toSub(1, 111) != audio {
+		t.Fatal("stable ssrc changed")
+	}
+	// a second stream of the same payload type gets its own ssrc
+	video2 := m.toSub(3, 96)
+	if video2 == video || video2 == audio {
+		t.Fatalf("second video ssrc %d, want a new one", video2)
+	}
+	if _, found := m.lookup(4); found {
+		t.Fatal("unknown ssrc has a stable ssrc")
+	}
+	if m.toPub(video) != 2 || m.toPub(42) != 42 {
+		t.Fatalf("toPub(%d)=%d toPub(42)=%d, want 2 and 42", video, m.toPub(video), m.toPub(42))
+	}
+
+	// the streams of the new pub take over the ssrcs by payload type
+	m.switchPub()
+	if _, found := m.lookup(2); found {
+		t.Fatal("old pub ssrc still mapped after switch")
+	}
+	if m.toPub(video) != 2 {
+		t.Fatal("feedback lost before the new pub sent")
+	}
+	if got := m.toSub(20, 96); got != video && got != video2 {
+		t.Fatalf("new video ssrc %d, want %d or %d", got, video, video2)
+	}
+	if got := m.toSub(10, 111); got != audio {
+		t.Fatalf("new audio ssrc %d, want %d", got, audio)
+	}
+	if m.toPub(audio) != 10 {
+		t.Fatalf("toPub(%d)=%d, want the new pub ssrc 10", audio, m.toPub(audio))
+	}
+	if got := m.toSub(30, 8); got == audio || got == video || got == video2 {
+		t.Fatalf("new payload type got old ssrc %d", got)
+	}
+}
+
+func TestRouterRemapsSSRC(t *testing.T) {
+	InitRouter(RouterConfig{RemapSSRC: true, PLIInterval: 1})
+	defer InitRouter(RouterConfig{})
+
+	router := NewRouter("router")
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	defer router.Close()
+
+	stable := router.SubSSRC(1234, 96)
+	if stable == 1234 {
+		t.Fatal("pub ssrc not remapped")
+	}
+	waitRTP := func(n int) *rtp.Packet {
+		testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= n })
+		sub.lock.Lock()
+		defer sub.lock.Unlock()
+		return sub.written[n-1]
+	}
+	waitRTCP := func(f *fakeTransport, n int) rtcp.Packet {
+		testhelper.WaitFor(t, time.Second, func() bool { return f.writtenRTCPTotal() >= n })
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		return f.writtenRTCP[n-1]
+	}
+
+	pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 1234, PayloadType: 96, SequenceNumber: 1}}
+	if pkt := waitRTP(1); pkt.SSRC != stable {
+		t.Fatalf("sub got ssrc %d, want %d", pkt.SSRC, stable)
+	}
+	sub.rtcpCh <- &rtcp.PictureLossIndication{MediaSSRC: stable}
+	if pli, ok := waitRTCP(pub, 1).(*rtcp.PictureLossIndication); !ok || pli.MediaSSRC != 1234 {
+		t.Fatalf("pub got %+v, want a pli for 1234", pli)
+	}
+
+	// the new pub streams keep the ssrc and the sequence the sub sees
+	pub2 := newFakeTransport("pub2")
+	router.SwitchPub(pub2)
+	pub2.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: 5678, PayloadType: 96, SequenceNumber: 100}}
+	if pkt := waitRTP(2); pkt.SSRC != stable || pkt.SequenceNumber != 2 {
+		t.Fatalf("sub got ssrc %d sn %d after switch, want %d and 2", pkt.SSRC, pkt.SequenceNumber, stable)
+	}
+
+	// the sender report of a stream not sent yet is dropped
+	pub2.rtcpCh <- &rtcp.SenderReport{SSRC: 9999}
+	pub2.rtcpCh <- &rtcp.SenderReport{SSRC: 5678, RTPTime: 90000}
+	if sr, ok := waitRTCP(sub, 1).(*rtcp.SenderReport); !ok || sr.SSRC != stable || sr.RTPTime != 90000 {
+		t.Fatalf("sub got %+v, want the report of %d", sr, stable)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	sub.rtcpCh <- &rtcp.PictureLossIndication{MediaSSRC: stable}
+	if pli, ok := waitRTCP(pub2, 1).(*rtcp.PictureLossIndication); !ok || pli.MediaSSRC != 5678 {
+		t.Fatalf("pub2 got %+v, want a pli for 5678", pli)
+	}
+	sub.rtcpCh <- &rtcp.TransportLayerNack{MediaSSRC: stable, Nacks: []rtcp.NackPair{{PacketID: 2}}}
+	if nack, ok := waitRTCP(pub2, 2).(*rtcp.TransportLayerNack); !ok || nack.MediaSSRC != 5678 || nack.Nacks[0].PacketID != 100 {
+		t.Fatalf("pub2 got %+v, want a nack for 5678", nack)
+	}
+	if srs := sub.senderReports(); len(srs) != 1 {
+		t.Fatalf("sub got %d sender reports, want 1", len(srs))
+	}
+}
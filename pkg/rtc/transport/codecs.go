@@ -0,0 +1,162 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// codec names of the webrtc.codecs config
+const (
+	CodecVP8  = "vp8"
+	CodecVP9  = "vp9"
+	CodecH264 = "h264"
+	CodecOpus = "opus"
+	CodecG722 = "g722"
+)
+
+var (
+	errUnknownCodec     = errors.New("codec must be vp8, vp9, h264, opus or g722")
+	errCodecPayloadType = errors.New("payload type must be dynamic, 96 to 127, and used by a single codec")
+	errNoCodec          = errors.New("no codec enabled")
+)
+
+// CodecConfig changes a codec of the transports from its defaults
+type CodecConfig struct {
+	// Name is vp8, vp9, h264, opus or g722
+	Name     string `mapstructure:"name"`
+	Disabled bool   `mapstructure:"disabled"`
+	// PayloadTypes replace the payload types the codec is registered with
+	PayloadTypes []uint8 `mapstructure:"payloadtypes"`
+	// Fmtp replaces the format parameters of every payload type of the codec
+	Fmtp string `mapstructure:"fmtp"`
+}
+
+// mediaCodec is a codec registered in the media engine of the transports,
+// fmtp holds the format parameters of each payload type
+type mediaCodec struct {
+	name         string
+	payloadTypes []uint8
+	fmtp         map[uint8]string
+}
+
+var (
+	// codecs of the media engines, in the order they are registered
+	mediaCodecs = defaultMediaCodecs()
+	// video payload types of mediaCodecs
+	videoPTs = codecVideoPTs(mediaCodecs)
+)
+
+// defaultMediaCodecs return the codecs registered without config, every one
+// but g722, with the payload types chrome and firefox offer
+func defaultMediaCodecs() []mediaCodec {
+	return []mediaCodec{
+		{name: CodecOpus, payloadTypes: []uint8{webrtc.DefaultPayloadTypeOpus, 109}},
+		{name: CodecVP8, payloadTypes: []uint8{webrtc.DefaultPayloadTypeVP8, 120}},
+		{name: CodecVP9, payloadTypes: []uint8{webrtc.DefaultPayloadTypeVP9, 121}},
+		{name: CodecH264, payloadTypes: []uint8{webrtc.DefaultPayloadTypeH264, 97}, fmtp: map[uint8]string{
+			webrtc.DefaultPayloadTypeH264: IOSH264Fmtp,
+			97:                            FireFoxH264Fmtp97,
+		}},
+	}
+}
+
+// buildMediaCodecs apply config to the default codecs, g722 is only
+// registered when configured
+func buildMediaCodecs(config []CodecConfig) ([]mediaCodec, error) {
+	codecs := append(defaultMediaCodecs(), mediaCodec{name: CodecG722, payloadTypes: []uint8{webrtc.DefaultPayloadTypeG722}})
+	enabled := map[string]bool{CodecOpus: true, CodecVP8: true, CodecVP9: true, CodecH264: true}
+	for _, c := range config {
+		name := strings.ToLower(c.Name)
+		i := 0
+		for i < len(codecs) && codecs[i].name != name {
+			i++
+		}
+		if i == len(codecs) {
+			return nil, fmt.Errorf("webrtc.codecs %s: %w", c.Name, errUnknownCodec)
+		}
+		enabled[name] = !c.Disabled
+		// g722 has a static payload type
+		if len(c.PayloadTypes) > 0 && name != CodecG722 {
+			codecs[i].payloadTypes = c.PayloadTypes
+			codecs[i].fmtp = nil
+		}
+		if c.Fmtp != "" {
+			codecs[i].fmtp = make(map[uint8]string, len(codecs[i].payloadTypes))
+			for _, pt := range codecs[i].payloadTypes {
+				codecs[i].fmtp[pt] = c.Fmtp
+			}
+		}
+	}
+
+	var built []mediaCodec
+	used := make(map[uint8]string)
+	for _, c := range codecs {
+		if !enabled[c.name] {
+			continue
+		}
+		for _, pt := range c.payloadTypes {
+			if c.name != CodecG722 && (pt < 96 || pt > 127) {
+				return nil, fmt.Errorf("webrtc.codecs %s payload type %d: %w", c.name, pt, errCodecPayloadType)
+			}
+			if other, found := used[pt]; found {
+				return nil, fmt.Errorf("webrtc.codecs %s payload type %d of %s: %w", c.name, pt, other, errCodecPayloadType)
+			}
+			used[pt] = c.name
+		}
+		built = append(built, c)
+	}
+	if len(built) == 0 {
+		return nil, errNoCodec
+	}
+	return built, nil
+}
+
+// codecVideoPTs return the video payload types of codecs
+func codecVideoPTs(codecs []mediaCodec) map[uint8]bool {
+	pts := make(map[uint8]bool)
+	for _, c := range codecs {
+		if c.name == CodecVP8 || c.name == CodecVP9 || c.name == CodecH264 {
+			for _, pt := range c.payloadTypes {
+				pts[pt] = true
+			}
+		}
+	}
+	return pts
+}
+
+// newRTPCodec return payload type pt of c, video with the rtcp feedback
+// rtcpfb
+func newRTPCodec(c mediaCodec, pt uint8, rtcpfb []webrtc.RTCPFeedback) *webrtc.RTPCodec {
+	fmtp := c.fmtp[pt]
+	var codec *webrtc.RTPCodec
+	switch c.name {
+	case CodecOpus:
+		codec = webrtc.NewRTPOpusCodec(pt, 48000)
+	case CodecG722:
+		codec = webrtc.NewRTPG722Codec(pt, 8000)
+	case CodecVP8:
+		return webrtc.NewRTPVP8CodecExt(pt, 90000, rtcpfb, fmtp)
+	case CodecVP9:
+		codec = webrtc.NewRTPVP9Codec(pt, 90000)
+	case CodecH264:
+		return webrtc.NewRTPH264CodecExt(pt, 90000, rtcpfb, fmtp)
+	}
+	if fmtp != "" {
+		codec.SDPFmtpLine = fmtp
+	}
+	return codec
+}
+
+// CodecEnabled report if the transports negotiate the codec of sdp name
+// name, e.g. VP8 or opus
+func CodecEnabled(name string) bool {
+	for _, c := range mediaCodecs {
+		if strings.EqualFold(c.name, name) {
+			return true
+		}
+	}
+	return false
+}
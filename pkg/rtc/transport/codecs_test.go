@@ -0,0 +1,75 @@
+package transport
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// registered return the payload types by codec name of the media engine of w
+func registered(w *WebRTCTransport) map[string][]uint8 {
+	codecs := make(map[string][]uint8)
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		for _, c := range w.mediaEngine.GetCodecsByKind(kind) {
+			codecs[c.Name] = append(codecs[c.Name], c.PayloadType)
+		}
+	}
+	return codecs
+}
+
+func TestInitWebRTCCodecs(t *testing.T) {
+	defer InitWebRTC(WebRTCConfig{})
+
+	w := NewWebRTCTransport("default", RTCOptions{})
+	defer w.Close()
+	codecs := registered(w)
+	if len(codecs) != 4 || len(codecs[webrtc.VP8]) != 2 || len(codecs[webrtc.VP9]) != 2 ||
+		len(codecs[webrtc.H264]) != 2 || len(codecs[webrtc.Opus]) != 2 {
+		t.Fatalf("codecs=%v, want two payload types of vp8, vp9, h264 and opus", codecs)
+	}
+
+	// h264 only for the hardware decoders, with g722 audio
+	err := InitWebRTC(WebRTCConfig{Codecs: []CodecConfig{
+		{Name: "VP8", Disabled: true},
+		{Name: "vp9", Disabled: true},
+		{Name: "h264", PayloadTypes: []uint8{100}, Fmtp: "packetization-mode=1;profile-level-id=42e01f"},
+		{Name: "g722"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = NewWebRTCTransport("h264", RTCOptions{})
+	defer w.Close()
+	codecs = registered(w)
+	if len(codecs) != 3 || len(codecs[webrtc.H264]) != 1 || codecs[webrtc.H264][0] != 100 ||
+		len(codecs[webrtc.G722]) != 1 || codecs[webrtc.G722][0] != webrtc.DefaultPayloadTypeG722 || len(codecs[webrtc.Opus]) != 2 {
+		t.Fatalf("codecs=%v, want h264 100, g722 and opus", codecs)
+	}
+	h264 := w.mediaEngine.GetCodecsByName(webrtc.H264)[0]
+	if h264.SDPFmtpLine != "packetization-mode=1;profile-level-id=42e01f" {
+		t.Fatalf("fmtp=%s, want the configured one", h264.SDPFmtpLine)
+	}
+	if !IsVideo(100) || CodecEnabled(webrtc.VP8) || !CodecEnabled(webrtc.G722) {
+		t.Fatal("codecs enabled not updated")
+	}
+
+	for _, c := range []struct {
+		config []CodecConfig
+		err    error
+	}{
+		{[]CodecConfig{{Name: "av1"}}, errUnknownCodec},
+		{[]CodecConfig{{Name: "vp8", PayloadTypes: []uint8{34}}}, errCodecPayloadType},
+		{[]CodecConfig{{Name: "vp8", PayloadTypes: []uint8{97}}}, errCodecPayloadType},
+		{[]CodecConfig{
+			{Name: "opus", Disabled: true},
+			{Name: "vp8", Disabled: true},
+			{Name: "vp9", Disabled: true},
+			{Name: "h264", Disabled: true},
+		}, errNoCodec},
+	} {
+		if err := InitWebRTC(WebRTCConfig{Codecs: c.config}); !errors.Is(err, c.err) {
+			t.Fatalf("config %+v err=%v, want %v", c.config, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package transport
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pion/ion-sfu/pkg/log"
+	"github.com/pion/sdp/v2"
+	"github.com/pion/webrtc/v2"
+)
+
+// header extension uris
+const (
+	AudioLevelURI       = "urn:ietf:params:rtp-hdrext:ssrc-audio-level"
+	VideoOrientationURI = "urn:3gpp:video-orientation"
+	TransmissionTimeURI = "urn:ietf:params:rtp-hdrext:toffset"
+	PlayoutDelayURI     = "http://www.webrtc.org/experiments/rtp-hdrext/playout-delay"
+)
+
+// ForwardedExtensions are the header extensions meaningful to the subs of
+// a pub, the ones about the transport of one hop like transport-cc are not
+var ForwardedExtensions = []string{AudioLevelURI, VideoOrientationURI, TransmissionTimeURI, PlayoutDelayURI}
+
+// parseExtMap return the id and uri of extmap attribute value
+// <id>[/<direction>] <uri> [<attributes>]
+func parseExtMap(value string) (uint8, string, bool) {
+	fields := strings.Fields(value)
+	if len(fields) < 2 {
+		return 0, "", false
+	}
+	id, err := strconv.ParseUint(strings.SplitN(fields[0], "/", 2)[0], 10, 8)
+	if err != nil || id == 0 {
+		return 0, "", false
+	}
+	return uint8(id), fields[1], true
+}
+
+// ExtMaps return the header extension ids by uri the transport negotiated
+func (w *WebRTCTransport) ExtMaps() map[string]uint8 {
+	w.extLock.RLock()
+	defer w.extLock.RUnlock()
+	extMaps := make(map[string]uint8, len(w.extMaps))
+	for uri, id := range w.extMaps {
+		extMaps[uri] = id
+	}
+	return extMaps
+}
+
+// withExtMaps return the answer desc with the extmaps of offer whose uris
+// are in RTCOptions.HeaderExtensions, pion answers none
+func (w *WebRTCTransport) withExtMaps(offer, desc webrtc.SessionDescription) webrtc.SessionDescription {
+	w.extLock.Lock()
+	defer w.extLock.Unlock()
+	if len(w.extURIs) == 0 {
+		return desc
+	}
+
+	parsedOffer := sdp.SessionDescription{}
+	parsed := sdp.SessionDescription{}
+	if err := parsedOffer.Unmarshal([]byte(offer.SDP)); err != nil {
+		log.Errorf("WebRTCTransport.withExtMaps unmarshal offer err=%v", err)
+		return desc
+	}
+	if err := parsed.Unmarshal([]byte(desc.SDP)); err != nil {
+		log.Errorf("WebRTCTransport.withExtMaps unmarshal err=%v", err)
+		return desc
+	}
+	// the extmaps of the offer by mid
+	offered := make(map[string][]sdp.Attribute)
+	for _, md := range parsedOffer.MediaDescriptions {
+		mid, _ := md.Attribute("mid")
+		for _, attr := range md.Attributes {
+			if attr.Key != "extmap" {
+				continue
+			}
+			id, uri, ok := parseExtMap(attr.Value)
+			if !ok || !w.extURIs[uri] {
+				continue
+			}
+			offered[mid] = append(offered[mid], sdp.Attribute{Key: "extmap", Value: strconv.Itoa(int(id)) + " " + uri})
+			w.extMaps[uri] = id
+		}
+	}
+	for _, md := range parsed.MediaDescriptions {
+		if md.MediaName.Media != "audio" && md.MediaName.Media != "video" {
+			continue
+		}
+		mid, _ := md.Attribute("mid")
+		md.Attributes = append(md.Attributes, offered[mid]...)
+	}
+	out, err := parsed.Marshal()
+	if err != nil {
+		log.Errorf("WebRTCTransport.withExtMaps marshal err=%v", err)
+		return desc
+	}
+	desc.SDP = string(out)
+	return desc
+}
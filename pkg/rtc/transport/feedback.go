@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"strings"
+
+	"github.com/pion/ion-sfu/pkg/log"
+	"github.com/pion/sdp/v2"
+	"github.com/pion/webrtc/v2"
+)
+
+// congestion control feedback a transport negotiated
+const (
+	// FeedbackREMB the remote sends and takes remb estimates
+	FeedbackREMB = webrtc.TypeRTCPFBGoogREMB
+	// FeedbackTransportCC the remote sends and takes transport-cc feedback,
+	// the sender estimates the bandwidth. remb still caps it.
+	FeedbackTransportCC = webrtc.TypeRTCPFBTransportCC
+)
+
+// FeedbackTransport is a Transport knowing the congestion control feedback
+// negotiated with the remote, the others use the sfu defaults
+type FeedbackTransport interface {
+	Transport
+	// Feedback return FeedbackTransportCC, FeedbackREMB, or empty when the
+	// remote negotiated neither
+	Feedback() string
+}
+
+// remoteFeedback return which feedback the media of desc take
+func remoteFeedback(desc webrtc.SessionDescription) (remb, tcc bool) {
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(desc.SDP)); err != nil {
+		log.Errorf("remoteFeedback unmarshal err=%v", err)
+		return false, false
+	}
+	for _, md := range parsed.MediaDescriptions {
+		for _, attr := range md.Attributes {
+			if attr.Key != "rtcp-fb" {
+				continue
+			}
+			// <pt> <type> [<param>]
+			fields := strings.Fields(attr.Value)
+			if len(fields) < 2 {
+				continue
+			}
+			switch fields[1] {
+			case FeedbackREMB:
+				remb = true
+			case FeedbackTransportCC:
+				tcc = true
+			}
+		}
+	}
+	return remb, tcc
+}
+
+// setFeedback keep the feedback negotiated with the remote description,
+// transport-cc is preferred when both sides take it
+func (w *WebRTCTransport) setFeedback(remote webrtc.SessionDescription) {
+	remb, tcc := remoteFeedback(remote)
+	feedback := ""
+	switch {
+	case tcc && w.transportCC:
+		feedback = FeedbackTransportCC
+	case remb:
+		feedback = FeedbackREMB
+	}
+	w.extLock.Lock()
+	w.feedback = feedback
+	w.extLock.Unlock()
+	log.Infof("WebRTCTransport.setFeedback id=%s feedback=%q", w.id, feedback)
+}
+
+// Feedback return the congestion control feedback negotiated
+func (w *WebRTCTransport) Feedback() string {
+	w.extLock.RLock()
+	defer w.extLock.RUnlock()
+	return w.feedback
+}
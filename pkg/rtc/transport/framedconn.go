@@ -0,0 +1,66 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/pion/ion-sfu/pkg/log"
+)
+
+// max payload of a frame, the length prefix is 2 bytes
+const maxFrameSize = 0xffff
+
+var errFrameTooLarge = errors.New("frame too large")
+
+// framedConn turns a stream conn into a packet conn by prefixing every
+// packet with its 2-byte big endian length, each Read returns one packet
+type framedConn struct {
+	net.Conn
+	readLock  sync.Mutex
+	writeLock sync.Mutex
+}
+
+func newFramedConn(conn net.Conn) net.Conn {
+	return &framedConn{Conn: conn}
+}
+
+// Read read the next packet, packets larger than b are skipped
+func (c *framedConn) Read(b []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	var hdr [2]byte
+	for {
+		if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+			return 0, err
+		}
+		size := int(binary.BigEndian.Uint16(hdr[:]))
+		if size <= len(b) {
+			return io.ReadFull(c.Conn, b[:size])
+		}
+		log.Warnf("framedConn.Read skip frame size=%d buffer=%d", size, len(b))
+		if _, err := io.CopyN(ioutil.Discard, c.Conn, int64(size)); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write write b as one packet
+func (c *framedConn) Write(b []byte) (int, error) {
+	if len(b) > maxFrameSize {
+		return 0, errFrameTooLarge
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if _, err := c.Conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,61 @@
+package transport
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFramedConnAcrossBoundaries(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// two frames written in chunks that split the length prefix and payload
+	raw := []byte{0x00, 0x03, 'a', 'b', 'c', 0x00, 0x02, 'd', 'e'}
+	go func() {
+		for i := 0; i < len(raw); i += 2 {
+			end := i + 2
+			if end > len(raw) {
+				end = len(raw)
+			}
+			if _, err := client.Write(raw[i:end]); err != nil {
+				return
+			}
+		}
+	}()
+
+	conn := newFramedConn(server)
+	buf := make([]byte, 1500)
+	for _, want := range []string{"abc", "de"} {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Read err=%v", err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Fatalf("Read=%q, want %q", got, want)
+		}
+	}
+}
+
+func TestFramedConnWrite(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_, _ = newFramedConn(client).Write([]byte("hello"))
+	}()
+	buf := make([]byte, 7)
+	n, err := server.Read(buf)
+	for err == nil && n < len(buf) {
+		var m int
+		m, err = server.Read(buf[n:])
+		n += m
+	}
+	if err != nil {
+		t.Fatalf("Read err=%v", err)
+	}
+	if string(buf) != "\x00\x05hello" {
+		t.Fatalf("frame=%q", buf)
+	}
+}
@@ -0,0 +1,93 @@
+package transport
+
+import "github.com/pion/webrtc/v2"
+
+const (
+	h264NALUTypeIDR   = 5
+	h264NALUTypeSPS   = 7
+	h264NALUTypeSTAPA = 24
+	h264NALUTypeFUA   = 28
+)
+
+// IsKeyFrame check if the rtp payload starts a key frame, now support vp8 and h264
+func IsKeyFrame(pt uint8, payload []byte) bool {
+	switch pt {
+	case webrtc.DefaultPayloadTypeVP8, 120:
+		return isVP8KeyFrame(payload)
+	case webrtc.DefaultPayloadTypeH264, 97, 126:
+		return isH264KeyFrame(payload)
+	}
+	return false
+}
+
+// isVP8KeyFrame parse the vp8 payload descriptor, rfc7741 section 4.2
+func isVP8KeyFrame(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	// only the first packet of partition 0 carries the frame header
+	start := payload[0]&0x10 != 0
+	pid := payload[0] & 0x07
+	if !start || pid != 0 {
+		return false
+	}
+
+	i := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) < 2 {
+			return false
+		}
+		ext := payload[1]
+		i++
+		// picture id, 7 or 15 bits
+		if ext&0x80 != 0 {
+			if len(payload) <= i {
+				return false
+			}
+			if payload[i]&0x80 != 0 {
+				i++
+			}
+			i++
+		}
+		// tl0picidx
+		if ext&0x40 != 0 {
+			i++
+		}
+		// tid/keyidx
+		if ext&0x20 != 0 || ext&0x10 != 0 {
+			i++
+		}
+	}
+	if len(payload) <= i {
+		return false
+	}
+	// the P bit of the frame header is 0 for key frames
+	return payload[i]&0x01 == 0
+}
+
+// isH264KeyFrame look for an idr or sps nalu, rfc6184 section 5.4
+func isH264KeyFrame(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	switch naluType := payload[0] & 0x1f; naluType {
+	case h264NALUTypeIDR, h264NALUTypeSPS:
+		return true
+	case h264NALUTypeSTAPA:
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			t := payload[i+2] & 0x1f
+			if t == h264NALUTypeIDR || t == h264NALUTypeSPS {
+				return true
+			}
+			i += 2 + size
+		}
+	case h264NALUTypeFUA:
+		// the first fragment of an idr
+		if len(payload) < 2 {
+			return false
+		}
+		return payload[1]&0x80 != 0 && payload[1]&0x1f == h264NALUTypeIDR
+	}
+	return false
+}
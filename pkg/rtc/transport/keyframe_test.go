@@ -0,0 +1,38 @@
+package transport
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v2"
+)
+
+func TestIsKeyFrame(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		pt      uint8
+		payload []byte
+		want    bool
+	}{
+		{"vp8 key frame", webrtc.DefaultPayloadTypeVP8, []byte{0x10, 0x00}, true},
+		{"vp8 delta frame", webrtc.DefaultPayloadTypeVP8, []byte{0x10, 0x01}, false},
+		{"vp8 not first packet", webrtc.DefaultPayloadTypeVP8, []byte{0x00, 0x00}, false},
+		{"vp8 other partition", webrtc.DefaultPayloadTypeVP8, []byte{0x11, 0x00}, false},
+		// X, I with a 15 bit picture id, L, T
+		{"vp8 extended key frame", webrtc.DefaultPayloadTypeVP8, []byte{0x90, 0xe0, 0x80, 0x01, 0x02, 0x03, 0x00}, true},
+		{"vp8 extended delta frame", webrtc.DefaultPayloadTypeVP8, []byte{0x90, 0xe0, 0x80, 0x01, 0x02, 0x03, 0x01}, false},
+		{"vp8 truncated", webrtc.DefaultPayloadTypeVP8, []byte{0x90, 0x80}, false},
+		{"vp8 transformed pt", 120, []byte{0x10, 0x00}, true},
+		{"h264 idr", webrtc.DefaultPayloadTypeH264, []byte{0x65}, true},
+		{"h264 non idr", webrtc.DefaultPayloadTypeH264, []byte{0x41}, false},
+		{"h264 stap-a sps", webrtc.DefaultPayloadTypeH264, []byte{0x78, 0x00, 0x01, 0x67, 0x00, 0x01, 0x68}, true},
+		{"h264 stap-a without idr", webrtc.DefaultPayloadTypeH264, []byte{0x78, 0x00, 0x01, 0x41}, false},
+		{"h264 fu-a idr start", 97, []byte{0x7c, 0x85}, true},
+		{"h264 fu-a idr middle", 97, []byte{0x7c, 0x05}, false},
+		{"opus", webrtc.DefaultPayloadTypeOpus, []byte{0x00}, false},
+		{"empty", webrtc.DefaultPayloadTypeVP8, nil, false},
+	} {
+		if got := IsKeyFrame(tc.pt, tc.payload); got != tc.want {
+			t.Errorf("%s: IsKeyFrame=%v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+const memoryBufferSize = 1000
+
+var errMemoryFull = errors.New("memory transport buffer full")
+
+// MemoryTransport is an in-memory Transport for tests, the remote end sends
+// with PushRTP and PushRTCP and what the transport was written is kept
+type MemoryTransport struct {
+	id             string
+	rtpCh          chan *rtp.Packet
+	rtcpCh         chan rtcp.Packet
+	done           chan struct{}
+	lock           sync.Mutex
+	written        []*rtp.Packet
+	writtenRTCP    []rtcp.Packet
+	writeErr       error
+	writeErrCnt    int
+	bandwidth      uint32
+	stop           bool
+	onCloseHandler func()
+	onStateHandler func(int)
+}
+
+// NewMemoryTransport create a MemoryTransport
+func NewMemoryTransport(id string) *MemoryTransport {
+	return &MemoryTransport{
+		id:     id,
+		rtpCh:  make(chan *rtp.Packet, memoryBufferSize),
+		rtcpCh: make(chan rtcp.Packet, memoryBufferSize),
+		done:   make(chan struct{}),
+	}
+}
+
+// ID return id
+func (m *MemoryTransport) ID() string {
+	return m.id
+}
+
+// Type return type of transport
+func (m *MemoryTransport) Type() int {
+	return TypeMemoryTransport
+}
+
+// ReadRTP return the next packet pushed by PushRTP, io.EOF once closed
+func (m *MemoryTransport) ReadRTP() (*rtp.Packet, error) {
+	select {
+	case pkt := <-m.rtpCh:
+		return pkt, nil
+	case <-m.done:
+		return nil, io.EOF
+	}
+}
+
+// WriteRTP keep pkt, it fails with the error set by SetWriteErr
+func (m *MemoryTransport) WriteRTP(pkt *rtp.Packet) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stop {
+		return io.ErrClosedPipe
+	}
+	if m.writeErr != nil {
+		m.writeErrCnt++
+		return m.writeErr
+	}
+	m.written = append(m.written, pkt)
+	return nil
+}
+
+// WriteRTCP keep pkt
+func (m *MemoryTransport) WriteRTCP(pkt rtcp.Packet) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stop {
+		return io.ErrClosedPipe
+	}
+	m.writtenRTCP = append(m.writtenRTCP, pkt)
+	return nil
+}
+
+// GetRTCPChan return the rtcp pushed by PushRTCP, closed with the transport
+func (m *MemoryTransport) GetRTCPChan() chan rtcp.Packet {
+	return m.rtcpCh
+}
+
+// Close stop the transport and call the OnClose handler once
+func (m *MemoryTransport) Close() {
+	m.lock.Lock()
+	if m.stop {
+		m.lock.Unlock()
+		return
+	}
+	m.stop = true
+	close(m.done)
+	close(m.rtcpCh)
+	f := m.onCloseHandler
+	m.lock.Unlock()
+	if f != nil {
+		f()
+	}
+}
+
+// OnClose calls passed handler when closing
+func (m *MemoryTransport) OnClose(f func()) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.onCloseHandler = f
+}
+
+// OnConnectionStateChange calls passed handler on SetState
+func (m *MemoryTransport) OnConnectionStateChange(f func(state int)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.onStateHandler = f
+}
+
+// WriteErrTotal return the write errors since the last reset
+func (m *MemoryTransport) WriteErrTotal() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.writeErrCnt
+}
+
+// WriteErrReset reset the write errors
+func (m *MemoryTransport) WriteErrReset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.writeErrCnt = 0
+}
+
+// GetBandwidth return the bandwidth set by SetBandwidth
+func (m *MemoryTransport) GetBandwidth() uint32 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.bandwidth
+}
+
+// PushRTP send pkt from the remote end, ReadRTP returns it
+func (m *MemoryTransport) PushRTP(pkt *rtp.Packet) error {
+	select {
+	case <-m.done:
+		return io.ErrClosedPipe
+	default:
+	}
+	select {
+	case m.rtpCh <- pkt:
+		return nil
+	case <-m.done:
+		return io.ErrClosedPipe
+	}
+}
+
+// PushRTCP send pkt from the remote end to GetRTCPChan
+func (m *MemoryTransport) PushRTCP(pkt rtcp.Packet) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stop {
+		return io.ErrClosedPipe
+	}
+	select {
+	case m.rtcpCh <- pkt:
+		return nil
+	default:
+		return errMemoryFull
+	}
+}
+
+// SetState report a connection state change like the ice agent would
+func (m *MemoryTransport) SetState(state int) {
+	m.lock.Lock()
+	f := m.onStateHandler
+	m.lock.Unlock()
+	if f != nil {
+		f(state)
+	}
+}
+
+// SetWriteErr make WriteRTP fail with err, nil writes again
+func (m *MemoryTransport) SetWriteErr(err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.writeErr = err
+}
+
+// SetBandwidth set the bandwidth GetBandwidth returns
+func (m *MemoryTransport) SetBandwidth(bandwidth uint32) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.bandwidth = bandwidth
+}
+
+// Written return the rtp written so far
+func (m *MemoryTransport) Written() []*rtp.Packet {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]*rtp.Packet(nil), m.written...)
+}
+
+// WrittenRTCP return the rtcp written so far
+func (m *MemoryTransport) WrittenRTCP() []rtcp.Packet {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]rtcp.Packet(nil), m.writtenRTCP...)
+}
+
+// IsClosed report if the transport was closed
+func (m *MemoryTransport) IsClosed() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.stop
+}
@@ -0,0 +1,103 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+var _ Transport = &MemoryTransport{}
+
+func TestMemoryTransport(t *testing.T) {
+	m := NewMemoryTransport("mem")
+	if m.ID() != "mem" || m.Type() != TypeMemoryTransport {
+		t.Fatalf("id=%s type=%d", m.ID(), m.Type())
+	}
+
+	// the remote end sends rtp and rtcp
+	if err := m.PushRTP(&rtp.Packet{Header: rtp.Header{SequenceNumber: 7}}); err != nil {
+		t.Fatal(err)
+	}
+	if pkt, err := m.ReadRTP(); err != nil || pkt.SequenceNumber != 7 {
+		t.Fatalf("read %v, %v", pkt, err)
+	}
+	if err := m.PushRTCP(&rtcp.PictureLossIndication{MediaSSRC: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if pkt := <-m.GetRTCPChan(); pkt.(*rtcp.PictureLossIndication).MediaSSRC != 1 {
+		t.Fatalf("rtcp=%v", pkt)
+	}
+
+	// what is written is kept
+	if err := m.WriteRTP(&rtp.Packet{Header: rtp.Header{SequenceNumber: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteRTCP(&rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Written()) != 1 || len(m.WrittenRTCP()) != 1 {
+		t.Fatalf("written=%d rtcp=%d, want 1 and 1", len(m.Written()), len(m.WrittenRTCP()))
+	}
+
+	// write errors are counted until reset
+	errWrite := errors.New("write failed")
+	m.SetWriteErr(errWrite)
+	for i := 0; i < 3; i++ {
+		if err := m.WriteRTP(&rtp.Packet{}); err != errWrite {
+			t.Fatalf("err=%v, want errWrite", err)
+		}
+	}
+	if m.WriteErrTotal() != 3 || len(m.Written()) != 1 {
+		t.Fatalf("errors=%d written=%d, want 3 and 1", m.WriteErrTotal(), len(m.Written()))
+	}
+	m.WriteErrReset()
+	if m.WriteErrTotal() != 0 {
+		t.Fatal("write errors not reset")
+	}
+
+	state := -1
+	m.OnConnectionStateChange(func(s int) { state = s })
+	m.SetState(StateDisconnected)
+	if state != StateDisconnected {
+		t.Fatalf("state=%d, want disconnected", state)
+	}
+	m.SetBandwidth(500)
+	if m.GetBandwidth() != 500 {
+		t.Fatalf("bandwidth=%d, want 500", m.GetBandwidth())
+	}
+}
+
+func TestMemoryTransportClose(t *testing.T) {
+	m := NewMemoryTransport("mem")
+	closed := 0
+	m.OnClose(func() { closed++ })
+
+	read := make(chan error)
+	go func() {
+		_, err := m.ReadRTP()
+		read <- err
+	}()
+	m.Close()
+	m.Close()
+	if err := <-read; err != io.EOF {
+		t.Fatalf("read err=%v, want io.EOF", err)
+	}
+	if closed != 1 || !m.IsClosed() {
+		t.Fatalf("close handler called %d times, want 1", closed)
+	}
+	if _, ok := <-m.GetRTCPChan(); ok {
+		t.Fatal("rtcp chan open after close")
+	}
+	if err := m.PushRTP(&rtp.Packet{}); err != io.ErrClosedPipe {
+		t.Fatalf("push err=%v, want io.ErrClosedPipe", err)
+	}
+	if err := m.PushRTCP(&rtcp.PictureLossIndication{}); err != io.ErrClosedPipe {
+		t.Fatalf("push rtcp err=%v, want io.ErrClosedPipe", err)
+	}
+	if err := m.WriteRTP(&rtp.Packet{}); err != io.ErrClosedPipe {
+		t.Fatalf("write err=%v, want io.ErrClosedPipe", err)
+	}
+}
@@ -0,0 +1,40 @@
+package transport
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+// packetPool holds the packets read by the transports, a packet keeps the
+// buffer it was unmarshaled from in Raw so both are reused together
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		return &rtp.Packet{Raw: make([]byte, receiveMTU)}
+	},
+}
+
+// readPacket read a packet with read into a packet of the pool
+func readPacket(read func([]byte) (int, error)) (*rtp.Packet, error) {
+	pkt := packetPool.Get().(*rtp.Packet)
+	buf := pkt.Raw[:cap(pkt.Raw)]
+	n, err := read(buf)
+	if err == nil {
+		err = pkt.Unmarshal(buf[:n])
+	}
+	if err != nil {
+		releasePacket(pkt)
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// releasePacket put a packet back to the pool, packets not read by
+// readPacket are left to the gc
+func releasePacket(pkt *rtp.Packet) {
+	if pkt == nil || cap(pkt.Raw) < receiveMTU {
+		return
+	}
+	*pkt = rtp.Packet{Raw: pkt.Raw[:cap(pkt.Raw)]}
+	packetPool.Put(pkt)
+}
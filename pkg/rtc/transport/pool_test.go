@@ -0,0 +1,34 @@
+package transport
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func TestReadPacket(t *testing.T) {
+	raw, err := (&rtp.Packet{Header: rtp.Header{Version: 2, SSRC: 1234, SequenceNumber: 7}, Payload: []byte{1, 2, 3}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := readPacket(func(buf []byte) (int, error) {
+		return copy(buf, raw), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.SSRC != 1234 || pkt.SequenceNumber != 7 || len(pkt.Payload) != 3 || cap(pkt.Raw) < receiveMTU {
+		t.Fatalf("unexpected packet %v", pkt)
+	}
+
+	releasePacket(pkt)
+	if pkt.SSRC != 0 || pkt.Payload != nil || len(pkt.Raw) != receiveMTU {
+		t.Fatalf("released packet not reset %v", pkt)
+	}
+
+	errRead := errors.New("read failed")
+	if _, err := readPacket(func([]byte) (int, error) { return 0, errRead }); err != errRead {
+		t.Fatalf("err=%v, want %v", err, errRead)
+	}
+}
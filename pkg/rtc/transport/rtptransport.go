@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 
 	"github.com/pion/ion-sfu/pkg/log"
 	"github.com/pion/ion-sfu/pkg/rtc/rtpengine/muxrtp"
@@ -26,16 +27,17 @@ var (
 
 // RTPTransport ..
 type RTPTransport struct {
-	rtpSession     *muxrtp.SessionRTP
-	rtcpSession    *muxrtp.SessionRTCP
-	rtpEndpoint    *mux.Endpoint
-	rtcpEndpoint   *mux.Endpoint
-	conn           net.Conn
-	mux            *mux.Mux
-	rtpCh          chan *rtp.Packet
-	ssrcPT         map[uint32]uint8
-	ssrcPTLock     sync.RWMutex
-	stop           bool
+	rtpSession   *muxrtp.SessionRTP
+	rtcpSession  *muxrtp.SessionRTCP
+	rtpEndpoint  *mux.Endpoint
+	rtcpEndpoint *mux.Endpoint
+	conn         net.Conn
+	mux          *mux.Mux
+	rtpCh        chan *rtp.Packet
+	ssrcPT       map[uint32]uint8
+	ssrcPTLock   sync.RWMutex
+	// set by Close, accessed atomically
+	stop           uint32
 	id             string
 	idLock         sync.RWMutex
 	writeErrCnt    int
@@ -121,6 +123,36 @@ func NewOutRTPTransportWithKCP(id, addr string, kcpKey, kcpSalt string) *RTPTran
 	return r
 }
 
+// NewOutRTPTransportTCP new a outgoing RTPTransport over tcp,
+// every packet is framed with a 2-byte length prefix
+func NewOutRTPTransportTCP(id, addr string) *RTPTransport {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		log.Errorf("net.Dial => %s", err.Error())
+		return nil
+	}
+	r := NewRTPTransport(newFramedConn(conn))
+	if r == nil {
+		conn.Close()
+		return nil
+	}
+	r.receiveRTCP()
+	log.Infof("NewOutRTPTransportTCP %s %s", id, addr)
+	r.idLock.Lock()
+	defer r.idLock.Unlock()
+	r.id = id
+	return r
+}
+
+// NewRTPTransportTCP create a RTPTransport by an accepted tcp conn
+func NewRTPTransportTCP(conn net.Conn) *RTPTransport {
+	if conn == nil {
+		log.Errorf("NewRTPTransportTCP err=%v", errInvalidConn)
+		return nil
+	}
+	return NewRTPTransport(newFramedConn(conn))
+}
+
 // ID return id
 func (r *RTPTransport) ID() string {
 	r.idLock.RLock()
@@ -135,11 +167,10 @@ func (r *RTPTransport) Type() int {
 
 // Close release all
 func (r *RTPTransport) Close() {
-	if r.stop {
+	if !atomic.CompareAndSwapUint32(&r.stop, 0, 1) {
 		return
 	}
 	log.Infof("RTPTransport.Close()")
-	r.stop = true
 	r.rtpSession.Close()
 	r.rtcpSession.Close()
 	r.rtpEndpoint.Close()
@@ -148,11 +179,20 @@ func (r *RTPTransport) Close() {
 	r.conn.Close()
 }
 
+// closed report if Close was called
+func (r *RTPTransport) closed() bool {
+	return atomic.LoadUint32(&r.stop) == 1
+}
+
 // OnClose calls passed handler when closing pc
 func (r *RTPTransport) OnClose(f func()) {
 	r.onCloseHandler = f
 }
 
+// OnConnectionStateChange do nothing, there is no ice and the transport
+// stays connected until it is closed
+func (r *RTPTransport) OnConnectionStateChange(f func(state int)) {}
+
 // newEndpoint registers a new endpoint on the underlying mux.
 func (r *RTPTransport) newEndpoint(f mux.MatchFunc) *mux.Endpoint {
 	return r.mux.NewEndpoint(f)
@@ -162,7 +202,7 @@ func (r *RTPTransport) newEndpoint(f mux.MatchFunc) *mux.Endpoint {
 func (r *RTPTransport) receiveRTP() {
 	go func() {
 		for {
-			if r.stop {
+			if r.closed() {
 				break
 			}
 			readStream, ssrc, err := r.rtpSession.AcceptStream()
@@ -178,11 +218,10 @@ func (r *RTPTransport) receiveRTP() {
 			go func() {
 
 				for {
-					if r.stop {
+					if r.closed() {
 						return
 					}
-					rtpBuf := make([]byte, receiveMTU)
-					_, pkt, err := readStream.ReadRTP(rtpBuf)
+					pkt, err := readPacket(readStream.Read)
 					if err != nil {
 						log.Warnf("Failed to read rtp %v %d ", err, ssrc)
 						//for non-blocking ReadRTP()
@@ -218,11 +257,16 @@ func (r *RTPTransport) ReadRTP() (*rtp.Packet, error) {
 	return <-r.rtpCh, nil
 }
 
+// ReleaseRTP give back a packet returned by ReadRTP
+func (r *RTPTransport) ReleaseRTP(pkt *rtp.Packet) {
+	releasePacket(pkt)
+}
+
 // rtp sub receive rtcp
 func (r *RTPTransport) receiveRTCP() {
 	go func() {
 		for {
-			if r.stop {
+			if r.closed() {
 				break
 			}
 			readStream, ssrc, err := r.rtcpSession.AcceptStream()
@@ -236,7 +280,7 @@ func (r *RTPTransport) receiveRTCP() {
 			go func() {
 				rtcpBuf := make([]byte, receiveMTU)
 				for {
-					if r.stop {
+					if r.closed() {
 						return
 					}
 					rtcps, err := readStream.ReadRTCP(rtcpBuf)
@@ -252,6 +296,8 @@ func (r *RTPTransport) receiveRTCP() {
 						case *rtcp.TransportLayerNack:
 							log.Debugf("rtptransport got nack: %+v", pkt)
 							r.rtcpCh <- pkt
+						case *rtcp.SenderReport:
+							r.rtcpCh <- pkt
 						}
 					}
 				}
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"net"
 	"testing"
 
 	"github.com/pion/rtp"
@@ -45,3 +46,47 @@ func TestNewRTPTransportKCP(t *testing.T) {
 		return
 	}
 }
+
+func TestRTPTransportTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen err=%v", err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan *RTPTransport, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- NewRTPTransportTCP(conn)
+	}()
+
+	out := NewOutRTPTransportTCP("tcp", listener.Addr().String())
+	if out == nil {
+		t.Fatal("NewOutRTPTransportTCP failed")
+	}
+	defer out.Close()
+	in := <-accepted
+	defer in.Close()
+
+	for sn := uint16(1); sn <= 5; sn++ {
+		pkt := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SSRC: 1234, PayloadType: 96, SequenceNumber: sn},
+			Payload: []byte{byte(sn), 0x01, 0x02},
+		}
+		if err := out.WriteRTP(pkt); err != nil {
+			t.Fatalf("WriteRTP err=%v", err)
+		}
+	}
+	for sn := uint16(1); sn <= 5; sn++ {
+		pkt, err := in.ReadRTP()
+		if err != nil || pkt == nil {
+			t.Fatalf("ReadRTP pkt=%v err=%v", pkt, err)
+		}
+		if pkt.SequenceNumber != sn || pkt.Payload[0] != byte(sn) {
+			t.Fatalf("got sn=%d payload=%v, want sn=%d", pkt.SequenceNumber, pkt.Payload, sn)
+		}
+	}
+}
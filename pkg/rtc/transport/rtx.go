@@ -0,0 +1,74 @@
+package transport
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pion/ion-sfu/pkg/log"
+	"github.com/pion/sdp/v2"
+	"github.com/pion/webrtc/v2"
+)
+
+// rtxCodec return the rfc 4588 codec resending payload type apt as pt
+func rtxCodec(pt, apt uint8) *webrtc.RTPCodec {
+	return webrtc.NewRTPCodec(webrtc.RTPCodecTypeVideo, "rtx", 90000, 0, fmt.Sprintf("apt=%d", apt), pt, nil)
+}
+
+// AddRTX send the retransmissions of send track ssrc on rtxSSRC, the
+// payload type of the rtx packets must be set in RTCOptions.RTX. The
+// descriptions of the transport group the two ssrcs from then on.
+func (w *WebRTCTransport) AddRTX(ssrc, rtxSSRC uint32) {
+	w.outTrackLock.Lock()
+	defer w.outTrackLock.Unlock()
+	w.rtxSSRCs[rtxSSRC] = ssrc
+}
+
+// withRTX return desc with the rtx ssrcs grouped with their send tracks
+func (w *WebRTCTransport) withRTX(desc webrtc.SessionDescription) webrtc.SessionDescription {
+	w.outTrackLock.RLock()
+	rtx := make(map[uint32]uint32, len(w.rtxSSRCs))
+	for rtxSSRC, ssrc := range w.rtxSSRCs {
+		rtx[ssrc] = rtxSSRC
+	}
+	w.outTrackLock.RUnlock()
+	if len(rtx) == 0 {
+		return desc
+	}
+
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(desc.SDP)); err != nil {
+		log.Errorf("WebRTCTransport.withRTX unmarshal err=%v", err)
+		return desc
+	}
+	for _, md := range parsed.MediaDescriptions {
+		var added []sdp.Attribute
+		for _, attr := range md.Attributes {
+			if attr.Key != "ssrc" {
+				continue
+			}
+			// ssrc:<ssrc> <attribute>
+			fields := strings.SplitN(attr.Value, " ", 2)
+			ssrc, err := strconv.ParseUint(fields[0], 10, 32)
+			if err != nil || len(fields) != 2 {
+				continue
+			}
+			rtxSSRC, ok := rtx[uint32(ssrc)]
+			if !ok {
+				continue
+			}
+			if len(added) == 0 {
+				added = append(added, sdp.Attribute{Key: "ssrc-group", Value: fmt.Sprintf("FID %d %d", ssrc, rtxSSRC)})
+			}
+			added = append(added, sdp.Attribute{Key: "ssrc", Value: fmt.Sprintf("%d %s", rtxSSRC, fields[1])})
+		}
+		md.Attributes = append(md.Attributes, added...)
+	}
+	out, err := parsed.Marshal()
+	if err != nil {
+		log.Errorf("WebRTCTransport.withRTX marshal err=%v", err)
+		return desc
+	}
+	desc.SDP = string(out)
+	return desc
+}
@@ -0,0 +1,142 @@
+package transport
+
+import (
+	"errors"
+	"reflect"
+	"unsafe"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/webrtc/v2"
+)
+
+const (
+	// exporter label of the srtp keying material, rfc 5764 4.2
+	srtpExporterLabel = "EXTRACTOR-dtls_srtp"
+	// key and salt lengths of SRTP_AES128_CM_HMAC_SHA1_80, the only profile
+	// pion negotiates
+	srtpKeyLen  = 16
+	srtpSaltLen = 14
+
+	// the export reads unexported fields, DTLSTransport.conn of pion/webrtc
+	// and State.isClient of pion/dtls, as laid out in these versions. A
+	// test fails once go.mod moves to others, the fields must be checked
+	// again then.
+	pionWebRTCVersion = "v2.2.19"
+	pionDTLSVersion   = "v2.0.1"
+)
+
+var (
+	errSRTPKeyExport  = errors.New("srtp key export is disabled, see webrtc.srtpkeyexport")
+	errDTLSNotStarted = errors.New("dtls transport not connected")
+	errDTLSConn       = errors.New("dtls conn not found in the pion dtls transport")
+	errSRTPProfile    = errors.New("srtp protection profile not supported")
+
+	dtlsConnType = reflect.TypeOf((*dtls.Conn)(nil))
+)
+
+// SRTPKeys is the srtp keying material of a transport, local protects the
+// packets it sends and remote the ones it receives
+type SRTPKeys struct {
+	Profile          string
+	LocalMasterKey   []byte
+	LocalMasterSalt  []byte
+	RemoteMasterKey  []byte
+	RemoteMasterSalt []byte
+}
+
+// dtlsConn return the dtls conn of t. pion v2 doesn't expose it, it is
+// read with unsafe from the unexported field, checked against the type so
+// a pion upgrade moving it fails instead of crashing.
+func dtlsConn(t *webrtc.DTLSTransport) (*dtls.Conn, error) {
+	if t == nil {
+		return nil, errDTLSNotStarted
+	}
+	if t.State() != webrtc.DTLSTransportStateConnected {
+		return nil, errDTLSNotStarted
+	}
+	field := reflect.ValueOf(t).Elem().FieldByName("conn")
+	if !field.IsValid() || field.Type() != dtlsConnType {
+		return nil, errDTLSConn
+	}
+	conn := (*dtls.Conn)(unsafe.Pointer(field.Pointer()))
+	if conn == nil {
+		return nil, errDTLSNotStarted
+	}
+	return conn, nil
+}
+
+// exportSRTPKeys derive the srtp keys of t from its dtls session, rfc 5764
+// 4.2. Both ends of the session export the same material, the local keys
+// of one are the remote keys of the other.
+func exportSRTPKeys(t *webrtc.DTLSTransport) (SRTPKeys, error) {
+	conn, err := dtlsConn(t)
+	if err != nil {
+		return SRTPKeys{}, err
+	}
+	if profile, ok := conn.SelectedSRTPProtectionProfile(); !ok || profile != dtls.SRTP_AES128_CM_HMAC_SHA1_80 {
+		return SRTPKeys{}, errSRTPProfile
+	}
+	state := conn.ConnectionState()
+	material, err := state.ExportKeyingMaterial(srtpExporterLabel, nil, 2*(srtpKeyLen+srtpSaltLen))
+	if err != nil {
+		return SRTPKeys{}, err
+	}
+
+	// client key, server key, client salt, server salt
+	clientKey, serverKey := material[:srtpKeyLen], material[srtpKeyLen:2*srtpKeyLen]
+	salts := material[2*srtpKeyLen:]
+	clientSalt, serverSalt := salts[:srtpSaltLen], salts[srtpSaltLen:]
+	client, err := isClient(&state)
+	if err != nil {
+		return SRTPKeys{}, err
+	}
+	keys := SRTPKeys{Profile: "SRTP_AES128_CM_HMAC_SHA1_80"}
+	if client {
+		keys.LocalMasterKey, keys.LocalMasterSalt = clientKey, clientSalt
+		keys.RemoteMasterKey, keys.RemoteMasterSalt = serverKey, serverSalt
+	} else {
+		keys.LocalMasterKey, keys.LocalMasterSalt = serverKey, serverSalt
+		keys.RemoteMasterKey, keys.RemoteMasterSalt = clientKey, clientSalt
+	}
+	return keys, nil
+}
+
+// isClient return whether the local end of the dtls session of state is
+// the client. pion/dtls only keeps it in an unexported field, checked like
+// the conn of dtlsConn.
+func isClient(state *dtls.State) (bool, error) {
+	field := reflect.ValueOf(state).Elem().FieldByName("isClient")
+	if !field.IsValid() || field.Kind() != reflect.Bool {
+		return false, errDTLSConn
+	}
+	return field.Bool(), nil
+}
+
+// pcDTLSTransport return the dtls transport of the media of pc, bundled so
+// every sender and receiver share it
+func pcDTLSTransport(pc *webrtc.PeerConnection) *webrtc.DTLSTransport {
+	for _, t := range pc.GetTransceivers() {
+		if s := t.Sender(); s != nil && s.Transport() != nil {
+			return s.Transport()
+		}
+		if r := t.Receiver(); r != nil && r.Transport() != nil {
+			return r.Transport()
+		}
+	}
+	return nil
+}
+
+// ExportSRTPKeys return the srtp keys negotiated by the transport, so a
+// recorder or forwarder can decrypt or protect its packets again. The keys
+// decrypt the whole session, they are only exported when
+// webrtc.srtpkeyexport is set.
+func (w *WebRTCTransport) ExportSRTPKeys() (SRTPKeys, error) {
+	if !srtpKeyExport {
+		return SRTPKeys{}, errSRTPKeyExport
+	}
+	pc := w.getPC()
+	if pc == nil {
+		return SRTPKeys{}, errInvalidPC
+	}
+	return exportSRTPKeys(pcDTLSTransport(pc))
+}
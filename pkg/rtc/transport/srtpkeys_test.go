@@ -0,0 +1,89 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"runtime/debug"
+	"testing"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/webrtc/v2"
+)
+
+func TestSRTPKeysPionInternals(t *testing.T) {
+	// the fields the export reads with reflect and unsafe
+	if field, ok := reflect.TypeOf(webrtc.DTLSTransport{}).FieldByName("conn"); !ok || field.Type != dtlsConnType {
+		t.Fatal("webrtc.DTLSTransport has no conn *dtls.Conn field")
+	}
+	if field, ok := reflect.TypeOf(dtls.State{}).FieldByName("isClient"); !ok || field.Type.Kind() != reflect.Bool {
+		t.Fatal("dtls.State has no isClient bool field")
+	}
+	if _, err := isClient(&dtls.State{}); err != nil {
+		t.Fatalf("isClient err=%v", err)
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		t.Skip("no build info, the pion versions are not checked")
+	}
+	want := map[string]string{
+		"github.com/pion/webrtc/v2": pionWebRTCVersion,
+		"github.com/pion/dtls/v2":   pionDTLSVersion,
+	}
+	for _, dep := range info.Deps {
+		if version, ok := want[dep.Path]; ok && dep.Version != version {
+			t.Errorf("%s is %s, the export was checked against %s, check its fields again", dep.Path, dep.Version, version)
+		}
+	}
+}
+
+func TestWebRTCTransportExportSRTPKeys(t *testing.T) {
+	defer InitWebRTC(WebRTCConfig{})
+
+	pub := NewWebRTCTransport("pub", RTCOptions{Publish: true})
+	pub.OnClose(func() {})
+	defer pub.Close()
+	client := newTestClient(t, pub, 1234, false, nil)
+	defer client.close()
+	waitRTP(t, pub, 1234)
+
+	if _, err := pub.ExportSRTPKeys(); !errors.Is(err, errSRTPKeyExport) {
+		t.Fatalf("err=%v, want errSRTPKeyExport", err)
+	}
+	if err := InitWebRTC(WebRTCConfig{SRTPKeyExport: true}); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := pub.ExportSRTPKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys.LocalMasterKey) != srtpKeyLen || len(keys.LocalMasterSalt) != srtpSaltLen ||
+		len(keys.RemoteMasterKey) != srtpKeyLen || len(keys.RemoteMasterSalt) != srtpSaltLen {
+		t.Fatalf("keys=%+v, want %d byte keys and %d byte salts", keys, srtpKeyLen, srtpSaltLen)
+	}
+	if bytes.Equal(keys.LocalMasterKey, keys.RemoteMasterKey) {
+		t.Fatal("local and remote keys are the same")
+	}
+
+	// the other end of the dtls session exports the same material, swapped
+	peer, err := exportSRTPKeys(pcDTLSTransport(client.pc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keys.LocalMasterKey, peer.RemoteMasterKey) || !bytes.Equal(keys.LocalMasterSalt, peer.RemoteMasterSalt) ||
+		!bytes.Equal(keys.RemoteMasterKey, peer.LocalMasterKey) || !bytes.Equal(keys.RemoteMasterSalt, peer.LocalMasterSalt) {
+		t.Fatalf("keys=%+v peer=%+v, want the same material swapped", keys, peer)
+	}
+	if again, err := pub.ExportSRTPKeys(); err != nil || !bytes.Equal(again.LocalMasterKey, keys.LocalMasterKey) {
+		t.Fatalf("keys=%+v err=%v, want the same keys again", again, err)
+	}
+
+	// not connected yet
+	idle := NewWebRTCTransport("idle", RTCOptions{})
+	idle.OnClose(func() {})
+	defer idle.Close()
+	if _, err := idle.ExportSRTPKeys(); !errors.Is(err, errDTLSNotStarted) {
+		t.Fatalf("err=%v, want errDTLSNotStarted", err)
+	}
+}
@@ -3,16 +3,28 @@ package transport
 import (
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
 )
 
 // type of transport
 const (
 	TypeWebRTCTransport = iota
 	TypeRTPTransport
+	TypeReplayer
+	TypeMemoryTransport
 
 	TypeUnkown = -1
 )
 
+// connection state of a transport
+const (
+	StateConnecting = iota
+	StateConnected
+	StateDisconnected
+	StateFailed
+	StateClosed
+)
+
 // Transport is a interface
 type Transport interface {
 	ID() string
@@ -23,7 +35,49 @@ type Transport interface {
 	GetRTCPChan() chan rtcp.Packet
 	Close()
 	OnClose(func())
+	OnConnectionStateChange(func(state int))
 	WriteErrTotal() int
 	WriteErrReset()
 	GetBandwidth() uint32
 }
+
+// DataChannelOptions is how a data channel delivers messages,
+// reliable when neither MaxRetransmits nor MaxPacketLifeTime is set
+type DataChannelOptions struct {
+	Ordered           bool
+	MaxRetransmits    *uint16
+	MaxPacketLifeTime *uint16
+}
+
+// DataTransport is a Transport also carrying data channels
+type DataTransport interface {
+	Transport
+	OnDataChannel(func(label string, options DataChannelOptions))
+	OnDataMessage(func(label string, msg []byte))
+	CreateDataChannel(label string, options DataChannelOptions) error
+	WriteData(label string, msg []byte) error
+}
+
+// PooledTransport is a Transport whose ReadRTP packets come from a pool,
+// whoever is done with a packet last may give it back with ReleaseRTP.
+// A released packet must not be used anymore.
+type PooledTransport interface {
+	Transport
+	ReleaseRTP(*rtp.Packet)
+}
+
+// TrackInfo describes a track of a pub, as a sub sends it
+type TrackInfo struct {
+	SSRC     uint32
+	PT       uint8
+	StreamID string
+	TrackID  string
+}
+
+// BundleTransport is a sub Transport whose send tracks can be added while it
+// is connected, e.g. to receive several pubs through one pc
+type BundleTransport interface {
+	Transport
+	AddTracks(tracks []TrackInfo) (webrtc.SessionDescription, error)
+	SetRemoteSDP(sdp webrtc.SessionDescription) error
+}
@@ -1,17 +1,35 @@
 package transport
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net"
+	"strings"
+	"time"
 
 	"sync"
+	"sync/atomic"
 
+	"github.com/pion/ice"
 	"github.com/pion/ion-sfu/pkg/log"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
+	"github.com/pion/sdp/v2"
 	"github.com/pion/webrtc/v2"
 )
 
+// mdns modes of the transports
+const (
+	// MDNSDisabled drop the remote .local candidates
+	MDNSDisabled = "disabled"
+	// MDNSQueryOnly resolve the remote .local candidates, the local ones stay ips
+	MDNSQueryOnly = "query-only"
+)
+
 const (
 	maxChanSize       = 100
 	IOSH264Fmtp       = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"
@@ -24,13 +42,25 @@ var (
 		SDPSemantics: webrtc.SDPSemanticsUnifiedPlanWithFallback,
 	}
 
-	setting webrtc.SettingEngine
-
-	errChanClosed     = errors.New("channel closed")
-	errInvalidTrack   = errors.New("track is nil")
-	errInvalidPacket  = errors.New("packet is nil")
-	errInvalidPC      = errors.New("pc is nil")
-	errInvalidOptions = errors.New("invalid options")
+	setting  webrtc.SettingEngine
+	mdnsMode = MDNSQueryOnly
+	// network types of the setting engine, nil for the pion defaults
+	networkTypes []webrtc.NetworkType
+	// if the transports export their srtp keys
+	srtpKeyExport bool
+
+	// wraps io.EOF, the reader knows no more packets come
+	errChanClosed         = fmt.Errorf("channel closed: %w", io.EOF)
+	errInvalidTrack       = errors.New("track is nil")
+	errInvalidPacket      = errors.New("packet is nil")
+	errInvalidPC          = errors.New("pc is nil")
+	errInvalidOptions     = errors.New("invalid options")
+	errInvalidDataChannel = errors.New("data channel not found")
+	errInvalidMDNS        = errors.New("webrtc.mdns must be disabled or query-only")
+	errCertificateKey     = errors.New("webrtc certificate and key must be set together")
+	errTCPNetworkType     = errors.New("tcp ice candidates are not supported")
+	errNAT1To1IP          = errors.New("must be a public ip, or public/private ips of the same family")
+	errGatheringTimeout   = errors.New("ice gathering not complete")
 
 	ptTransformMap = map[uint8][]uint8{
 		webrtc.DefaultPayloadTypeVP8:  {120},
@@ -69,10 +99,12 @@ func IsVideo(pt uint8) bool {
 		pt == 126 || pt == 97 {
 		return true
 	}
-	return false
+	// the payload types webrtc.codecs set
+	return videoPTs[pt]
 }
 
-// ICEServerConfig defines parameters for ice servers
+// ICEServerConfig defines parameters for ice servers, the username and
+// credential are the long-term credentials of turn and turns servers
 type ICEServerConfig struct {
 	URLs       []string `mapstructure:"urls"`
 	Username   string   `mapstructure:"username"`
@@ -83,6 +115,157 @@ type ICEServerConfig struct {
 type WebRTCConfig struct {
 	ICEPortRange []uint16          `mapstructure:"portrange"`
 	ICEServers   []ICEServerConfig `mapstructure:"iceserver"`
+	Certificate  string            `mapstructure:"certificate"`
+	Key          string            `mapstructure:"key"`
+	// MDNS is how the remote .local candidates browsers send instead of their
+	// ip are handled. query-only, the default, resolves them on the lan, which
+	// makes the sfu answer multicast queries and is useless across the
+	// internet. disabled drops them, so only the ip candidates can connect.
+	MDNS string `mapstructure:"mdns"`
+	// NetworkTypes restrict ice to udp4 and/or udp6, e.g. where ipv6 is
+	// broken. Both are gathered when empty. pion gathers no tcp host
+	// candidates, tcp4 and tcp6 are refused.
+	NetworkTypes []string `mapstructure:"networktypes"`
+	// NAT1To1IPs are advertised in the host candidates instead of the
+	// private ips, e.g. the public ip of a 1:1 nat. An ip replaces every
+	// private ip of its family, public/private maps one private ip.
+	NAT1To1IPs []string `mapstructure:"nat1to1ips"`
+	// InterfaceFilter names the interfaces candidates are gathered on, all
+	// when empty
+	InterfaceFilter []string `mapstructure:"interfacefilter"`
+	// SRTPKeyExport lets ExportSRTPKeys hand out the srtp keys of the
+	// transports, e.g. to a recorder of the encrypted packets. Anyone
+	// holding them can decrypt the sessions.
+	SRTPKeyExport bool `mapstructure:"srtpkeyexport"`
+	// Codecs enable, disable or change codecs of the transports. vp8, vp9,
+	// h264 and opus are enabled when not listed, g722 only when listed.
+	Codecs []CodecConfig `mapstructure:"codecs"`
+}
+
+// CheckICEServers check the ice server urls are stun or turn urls, and
+// that turn servers have credentials
+func CheckICEServers(servers []ICEServerConfig) error {
+	for i, iceServer := range servers {
+		if len(iceServer.URLs) == 0 {
+			return fmt.Errorf("webrtc.iceserver[%d].urls is empty", i)
+		}
+		for j, rawURL := range iceServer.URLs {
+			u, err := ice.ParseURL(rawURL)
+			if err != nil {
+				return fmt.Errorf("webrtc.iceserver[%d].urls[%d] %q is not a stun/turn url: %v", i, j, rawURL, err)
+			}
+			if (u.Scheme == ice.SchemeTypeTURN || u.Scheme == ice.SchemeTypeTURNS) &&
+				(iceServer.Username == "" || iceServer.Credential == "") {
+				return fmt.Errorf("webrtc.iceserver[%d] turn server %q needs a username and credential", i, rawURL)
+			}
+		}
+	}
+	return nil
+}
+
+// iceServers convert the ice server config for the pc configuration
+func iceServers(servers []ICEServerConfig) []webrtc.ICEServer {
+	var iceServers []webrtc.ICEServer
+	for _, iceServer := range servers {
+		s := webrtc.ICEServer{
+			URLs: iceServer.URLs,
+		}
+		if iceServer.Username != "" || iceServer.Credential != "" {
+			s.Username = iceServer.Username
+			s.Credential = iceServer.Credential
+			s.CredentialType = webrtc.ICECredentialTypePassword
+		}
+		iceServers = append(iceServers, s)
+	}
+	return iceServers
+}
+
+// parseNetworkTypes parse the configured ice network types, nil for the
+// pion defaults
+func parseNetworkTypes(types []string) ([]webrtc.NetworkType, error) {
+	var networkTypes []webrtc.NetworkType
+	for i, raw := range types {
+		t, err := webrtc.NewNetworkType(strings.ToLower(raw))
+		if err != nil {
+			return nil, fmt.Errorf("webrtc.networktypes[%d]: %v", i, err)
+		}
+		if t.Protocol() == "tcp" {
+			return nil, fmt.Errorf("webrtc.networktypes[%d] %q: %w", i, raw, errTCPNetworkType)
+		}
+		networkTypes = append(networkTypes, t)
+	}
+	return networkTypes, nil
+}
+
+// checkNAT1To1IPs check the nat 1:1 ips, one public ip per family or
+// public/private pairs mapping each private ip once
+func checkNAT1To1IPs(ips []string) error {
+	sole := make(map[bool]bool)
+	mapped := make(map[bool]bool)
+	private := make(map[string]bool)
+	for i, raw := range ips {
+		pair := strings.Split(raw, "/")
+		public := net.ParseIP(pair[0])
+		if len(pair) > 2 || public == nil {
+			return fmt.Errorf("webrtc.nat1to1ips[%d] %q: %w", i, raw, errNAT1To1IP)
+		}
+		v4 := public.To4() != nil
+		if len(pair) == 1 {
+			if sole[v4] || mapped[v4] {
+				return fmt.Errorf("webrtc.nat1to1ips[%d] %q: a public ip can't be mapped along another ip of its family", i, raw)
+			}
+			sole[v4] = true
+			continue
+		}
+		local := net.ParseIP(pair[1])
+		if local == nil || (local.To4() != nil) != v4 {
+			return fmt.Errorf("webrtc.nat1to1ips[%d] %q: %w", i, raw, errNAT1To1IP)
+		}
+		if sole[v4] || private[local.String()] {
+			return fmt.Errorf("webrtc.nat1to1ips[%d] %q: private ip %s is already mapped", i, raw, local)
+		}
+		mapped[v4] = true
+		private[local.String()] = true
+	}
+	return nil
+}
+
+// interfaceFilter return the filter of the interfaces candidates are
+// gathered on, nil for all of them
+func interfaceFilter(names []string) (func(string) bool, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	allowed := make(map[string]bool, len(names))
+	for i, name := range names {
+		if _, err := net.InterfaceByName(name); err != nil {
+			return nil, fmt.Errorf("webrtc.interfacefilter[%d] %q: %v", i, name, err)
+		}
+		allowed[name] = true
+	}
+	return func(name string) bool {
+		return allowed[name]
+	}, nil
+}
+
+// loadCertificate load the dtls certificate of every transport from pem files,
+// none when both are empty so each pc generates its own
+func loadCertificate(certFile, keyFile string) ([]webrtc.Certificate, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errCertificateKey
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("webrtc certificate %s key %s: %v", certFile, keyFile, err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("webrtc certificate %s: %v", certFile, err)
+	}
+	return []webrtc.Certificate{webrtc.CertificateFromX509(pair.PrivateKey, cert)}, nil
 }
 
 // InitWebRTC init WebRTCTransport setting
@@ -99,18 +282,56 @@ func InitWebRTC(config WebRTCConfig) error {
 	if icePortStart != 0 || icePortEnd != 0 {
 		err = setting.SetEphemeralUDPPortRange(icePortStart, icePortEnd)
 	}
+	if err != nil {
+		return err
+	}
 
-	var iceServers []webrtc.ICEServer
-	for _, iceServer := range config.ICEServers {
-		s := webrtc.ICEServer{
-			URLs:       iceServer.URLs,
-			Username:   iceServer.Username,
-			Credential: iceServer.Credential,
-		}
-		iceServers = append(iceServers, s)
+	switch config.MDNS {
+	case "", MDNSQueryOnly:
+		mdnsMode = MDNSQueryOnly
+	case MDNSDisabled:
+		mdnsMode = MDNSDisabled
+	default:
+		return errInvalidMDNS
+	}
+	// the local candidates stay ips, pion then only queries mdns
+	setting.GenerateMulticastDNSCandidates(false)
+
+	networkTypes, err = parseNetworkTypes(config.NetworkTypes)
+	if err != nil {
+		return err
+	}
+	setting.SetNetworkTypes(networkTypes)
+
+	if err := checkNAT1To1IPs(config.NAT1To1IPs); err != nil {
+		return err
 	}
+	setting.SetNAT1To1IPs(config.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+	filter, err := interfaceFilter(config.InterfaceFilter)
+	if err != nil {
+		return err
+	}
+	setting.SetInterfaceFilter(filter)
+
+	codecs, err := buildMediaCodecs(config.Codecs)
+	if err != nil {
+		return err
+	}
+	mediaCodecs, videoPTs = codecs, codecVideoPTs(codecs)
+
+	srtpKeyExport = config.SRTPKeyExport
+	if srtpKeyExport {
+		log.Warnf("InitWebRTC srtpkeyexport is set, the srtp keys of the transports can be exported")
+	}
+
+	// every pc is created with cfg, so all transports use these servers
+	if err := CheckICEServers(config.ICEServers); err != nil {
+		return err
+	}
+	cfg.ICEServers = iceServers(config.ICEServers)
 
-	cfg.ICEServers = iceServers
+	// the same certificate for all transports, so the fingerprint can be pinned
+	cfg.Certificates, err = loadCertificate(config.Certificate, config.Key)
 	return err
 }
 
@@ -120,22 +341,44 @@ type WebRTCTransport struct {
 	api          *webrtc.API
 	id           string
 	pc           *webrtc.PeerConnection
+	pcLock       sync.RWMutex
 	outTracks    map[uint32]*webrtc.Track
 	outTrackLock sync.RWMutex
 	inTracks     map[uint32]*webrtc.Track
 	inTrackLock  sync.RWMutex
 	writeErrCnt  int
 
-	rtpCh             chan *rtp.Packet
-	rtcpCh            chan rtcp.Packet
-	stop              bool
+	rtpCh  chan *rtp.Packet
+	rtcpCh chan rtcp.Packet
+	// set by Close, accessed atomically
+	stop              uint32
 	pendingCandidates []*webrtc.ICECandidate
 	candidateLock     sync.RWMutex
 	candidateCh       chan *webrtc.ICECandidate
-	bandwidth         uint32
-	isPub             bool
-	ssrcPtMap         map[uint32]uint8
-	onCloseHandler    func()
+	// remote candidates added before the remote description
+	remoteCandidates    []webrtc.ICECandidateInit
+	remoteCandidateLock sync.Mutex
+	bandwidth           uint32
+	isPub               bool
+	ssrcPtMap           map[uint32]uint8
+	onCloseHandler      func()
+	onStateHandler      func(int)
+	onStateLock         sync.RWMutex
+	// send track ssrc by rtx ssrc
+	rtxSSRCs map[uint32]uint32
+	// header extensions to answer, and the ids negotiated by uri
+	extURIs map[string]bool
+	extMaps map[string]uint8
+	// congestion control feedback offered, and negotiated
+	transportCC bool
+	feedback    string
+	extLock     sync.RWMutex
+	// data channels by label, and the options of the ones opened locally
+	dataChannels         map[string]*webrtc.DataChannel
+	localData            map[string]DataChannelOptions
+	onDataChannelHandler func(string, DataChannelOptions)
+	onDataMessageHandler func(string, []byte)
+	dataLock             sync.RWMutex
 }
 
 func (w *WebRTCTransport) init(options RTCOptions) {
@@ -153,30 +396,26 @@ func (w *WebRTCTransport) init(options RTCOptions) {
 	}
 
 	if options.TransportCC {
+		w.transportCC = true
 		rtcpfb = append(rtcpfb, webrtc.RTCPFeedback{
 			Type: webrtc.TypeRTCPFBTransportCC,
 		})
 	}
 
-	codecMap := map[uint8]*webrtc.RTPCodec{
-		// Opus
-		webrtc.DefaultPayloadTypeOpus: webrtc.NewRTPOpusCodec(webrtc.DefaultPayloadTypeOpus, 48000),
-		109:                           webrtc.NewRTPOpusCodec(109, 48000),
-		// VP8
-		webrtc.DefaultPayloadTypeVP8: webrtc.NewRTPVP8CodecExt(webrtc.DefaultPayloadTypeVP8, 90000, rtcpfb, ""),
-		120:                          webrtc.NewRTPVP8CodecExt(120, 90000, rtcpfb, ""),
-		// VP9
-		webrtc.DefaultPayloadTypeVP9: webrtc.NewRTPVP9Codec(webrtc.DefaultPayloadTypeVP9, 90000),
-		121:                          webrtc.NewRTPVP9Codec(121, 90000),
-		// H264
-		webrtc.DefaultPayloadTypeH264: webrtc.NewRTPH264CodecExt(webrtc.DefaultPayloadTypeH264, 90000, rtcpfb, IOSH264Fmtp),
-		97:                            webrtc.NewRTPH264CodecExt(97, 90000, rtcpfb, FireFoxH264Fmtp97),
+	// the codecs enabled by webrtc.codecs
+	codecMap := make(map[uint8]*webrtc.RTPCodec)
+	var pts []uint8
+	for _, c := range mediaCodecs {
+		for _, pt := range c.payloadTypes {
+			codecMap[pt] = newRTPCodec(c, pt, rtcpfb)
+			pts = append(pts, pt)
+		}
 	}
 
 	if len(options.Codecs) == 0 {
 		// Default add everything?
-		for _, v := range codecMap {
-			w.mediaEngine.RegisterCodec(v)
+		for _, pt := range pts {
+			w.mediaEngine.RegisterCodec(codecMap[pt])
 		}
 	} else {
 		for _, c := range options.Codecs {
@@ -185,11 +424,16 @@ func (w *WebRTCTransport) init(options RTCOptions) {
 			}
 		}
 	}
+	for apt, pt := range options.RTX {
+		w.mediaEngine.RegisterCodec(rtxCodec(pt, apt))
+	}
 
+	// a copy, so detaching doesn't stick to the transports created later
+	s := setting
 	if !options.DataChannel {
-		setting.DetachDataChannels()
+		s.DetachDataChannels()
 	}
-	w.api = webrtc.NewAPI(webrtc.WithMediaEngine(w.mediaEngine), webrtc.WithSettingEngine(setting))
+	w.api = webrtc.NewAPI(webrtc.WithMediaEngine(w.mediaEngine), webrtc.WithSettingEngine(s))
 }
 
 // RTCOptions options to open new transport
@@ -201,6 +445,10 @@ type RTCOptions struct {
 	Codecs      []uint8
 	Bandwidth   uint32
 	Ssrcpt      map[uint32]uint8
+	// rtx payload type by the video payload type it resends
+	RTX map[uint8]uint8
+	// uris of the header extensions of the offer to answer
+	HeaderExtensions []string
 }
 
 // NewWebRTCTransport create a WebRTCTransport
@@ -213,34 +461,50 @@ func NewWebRTCTransport(id string, options RTCOptions) *WebRTCTransport {
 		rtcpCh:      make(chan rtcp.Packet, maxChanSize),
 		candidateCh: make(chan *webrtc.ICECandidate, maxChanSize),
 		ssrcPtMap:   make(map[uint32]uint8),
+		rtxSSRCs:    make(map[uint32]uint32),
+		extURIs:     make(map[string]bool),
+		extMaps:     make(map[string]uint8),
+
+		dataChannels: make(map[string]*webrtc.DataChannel),
+		localData:    make(map[string]DataChannelOptions),
 	}
 	w.init(options)
 
-	var err error
-	w.pc, err = w.api.NewPeerConnection(cfg)
+	pc, err := w.newPeerConnection()
 	if err != nil {
-		log.Errorf("NewWebRTCTransport api.NewPeerConnection %v", err)
 		return nil
 	}
+	w.pc = pc
+	return w
+}
+
+// newPeerConnection create a pc receiving audio and video, its events are
+// ignored once it is replaced by an ice restart
+func (w *WebRTCTransport) newPeerConnection() (*webrtc.PeerConnection, error) {
+	pc, err := w.api.NewPeerConnection(cfg)
+	if err != nil {
+		log.Errorf("NewWebRTCTransport api.NewPeerConnection %v", err)
+		return nil, err
+	}
 
-	_, err = w.pc.AddTransceiver(webrtc.RTPCodecTypeVideo, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	_, err = pc.AddTransceiver(webrtc.RTPCodecTypeVideo, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
 	if err != nil {
 		log.Errorf("w.pc.AddTransceiver video %v", err)
-		return nil
+		return nil, err
 	}
 
-	_, err = w.pc.AddTransceiver(webrtc.RTPCodecTypeAudio, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	_, err = pc.AddTransceiver(webrtc.RTPCodecTypeAudio, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
 	if err != nil {
 		log.Errorf("w.pc.AddTransceiver audio %v", err)
-		return nil
+		return nil, err
 	}
 
-	w.pc.OnICECandidate(func(c *webrtc.ICECandidate) {
-		if c == nil {
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil || w.getPC() != pc {
 			return
 		}
 
-		remoteSDP := w.pc.RemoteDescription()
+		remoteSDP := pc.RemoteDescription()
 		if remoteSDP == nil {
 			w.candidateLock.Lock()
 			defer w.candidateLock.Unlock()
@@ -252,20 +516,44 @@ func NewWebRTCTransport(id string, options RTCOptions) *WebRTCTransport {
 		}
 	})
 
-	w.pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if w.getPC() != pc {
+			return
+		}
+		w.addDataChannel(dc)
+	})
+
+	id := w.id
+	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		if w.getPC() != pc {
+			return
+		}
 		switch connectionState {
+		case webrtc.ICEConnectionStateChecking:
+			w.setState(StateConnecting)
+		case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+			w.setState(StateConnected)
 		case webrtc.ICEConnectionStateDisconnected:
 			log.Infof("webrtc ice disconnected for mid: %s", id)
+			w.setState(StateDisconnected)
 		case webrtc.ICEConnectionStateFailed:
 			log.Infof("webrtc ice failed for mid: %s", id)
+			w.setState(StateFailed)
 			w.Close()
 		case webrtc.ICEConnectionStateClosed:
 			log.Infof("webrtc ice closed for mid: %s", id)
+			w.setState(StateClosed)
 			w.Close()
 		}
 	})
 
-	return w
+	return pc, nil
+}
+
+func (w *WebRTCTransport) getPC() *webrtc.PeerConnection {
+	w.pcLock.RLock()
+	defer w.pcLock.RUnlock()
+	return w.pc
 }
 
 // ID return id
@@ -280,39 +568,46 @@ func (w *WebRTCTransport) Type() int {
 
 // Offer return a offer
 func (w *WebRTCTransport) Offer() (webrtc.SessionDescription, error) {
-	if w.pc == nil {
+	if w.getPC() == nil {
 		return webrtc.SessionDescription{}, errInvalidPC
 	}
-	offer, err := w.pc.CreateOffer(nil)
+	offer, err := w.getPC().CreateOffer(nil)
 	if err != nil {
 		return webrtc.SessionDescription{}, err
 	}
-	err = w.pc.SetLocalDescription(offer)
+	err = w.getPC().SetLocalDescription(offer)
 	if err != nil {
 		return webrtc.SessionDescription{}, err
 	}
-	return offer, nil
+	return w.withRTX(offer), nil
 }
 
 // SetRemoteSDP after Offer()
 func (w *WebRTCTransport) SetRemoteSDP(sdp webrtc.SessionDescription) error {
-	if w.pc == nil {
+	if w.getPC() == nil {
 		return errInvalidPC
 	}
-	return w.pc.SetRemoteDescription(sdp)
+	err := w.getPC().SetRemoteDescription(sdp)
+	if err != nil {
+		return err
+	}
+	w.setFeedback(sdp)
+	w.addRemoteCandidates()
+	w.sendPendingCandidates()
+	return nil
 }
 
 // AddTrack add track to pc
 func (w *WebRTCTransport) AddSendTrack(ssrc uint32, pt uint8, streamID string, trackID string) (*webrtc.Track, error) {
-	if w.pc == nil {
+	if w.getPC() == nil {
 		return nil, errInvalidPC
 	}
-	track, err := w.pc.NewTrack(pt, ssrc, trackID, streamID)
+	track, err := w.getPC().NewTrack(pt, ssrc, trackID, streamID)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = w.pc.AddTransceiverFromTrack(track, webrtc.RtpTransceiverInit{
+	_, err = w.getPC().AddTransceiverFromTrack(track, webrtc.RtpTransceiverInit{
 		Direction: webrtc.RTPTransceiverDirectionSendonly,
 		SendEncodings: []webrtc.RTPEncodingParameters{webrtc.RTPEncodingParameters{
 			RTPCodingParameters: webrtc.RTPCodingParameters{SSRC: ssrc, PayloadType: pt}},
@@ -322,37 +617,110 @@ func (w *WebRTCTransport) AddSendTrack(ssrc uint32, pt uint8, streamID string, t
 		return nil, err
 	}
 
-	w.ssrcPtMap[ssrc] = pt
-
 	w.outTrackLock.Lock()
+	w.ssrcPtMap[ssrc] = pt
 	w.outTracks[ssrc] = track
 	w.outTrackLock.Unlock()
 	return track, nil
 }
 
-// AddCandidate add candidate to pc
+// AddTracks add send tracks to a sub, e.g. the tracks of a pub joining a
+// bundled session, and return the offer renegotiating them with the remote.
+// The answer of the remote goes to SetRemoteSDP.
+func (w *WebRTCTransport) AddTracks(tracks []TrackInfo) (webrtc.SessionDescription, error) {
+	for _, info := range tracks {
+		track, err := w.AddSendTrack(info.SSRC, info.PT, info.StreamID, info.TrackID)
+		if err != nil {
+			return webrtc.SessionDescription{}, err
+		}
+		for _, sender := range w.getPC().GetSenders() {
+			if sender.Track() == track {
+				go w.receiveOutTrackRTCP(sender)
+			}
+		}
+	}
+	return w.Offer()
+}
+
+// TrackInfos return the tracks received from the pub
+func (w *WebRTCTransport) TrackInfos() []TrackInfo {
+	w.inTrackLock.RLock()
+	defer w.inTrackLock.RUnlock()
+	infos := make([]TrackInfo, 0, len(w.inTracks))
+	for ssrc, track := range w.inTracks {
+		infos = append(infos, TrackInfo{SSRC: ssrc, PT: track.PayloadType(), StreamID: w.id, TrackID: track.ID()})
+	}
+	return infos
+}
+
+// AddCandidate add candidate to pc, candidate is a RTCIceCandidateInit json
+// or a bare candidate line. Candidates added before the remote description
+// are queued until it is set.
 func (w *WebRTCTransport) AddCandidate(candidate string) error {
-	if w.pc == nil {
+	if w.getPC() == nil {
 		return errInvalidPC
 	}
 
-	err := w.pc.AddICECandidate(webrtc.ICECandidateInit{Candidate: candidate})
+	var init webrtc.ICECandidateInit
+	if strings.HasPrefix(strings.TrimSpace(candidate), "{") {
+		if err := json.Unmarshal([]byte(candidate), &init); err != nil {
+			return err
+		}
+	} else {
+		init.Candidate = candidate
+	}
+	// pion v2 can't disable mdns, the candidates are dropped before it
+	if mdnsMode == MDNSDisabled && isMDNSCandidate(init.Candidate) {
+		log.Infof("WebRTCTransport.AddCandidate mdns disabled, drop candidate=%v", init.Candidate)
+		return nil
+	}
+
+	w.remoteCandidateLock.Lock()
+	if w.getPC().RemoteDescription() == nil {
+		log.Infof("WebRTCTransport.AddCandidate no remote description, queue candidate=%v", init.Candidate)
+		w.remoteCandidates = append(w.remoteCandidates, init)
+		w.remoteCandidateLock.Unlock()
+		return nil
+	}
+	w.remoteCandidateLock.Unlock()
+
+	err := w.getPC().AddICECandidate(init)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// isMDNSCandidate check the address of a candidate line is a .local name
+func isMDNSCandidate(candidate string) bool {
+	// candidate:foundation component protocol priority address port typ ...
+	fields := strings.Fields(strings.TrimPrefix(candidate, "a="))
+	return len(fields) > 4 && strings.HasSuffix(strings.ToLower(fields[4]), ".local")
+}
+
+// addRemoteCandidates add the candidates queued before the remote description
+func (w *WebRTCTransport) addRemoteCandidates() {
+	w.remoteCandidateLock.Lock()
+	candidates := w.remoteCandidates
+	w.remoteCandidates = nil
+	w.remoteCandidateLock.Unlock()
+	for _, candidate := range candidates {
+		if err := w.getPC().AddICECandidate(candidate); err != nil {
+			log.Errorf("WebRTCTransport.addRemoteCandidates candidate=%v err=%v", candidate.Candidate, err)
+		}
+	}
+}
+
 // Answer answer to pub or sub
 func (w *WebRTCTransport) Answer(offer webrtc.SessionDescription, options RTCOptions) (webrtc.SessionDescription, error) {
 	w.isPub = options.Publish
+	w.extLock.Lock()
+	for _, uri := range options.HeaderExtensions {
+		w.extURIs[uri] = true
+	}
+	w.extLock.Unlock()
 	if w.isPub {
-		w.pc.OnTrack(func(remoteTrack *webrtc.Track, receiver *webrtc.RTPReceiver) {
-			w.inTrackLock.Lock()
-			w.inTracks[remoteTrack.SSRC()] = remoteTrack
-			w.inTrackLock.Unlock()
-			w.receiveInTrackRTP(remoteTrack)
-		})
+		w.receiveInTracks(w.getPC())
 	} else {
 		if options.Ssrcpt == nil {
 			log.Debugf("Answer: invalid options, ssrcpt nil")
@@ -366,9 +734,9 @@ func (w *WebRTCTransport) Answer(offer webrtc.SessionDescription, options RTCOpt
 
 		for ssrc, pt := range ssrcPTMap {
 			if _, found := w.outTracks[ssrc]; !found {
-				track, _ := w.pc.NewTrack(pt, ssrc, "pion", "pion")
+				track, _ := w.getPC().NewTrack(pt, ssrc, "pion", "pion")
 				if track != nil {
-					_, err := w.pc.AddTrack(track)
+					_, err := w.getPC().AddTrack(track)
 					if err == nil {
 						w.outTrackLock.Lock()
 						w.outTracks[ssrc] = track
@@ -381,23 +749,109 @@ func (w *WebRTCTransport) Answer(offer webrtc.SessionDescription, options RTCOpt
 		}
 		w.receiveOutTracksRTCP()
 	}
+	return w.answer(offer)
+}
+
+// ICERestart answer an ice restart offer of the remote, e.g. after its
+// network changed. The pc is replaced by a new one sending and receiving
+// the same tracks, so the id, ssrcs and the router entry of the transport
+// stay the same. pion can't restart ice on a running pc, so dtls is
+// negotiated again too.
+func (w *WebRTCTransport) ICERestart(offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	if w.closed() {
+		return webrtc.SessionDescription{}, errInvalidPC
+	}
+	log.Infof("WebRTCTransport.ICERestart t.ID()=%v", w.ID())
+	pc, err := w.newPeerConnection()
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+
+	outTracks := make(map[uint32]*webrtc.Track)
+	if w.isPub {
+		w.receiveInTracks(pc)
+	} else {
+		for ssrc, old := range w.GetOutTracks() {
+			track, err := pc.NewTrack(old.PayloadType(), ssrc, old.ID(), old.Label())
+			if err != nil {
+				pc.Close()
+				return webrtc.SessionDescription{}, err
+			}
+			if _, err := pc.AddTrack(track); err != nil {
+				pc.Close()
+				return webrtc.SessionDescription{}, err
+			}
+			outTracks[ssrc] = track
+		}
+	}
+
+	// from now on the old pc events are ignored, and rtp goes to the new tracks
+	w.pcLock.Lock()
+	old := w.pc
+	w.pc = pc
+	w.pcLock.Unlock()
+	if !w.isPub {
+		w.outTrackLock.Lock()
+		w.outTracks = outTracks
+		w.outTrackLock.Unlock()
+		w.receiveOutTracksRTCP()
+	}
+	w.candidateLock.Lock()
+	w.pendingCandidates = nil
+	w.candidateLock.Unlock()
+	w.reopenDataChannels()
+	if err := old.Close(); err != nil {
+		log.Errorf("WebRTCTransport.ICERestart close old pc err=%v", err)
+	}
+	return w.answer(offer)
+}
+
+// Receive read the tracks the remote sends like a pub does, for transports
+// making the offer, e.g. one subscribed to the pub of another sfu
+func (w *WebRTCTransport) Receive() {
+	w.isPub = true
+	w.receiveInTracks(w.getPC())
+}
+
+// receiveInTracks read the tracks pc receives from the pub
+func (w *WebRTCTransport) receiveInTracks(pc *webrtc.PeerConnection) {
+	pc.OnTrack(func(remoteTrack *webrtc.Track, receiver *webrtc.RTPReceiver) {
+		w.inTrackLock.Lock()
+		w.inTracks[remoteTrack.SSRC()] = remoteTrack
+		w.inTrackLock.Unlock()
+		go w.receiveInTrackRTCP(receiver)
+		w.receiveInTrackRTP(remoteTrack)
+	})
+}
 
-	err := w.pc.SetRemoteDescription(offer)
+// answer set the remote offer and return the local answer
+func (w *WebRTCTransport) answer(offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	pc := w.getPC()
+	err := pc.SetRemoteDescription(offer)
 	if err != nil {
 		log.Errorf("pc.SetRemoteDescription %v", err)
 		return webrtc.SessionDescription{}, err
 	}
+	w.setFeedback(offer)
+	w.addRemoteCandidates()
 
-	answer, err := w.pc.CreateAnswer(nil)
+	answer, err := pc.CreateAnswer(nil)
 	if err != nil {
 		log.Errorf("pc.CreateAnswer answer=%v err=%v", answer, err)
 		return webrtc.SessionDescription{}, err
 	}
 
-	err = w.pc.SetLocalDescription(answer)
+	err = pc.SetLocalDescription(answer)
 	if err != nil {
 		log.Errorf("pc.SetLocalDescription answer=%v err=%v", answer, err)
 	}
+	w.sendPendingCandidates()
+	return w.withExtMaps(offer, w.withRTX(answer)), err
+}
+
+// sendPendingCandidates send the local candidates gathered before the
+// remote description was set
+func (w *WebRTCTransport) sendPendingCandidates() {
 	go func() {
 		w.candidateLock.Lock()
 		defer w.candidateLock.Unlock()
@@ -407,19 +861,19 @@ func (w *WebRTCTransport) Answer(offer webrtc.SessionDescription, options RTCOpt
 		}
 		w.pendingCandidates = nil
 	}()
-	return answer, err
 }
 
 // receiveInTrackRTP receive all incoming tracks' rtp and sent to one channel
 func (w *WebRTCTransport) receiveInTrackRTP(remoteTrack *webrtc.Track) {
 	for {
-		if w.stop {
+		if w.closed() {
 			return
 		}
 
-		rtp, err := remoteTrack.ReadRTP()
+		rtp, err := readPacket(remoteTrack.Read)
 		if err != nil {
-			if err == io.EOF {
+			// the track of a pc replaced by an ice restart is closed
+			if err == io.EOF || err == io.ErrClosedPipe {
 				return
 			}
 			log.Errorf("rtp err => %v", err)
@@ -437,6 +891,11 @@ func (w *WebRTCTransport) ReadRTP() (*rtp.Packet, error) {
 	return rtp, nil
 }
 
+// ReleaseRTP give back a packet returned by ReadRTP
+func (w *WebRTCTransport) ReleaseRTP(pkt *rtp.Packet) {
+	releasePacket(pkt)
+}
+
 // WriteRTP send rtp packet to outgoing tracks
 func (w *WebRTCTransport) WriteRTP(pkt *rtp.Packet) error {
 	if pkt == nil {
@@ -446,7 +905,9 @@ func (w *WebRTCTransport) WriteRTP(pkt *rtp.Packet) error {
 	// Handle PT rewrites
 	// If pub packet is not of paylod sub wants
 	srcType := pkt.Header.PayloadType
+	w.outTrackLock.RLock()
 	destType := w.ssrcPtMap[pkt.Header.SSRC]
+	w.outTrackLock.RUnlock()
 	if srcType != destType {
 		// And we can "transform it"
 		if candid, ok := ptTransformMap[srcType]; ok {
@@ -466,6 +927,10 @@ func (w *WebRTCTransport) WriteRTP(pkt *rtp.Packet) error {
 
 	w.outTrackLock.RLock()
 	track := w.outTracks[pkt.SSRC]
+	if track == nil {
+		// retransmissions go out with the sender of their track
+		track = w.outTracks[w.rtxSSRCs[pkt.SSRC]]
+	}
 	w.outTrackLock.RUnlock()
 
 	if track == nil {
@@ -483,25 +948,174 @@ func (w *WebRTCTransport) WriteRTP(pkt *rtp.Packet) error {
 	return nil
 }
 
+// closed report if Close was called
+func (w *WebRTCTransport) closed() bool {
+	return atomic.LoadUint32(&w.stop) == 1
+}
+
 // Close all
 func (w *WebRTCTransport) Close() {
-	if w.stop {
+	if !atomic.CompareAndSwapUint32(&w.stop, 0, 1) {
 		return
 	}
-	w.stop = true
 	log.Infof("WebRTCTransport.Close t.ID()=%v", w.ID())
 	// close pc first, otherwise remoteTrack.ReadRTP will be blocked
-	w.pc.Close()
-	w.onCloseHandler()
+	w.getPC().Close()
+	w.onStateLock.RLock()
+	f := w.onCloseHandler
+	w.onStateLock.RUnlock()
+	if f != nil {
+		f()
+	}
 }
 
 // OnClose calls passed handler when closing pc
 func (w *WebRTCTransport) OnClose(f func()) {
+	w.onStateLock.Lock()
+	defer w.onStateLock.Unlock()
 	w.onCloseHandler = f
 }
 
+// OnConnectionStateChange calls passed handler when the ice connection state changes
+func (w *WebRTCTransport) OnConnectionStateChange(f func(state int)) {
+	w.onStateLock.Lock()
+	defer w.onStateLock.Unlock()
+	w.onStateHandler = f
+}
+
+func (w *WebRTCTransport) setState(state int) {
+	w.onStateLock.RLock()
+	f := w.onStateHandler
+	w.onStateLock.RUnlock()
+	if f != nil {
+		f(state)
+	}
+}
+
+// OnDataChannel calls passed handler when a data channel the remote opened is
+// open, the ones already open are passed right away
+func (w *WebRTCTransport) OnDataChannel(f func(label string, options DataChannelOptions)) {
+	w.dataLock.Lock()
+	w.onDataChannelHandler = f
+	var open []*webrtc.DataChannel
+	for label, dc := range w.dataChannels {
+		if _, local := w.localData[label]; !local && dc.ReadyState() == webrtc.DataChannelStateOpen {
+			open = append(open, dc)
+		}
+	}
+	w.dataLock.Unlock()
+	for _, dc := range open {
+		f(dc.Label(), dataChannelOptions(dc))
+	}
+}
+
+// OnDataMessage calls passed handler for every message received on a data channel
+func (w *WebRTCTransport) OnDataMessage(f func(label string, msg []byte)) {
+	w.dataLock.Lock()
+	defer w.dataLock.Unlock()
+	w.onDataMessageHandler = f
+}
+
+// CreateDataChannel open a data channel to the remote, it is reused when the
+// remote already opened one with that label. The remote offer must have
+// negotiated data channels, i.e. have an application media section.
+func (w *WebRTCTransport) CreateDataChannel(label string, options DataChannelOptions) error {
+	w.dataLock.Lock()
+	defer w.dataLock.Unlock()
+	if _, found := w.dataChannels[label]; found {
+		return nil
+	}
+	dc, err := w.openDataChannel(w.getPC(), label, options)
+	if err != nil {
+		return err
+	}
+	w.dataChannels[label] = dc
+	w.localData[label] = options
+	return nil
+}
+
+// WriteData send msg on the data channel labeled label
+func (w *WebRTCTransport) WriteData(label string, msg []byte) error {
+	w.dataLock.RLock()
+	dc := w.dataChannels[label]
+	w.dataLock.RUnlock()
+	if dc == nil {
+		return errInvalidDataChannel
+	}
+	return dc.Send(msg)
+}
+
+func (w *WebRTCTransport) openDataChannel(pc *webrtc.PeerConnection, label string, options DataChannelOptions) (*webrtc.DataChannel, error) {
+	ordered := options.Ordered
+	dc, err := pc.CreateDataChannel(label, &webrtc.DataChannelInit{
+		Ordered:           &ordered,
+		MaxRetransmits:    options.MaxRetransmits,
+		MaxPacketLifeTime: options.MaxPacketLifeTime,
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.receiveData(label, dc)
+	return dc, nil
+}
+
+// addDataChannel keep a data channel the remote opened
+func (w *WebRTCTransport) addDataChannel(dc *webrtc.DataChannel) {
+	label := dc.Label()
+	log.Infof("WebRTCTransport.addDataChannel t.ID()=%v label=%s", w.ID(), label)
+	w.receiveData(label, dc)
+	dc.OnOpen(func() {
+		w.dataLock.Lock()
+		w.dataChannels[label] = dc
+		// the remote took over a label opened locally
+		delete(w.localData, label)
+		f := w.onDataChannelHandler
+		w.dataLock.Unlock()
+		if f != nil {
+			f(label, dataChannelOptions(dc))
+		}
+	})
+}
+
+func (w *WebRTCTransport) receiveData(label string, dc *webrtc.DataChannel) {
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		w.dataLock.RLock()
+		f := w.onDataMessageHandler
+		w.dataLock.RUnlock()
+		if f != nil {
+			f(label, msg.Data)
+		}
+	})
+}
+
+// reopenDataChannels open the local data channels again on the pc of an ice
+// restart, the remote opens its own again
+func (w *WebRTCTransport) reopenDataChannels() {
+	w.dataLock.Lock()
+	defer w.dataLock.Unlock()
+	for label := range w.dataChannels {
+		delete(w.dataChannels, label)
+	}
+	for label, options := range w.localData {
+		dc, err := w.openDataChannel(w.getPC(), label, options)
+		if err != nil {
+			log.Errorf("WebRTCTransport.reopenDataChannels label=%s err=%v", label, err)
+			continue
+		}
+		w.dataChannels[label] = dc
+	}
+}
+
+func dataChannelOptions(dc *webrtc.DataChannel) DataChannelOptions {
+	return DataChannelOptions{
+		Ordered:           dc.Ordered(),
+		MaxRetransmits:    dc.MaxRetransmits(),
+		MaxPacketLifeTime: dc.MaxPacketLifeTime(),
+	}
+}
+
 func (w *WebRTCTransport) receiveOutTracksRTCP() {
-	for _, sender := range w.pc.GetSenders() {
+	for _, sender := range w.getPC().GetSenders() {
 		go w.receiveOutTrackRTCP(sender)
 	}
 }
@@ -518,7 +1132,30 @@ func (w *WebRTCTransport) receiveOutTrackRTCP(sender *webrtc.RTPSender) {
 			log.Errorf("rtcp err => %v", err)
 		}
 
-		if w.stop {
+		if w.closed() {
+			return
+		}
+
+		for _, pkt := range pkts {
+			w.rtcpCh <- pkt
+		}
+	}
+}
+
+// receiveInTrackRTCP receive the rtcp of an incoming track, e.g. the sender
+// reports of the pub
+func (w *WebRTCTransport) receiveInTrackRTCP(receiver *webrtc.RTPReceiver) {
+	for {
+		pkts, err := receiver.ReadRTCP()
+		if err == io.EOF || err == io.ErrClosedPipe {
+			return
+		}
+
+		if err != nil {
+			log.Errorf("rtcp err => %v", err)
+		}
+
+		if w.closed() {
 			return
 		}
 
@@ -544,11 +1181,11 @@ func (w *WebRTCTransport) GetOutTracks() map[uint32]*webrtc.Track {
 
 // WriteRTCP write rtcp packet to pc
 func (w *WebRTCTransport) WriteRTCP(pkt rtcp.Packet) error {
-	if w.pc == nil {
+	if w.getPC() == nil {
 		return errInvalidPC
 	}
 	// log.Infof("WebRTCTransport.WriteRTCP pkt=%+v", pkt)
-	return w.pc.WriteRTCP([]rtcp.Packet{pkt})
+	return w.getPC().WriteRTCP([]rtcp.Packet{pkt})
 }
 
 // WriteErrTotal return write error
@@ -571,6 +1208,44 @@ func (w *WebRTCTransport) GetCandidateChan() chan *webrtc.ICECandidate {
 	return w.candidateCh
 }
 
+// LocalCandidates wait up to timeout for the transport to gather its
+// candidates and return them as sdp candidate attribute values, for the
+// clients signaling without trickle. The ones gathered so far are returned
+// with errGatheringTimeout when it doesn't complete in time.
+func (w *WebRTCTransport) LocalCandidates(timeout time.Duration) ([]string, error) {
+	pc := w.getPC()
+	if pc == nil {
+		return nil, errInvalidPC
+	}
+	var err error
+	deadline := time.Now().Add(timeout)
+	for pc.ICEGatheringState() != webrtc.ICEGatheringStateComplete {
+		if time.Now().After(deadline) {
+			err = errGatheringTimeout
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	local := pc.LocalDescription()
+	if local == nil {
+		return nil, errInvalidPC
+	}
+	parsed := sdp.SessionDescription{}
+	if perr := parsed.Unmarshal([]byte(local.SDP)); perr != nil {
+		return nil, perr
+	}
+	// the media are bundled, every section has the same candidates
+	var candidates []string
+	if len(parsed.MediaDescriptions) > 0 {
+		for _, attr := range parsed.MediaDescriptions[0].Attributes {
+			if attr.Key == "candidate" {
+				candidates = append(candidates, attr.Value)
+			}
+		}
+	}
+	return candidates, err
+}
+
 // GetBandwidth return bandwidth
 func (w *WebRTCTransport) GetBandwidth() uint32 {
 	return w.bandwidth
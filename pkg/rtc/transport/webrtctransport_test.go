@@ -1,9 +1,31 @@
 package transport
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
 )
 
 func TestWebRTCTransportOffer(t *testing.T) {
@@ -62,3 +84,709 @@ func TestWebRTCTransportCloseHandlerOnlyOnce(t *testing.T) {
 		t.Fatal("OnClose called on already closed transport")
 	}
 }
+
+func TestWebRTCTransportQueueCandidateBeforeRemoteSDP(t *testing.T) {
+	options := RTCOptions{
+		TransportCC: true,
+	}
+	pub := NewWebRTCTransport("pub", options)
+	offer, err := pub.Offer()
+	if err != nil {
+		t.Fatalf("err=%v", err)
+	}
+	_, err = pub.AddSendTrack(12345, webrtc.DefaultPayloadTypeH264, "video", "pion")
+	if err != nil {
+		t.Fatalf("err=%v", err)
+	}
+
+	sub := NewWebRTCTransport("sub", options)
+	candidate := `{"candidate":"candidate:1 1 udp 2130706431 192.168.1.2 50000 typ host","sdpMid":"0","sdpMLineIndex":0}`
+	if err := sub.AddCandidate(candidate); err != nil {
+		t.Fatalf("AddCandidate err=%v", err)
+	}
+	if n := len(sub.remoteCandidates); n != 1 {
+		t.Fatalf("queued=%d, want 1", n)
+	}
+
+	options.Subscribe = true
+	options.Ssrcpt = map[uint32]uint8{12345: webrtc.DefaultPayloadTypeH264}
+	if _, err := sub.Answer(offer, options); err != nil {
+		t.Fatalf("err=%v", err)
+	}
+	if n := len(sub.remoteCandidates); n != 0 {
+		t.Fatalf("queued=%d after Answer, want 0", n)
+	}
+}
+
+// testClient is a browser like pc publishing a vp8 track
+type testClient struct {
+	pc    *webrtc.PeerConnection
+	track *webrtc.Track
+	done  chan struct{}
+}
+
+// newTestClient publish ssrc to pub, with an ice restart when restart is set,
+// setup can add to the pc before the offer
+func newTestClient(t *testing.T, pub *WebRTCTransport, ssrc uint32, restart bool, setup func(*webrtc.PeerConnection)) *testClient {
+	m := webrtc.MediaEngine{}
+	m.RegisterDefaultCodecs()
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m))
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	track, err := pc.NewTrack(webrtc.DefaultPayloadTypeVP8, ssrc, "video", "pion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(pc)
+	}
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		candidate, _ := json.Marshal(c.ToJSON())
+		if err := pub.AddCandidate(string(candidate)); err != nil {
+			t.Error(err)
+		}
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	var answer webrtc.SessionDescription
+	if restart {
+		answer, err = pub.ICERestart(offer)
+	} else {
+		answer, err = pub.Answer(offer, RTCOptions{Publish: true})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetRemoteDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testClient{pc: pc, track: track, done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				// a vp8 key frame header, enough for the packetizer
+				_ = track.WriteSample(media.Sample{Data: []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a}, Samples: 1800})
+			case candidate := <-pub.GetCandidateChan():
+				if err := pc.AddICECandidate(candidate.ToJSON()); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+	}()
+	return c
+}
+
+func (c *testClient) close() {
+	close(c.done)
+	c.pc.Close()
+}
+
+// waitRTP wait for a packet of ssrc read from pub
+func waitRTP(t *testing.T, pub *WebRTCTransport, ssrc uint32) *rtp.Packet {
+	got := make(chan *rtp.Packet, 1)
+	go func() {
+		for {
+			pkt, err := pub.ReadRTP()
+			if err != nil {
+				return
+			}
+			if pkt != nil && pkt.SSRC == ssrc {
+				got <- pkt
+				return
+			}
+		}
+	}()
+	select {
+	case pkt := <-got:
+		return pkt
+	case <-time.After(10 * time.Second):
+		t.Fatal("no rtp received")
+	}
+	return nil
+}
+
+func TestWebRTCTransportICERestart(t *testing.T) {
+	pub := NewWebRTCTransport("pub", RTCOptions{Publish: true})
+	closed := make(chan struct{})
+	pub.OnClose(func() {
+		close(closed)
+	})
+	defer pub.Close()
+
+	client := newTestClient(t, pub, 1234, false, nil)
+	first := waitRTP(t, pub, 1234)
+
+	// the client network changed, it restarts ice with a new offer
+	restarted := newTestClient(t, pub, 1234, true, nil)
+	defer restarted.close()
+	client.close()
+
+	// media keeps flowing on the same transport
+	for i := 0; i < 10; i++ {
+		pkt := waitRTP(t, pub, 1234)
+		if i == 9 && pkt.SequenceNumber == first.SequenceNumber {
+			t.Fatal("no new packets after the restart")
+		}
+	}
+	select {
+	case <-closed:
+		t.Fatal("transport closed by the ice restart")
+	default:
+	}
+	if pub.ID() != "pub" || len(pub.GetInTracks()) != 1 {
+		t.Fatalf("id=%s tracks=%d, want the same transport", pub.ID(), len(pub.GetInTracks()))
+	}
+}
+
+// writeCertificate write a self signed pem certificate and key to dir
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ion-sfu"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tpl, &tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+var fingerprintRe = regexp.MustCompile(`a=fingerprint:(\S+ \S+)`)
+
+func fingerprint(t *testing.T, w *WebRTCTransport) string {
+	offer, err := w.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := fingerprintRe.FindStringSubmatch(offer.SDP)
+	if m == nil {
+		t.Fatalf("no fingerprint in %s", offer.SDP)
+	}
+	return m[1]
+}
+
+func TestWebRTCTransportCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCertificate(t, dir)
+
+	if err := InitWebRTC(WebRTCConfig{Certificate: certFile, Key: keyFile}); err != nil {
+		t.Fatal(err)
+	}
+	defer InitWebRTC(WebRTCConfig{})
+
+	a := NewWebRTCTransport("a", RTCOptions{})
+	b := NewWebRTCTransport("b", RTCOptions{})
+	if fa, fb := fingerprint(t, a), fingerprint(t, b); fa != fb {
+		t.Fatalf("fingerprints %s and %s, want the same", fa, fb)
+	}
+
+	// without a certificate each transport generates its own
+	if err := InitWebRTC(WebRTCConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	c := NewWebRTCTransport("c", RTCOptions{})
+	if fingerprint(t, a) == fingerprint(t, c) {
+		t.Fatal("generated certificate has the configured fingerprint")
+	}
+}
+
+func TestInitWebRTCInvalidCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, _ := writeCertificate(t, dir)
+	defer InitWebRTC(WebRTCConfig{})
+
+	if err := InitWebRTC(WebRTCConfig{Certificate: certFile}); err != errCertificateKey {
+		t.Fatalf("err=%v, want errCertificateKey", err)
+	}
+	// the certificate is no key
+	if err := InitWebRTC(WebRTCConfig{Certificate: certFile, Key: certFile}); err == nil {
+		t.Fatal("mismatched key loaded")
+	}
+	if err := InitWebRTC(WebRTCConfig{Certificate: certFile, Key: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Fatal("missing key loaded")
+	}
+}
+
+func TestWebRTCTransportDataChannel(t *testing.T) {
+	pub := NewWebRTCTransport("pub", RTCOptions{Publish: true, DataChannel: true})
+	pub.OnClose(func() {})
+	defer pub.Close()
+	opened := make(chan DataChannelOptions, 1)
+	pub.OnDataChannel(func(label string, options DataChannelOptions) {
+		if label == "chat" {
+			opened <- options
+		}
+	})
+	received := make(chan string, 1)
+	pub.OnDataMessage(func(label string, msg []byte) {
+		received <- label + ":" + string(msg)
+	})
+
+	fromSFU := make(chan string, 1)
+	client := newTestClient(t, pub, 1234, false, func(pc *webrtc.PeerConnection) {
+		// unordered messages could overtake the channel open, so only unreliable
+		ordered := true
+		retransmits := uint16(0)
+		chat, err := pc.CreateDataChannel("chat", &webrtc.DataChannelInit{Ordered: &ordered, MaxRetransmits: &retransmits})
+		if err != nil {
+			t.Fatal(err)
+		}
+		chat.OnOpen(func() {
+			if err := chat.SendText("hello"); err != nil {
+				t.Error(err)
+			}
+		})
+		pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+			dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+				fromSFU <- dc.Label() + ":" + string(msg.Data)
+			})
+		})
+	})
+	defer client.close()
+
+	select {
+	case options := <-opened:
+		if !options.Ordered || options.MaxRetransmits == nil || *options.MaxRetransmits != 0 {
+			t.Fatalf("options=%+v, want ordered without retransmits", options)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("data channel not opened")
+	}
+	select {
+	case msg := <-received:
+		if msg != "chat:hello" {
+			t.Fatalf("msg=%s, want chat:hello", msg)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no data channel message")
+	}
+
+	// a data channel opened by the sfu, like the router does for subs
+	if err := pub.CreateDataChannel("cursor", DataChannelOptions{Ordered: true}); err != nil {
+		t.Fatal(err)
+	}
+	testhelper.WaitFor(t, 10*time.Second, func() bool { return pub.WriteData("cursor", []byte("moved")) == nil })
+	select {
+	case msg := <-fromSFU:
+		if msg != "cursor:moved" {
+			t.Fatalf("msg=%s, want cursor:moved", msg)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no message from the sfu")
+	}
+}
+
+func TestWebRTCTransportICEServers(t *testing.T) {
+	config := WebRTCConfig{
+		ICEServers: []ICEServerConfig{
+			{URLs: []string{"stun:stun.stunprotocol.org:3478"}},
+			{URLs: []string{"turn:turn.awsome.org:3478", "turns:turn.awsome.org:5349"}, Username: "awsome", Credential: "secret"},
+		},
+	}
+	if err := InitWebRTC(config); err != nil {
+		t.Fatal(err)
+	}
+	defer InitWebRTC(WebRTCConfig{})
+
+	w := NewWebRTCTransport("pub", RTCOptions{})
+	if w == nil {
+		t.Fatal("transport not created")
+	}
+	servers := w.getPC().GetConfiguration().ICEServers
+	if len(servers) != 2 {
+		t.Fatalf("ice servers=%+v, want 2", servers)
+	}
+	if len(servers[0].URLs) != 1 || servers[0].URLs[0] != "stun:stun.stunprotocol.org:3478" || servers[0].Username != "" {
+		t.Fatalf("stun server=%+v", servers[0])
+	}
+	turn := servers[1]
+	if len(turn.URLs) != 2 || turn.URLs[1] != "turns:turn.awsome.org:5349" ||
+		turn.Username != "awsome" || turn.Credential != "secret" || turn.CredentialType != webrtc.ICECredentialTypePassword {
+		t.Fatalf("turn server=%+v", turn)
+	}
+}
+
+func TestInitWebRTCTurnWithoutCredential(t *testing.T) {
+	defer InitWebRTC(WebRTCConfig{})
+	err := InitWebRTC(WebRTCConfig{ICEServers: []ICEServerConfig{{URLs: []string{"turns:turn.awsome.org:5349"}, Username: "awsome"}}})
+	if err == nil || err.Error() != `webrtc.iceserver[0] turn server "turns:turn.awsome.org:5349" needs a username and credential` {
+		t.Fatalf("err=%v, want a missing credential error", err)
+	}
+}
+
+func TestInitWebRTCMDNS(t *testing.T) {
+	defer InitWebRTC(WebRTCConfig{})
+	candidates := []string{
+		"candidate:1 1 udp 2122260223 0d5e6a6c-1b34-4a09-9d2b-4b3f2d2a3c7e.local 54321 typ host",
+		"candidate:2 1 udp 2122260223 192.168.1.2 54322 typ host",
+	}
+	for mode, want := range map[string]int{"": 2, MDNSQueryOnly: 2, MDNSDisabled: 1} {
+		if err := InitWebRTC(WebRTCConfig{MDNS: mode}); err != nil {
+			t.Fatal(err)
+		}
+		w := NewWebRTCTransport("pub", RTCOptions{})
+		// no remote description yet, so the candidates kept are queued
+		for _, c := range candidates {
+			if err := w.AddCandidate(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(w.remoteCandidates) != want {
+			t.Fatalf("mdns %q queued %d candidates, want %d", mode, len(w.remoteCandidates), want)
+		}
+	}
+
+	if err := InitWebRTC(WebRTCConfig{MDNS: "gather"}); err != errInvalidMDNS {
+		t.Fatalf("err=%v, want errInvalidMDNS", err)
+	}
+}
+
+func TestInitWebRTCNetworkTypes(t *testing.T) {
+	defer InitWebRTC(WebRTCConfig{})
+
+	if err := InitWebRTC(WebRTCConfig{NetworkTypes: []string{"UDP4"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(networkTypes) != 1 || networkTypes[0] != webrtc.NetworkTypeUDP4 {
+		t.Fatalf("network types %v, want udp4", networkTypes)
+	}
+	if err := InitWebRTC(WebRTCConfig{NetworkTypes: []string{"udp4", "udp6"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(networkTypes) != 2 || networkTypes[1] != webrtc.NetworkTypeUDP6 {
+		t.Fatalf("network types %v, want udp4 and udp6", networkTypes)
+	}
+	// empty keeps the pion defaults
+	if err := InitWebRTC(WebRTCConfig{}); err != nil || networkTypes != nil {
+		t.Fatalf("network types %v err=%v, want none set", networkTypes, err)
+	}
+
+	if err := InitWebRTC(WebRTCConfig{NetworkTypes: []string{"udp5"}}); err == nil {
+		t.Fatal("unknown network type accepted")
+	}
+	if err := InitWebRTC(WebRTCConfig{NetworkTypes: []string{"udp4", "tcp4"}}); !errors.Is(err, errTCPNetworkType) {
+		t.Fatalf("err=%v, want errTCPNetworkType", err)
+	}
+}
+
+func ipv4Interface(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				return iface.Name
+			}
+		}
+	}
+	t.Skip("no ipv4 interface")
+	return ""
+}
+
+func TestInitWebRTCNAT1To1IPs(t *testing.T) {
+	defer InitWebRTC(WebRTCConfig{})
+
+	err := InitWebRTC(WebRTCConfig{
+		NetworkTypes:    []string{"udp4"},
+		NAT1To1IPs:      []string{"203.0.113.7"},
+		InterfaceFilter: []string{ipv4Interface(t)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWebRTCTransport("pub", RTCOptions{})
+	defer w.Close()
+	if _, err := w.Offer(); err != nil {
+		t.Fatal(err)
+	}
+	// the candidates wait for the remote description
+	var candidates []*webrtc.ICECandidate
+	testhelper.WaitFor(t, 5*time.Second, func() bool {
+		w.candidateLock.RLock()
+		defer w.candidateLock.RUnlock()
+		candidates = append(candidates[:0], w.pendingCandidates...)
+		return len(candidates) != 0
+	})
+	for _, c := range candidates {
+		if c.Typ != webrtc.ICECandidateTypeHost || c.Address != "203.0.113.7" {
+			t.Fatalf("candidate %s, want a host candidate with the nat 1:1 ip", c)
+		}
+	}
+
+	for _, ips := range [][]string{
+		{"203.0.113"},
+		{"203.0.113.7/fd00::7"},
+		{"203.0.113.7", "203.0.113.8"},
+		{"203.0.113.7/10.0.0.7", "203.0.113.8/10.0.0.7"},
+		{"203.0.113.7/10.0.0.7/10.0.0.8"},
+	} {
+		if err := InitWebRTC(WebRTCConfig{NAT1To1IPs: ips}); err == nil {
+			t.Fatalf("nat 1:1 ips %v accepted", ips)
+		}
+	}
+	// a public ip per family
+	if err := InitWebRTC(WebRTCConfig{NAT1To1IPs: []string{"203.0.113.7", "2001:db8::7"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitWebRTC(WebRTCConfig{InterfaceFilter: []string{"nosuchif0"}}); err == nil {
+		t.Fatal("unknown interface accepted")
+	}
+}
+
+func TestWebRTCTransportFeedback(t *testing.T) {
+	// offer a vp8 track taking rtcpfb
+	offer := func(rtcpfb ...string) webrtc.SessionDescription {
+		var feedback []webrtc.RTCPFeedback
+		for _, typ := range rtcpfb {
+			feedback = append(feedback, webrtc.RTCPFeedback{Type: typ})
+		}
+		m := webrtc.MediaEngine{}
+		m.RegisterCodec(webrtc.NewRTPVP8CodecExt(webrtc.DefaultPayloadTypeVP8, 90000, feedback, ""))
+		pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+		track, err := pc.NewTrack(webrtc.DefaultPayloadTypeVP8, 5000, "video", "pion")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pc.AddTrack(track); err != nil {
+			t.Fatal(err)
+		}
+		desc, err := pc.CreateOffer(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return desc
+	}
+
+	for _, c := range []struct {
+		name        string
+		transportCC bool
+		offer       webrtc.SessionDescription
+		want        string
+	}{
+		{"transport-cc", true, offer(FeedbackREMB, FeedbackTransportCC, webrtc.TypeRTCPFBNACK), FeedbackTransportCC},
+		{"remb", true, offer(FeedbackREMB, webrtc.TypeRTCPFBNACK), FeedbackREMB},
+		{"transport-cc not offered by the sfu", false, offer(FeedbackREMB, FeedbackTransportCC), FeedbackREMB},
+		{"none", true, offer(webrtc.TypeRTCPFBNACK), ""},
+	} {
+		options := RTCOptions{Publish: true, TransportCC: c.transportCC}
+		pub := NewWebRTCTransport("pub", options)
+		if _, err := pub.Answer(c.offer, options); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		var _ FeedbackTransport = pub
+		if feedback := pub.Feedback(); feedback != c.want {
+			t.Fatalf("%s: feedback %q, want %q", c.name, feedback, c.want)
+		}
+		pub.Close()
+	}
+}
+
+func TestWebRTCTransportAddTracks(t *testing.T) {
+	sub := NewWebRTCTransport("sub", RTCOptions{Subscribe: true})
+	sub.OnClose(func() {})
+	var _ BundleTransport = sub
+
+	m := webrtc.MediaEngine{}
+	m.RegisterDefaultCodecs()
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	tracks := make(chan uint32, 2)
+	pc.OnTrack(func(track *webrtc.Track, _ *webrtc.RTPReceiver) {
+		tracks <- track.SSRC()
+	})
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		candidate, _ := json.Marshal(c.ToJSON())
+		if err := sub.AddCandidate(string(candidate)); err != nil {
+			t.Error(err)
+		}
+	})
+	done := make(chan struct{})
+	defer close(done)
+	var ssrcs []uint32
+	var ssrcLock sync.Mutex
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for sn := uint16(0); ; sn++ {
+			select {
+			case <-done:
+				return
+			case candidate := <-sub.GetCandidateChan():
+				if err := pc.AddICECandidate(candidate.ToJSON()); err != nil {
+					t.Error(err)
+				}
+			case <-ticker.C:
+				ssrcLock.Lock()
+				for _, ssrc := range ssrcs {
+					_ = sub.WriteRTP(&rtp.Packet{
+						Header:  rtp.Header{Version: 2, SSRC: ssrc, PayloadType: webrtc.DefaultPayloadTypeVP8, SequenceNumber: sn},
+						Payload: []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a},
+					})
+				}
+				ssrcLock.Unlock()
+			}
+		}
+	}()
+
+	// every pub joining adds a track and the remote answers a new offer
+	for i, ssrc := range []uint32{1111, 2222} {
+		offer, err := sub.AddTracks([]TrackInfo{{SSRC: ssrc, PT: webrtc.DefaultPayloadTypeVP8, StreamID: fmt.Sprintf("pub%d", i), TrackID: "video"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pc.SetRemoteDescription(offer); err != nil {
+			t.Fatal(err)
+		}
+		answer, err := pc.CreateAnswer(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pc.SetLocalDescription(answer); err != nil {
+			t.Fatal(err)
+		}
+		if err := sub.SetRemoteSDP(answer); err != nil {
+			t.Fatal(err)
+		}
+		ssrcLock.Lock()
+		ssrcs = append(ssrcs, ssrc)
+		ssrcLock.Unlock()
+
+		select {
+		case got := <-tracks:
+			if got != ssrc {
+				t.Fatalf("track ssrc=%d, want %d", got, ssrc)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("track %d not received", ssrc)
+		}
+	}
+}
+
+func TestWebRTCTransportRTX(t *testing.T) {
+	pub := NewWebRTCTransport("pub", RTCOptions{})
+	offer, err := pub.Offer()
+	if err != nil {
+		t.Fatalf("err=%v", err)
+	}
+
+	options := RTCOptions{
+		Subscribe: true,
+		Codecs:    []uint8{webrtc.DefaultPayloadTypeVP8},
+		Ssrcpt:    map[uint32]uint8{12345: webrtc.DefaultPayloadTypeVP8},
+		RTX:       map[uint8]uint8{webrtc.DefaultPayloadTypeVP8: 97},
+	}
+	sub := NewWebRTCTransport("sub", options)
+	defer sub.Close()
+	if _, err := sub.AddSendTrack(12345, webrtc.DefaultPayloadTypeVP8, "stream", "video"); err != nil {
+		t.Fatalf("err=%v", err)
+	}
+	sub.AddRTX(12345, 6789)
+	answer, err := sub.Answer(offer, options)
+	if err != nil {
+		t.Fatalf("err=%v", err)
+	}
+
+	for _, line := range []string{
+		"a=rtpmap:97 rtx/90000",
+		"a=fmtp:97 apt=96",
+		"a=ssrc-group:FID 12345 6789",
+		"a=ssrc:6789 cname:",
+	} {
+		if !strings.Contains(answer.SDP, line) {
+			t.Fatalf("answer without %q:\n%s", line, answer.SDP)
+		}
+	}
+}
+
+func TestWebRTCTransportExtMaps(t *testing.T) {
+	remote := NewWebRTCTransport("remote", RTCOptions{})
+	defer remote.Close()
+	if _, err := remote.AddSendTrack(12345, webrtc.DefaultPayloadTypeVP8, "stream", "video"); err != nil {
+		t.Fatalf("err=%v", err)
+	}
+	offer, err := remote.Offer()
+	if err != nil {
+		t.Fatalf("err=%v", err)
+	}
+	midLine := regexp.MustCompile(`(a=mid:[^\r\n]*\r\n)`)
+	offer.SDP = midLine.ReplaceAllString(offer.SDP, "${1}a=extmap:4 "+VideoOrientationURI+"\r\na=extmap:5/sendrecv http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01\r\n")
+
+	options := RTCOptions{Publish: true, HeaderExtensions: ForwardedExtensions}
+	pub := NewWebRTCTransport("pub", options)
+	defer pub.Close()
+	answer, err := pub.Answer(offer, options)
+	if err != nil {
+		t.Fatalf("err=%v", err)
+	}
+	if !strings.Contains(answer.SDP, "a=extmap:4 "+VideoOrientationURI) {
+		t.Fatalf("answer without the video orientation:\n%s", answer.SDP)
+	}
+	if strings.Contains(answer.SDP, "transport-wide-cc") {
+		t.Fatalf("answer with an extension not forwarded:\n%s", answer.SDP)
+	}
+	if extMaps := pub.ExtMaps(); len(extMaps) != 1 || extMaps[VideoOrientationURI] != 4 {
+		t.Fatalf("ExtMaps()=%v, want the video orientation as 4", extMaps)
+	}
+}
@@ -0,0 +1,72 @@
+package rtc
+
+import (
+	"time"
+
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+	"github.com/pion/webrtc/v2"
+)
+
+// g722 keeps the 8kHz rtp clock of rfc 3551 at 16kHz sampling
+const g722ClockRate = 8000
+
+// rtpClockRate return the rtp clock rate of payload type pt
+func rtpClockRate(pt uint8) uint32 {
+	switch {
+	case transport.IsVideo(pt):
+		return videoClockRate
+	case pt == webrtc.DefaultPayloadTypeG722:
+		return g722ClockRate
+	}
+	return audioClockRate
+}
+
+// tsRewriter keep the rtp timestamps of a stream a sub receives continuous
+// when its source changes, e.g. a simulcast layer switch or a new pub
+// taking over the stream. The first packet of a new source follows the
+// last one sent by the time elapsed since.
+type tsRewriter struct {
+	started bool
+	src     uint32
+	offset  uint32
+	// newest timestamp sent and when
+	lastTS uint32
+	lastAt time.Time
+}
+
+// rewrite return the sub timestamp of ts of src received at now
+func (w *tsRewriter) rewrite(src, ts uint32, now time.Time, clockRate uint32) uint32 {
+	switch {
+	case !w.started:
+		w.started = true
+		w.src = src
+		w.lastTS = ts
+		w.lastAt = now
+	case src != w.src:
+		next := w.lastTS + rtpElapsed(now.Sub(w.lastAt), clockRate)
+		// a new frame, even when it arrived at once
+		if next == w.lastTS {
+			next++
+		}
+		w.src = src
+		w.offset = next - ts
+	}
+	out := ts + w.offset
+	if int32(out-w.lastTS) > 0 {
+		w.lastTS = out
+		w.lastAt = now
+	}
+	return out
+}
+
+// reference return ts of src as the sub sees it, false if src isn't the
+// source sent, e.g. the report of a layer the sub left
+func (w *tsRewriter) reference(src, ts uint32) (uint32, bool) {
+	if !w.started {
+		return ts, true
+	}
+	if src != w.src {
+		return 0, false
+	}
+	return ts + w.offset, true
+}
@@ -0,0 +1,144 @@
+package rtc
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+)
+
+func TestTSRewriter(t *testing.T) {
+	w := &tsRewriter{}
+	start := time.Now()
+	var out []uint32
+	// 10ms frames, 900 at 90kHz
+	for i := 0; i < 3; i++ {
+		out = append(out, w.rewrite(1, 4294966000+uint32(i)*900, start.Add(time.Duration(i)*10*time.Millisecond), videoClockRate))
+	}
+	// the second source starts anywhere, its first frame 10ms later
+	for i := 3; i < 6; i++ {
+		out = append(out, w.rewrite(2, 500000+uint32(i)*900, start.Add(time.Duration(i)*10*time.Millisecond), videoClockRate))
+	}
+	for i, ts := range out {
+		if want := 4294966000 + uint32(i)*900; ts != want {
+			t.Fatalf("ts %d=%d, want %d", i, ts, want)
+		}
+	}
+	// the packets of a frame keep its timestamp
+	if ts := w.rewrite(2, 500000+5*900, start.Add(55*time.Millisecond), videoClockRate); ts != out[5] {
+		t.Fatalf("ts=%d, want %d", ts, out[5])
+	}
+
+	if ts, ok := w.reference(2, 500000); !ok || ts != out[5]-5*900 {
+		t.Fatalf("reference=%d,%v, want %d", ts, ok, out[5]-5*900)
+	}
+	if _, ok := w.reference(1, 0); ok {
+		t.Fatal("reference of the old source mapped")
+	}
+
+	// a switch at once still moves forward
+	if ts := w.rewrite(1, 0, start.Add(50*time.Millisecond), videoClockRate); ts != out[5]+1 {
+		t.Fatalf("ts=%d, want %d", ts, out[5]+1)
+	}
+
+	for pt, rate := range map[uint8]uint32{96: videoClockRate, 111: audioClockRate, 9: g722ClockRate} {
+		if got := rtpClockRate(pt); got != rate {
+			t.Fatalf("clock rate of %d=%d, want %d", pt, got, rate)
+		}
+	}
+}
+
+// tsRouter return a router rewriting the timestamps with a fake clock moved
+// by advance, and its sub
+func tsRouter(t *testing.T) (*Router, *fakeTransport, *fakeTransport, func(time.Duration)) {
+	var lock sync.Mutex
+	clock := time.Now()
+	router := NewRouter("router")
+	router.now = func() time.Time {
+		lock.Lock()
+		defer lock.Unlock()
+		return clock
+	}
+	pub := newFakeTransport("pub")
+	router.AddPub(pub)
+	sub := newFakeTransport("sub")
+	router.AddSub("sub", sub)
+	return router, pub, sub, func(d time.Duration) {
+		lock.Lock()
+		clock = clock.Add(d)
+		lock.Unlock()
+	}
+}
+
+// sendFrames send a 10ms frame of two packets of ssrc every step of the
+// clock, and wait for sub to have written them
+func sendFrames(t *testing.T, pub, sub *fakeTransport, advance func(time.Duration), ssrc uint32, sn uint16, ts uint32, frames int) {
+	for i := 0; i < frames; i++ {
+		for k := 0; k < 2; k++ {
+			pub.rtpCh <- &rtp.Packet{Header: rtp.Header{SSRC: ssrc, PayloadType: 96, SequenceNumber: sn, Timestamp: ts}}
+			sn++
+		}
+		want := sub.writtenTotal() + 2
+		testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenTotal() >= want })
+		advance(10 * time.Millisecond)
+		ts += 900
+	}
+}
+
+// checkTimestamps check the frames of sub have increasing timestamps 900
+// apart
+func checkTimestamps(t *testing.T, sub *fakeTransport) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	first := sub.written[0].Timestamp
+	for i, pkt := range sub.written {
+		if want := first + uint32(i/2)*900; pkt.Timestamp != want {
+			t.Fatalf("packet %d ssrc=%d ts=%d, want %d", i, pkt.SSRC, pkt.Timestamp, want)
+		}
+	}
+}
+
+func TestRouterRewriteTimestampsPubSwitch(t *testing.T) {
+	InitRouter(RouterConfig{RemapSSRC: true, RewriteTimestamps: true})
+	defer InitRouter(RouterConfig{})
+
+	router, pub, sub, advance := tsRouter(t)
+	defer router.Close()
+	sendFrames(t, pub, sub, advance, 1234, 1, 1000, 3)
+
+	// the new pub starts its own clock
+	pub2 := newFakeTransport("pub2")
+	router.SwitchPub(pub2)
+	sendFrames(t, pub2, sub, advance, 5678, 100, 700000, 3)
+	checkTimestamps(t, sub)
+
+	// the report of the new pub maps to the timestamps of the sub
+	pub2.rtcpCh <- &rtcp.SenderReport{SSRC: 5678, RTPTime: 700000}
+	testhelper.WaitFor(t, time.Second, func() bool { return sub.writtenRTCPTotal() != 0 })
+	sub.lock.Lock()
+	sr, ok := sub.writtenRTCP[0].(*rtcp.SenderReport)
+	sub.lock.Unlock()
+	if want := uint32(1000 + 3*900); !ok || sr.RTPTime != want {
+		t.Fatalf("sub got %+v, want rtp time %d", sr, want)
+	}
+}
+
+func TestRouterRewriteTimestampsLayerSwitch(t *testing.T) {
+	InitRouter(RouterConfig{RewriteTimestamps: true})
+	defer InitRouter(RouterConfig{})
+
+	router, pub, sub, advance := tsRouter(t)
+	defer router.Close()
+	router.SetPubLayers([]uint32{1, 2})
+	router.SetSubLayer("sub", 0)
+	sendFrames(t, pub, sub, advance, 1, 1, 4294966000, 3)
+
+	// the layers don't share the clock
+	router.SetSubLayer("sub", 1)
+	sendFrames(t, pub, sub, advance, 2, 1, 90000, 3)
+	checkTimestamps(t, sub)
+}
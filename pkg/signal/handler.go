@@ -0,0 +1,303 @@
+package signal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v2"
+
+	"github.com/pion/ion-sfu/pkg/log"
+	sfu "github.com/pion/ion-sfu/pkg/node"
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+)
+
+// ops passed to Handler.Authorize
+const (
+	OpPublish   = "publish"
+	OpSubscribe = "subscribe"
+)
+
+var (
+	errNoDescription = errors.New("missing description")
+	errNoCandidate   = errors.New("missing candidate")
+	errNoTransport   = errors.New("transport not found")
+	errNoRouter      = errors.New("router not found")
+)
+
+// Handler serve websocket signaling connections to node. A connection may
+// publish and subscribe any number of times, its transports are closed
+// with it.
+type Handler struct {
+	node     *sfu.SFU
+	upgrader websocket.Upgrader
+	// Authorize decide if the request of a connection may do op on mid,
+	// mid is empty to publish. Everything is allowed when nil.
+	Authorize func(req *http.Request, op, mid string) error
+}
+
+// NewHandler return a handler of node accepting any origin, the browsers
+// run the clients from anywhere and the calls are checked by Authorize
+func NewHandler(node *sfu.SFU) *Handler {
+	return &Handler{
+		node: node,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(*http.Request) bool { return true },
+		},
+	}
+}
+
+// ServeHTTP upgrade req to a websocket and serve its messages until it
+// closes
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ws, err := h.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// the upgrader replied with the error
+		log.Errorf("signal: upgrade err=%v", err)
+		return
+	}
+	c := &conn{
+		h:          h,
+		req:        req,
+		ws:         ws,
+		transports: make(map[string]*transport.WebRTCTransport),
+		mids:       make(map[string]string),
+		routers:    make(map[string]func()),
+		done:       make(chan struct{}),
+	}
+	c.serve()
+}
+
+// conn is a websocket connection and the transports it opened
+type conn struct {
+	h   *Handler
+	req *http.Request
+	ws  *websocket.Conn
+	// websocket takes one writer at a time
+	writeLock  sync.Mutex
+	lock       sync.Mutex
+	transports map[string]*transport.WebRTCTransport
+	// router mid of every transport
+	mids map[string]string
+	// remove the close handler the conn added to router mid, one per router
+	routers map[string]func()
+	done    chan struct{}
+}
+
+func (c *conn) serve() {
+	defer func() {
+		close(c.done)
+		// closed unlocked, closing a pub closes its router and runs the
+		// router handlers of the conn
+		c.lock.Lock()
+		transports := c.transports
+		c.transports = make(map[string]*transport.WebRTCTransport)
+		c.mids = make(map[string]string)
+		for mid, remove := range c.routers {
+			remove()
+			delete(c.routers, mid)
+		}
+		c.lock.Unlock()
+		for _, t := range transports {
+			t.Close()
+		}
+		c.ws.Close()
+	}()
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Debugf("signal: read err=%v", err)
+			}
+			return
+		}
+		var msg Message
+		if err = json.Unmarshal(data, &msg); err == nil {
+			err = c.handle(msg)
+		}
+		if err != nil {
+			log.Errorf("signal: %s id=%s mid=%s err=%v", msg.Method, msg.ID, msg.Mid, err)
+			if err := c.send(Message{Method: MethodError, ID: msg.ID, Mid: msg.Mid, Error: err.Error()}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handle a message of the client
+func (c *conn) handle(msg Message) error {
+	switch msg.Method {
+	case MethodOffer, MethodJoin:
+		if msg.Description == nil {
+			return errNoDescription
+		}
+		offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: msg.Description.SDP}
+		if msg.ID != "" {
+			return c.restart(msg.ID, offer)
+		}
+		if msg.Method == MethodOffer {
+			return c.publish(offer)
+		}
+		return c.subscribe(msg.Mid, offer)
+	case MethodCandidate:
+		if msg.Candidate == nil {
+			return errNoCandidate
+		}
+		t := c.transport(msg.ID)
+		if t == nil {
+			return errNoTransport
+		}
+		candidate, err := json.Marshal(msg.Candidate)
+		if err != nil {
+			return err
+		}
+		return t.AddCandidate(string(candidate))
+	case MethodLeave:
+		c.lock.Lock()
+		t := c.transports[msg.ID]
+		c.remove(msg.ID)
+		c.lock.Unlock()
+		if t == nil {
+			return errNoTransport
+		}
+		t.Close()
+		return nil
+	default:
+		return fmt.Errorf("unknown method %q", msg.Method)
+	}
+}
+
+func (c *conn) authorize(op, mid string) error {
+	if c.h.Authorize == nil {
+		return nil
+	}
+	return c.h.Authorize(c.req, op, mid)
+}
+
+func (c *conn) publish(offer webrtc.SessionDescription) error {
+	if err := c.authorize(OpPublish, ""); err != nil {
+		return err
+	}
+	pub, answer, err := c.h.node.Publish(offer)
+	if err != nil {
+		return err
+	}
+	return c.open(pub.ID(), pub, answer)
+}
+
+func (c *conn) subscribe(mid string, offer webrtc.SessionDescription) error {
+	if err := c.authorize(OpSubscribe, mid); err != nil {
+		return err
+	}
+	sub, answer, err := c.h.node.Subscribe(mid, offer)
+	if err != nil {
+		return err
+	}
+	return c.open(mid, sub, answer)
+}
+
+// restart ice of transport id, e.g. after the client network changed
+func (c *conn) restart(id string, offer webrtc.SessionDescription) error {
+	t := c.transport(id)
+	if t == nil {
+		return errNoTransport
+	}
+	answer, err := t.ICERestart(offer)
+	if err != nil {
+		return err
+	}
+	return c.send(Message{Method: MethodAnswer, ID: id, Description: &answer})
+}
+
+// open keep t of router mid until the connection or the router closes,
+// answer the client and trickle the candidates of t
+func (c *conn) open(mid string, t *transport.WebRTCTransport, answer *webrtc.SessionDescription) error {
+	router := c.h.node.GetRouter(mid)
+	if router == nil {
+		t.Close()
+		return errNoRouter
+	}
+	c.lock.Lock()
+	c.transports[t.ID()] = t
+	c.mids[t.ID()] = mid
+	if c.routers[mid] == nil {
+		c.routers[mid] = router.OnClose(func() { c.routerClosed(mid) })
+	}
+	c.lock.Unlock()
+
+	if err := c.send(Message{Method: MethodAnswer, ID: t.ID(), Mid: mid, Description: answer}); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case <-c.done:
+				return
+			case candidate := <-t.GetCandidateChan():
+				if candidate == nil {
+					return
+				}
+				init := candidate.ToJSON()
+				if err := c.send(Message{Method: MethodCandidate, ID: t.ID(), Candidate: &init}); err != nil {
+					log.Errorf("signal: error sending candidate: %v", err)
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// routerClosed forget the transports of router mid and tell the client
+// they left
+func (c *conn) routerClosed(mid string) {
+	var left []string
+	c.lock.Lock()
+	for id, transportMid := range c.mids {
+		if transportMid == mid {
+			delete(c.transports, id)
+			delete(c.mids, id)
+			left = append(left, id)
+		}
+	}
+	delete(c.routers, mid)
+	c.lock.Unlock()
+	for _, id := range left {
+		_ = c.send(Message{Method: MethodLeave, ID: id, Mid: mid})
+	}
+}
+
+// remove forget transport id, and the router of the last transport on it.
+// c.lock must be held.
+func (c *conn) remove(id string) {
+	mid, found := c.mids[id]
+	delete(c.transports, id)
+	delete(c.mids, id)
+	if !found {
+		return
+	}
+	for _, other := range c.mids {
+		if other == mid {
+			return
+		}
+	}
+	if remove := c.routers[mid]; remove != nil {
+		remove()
+		delete(c.routers, mid)
+	}
+}
+
+func (c *conn) transport(id string) *transport.WebRTCTransport {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.transports[id]
+}
+
+func (c *conn) send(msg Message) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.ws.WriteJSON(msg)
+}
@@ -0,0 +1,283 @@
+package signal
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+	sfu "github.com/pion/ion-sfu/pkg/node"
+	"github.com/pion/ion-sfu/pkg/rtc/plugins"
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+)
+
+// testClient is a websocket signaling client negotiating one pc
+type testClient struct {
+	t  *testing.T
+	ws *websocket.Conn
+	pc *webrtc.PeerConnection
+	// answers, errors and leaves of the sfu
+	replies chan Message
+
+	lock sync.Mutex
+	id   string
+	// local candidates gathered before the answer named the transport
+	pending []webrtc.ICECandidateInit
+}
+
+func newTestClient(t *testing.T, url string, pc *webrtc.PeerConnection) *testClient {
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{t: t, ws: ws, pc: pc, replies: make(chan Message, 10)}
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if c.id == "" {
+			c.pending = append(c.pending, candidate.ToJSON())
+			return
+		}
+		c.trickle(candidate.ToJSON())
+	})
+	go func() {
+		for {
+			var msg Message
+			if err := ws.ReadJSON(&msg); err != nil {
+				close(c.replies)
+				return
+			}
+			if msg.Method == MethodCandidate {
+				_ = pc.AddICECandidate(*msg.Candidate)
+				continue
+			}
+			c.replies <- msg
+		}
+	}()
+	return c
+}
+
+// trickle send a local candidate, lock must be held
+func (c *testClient) trickle(candidate webrtc.ICECandidateInit) {
+	_ = c.ws.WriteJSON(Message{Method: MethodCandidate, ID: c.id, Candidate: &candidate})
+}
+
+func (c *testClient) reply() Message {
+	select {
+	case msg := <-c.replies:
+		return msg
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("no reply of the sfu")
+		return Message{}
+	}
+}
+
+// negotiate send the offer of the pc with method and apply the answer
+func (c *testClient) negotiate(method, mid string) Message {
+	offer, err := c.pc.CreateOffer(nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.pc.SetLocalDescription(offer); err != nil {
+		c.t.Fatal(err)
+	}
+	c.lock.Lock()
+	err = c.ws.WriteJSON(Message{Method: method, Mid: mid, Description: &offer})
+	c.lock.Unlock()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	answer := c.reply()
+	if answer.Method != MethodAnswer {
+		c.t.Fatalf("reply %+v, want an answer", answer)
+	}
+	if err := c.pc.SetRemoteDescription(*answer.Description); err != nil {
+		c.t.Fatal(err)
+	}
+	c.lock.Lock()
+	c.id = answer.ID
+	for _, candidate := range c.pending {
+		c.trickle(candidate)
+	}
+	c.pending = nil
+	c.lock.Unlock()
+	return answer
+}
+
+func newTestPC(t *testing.T) *webrtc.PeerConnection {
+	m := webrtc.MediaEngine{}
+	m.RegisterDefaultCodecs()
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pc
+}
+
+func newTestSFU(t *testing.T) *sfu.SFU {
+	s, err := sfu.New(sfu.Config{
+		Plugins: plugins.Config{On: true, JitterBuffer: plugins.JitterBufferConfig{On: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestHandlerPublishSubscribe(t *testing.T) {
+	node := newTestSFU(t)
+	defer node.Close()
+	server := httptest.NewServer(NewHandler(node))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// publish a vp8 track streaming until the test ends
+	pubPC := newTestPC(t)
+	defer pubPC.Close()
+	track, err := pubPC.NewTrack(webrtc.DefaultPayloadTypeVP8, 5000, "video", "pion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pubPC.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	pub := newTestClient(t, url, pubPC)
+	answer := pub.negotiate(MethodOffer, "")
+	mid := answer.Mid
+	if mid == "" || answer.ID != mid {
+		t.Fatalf("answer mid=%q id=%q, want the router of the pub", mid, answer.ID)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for sn := uint16(0); ; sn++ {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_ = track.WriteRTP(&rtp.Packet{
+					Header:  rtp.Header{Version: 2, SSRC: track.SSRC(), PayloadType: webrtc.DefaultPayloadTypeVP8, SequenceNumber: sn},
+					Payload: []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a},
+				})
+			}
+		}
+	}()
+	router := node.GetRouter(mid)
+	testhelper.WaitFor(t, 10*time.Second, func() bool { return len(router.Stats().PubSSRCs) != 0 })
+
+	// a sub of another connection receives the track
+	subPC := newTestPC(t)
+	defer subPC.Close()
+	if _, err := subPC.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan struct{})
+	var once sync.Once
+	subPC.OnTrack(func(track *webrtc.Track, _ *webrtc.RTPReceiver) {
+		if _, err := track.ReadRTP(); err == nil {
+			once.Do(func() { close(received) })
+		}
+	})
+	sub := newTestClient(t, url, subPC)
+	if answer := sub.negotiate(MethodJoin, mid); answer.Mid != mid || answer.ID == "" {
+		t.Fatalf("join answer mid=%q id=%q", answer.Mid, answer.ID)
+	}
+	select {
+	case <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("sub received no rtp")
+	}
+
+	// errors are replied, the connection stays open
+	if err := sub.ws.WriteJSON(Message{Method: MethodJoin, Mid: "unknown", Description: &webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0"}}); err != nil {
+		t.Fatal(err)
+	}
+	if reply := sub.reply(); reply.Method != MethodError || reply.Error == "" {
+		t.Fatalf("reply %+v, want an error", reply)
+	}
+	if err := sub.ws.WriteMessage(websocket.TextMessage, []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	if reply := sub.reply(); reply.Method != MethodError {
+		t.Fatalf("reply %+v, want an error for a malformed message", reply)
+	}
+
+	// the pub leaving closes its router, the sub is told
+	if err := pub.ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if reply := sub.reply(); reply.Method != MethodLeave || reply.ID != sub.id {
+		t.Fatalf("reply %+v, want the sub to leave", reply)
+	}
+	if node.GetRouter(mid) != nil {
+		t.Fatal("router of the pub not closed")
+	}
+}
+
+func TestHandlerAuthorize(t *testing.T) {
+	node := newTestSFU(t)
+	defer node.Close()
+	errDenied := errors.New("denied")
+	handler := NewHandler(node)
+	handler.Authorize = func(req *http.Request, op, mid string) error {
+		if req.URL.Query().Get("token") != "secret" {
+			return errDenied
+		}
+		return nil
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	pc := newTestPC(t)
+	defer pc.Close()
+	c := newTestClient(t, "ws"+strings.TrimPrefix(server.URL, "http")+"?token=wrong", pc)
+	defer c.ws.Close()
+	if err := c.ws.WriteJSON(Message{Method: MethodOffer, Description: &webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0"}}); err != nil {
+		t.Fatal(err)
+	}
+	if reply := c.reply(); reply.Method != MethodError || reply.Error != errDenied.Error() {
+		t.Fatalf("reply %+v, want the authorize error", reply)
+	}
+	if len(node.Routers()) != 0 {
+		t.Fatal("unauthorized publish opened a router")
+	}
+}
+
+func TestConnRemovesRouterHandler(t *testing.T) {
+	node := newTestSFU(t)
+	defer node.Close()
+	router, err := node.NewRouter("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &conn{
+		transports: make(map[string]*transport.WebRTCTransport),
+		mids:       map[string]string{"pub": "room", "sub": "room"},
+		routers:    make(map[string]func()),
+	}
+	c.routers["room"] = router.OnClose(func() { t.Error("handler of a conn gone from the router called") })
+
+	// the handler stays while a transport of the conn is on the router
+	c.remove("pub")
+	if c.routers["room"] == nil {
+		t.Fatal("handler removed with a transport left on the router")
+	}
+	c.remove("sub")
+	if len(c.routers) != 0 {
+		t.Fatal("handler kept without transports on the router")
+	}
+	router.Close()
+}
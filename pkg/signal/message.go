@@ -0,0 +1,36 @@
+// Package signal serves the sfu over websocket with json messages, for
+// clients which can't speak grpc like browsers, and as a json http api.
+package signal
+
+import "github.com/pion/webrtc/v2"
+
+// methods of the messages
+const (
+	// client publishes its offer, the answer is sent with the mid of the
+	// new router. An offer with the id of a transport restarts its ice.
+	MethodOffer = "offer"
+	// client subscribes its offer to the pub of mid, the answer is sent
+	// with the id of the new sub
+	MethodJoin = "join"
+	// sfu answers an offer or join
+	MethodAnswer = "answer"
+	// trickle ice candidate of transport id, both ways
+	MethodCandidate = "candidate"
+	// client closes transport id, sent by the sfu when its router closed
+	MethodLeave = "leave"
+	// sfu failed the request of the client, the connection stays open
+	MethodError = "error"
+)
+
+// Message is a signaling message of a websocket connection, one json text
+// message each. Method picks the fields used.
+type Message struct {
+	Method string `json:"method"`
+	// router of a join, and of the answers
+	Mid string `json:"mid,omitempty"`
+	// transport the message is about, a pub has the id of its router
+	ID          string                     `json:"id,omitempty"`
+	Description *webrtc.SessionDescription `json:"description,omitempty"`
+	Candidate   *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+	Error       string                     `json:"error,omitempty"`
+}
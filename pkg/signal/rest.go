@@ -0,0 +1,278 @@
+package signal
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lucsky/cuid"
+	"github.com/pion/sdp/v2"
+	"github.com/pion/webrtc/v2"
+
+	"github.com/pion/ion-sfu/pkg/log"
+	sfu "github.com/pion/ion-sfu/pkg/node"
+	"github.com/pion/ion-sfu/pkg/rtc/transport"
+)
+
+// ops passed to RESTHandler.Authorize besides publish and subscribe
+const (
+	// create or close router mid
+	OpManage = "manage"
+	// list or get router mid, mid is empty to list
+	OpList = "list"
+)
+
+// how long an answer waits for the sfu candidates, the clients can't trickle
+const restGatherTimeout = 3 * time.Second
+
+var errNoBody = errors.New("invalid body")
+
+// RESTRouter is a router of the rest api
+type RESTRouter struct {
+	Mid string `json:"mid"`
+	// id of the pub transport, empty without a pub
+	Pub  string   `json:"pub,omitempty"`
+	Subs []string `json:"subs,omitempty"`
+}
+
+// RESTOffer is the body of a publish or subscribe, the offer has its
+// candidates
+type RESTOffer struct {
+	Description *webrtc.SessionDescription `json:"description"`
+}
+
+// RESTAnswer answers a RESTOffer with the candidates of the sfu
+type RESTAnswer struct {
+	Mid string `json:"mid"`
+	// transport id, a pub has the id of its router
+	ID          string                     `json:"id"`
+	Description *webrtc.SessionDescription `json:"description"`
+}
+
+// restError is the body of the failed requests
+type restError struct {
+	Error string `json:"error"`
+}
+
+// RESTHandler serve the sfu as a json http api, for the integrations
+// without grpc or websocket. The transports live until their router is
+// closed or their connection fails.
+//
+//	GET    /routers                  list the routers, []RESTRouter
+//	POST   /routers                  create a router, {"mid"} optional, RESTRouter
+//	GET    /routers/<mid>            RESTRouter
+//	DELETE /routers/<mid>            close the router with its pub and subs
+//	POST   /routers/<mid>/publish    RESTOffer, RESTAnswer of the pub
+//	POST   /routers/<mid>/subscribe  RESTOffer, RESTAnswer of the new sub
+//
+// Errors are {"error"} with 400, 403, 404, 405, 409 or 503.
+type RESTHandler struct {
+	node *sfu.SFU
+	// Authorize decide if req may do op on mid, see the ops. Everything
+	// is allowed when nil.
+	Authorize func(req *http.Request, op, mid string) error
+}
+
+// NewRESTHandler return the rest api of node
+func NewRESTHandler(node *sfu.SFU) *RESTHandler {
+	return &RESTHandler{node: node}
+}
+
+func (h *RESTHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if parts[0] != "routers" || len(parts) > 3 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	var mid, action string
+	if len(parts) > 1 {
+		mid = parts[1]
+	}
+	if len(parts) > 2 {
+		action = parts[2]
+	}
+
+	switch {
+	case mid == "" && action != "":
+		// e.g. /routers//publish, there is no router to act on
+		writeError(w, http.StatusNotFound, "not found")
+	case mid == "" && req.Method == http.MethodGet:
+		h.list(w, req)
+	case mid == "" && req.Method == http.MethodPost:
+		h.create(w, req)
+	case mid != "" && action == "" && req.Method == http.MethodGet:
+		h.get(w, req, mid)
+	case mid != "" && action == "" && req.Method == http.MethodDelete:
+		h.close(w, req, mid)
+	case mid != "" && (action == OpPublish || action == OpSubscribe) && req.Method == http.MethodPost:
+		h.offer(w, req, mid, action)
+	case mid != "" && action != "" && action != OpPublish && action != OpSubscribe:
+		writeError(w, http.StatusNotFound, "not found")
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (h *RESTHandler) authorize(w http.ResponseWriter, req *http.Request, op, mid string) bool {
+	if h.Authorize == nil {
+		return true
+	}
+	if err := h.Authorize(req, op, mid); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return false
+	}
+	return true
+}
+
+func (h *RESTHandler) list(w http.ResponseWriter, req *http.Request) {
+	if !h.authorize(w, req, OpList, "") {
+		return
+	}
+	routers := []RESTRouter{}
+	for _, info := range h.node.ListRouters() {
+		routers = append(routers, RESTRouter{Mid: info.ID, Pub: info.Pub, Subs: info.Subs})
+	}
+	writeJSON(w, http.StatusOK, routers)
+}
+
+func (h *RESTHandler) create(w http.ResponseWriter, req *http.Request) {
+	var body RESTRouter
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, errNoBody.Error())
+			return
+		}
+	}
+	if body.Mid == "" {
+		body.Mid = cuid.New()
+	}
+	if !h.authorize(w, req, OpManage, body.Mid) {
+		return
+	}
+	router, err := h.node.NewRouter(body.Mid)
+	if errors.Is(err, sfu.ErrRouterExists) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	log.Infof("signal: rest created router %s", router.ID())
+	writeJSON(w, http.StatusCreated, RESTRouter{Mid: router.ID()})
+}
+
+func (h *RESTHandler) get(w http.ResponseWriter, req *http.Request, mid string) {
+	if !h.authorize(w, req, OpList, mid) {
+		return
+	}
+	for _, info := range h.node.ListRouters() {
+		if info.ID == mid {
+			writeJSON(w, http.StatusOK, RESTRouter{Mid: info.ID, Pub: info.Pub, Subs: info.Subs})
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, sfu.ErrRouterNotFound.Error())
+}
+
+func (h *RESTHandler) close(w http.ResponseWriter, req *http.Request, mid string) {
+	if !h.authorize(w, req, OpManage, mid) {
+		return
+	}
+	router := h.node.GetRouter(mid)
+	if router == nil {
+		writeError(w, http.StatusNotFound, sfu.ErrRouterNotFound.Error())
+		return
+	}
+	router.Close()
+	log.Infof("signal: rest closed router %s", mid)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// offer publish or subscribe the offer of req to router mid
+func (h *RESTHandler) offer(w http.ResponseWriter, req *http.Request, mid, op string) {
+	if !h.authorize(w, req, op, mid) {
+		return
+	}
+	var body RESTOffer
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Description == nil {
+		writeError(w, http.StatusBadRequest, errNoDescription.Error())
+		return
+	}
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: body.Description.SDP}
+
+	var t *transport.WebRTCTransport
+	var answer *webrtc.SessionDescription
+	var err error
+	if op == OpPublish {
+		t, answer, err = h.node.PublishTo(mid, offer)
+	} else {
+		t, answer, err = h.node.Subscribe(mid, offer)
+	}
+	if err != nil {
+		log.Errorf("signal: rest %s mid=%s err=%v", op, mid, err)
+		writeError(w, offerStatus(err), err.Error())
+		return
+	}
+
+	candidates, err := t.LocalCandidates(restGatherTimeout)
+	if err != nil {
+		log.Warnf("signal: rest %s mid=%s answers with %d candidates: %v", op, mid, len(candidates), err)
+	}
+	described, err := withCandidates(*answer, candidates)
+	if err != nil {
+		t.Close()
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, RESTAnswer{Mid: mid, ID: t.ID(), Description: &described})
+}
+
+// offerStatus return the status of err of a publish or subscribe, most are
+// offers the sfu can't answer
+func offerStatus(err error) int {
+	switch {
+	case errors.Is(err, sfu.ErrRouterNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, sfu.ErrRouterHasPub), errors.Is(err, sfu.ErrRouterExists), errors.Is(err, sfu.ErrNoPub):
+		return http.StatusConflict
+	case errors.Is(err, sfu.ErrRouterFull), errors.Is(err, sfu.ErrShutdown):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+// withCandidates return answer with candidates in every media section, the
+// gathering is over
+func withCandidates(answer webrtc.SessionDescription, candidates []string) (webrtc.SessionDescription, error) {
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(answer.SDP)); err != nil {
+		return answer, err
+	}
+	for _, md := range parsed.MediaDescriptions {
+		for _, c := range candidates {
+			md.WithValueAttribute("candidate", c)
+		}
+		md.WithPropertyAttribute("end-of-candidates")
+	}
+	raw, err := parsed.Marshal()
+	if err != nil {
+		return answer, err
+	}
+	answer.SDP = string(raw)
+	return answer, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("signal: rest write err=%v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, restError{Error: msg})
+}
@@ -0,0 +1,215 @@
+package signal
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+
+	"github.com/pion/ion-sfu/internal/testhelper"
+)
+
+// restCall send body as json with method to url and decode the reply to
+// out, it returns the status
+func restCall(t *testing.T, method, url string, body, out interface{}) int {
+	var reader *bytes.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(raw)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// restNegotiate post the offer of pc with its candidates to url and apply
+// the answer
+func restNegotiate(t *testing.T, pc *webrtc.PeerConnection, url string) RESTAnswer {
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	testhelper.WaitFor(t, 5*time.Second, func() bool { return pc.ICEGatheringState() == webrtc.ICEGatheringStateComplete })
+
+	var answer RESTAnswer
+	if status := restCall(t, http.MethodPost, url, RESTOffer{Description: pc.LocalDescription()}, &answer); status != http.StatusOK {
+		t.Fatalf("post %s status=%d", url, status)
+	}
+	if answer.Description == nil || !strings.Contains(answer.Description.SDP, "a=candidate:") {
+		t.Fatalf("answer %+v, want the sfu candidates", answer)
+	}
+	if err := pc.SetRemoteDescription(*answer.Description); err != nil {
+		t.Fatal(err)
+	}
+	return answer
+}
+
+func TestRESTHandlerCreatePublishSubscribeDelete(t *testing.T) {
+	node := newTestSFU(t)
+	defer node.Close()
+	server := httptest.NewServer(NewRESTHandler(node))
+	defer server.Close()
+	routers := server.URL + "/routers"
+
+	var created RESTRouter
+	if status := restCall(t, http.MethodPost, routers, RESTRouter{Mid: "room"}, &created); status != http.StatusCreated || created.Mid != "room" {
+		t.Fatalf("create status=%d router=%+v", status, created)
+	}
+	if status := restCall(t, http.MethodPost, routers, RESTRouter{Mid: "room"}, nil); status != http.StatusConflict {
+		t.Fatalf("create again status=%d, want 409", status)
+	}
+
+	// publish a vp8 track streaming until the test ends
+	pubPC := newTestPC(t)
+	defer pubPC.Close()
+	track, err := pubPC.NewTrack(webrtc.DefaultPayloadTypeVP8, 5000, "video", "pion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pubPC.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	pub := restNegotiate(t, pubPC, routers+"/room/publish")
+	if pub.Mid != "room" || pub.ID != "room" {
+		t.Fatalf("publish answer mid=%q id=%q, want the router", pub.Mid, pub.ID)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for sn := uint16(0); ; sn++ {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_ = track.WriteRTP(&rtp.Packet{
+					Header:  rtp.Header{Version: 2, SSRC: track.SSRC(), PayloadType: webrtc.DefaultPayloadTypeVP8, SequenceNumber: sn},
+					Payload: []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a},
+				})
+			}
+		}
+	}()
+	router := node.GetRouter("room")
+	testhelper.WaitFor(t, 10*time.Second, func() bool { return len(router.Stats().PubSSRCs) != 0 })
+	if status := restCall(t, http.MethodPost, routers+"/room/publish", RESTOffer{Description: pubPC.LocalDescription()}, nil); status != http.StatusConflict {
+		t.Fatalf("second publish status=%d, want 409", status)
+	}
+
+	subPC := newTestPC(t)
+	defer subPC.Close()
+	if _, err := subPC.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan struct{})
+	var once sync.Once
+	subPC.OnTrack(func(track *webrtc.Track, _ *webrtc.RTPReceiver) {
+		if _, err := track.ReadRTP(); err == nil {
+			once.Do(func() { close(received) })
+		}
+	})
+	sub := restNegotiate(t, subPC, routers+"/room/subscribe")
+	select {
+	case <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("sub received no rtp")
+	}
+
+	var list []RESTRouter
+	if status := restCall(t, http.MethodGet, routers, nil, &list); status != http.StatusOK ||
+		len(list) != 1 || list[0].Pub != "room" || len(list[0].Subs) != 1 || list[0].Subs[0] != sub.ID {
+		t.Fatalf("list status=%d routers=%+v, want room with its pub and sub", status, list)
+	}
+	var got RESTRouter
+	if status := restCall(t, http.MethodGet, routers+"/room", nil, &got); status != http.StatusOK || got.Pub != "room" {
+		t.Fatalf("get status=%d router=%+v", status, got)
+	}
+
+	if status := restCall(t, http.MethodDelete, routers+"/room", nil, nil); status != http.StatusNoContent {
+		t.Fatalf("delete status=%d, want 204", status)
+	}
+	if node.GetRouter("room") != nil {
+		t.Fatal("router not closed")
+	}
+	for _, c := range []struct {
+		method, url string
+		status      int
+	}{
+		{http.MethodGet, routers + "/room", http.StatusNotFound},
+		{http.MethodDelete, routers + "/room", http.StatusNotFound},
+		{http.MethodPut, routers + "/room", http.StatusMethodNotAllowed},
+		{http.MethodGet, server.URL + "/other", http.StatusNotFound},
+		{http.MethodPost, routers + "//publish", http.StatusNotFound},
+		{http.MethodPost, routers + "//subscribe", http.StatusNotFound},
+		{http.MethodGet, routers + "//other", http.StatusNotFound},
+	} {
+		if status := restCall(t, c.method, c.url, nil, nil); status != c.status {
+			t.Fatalf("%s %s status=%d, want %d", c.method, c.url, status, c.status)
+		}
+	}
+	if routers := node.Routers(); len(routers) != 0 {
+		t.Fatalf("%d routers left, want none", len(routers))
+	}
+	if status := restCall(t, http.MethodPost, routers+"/room/subscribe", RESTOffer{Description: subPC.LocalDescription()}, nil); status != http.StatusNotFound {
+		t.Fatalf("subscribe to a closed router status=%d, want 404", status)
+	}
+}
+
+func TestRESTHandlerCreateConcurrent(t *testing.T) {
+	node := newTestSFU(t)
+	defer node.Close()
+	server := httptest.NewServer(NewRESTHandler(node))
+	defer server.Close()
+
+	// one create wins, the others see the router it added
+	statuses := make([]int, 8)
+	var wg sync.WaitGroup
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = restCall(t, http.MethodPost, server.URL+"/routers", RESTRouter{Mid: "room"}, nil)
+		}(i)
+	}
+	wg.Wait()
+	created := 0
+	for _, status := range statuses {
+		switch status {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Fatalf("create status=%d, want 201 or 409", status)
+		}
+	}
+	if created != 1 || len(node.Routers()) != 1 {
+		t.Fatalf("%d creates succeeded with %d routers, want 1", created, len(node.Routers()))
+	}
+}